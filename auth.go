@@ -13,7 +13,10 @@ const (
 	EmailField    string = "email"
 	KeyField      string = "key"
 
-	ApiKeyRequiredError = "Apikey authorization required"
+	ApiKeyRequiredError    = "Apikey authorization required"
+	SuperuserRequiredError = "Superuser required"
+	InvalidAuthParams      = "Invalid authentication params"
+	IncorrectApiKey        = "Incorrect API key"
 )
 
 // Errors
@@ -31,9 +34,9 @@ type AuthParams struct {
 }
 
 // Set HTTP 401 and return WWW-Authenticate header with message
-func UnauthorizedHeader(rw http.ResponseWriter) {
+func UnauthorizedHeader(rw http.ResponseWriter, req *http.Request) {
 	rw.Header().Set("WWW-Authenticate", "Apikey")
-	http.Error(rw, ApiKeyRequiredError, http.StatusUnauthorized)
+	writeError(rw, req, http.StatusUnauthorized, ErrCodeUnauthorized, ApiKeyRequiredError)
 }
 
 /*
@@ -395,10 +395,10 @@ func TestGetAuthHeader(t *testing.T) {
 
 func TestUnauthorizedHeader(t *testing.T) {
 	testRw := httptest.NewRecorder()
-	UnauthorizedHeader(testRw)
+	req, _ := http.NewRequest("GET", "/api/user", nil)
+	UnauthorizedHeader(testRw, req)
 
-	assert.Equal(t, testRw.Code, http.StatusUnauthorized)
-	assert.Equal(t, testRw.Body.String(), ApiKeyRequiredError+"\n")
+	assertApiError(t, testRw, http.StatusUnauthorized, ErrCodeUnauthorized, ApiKeyRequiredError)
 
 	actualHeader, ok := testRw.HeaderMap[http.CanonicalHeaderKey("WWW-Authenticate")]
 	if !assert.True(t, ok, "WWW-Authenticate header should exist") {
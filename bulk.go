@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gocraft/web"
+	"net/http"
+)
+
+const (
+	// BulkOperation.Op values
+	BulkCreate = "create"
+	BulkUpdate = "update"
+	BulkDelete = "delete"
+
+	// Most operations in one request
+	MaxBulkOperations = 1000
+	// Largest body, room for the most operations with generous meta
+	MaxBulkBodyBytes = 8 << 20
+
+	// BulkPersonApi errors
+	BulkInvalidError     = "Bulk request is not valid"
+	BulkOperationsCount  = "Between 1 and 1000 operations are required"
+	BulkOperationInvalid = "Operation is not valid"
+	BulkOpUnknown        = "Must be create, update or delete"
+	BulkIdRequired       = "Required for update and delete"
+	BulkPersonRequired   = "Required for create and update"
+	BulkAbortedError     = "Not applied, another operation in the batch failed"
+	BulkTransactionError = "Error applying operations"
+)
+
+// Body of POST /api/person/bulk
+type BulkRequest struct {
+	// Apply each operation on its own, rather than all of them or none
+	BestEffort bool            `json:"best_effort"`
+	Operations []BulkOperation `json:"operations"`
+}
+
+// A change to one person, as its own route would make it
+type BulkOperation struct {
+	// BulkCreate, BulkUpdate or BulkDelete
+	Op string `json:"op"`
+	// The person to update or delete
+	Id int `json:"id"`
+	// ETag the person was read with, as If-Match, for update and delete
+	IfMatch string `json:"if_match"`
+	// The person to create, or to save over the one with Id
+	Person *PersonJSON `json:"person"`
+}
+
+// What became of an operation, in the order they were sent
+type BulkResult struct {
+	// The status its own route would have answered with
+	Status int `json:"status"`
+	// The person created or updated, and its ETag
+	Person *PersonJSON `json:"person,omitempty"`
+	ETag   string      `json:"etag,omitempty"`
+	Error  *ApiError   `json:"error,omitempty"`
+}
+
+// Body of the POST /api/person/bulk response
+type BulkResponse struct {
+	Results []BulkResult `json:"results"`
+	// How many operations were not applied
+	Failed int `json:"failed"`
+}
+
+// Messages for unexpected errors in each operation
+var bulkOpErrors = map[string]string{
+	BulkCreate: PersonCreateError,
+	BulkUpdate: PersonUpdateError,
+	BulkDelete: PersonDeleteError,
+}
+
+/*
+Handler for POST Person Bulk API
+
+Creates, updates and deletes several of the user's people at once, each
+operation checked as the route for it would. By default they are applied
+in one transaction, so if any fails none are kept, the others answered
+with 424 Failed Dependency. With best_effort each is applied on its own.
+Either way the response is 200 with a result per operation
+*/
+func (c *AuthContext) BulkPersonApi(rw web.ResponseWriter, req *web.Request) {
+	ct, ctok := req.Header["Content-Type"]
+	if !ctok || len(ct) < 1 || (len(ct) >= 1 && ct[0] != "application/json") {
+		writeError(rw, req.Request, http.StatusBadRequest, ErrCodeContentType, JsonContentTypeError)
+		return
+	}
+
+	dec := json.NewDecoder(http.MaxBytesReader(rw, req.Body, MaxBulkBodyBytes))
+	bulk := new(BulkRequest)
+	if err := dec.Decode(bulk); bodyTooLarge(err) {
+		writeError(rw, req.Request, http.StatusRequestEntityTooLarge, ErrCodeBodyTooLarge, fmt.Sprintf(BodyTooLargeError, MaxBulkBodyBytes))
+		return
+	} else if err != nil {
+		writeError(rw, req.Request, http.StatusBadRequest, ErrCodeMalformedJson, JsonMalformedError)
+		return
+	}
+
+	if len(bulk.Operations) == 0 || len(bulk.Operations) > MaxBulkOperations {
+		writeValidationError(rw, req.Request, BulkInvalidError, JsonErrors{"operations": BulkOperationsCount})
+		return
+	}
+
+	results := make([]BulkResult, len(bulk.Operations))
+	people := make([]*Person, len(bulk.Operations))
+	valid := true
+	for i := range bulk.Operations {
+		var err error
+		people[i], err = checkBulkOperation(&bulk.Operations[i])
+		if err != nil {
+			results[i] = bulkError(req, err, "")
+			valid = false
+		}
+	}
+
+	switch {
+	case bulk.BestEffort:
+		for i := range bulk.Operations {
+			if results[i].Error != nil {
+				continue
+			}
+			err := c.DB.WithTx(req.Context(), func(tx DbService) error {
+				return c.applyBulkOperation(req, tx, &bulk.Operations[i], people[i], &results[i])
+			})
+			if err != nil {
+				results[i] = bulkError(req, err, bulkOpErrors[bulk.Operations[i].Op])
+			}
+		}
+	case !valid:
+		abortBulk(req, results)
+	default:
+		failed := -1
+		err := c.DB.WithTx(req.Context(), func(tx DbService) error {
+			for i := range bulk.Operations {
+				if err := c.applyBulkOperation(req, tx, &bulk.Operations[i], people[i], &results[i]); err != nil {
+					failed = i
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil && failed < 0 {
+			// Not down to any one operation, such as the commit failing
+			writePersonWriteError(rw, req, err, BulkTransactionError)
+			return
+		}
+		if err != nil {
+			results[failed] = bulkError(req, err, bulkOpErrors[bulk.Operations[failed].Op])
+			abortBulk(req, results)
+		}
+	}
+
+	resp := BulkResponse{Results: results}
+	for i := range results {
+		if results[i].Error != nil {
+			resp.Failed++
+		}
+	}
+
+	jsonResponse(rw, resp)
+}
+
+/*
+Check an operation before anything is applied
+
+Returns the person sent with a create or update, valid, or an error for
+the operation's result
+*/
+func checkBulkOperation(op *BulkOperation) (*Person, error) {
+	errs := JsonErrors{}
+	switch op.Op {
+	case BulkCreate, BulkUpdate, BulkDelete:
+	default:
+		errs["op"] = BulkOpUnknown
+	}
+	if op.Op != BulkCreate && op.Id <= 0 {
+		errs["id"] = BulkIdRequired
+	}
+	if op.Op != BulkDelete && op.Person == nil {
+		errs["person"] = BulkPersonRequired
+	}
+	if len(errs) > 0 {
+		return nil, NewValidationError(BulkOperationInvalid, errs)
+	}
+
+	if op.Op != BulkCreate && op.IfMatch == "" {
+		return nil, errPreconditionRequired
+	}
+	if op.Op == BulkDelete {
+		return nil, nil
+	}
+
+	person := new(Person)
+	person.setJSON(op.Person)
+	if !person.Validate() {
+		return nil, NewValidationError(PersonInvalid, person.Errors())
+	}
+	return person, nil
+}
+
+// Apply a checked operation in tx, setting its result once it succeeds
+func (c *AuthContext) applyBulkOperation(req *web.Request, tx DbService, op *BulkOperation, person *Person, result *BulkResult) error {
+	switch op.Op {
+	case BulkCreate:
+		created, err := tx.CreatePerson(req.Context(), c.User.Id, person.Name, person.Meta, person.Color)
+		if err != nil {
+			return err
+		}
+		person = created
+	case BulkUpdate:
+		if err := checkPersonETag(req, tx, c.User.Id, op.Id, op.IfMatch); err != nil {
+			return err
+		}
+		person.Id = op.Id
+		person.UserId = c.User.Id
+		if err := tx.UpdatePerson(req.Context(), person); err != nil {
+			return err
+		}
+	case BulkDelete:
+		if err := checkPersonETag(req, tx, c.User.Id, op.Id, op.IfMatch); err != nil {
+			return err
+		}
+		if err := tx.DeletePerson(req.Context(), c.User.Id, op.Id); err != nil {
+			return err
+		}
+		*result = BulkResult{Status: http.StatusNoContent}
+		return nil
+	}
+
+	personJSON := person.JSON()
+	status := http.StatusOK
+	if op.Op == BulkCreate {
+		status = http.StatusCreated
+	}
+	*result = BulkResult{Status: status, Person: &personJSON, ETag: jsonETag(person)}
+	return nil
+}
+
+// The result of an operation that failed with err
+func bulkError(req *web.Request, err error, message string) BulkResult {
+	status, apiErr := personWriteError(req, err, message)
+	apiErr.RequestId = req.Header.Get(RequestIdHeader)
+	return BulkResult{Status: status, Error: &apiErr}
+}
+
+// Mark the operations that did not fail themselves as not kept
+func abortBulk(req *web.Request, results []BulkResult) {
+	for i := range results {
+		if results[i].Error != nil {
+			continue
+		}
+		results[i] = BulkResult{Status: http.StatusFailedDependency, Error: &ApiError{
+			Code:      ErrCodeBatchAborted,
+			Message:   BulkAbortedError,
+			RequestId: req.Header.Get(RequestIdHeader),
+		}}
+	}
+}
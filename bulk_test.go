@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/lib/pq/hstore"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// An AuthContext for a user of a memory database holding "One" and "Two"
+func bulkContext(t *testing.T) (*AuthContext, []*Person) {
+	db := NewMemDbService()
+	user, err := db.CreateUser(context.Background(), "test@example.com", "pwhash", "Test User", "apikey", true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	people := []*Person{}
+	for _, name := range []string{"One", "Two"} {
+		person, err := db.CreatePerson(context.Background(), user.Id, name, hstore.Hstore{}, sql.NullInt64{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		people = append(people, person)
+	}
+
+	return &AuthContext{Context: &Context{DB: db}, User: user}, people
+}
+
+func bulkRequest(t *testing.T, ac *AuthContext, body string) BulkResponse {
+	rw, req, rec := mockHandlerParams("POST", JsonContentType, body)
+	(*AuthContext).BulkPersonApi(ac, rw, req)
+
+	if !assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String()) {
+		t.FailNow()
+	}
+	var resp BulkResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func bulkStatuses(resp BulkResponse) []int {
+	statuses := []int{}
+	for _, result := range resp.Results {
+		statuses = append(statuses, result.Status)
+	}
+	return statuses
+}
+
+func bulkNames(t *testing.T, ac *AuthContext) []string {
+	people, err := ac.DB.GetPeople(context.Background(), ac.User.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, person := range people {
+		names = append(names, person.Name)
+	}
+	return names
+}
+
+func TestBulkPersonApiInvalid(t *testing.T) {
+	tests := []struct {
+		contentType string
+		content     string
+		code        string
+		message     string
+	}{
+		{"text/plain", `{"operations": []}`, ErrCodeContentType, JsonContentTypeError},
+		{JsonContentType, `{"operations": `, ErrCodeMalformedJson, JsonMalformedError},
+		{JsonContentType, `{"operations": []}`, ErrCodeValidation, BulkInvalidError},
+		{JsonContentType, `{"operations": [` + strings.Repeat(`{"op": "delete"}, `, MaxBulkOperations) + `{"op": "delete"}]}`,
+			ErrCodeValidation, BulkInvalidError},
+	}
+
+	ac, _ := bulkContext(t)
+
+	for _, test := range tests {
+		rw, req, rec := mockHandlerParams("POST", test.contentType, test.content)
+
+		(*AuthContext).BulkPersonApi(ac, rw, req)
+
+		assertApiError(t, rec, http.StatusBadRequest, test.code, test.message)
+	}
+}
+
+func TestBulkPersonApiTooLarge(t *testing.T) {
+	ac, _ := bulkContext(t)
+	body := `{"operations": [{"op": "create", "person": {"name": "Ann", "meta": {"notes": "` +
+		strings.Repeat("x", MaxBulkBodyBytes) + `"}}}]}`
+	rw, req, rec := mockHandlerParams("POST", JsonContentType, body)
+
+	(*AuthContext).BulkPersonApi(ac, rw, req)
+
+	assertApiError(t, rec, http.StatusRequestEntityTooLarge, ErrCodeBodyTooLarge,
+		fmt.Sprintf(BodyTooLargeError, MaxBulkBodyBytes))
+	assert.ElementsMatch(t, []string{"One", "Two"}, bulkNames(t, ac))
+}
+
+func TestBulkPersonApi(t *testing.T) {
+	ac, people := bulkContext(t)
+
+	resp := bulkRequest(t, ac, fmt.Sprintf(`{"operations": [
+		{"op": "create", "person": {"name": "Three", "meta": {"a": "b"}, "color": 4}},
+		{"op": "update", "id": %d, "if_match": %q, "person": {"name": "Changed", "meta": {}, "color": null}},
+		{"op": "delete", "id": %d, "if_match": %q}
+	]}`, people[0].Id, jsonETag(people[0]), people[1].Id, jsonETag(people[1])))
+
+	assert.Equal(t, []int{http.StatusCreated, http.StatusOK, http.StatusNoContent}, bulkStatuses(resp))
+	assert.Equal(t, 0, resp.Failed)
+	if assert.NotNil(t, resp.Results[0].Person) {
+		assert.Equal(t, "Three", resp.Results[0].Person.Name)
+		assert.Equal(t, ac.User.Id, resp.Results[0].Person.UserId)
+		assert.Equal(t, jsonETag(resp.Results[0].Person), resp.Results[0].ETag)
+	}
+	if assert.NotNil(t, resp.Results[1].Person) {
+		assert.Equal(t, people[0].Id, resp.Results[1].Person.Id)
+	}
+	assert.Nil(t, resp.Results[2].Person)
+	assert.ElementsMatch(t, []string{"Changed", "Three"}, bulkNames(t, ac))
+}
+
+// One operation failing leaves the others unapplied
+func TestBulkPersonApiRollback(t *testing.T) {
+	ac, people := bulkContext(t)
+
+	resp := bulkRequest(t, ac, fmt.Sprintf(`{"operations": [
+		{"op": "create", "person": {"name": "Three", "meta": {}, "color": null}},
+		{"op": "create", "person": {"name": "One", "meta": {}, "color": null}},
+		{"op": "update", "id": %d, "if_match": "\"stale\"", "person": {"name": "Changed", "meta": {}, "color": null}}
+	]}`, people[1].Id))
+
+	assert.Equal(t, []int{http.StatusFailedDependency, http.StatusConflict, http.StatusFailedDependency}, bulkStatuses(resp))
+	assert.Equal(t, 3, resp.Failed)
+	assert.Equal(t, ErrCodeBatchAborted, resp.Results[0].Error.Code)
+	assert.Equal(t, ErrCodeConflict, resp.Results[1].Error.Code)
+	assert.Equal(t, PersonExistsError, resp.Results[1].Error.Message)
+	assert.ElementsMatch(t, []string{"One", "Two"}, bulkNames(t, ac))
+}
+
+// Operations that cannot be applied are caught before any are
+func TestBulkPersonApiInvalidOperations(t *testing.T) {
+	ac, people := bulkContext(t)
+
+	resp := bulkRequest(t, ac, fmt.Sprintf(`{"operations": [
+		{"op": "create", "person": {"name": "Three", "meta": {}, "color": null}},
+		{"op": "rename"},
+		{"op": "update", "person": {"name": " ", "meta": {}, "color": null}},
+		{"op": "update", "id": %d, "if_match": "*", "person": {"name": " ", "meta": {}, "color": null}},
+		{"op": "delete", "id": %d}
+	]}`, people[0].Id, people[1].Id))
+
+	assert.Equal(t, []int{http.StatusFailedDependency, http.StatusBadRequest, http.StatusBadRequest,
+		http.StatusBadRequest, http.StatusPreconditionRequired}, bulkStatuses(resp))
+	assert.Equal(t, 5, resp.Failed)
+	assert.Equal(t, JsonErrors{"op": BulkOpUnknown, "id": BulkIdRequired, "person": BulkPersonRequired},
+		resp.Results[1].Error.Errors)
+	assert.Equal(t, JsonErrors{"id": BulkIdRequired}, resp.Results[2].Error.Errors)
+	assert.Equal(t, PersonInvalid, resp.Results[3].Error.Message)
+	assert.Equal(t, JsonErrors{"name": PersonNameEmpty}, resp.Results[3].Error.Errors)
+	assert.Equal(t, ErrCodePreconditionRequired, resp.Results[4].Error.Code)
+	assert.ElementsMatch(t, []string{"One", "Two"}, bulkNames(t, ac))
+}
+
+func TestBulkPersonApiBestEffort(t *testing.T) {
+	ac, people := bulkContext(t)
+
+	resp := bulkRequest(t, ac, fmt.Sprintf(`{"best_effort": true, "operations": [
+		{"op": "create", "person": {"name": "Three", "meta": {}, "color": null}},
+		{"op": "create", "person": {"name": "One", "meta": {}, "color": null}},
+		{"op": "delete", "id": 999999, "if_match": "*"},
+		{"op": "create", "person": {"name": " ", "meta": {}, "color": null}},
+		{"op": "delete", "id": %d, "if_match": %q}
+	]}`, people[1].Id, jsonETag(people[1])))
+
+	assert.Equal(t, []int{http.StatusCreated, http.StatusConflict, http.StatusNotFound,
+		http.StatusBadRequest, http.StatusNoContent}, bulkStatuses(resp))
+	assert.Equal(t, 3, resp.Failed)
+	assert.ElementsMatch(t, []string{"One", "Three"}, bulkNames(t, ac))
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	CommandServe       = ""
+	CommandConfigPrint = "config print"
+	CommandConfigCheck = "config check"
+	CommandOpenApi     = "openapi"
+	CommandRoutes      = "routes"
+
+	ConfigCheckOk = "Config OK"
+
+	ExitOk    = 0
+	ExitError = 1
+	ExitUsage = 2
+
+	// How long requests in flight get to finish after the listeners close
+	ShutdownTimeout = 30 * time.Second
+)
+
+/*
+Split leading command words from the flags that follow them
+
+"config print -config x.yml" gives "config print" and ["-config", "x.yml"]
+*/
+func splitCommand(args []string) (command string, rest []string) {
+	words := []string{}
+	for len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		words = append(words, args[0])
+		args = args[1:]
+	}
+	return strings.Join(words, " "), args
+}
+
+/*
+Run the command line given by args, returning the process exit code
+
+With no command the server is started. Every command but openapi
+accepts -config and the per-field config flags, and fails listing every
+config problem
+*/
+func runCommand(args []string, lookup EnvLookup, stdout, stderr io.Writer) int {
+	command, flagArgs := splitCommand(args)
+
+	switch command {
+	case CommandServe, CommandConfigPrint, CommandConfigCheck, CommandRoutes:
+	case CommandOpenApi:
+		// Generated from the routes alone, so needs no config
+		out, err := openApiJson()
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return ExitError
+		}
+		stdout.Write(out)
+		return ExitOk
+	default:
+		fmt.Fprintf(stderr, "Unknown command: %s\n", command)
+		return ExitUsage
+	}
+
+	fs := flag.NewFlagSet("people-server-go", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+
+	config, err := LoadConfig(fs, flagArgs, lookup)
+	if err == flag.ErrHelp {
+		return ExitOk
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return ExitError
+	}
+
+	switch command {
+	case CommandConfigCheck:
+		fmt.Fprintln(stdout, ConfigCheckOk)
+	case CommandConfigPrint:
+		out, err := config.Print()
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return ExitError
+		}
+		fmt.Fprint(stdout, out)
+	case CommandRoutes:
+		// The config decides which listener serves monitoring
+		if err := writeRouteTable(stdout, describeRoutes(config.adminEnabled())); err != nil {
+			fmt.Fprintln(stderr, err)
+			return ExitError
+		}
+	default:
+		if err := serve(config, flagArgs, lookup); err != nil {
+			fmt.Fprintln(stderr, err)
+			return ExitError
+		}
+	}
+
+	return ExitOk
+}
+
+/*
+Start the server, reloading the config from the same sources on SIGHUP
+
+SIGTERM drains the server for the configured delay before shutting it
+down, SIGINT shuts it down at once. Either way requests in flight get to
+finish
+*/
+func serve(config *appConfig, flagArgs []string, lookup EnvLookup) error {
+	logger, err := OpenLogger(config.LogOptions())
+	if err != nil {
+		return err
+	}
+	defer logger.Close()
+
+	server := NewServer(config)
+	server.SetLogger(logger)
+
+	load := func() (*appConfig, error) {
+		fs := flag.NewFlagSet("people-server-go", flag.ContinueOnError)
+		fs.SetOutput(ioutil.Discard)
+		return LoadConfig(fs, flagArgs, lookup)
+	}
+	apply := func(conf *appConfig) {
+		server.SetConfig(conf)
+		logger.SetLevel(conf.LogOptions().Level)
+	}
+	reloader := NewConfigReloader(config, load, apply, logger.StdLogger(LevelInfo))
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go reloader.Watch(signals)
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	shutdown := make(chan error, 1)
+	go func() {
+		sig := <-stop
+		var delay time.Duration
+		if sig == syscall.SIGTERM {
+			delay = server.Config().DrainDelay()
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), delay+ShutdownTimeout)
+		defer cancel()
+		shutdown <- server.Shutdown(ctx, delay)
+	}()
+
+	if err := server.Serve(); err != nil {
+		return err
+	}
+	return <-shutdown
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestSplitCommand(t *testing.T) {
+	tests := []struct {
+		in      []string
+		command string
+		rest    []string
+	}{
+		{[]string{}, "", []string{}},
+		{[]string{"-config", "x.yml"}, "", []string{"-config", "x.yml"}},
+		{[]string{"config", "print"}, "config print", []string{}},
+		{[]string{"config", "print", "-config", "x.yml"}, "config print", []string{"-config", "x.yml"}},
+	}
+
+	for _, test := range tests {
+		command, rest := splitCommand(test.in)
+		assert.Equal(t, test.command, command)
+		assert.Equal(t, test.rest, rest)
+	}
+}
+
+func TestRunCommandConfigPrint(t *testing.T) {
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	env := map[string]string{
+		"PEOPLE_DB_USER": "envuser",
+	}
+
+	args := []string{"config", "print", "-config", testConfigFile}
+	code := runCommand(args, mapLookup(env), stdout, stderr)
+
+	assert.Equal(t, ExitOk, code)
+	assert.Equal(t, "", stderr.String())
+	assert.True(t, strings.Contains(stdout.String(), "user: envuser"))
+	assert.True(t, strings.Contains(stdout.String(), SecretMask))
+	assert.False(t, strings.Contains(stdout.String(), "people-pw"))
+}
+
+func TestRunCommandUnknown(t *testing.T) {
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+
+	code := runCommand([]string{"frobnicate"}, mapLookup(nil), stdout, stderr)
+
+	assert.Equal(t, ExitUsage, code)
+	assert.Equal(t, "", stdout.String())
+	assert.NotEqual(t, "", stderr.String())
+}
+
+func TestRunCommandConfigError(t *testing.T) {
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+
+	args := []string{"config", "print", "-config", testNonexistentConfigFile}
+	code := runCommand(args, mapLookup(nil), stdout, stderr)
+
+	assert.Equal(t, ExitError, code)
+	assert.Equal(t, "", stdout.String())
+}
+
+func TestRunCommandConfigCheck(t *testing.T) {
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+
+	args := []string{"config", "check", "-config", testConfigFile}
+	code := runCommand(args, mapLookup(nil), stdout, stderr)
+
+	assert.Equal(t, ExitOk, code)
+	assert.Equal(t, ConfigCheckOk+"\n", stdout.String())
+	assert.Equal(t, "", stderr.String())
+}
+
+func TestRunCommandConfigCheckProblems(t *testing.T) {
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	env := map[string]string{
+		"PEOPLE_DB_SSLMODE": "sometimes",
+	}
+
+	args := []string{"config", "check", "-config", testConfigFile, "-listen.port", "99999"}
+	code := runCommand(args, mapLookup(env), stdout, stderr)
+
+	assert.Equal(t, ExitError, code)
+	assert.Equal(t, "", stdout.String())
+	assert.True(t, strings.Contains(stderr.String(), "PEOPLE_DB_SSLMODE: db.sslmode: "))
+	assert.True(t, strings.Contains(stderr.String(), "-listen.port: listen.port: "+ConfigInvalidPort))
+}
+
+func TestRunCommandOpenApi(t *testing.T) {
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+
+	// No configuration is needed to describe the API
+	args := []string{"openapi"}
+	code := runCommand(args, mapLookup(nil), stdout, stderr)
+
+	expected, err := openApiJson()
+	assert.Nil(t, err)
+	assert.Equal(t, ExitOk, code)
+	assert.Equal(t, "", stderr.String())
+	assert.Equal(t, string(expected), stdout.String())
+}
+
+func TestRunCommandRoutes(t *testing.T) {
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+
+	args := []string{"routes", "-config", testConfigFile}
+	code := runCommand(args, mapLookup(nil), stdout, stderr)
+
+	assert.Equal(t, ExitOk, code)
+	assert.Equal(t, "", stderr.String())
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	// A header, and every route but /debug/vars without an admin listener
+	assert.Equal(t, len(routeKeys()), len(lines))
+	assert.True(t, strings.Contains(stdout.String(), "/api/admin/routes"))
+}
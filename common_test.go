@@ -1,14 +1,19 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"github.com/gocraft/web"
 	"github.com/lib/pq/hstore"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"testing"
+	"time"
 )
 
 func newTestUser() *User {
@@ -36,6 +41,8 @@ func newTestPerson(userId int) *Person {
 			"other": {"", false},
 		}},
 		sql.NullInt64{1, true},
+		1,
+		1,
 		JsonErrors{},
 	}
 
@@ -56,10 +63,50 @@ func (mc *mockConfig) DbCreds() string {
 	return mc.dbCreds
 }
 
+func (mc *mockConfig) DbOptions() DbOptions {
+	return DbOptions{}
+}
+
+func (mc *mockConfig) RequestTimeout(route string) time.Duration {
+	return 0
+}
+
+func (mc *mockConfig) AuthCacheOptions() AuthCacheOptions {
+	return AuthCacheOptions{}
+}
+
+func (mc *mockConfig) LogOptions() LogOptions {
+	return LogOptions{}
+}
+
+func (mc *mockConfig) HealthCheckTimeout(check string) time.Duration {
+	return 0
+}
+
+func (mc *mockConfig) DrainDelay() time.Duration {
+	return 0
+}
+
+func (mc *mockConfig) TraceOptions() TraceOptions {
+	return TraceOptions{}
+}
+
+func (mc *mockConfig) CorsOptions(group string) CorsOptions {
+	return CorsOptions{}
+}
+
+func (mc *mockConfig) Debug() bool {
+	return false
+}
+
 func (mc *mockConfig) Listener() net.Listener {
 	return mc.listener
 }
 
+func (mc *mockConfig) AdminListener() net.Listener {
+	return nil
+}
+
 func newTestConfig() Config {
 	return &mockConfig{"mock", "", nil}
 }
@@ -76,9 +123,11 @@ func (m *MockNext) Next(rw web.ResponseWriter, req *web.Request) {
 type MockDbService struct {
 	mock.Mock
 	*User
+	txCount     int
+	lockedUsers []int
 }
 
-func (m *MockDbService) GetUser(email string) (*User, error) {
+func (m *MockDbService) GetUser(ctx context.Context, email string) (*User, error) {
 	args := m.Mock.Called(email)
 	if args.Get(0) != nil {
 		return args.Get(0).(*User), nil
@@ -90,7 +139,7 @@ func (m *MockDbService) PasswordCost() int {
 	return 4
 }
 
-func (m *MockDbService) CreateUser(email, pwhash, name, apikey string, isActive, isSuperuser bool) (*User, error) {
+func (m *MockDbService) CreateUser(ctx context.Context, email, pwhash, name, apikey string, isActive, isSuperuser bool) (*User, error) {
 	args := m.Mock.Called(email, pwhash, name, apikey, isActive, isSuperuser)
 	if args.Get(0) != nil {
 		user := args.Get(0).(*User)
@@ -106,12 +155,12 @@ func (m *MockDbService) CreateUser(email, pwhash, name, apikey string, isActive,
 	return nil, args.Error(1)
 }
 
-func (m *MockDbService) UpdateUser(user *User) error {
+func (m *MockDbService) UpdateUser(ctx context.Context, user *User) error {
 	args := m.Mock.Called(user)
 	return args.Error(0)
 }
 
-func (m *MockDbService) GetPerson(userId, id int) (*Person, error) {
+func (m *MockDbService) GetPerson(ctx context.Context, userId, id int) (*Person, error) {
 	args := m.Mock.Called(userId, id)
 	if args.Get(0) != nil {
 		return args.Get(0).(*Person), nil
@@ -119,7 +168,7 @@ func (m *MockDbService) GetPerson(userId, id int) (*Person, error) {
 	return nil, args.Error(1)
 }
 
-func (m *MockDbService) GetPeople(userId int) ([]Person, error) {
+func (m *MockDbService) GetPeople(ctx context.Context, userId int) ([]Person, error) {
 	args := m.Mock.Called(userId)
 	if args.Get(0) != nil {
 		return args.Get(0).([]Person), nil
@@ -127,7 +176,7 @@ func (m *MockDbService) GetPeople(userId int) ([]Person, error) {
 	return nil, args.Error(1)
 }
 
-func (m *MockDbService) CreatePerson(userId int, name string, meta hstore.Hstore, color sql.NullInt64) (*Person, error) {
+func (m *MockDbService) CreatePerson(ctx context.Context, userId int, name string, meta hstore.Hstore, color sql.NullInt64) (*Person, error) {
 	args := m.Mock.Called(userId, name, meta, color)
 	if args.Get(0) != nil {
 		person := args.Get(0).(*Person)
@@ -141,6 +190,46 @@ func (m *MockDbService) CreatePerson(userId int, name string, meta hstore.Hstore
 	return nil, args.Error(1)
 }
 
+func (m *MockDbService) UpdatePerson(ctx context.Context, person *Person) error {
+	args := m.Mock.Called(person)
+	return args.Error(0)
+}
+
+func (m *MockDbService) DeletePerson(ctx context.Context, userId, id int) error {
+	args := m.Mock.Called(userId, id)
+	return args.Error(0)
+}
+
+func (m *MockDbService) GetPersonChanges(ctx context.Context, userId int, since int64) (*PersonChanges, error) {
+	args := m.Mock.Called(userId, since)
+	if args.Get(0) != nil {
+		return args.Get(0).(*PersonChanges), nil
+	}
+	return nil, args.Error(1)
+}
+
+// Records the user, without needing an expectation
+func (m *MockDbService) LockPeople(ctx context.Context, userId int) error {
+	m.lockedUsers = append(m.lockedUsers, userId)
+	return nil
+}
+
+func (m *MockDbService) Ping(ctx context.Context) error {
+	args := m.Mock.Called()
+	return args.Error(0)
+}
+
+func (m *MockDbService) CheckSchema(ctx context.Context) error {
+	args := m.Mock.Called()
+	return args.Error(0)
+}
+
+// Runs fn against the mock itself, counting the units of work
+func (m *MockDbService) WithTx(ctx context.Context, fn func(tx DbService) error) error {
+	m.txCount++
+	return fn(m)
+}
+
 func mockMiddlewareParams() (web.ResponseWriter, *web.Request, *MockNext, *httptest.ResponseRecorder) {
 	// Build the ResponseRecorder
 	recorder := httptest.NewRecorder()
@@ -204,3 +293,23 @@ func mockHandlerParams(method, contenttype, content string) (web.ResponseWriter,
 
 	return rw, req, recorder
 }
+
+/*
+Check rec holds a JSON error response with the given status, code and message
+
+Returns the decoded error for further checks
+*/
+func assertApiError(t *testing.T, rec *httptest.ResponseRecorder, status int, code, message string) ApiError {
+	var envelope apiErrorEnvelope
+
+	assert.Equal(t, status, rec.Code)
+	assert.Equal(t, JsonContentType, rec.Header().Get("Content-Type"))
+	if !assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &envelope), rec.Body.String()) {
+		return ApiError{}
+	}
+	assert.Equal(t, code, envelope.Error.Code)
+	assert.Equal(t, message, envelope.Error.Message)
+	assert.NotEqual(t, "", envelope.Error.RequestId)
+	assert.Equal(t, envelope.Error.RequestId, rec.Header().Get(RequestIdHeader))
+	return envelope.Error
+}
@@ -2,24 +2,48 @@ package main
 
 import (
 	"fmt"
-	"gopkg.in/yaml.v2"
 	"io/ioutil"
 	"net"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // Defaults
 const (
 	DefaultAddress    = "127.0.0.1"
 	DefaultPort       = 3000
+	DefaultAdminPort  = 3002
 	DefaultDbType     = "postgres"
 	DefaultDbHost     = "localhost"
 	DefaultDbPort     = 5432
 	DefaultSslMode    = "disable"
 	DbApplicationName = "people-go"
+	DefaultSqlitePath = "people.db"
+
+	DefaultDbConnectTimeout  = 30 * time.Second
+	DefaultRequestTimeout    = 30 * time.Second
+	DefaultReplicaStickiness = 5 * time.Second
+
+	DefaultAuthCacheSize = 1000
+	DefaultAuthCacheTtl  = 30 * time.Second
+
+	DefaultLogLevel  = "info"
+	DefaultLogOutput = LogOutputStdout
+
+	DefaultHealthCheckTimeout = 2 * time.Second
+	DefaultDrainDelay         = 5 * time.Second
+
+	DefaultTraceExporter    = TraceExporterNone
+	DefaultTracePath        = "traces.json"
+	DefaultTraceEndpoint    = "http://localhost:4318"
+	DefaultTraceSampleRatio = 1.0
+	DefaultTraceServiceName = "people-server"
 )
 
+// Request headers browsers may send cross-origin, unless cors.<group>.headers is set
+var DefaultCorsHeaders = []string{AuthHeaderKey, "Content-Type", RequestIdHeader, IfMatchHeader, IfNoneMatchHeader}
+
 const (
 	KeyValTemplate     = "%s=%v"
 	ListenAddrTemplate = "%s:%d"
@@ -28,7 +52,49 @@ const (
 type Config interface {
 	DbType() string
 	DbCreds() string
+	DbOptions() DbOptions
+	RequestTimeout(route string) time.Duration
+	AuthCacheOptions() AuthCacheOptions
+	LogOptions() LogOptions
+	Debug() bool
+	HealthCheckTimeout(check string) time.Duration
+	DrainDelay() time.Duration
+	TraceOptions() TraceOptions
+	CorsOptions(group string) CorsOptions
 	Listener() net.Listener
+	AdminListener() net.Listener
+}
+
+// A time.Duration written as a string such as "30s" or "5m"
+type Duration time.Duration
+
+func (d Duration) Duration() time.Duration {
+	return time.Duration(d)
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(strings.TrimSpace(string(text)))
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	return d.UnmarshalText([]byte(s))
+}
+
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return d.String(), nil
 }
 
 type dbConfig struct {
@@ -36,9 +102,28 @@ type dbConfig struct {
 	Host     string
 	Port     int
 	User     string
-	Password string
-	DbName   string `yaml:"name"`
-	SslMode  string `yaml:"sslmode"`
+	Password string `secret:"true"`
+	// File containing the password, overrides Password when set
+	PasswordFile string `yaml:"password_file"`
+	DbName       string `yaml:"name"`
+	SslMode      string `yaml:"sslmode"`
+	// Data file for the sqlite type
+	Path string
+
+	// Connection pool, zero values keep the database/sql defaults
+	MaxOpenConns    int      `yaml:"max_open_conns"`
+	MaxIdleConns    int      `yaml:"max_idle_conns"`
+	ConnMaxLifetime Duration `yaml:"conn_max_lifetime"`
+
+	// Server-side limit on each statement, zero for none
+	StatementTimeout Duration `yaml:"statement_timeout"`
+	// How long to keep retrying the first connection at startup
+	ConnectTimeout Duration `yaml:"connect_timeout"`
+
+	// Read-only replicas, as connection strings. Secret, since they can hold passwords
+	Replicas []string `yaml:",omitempty" secret:"true"`
+	// How long a user's reads stay on the primary after they write
+	ReplicaStickiness Duration `yaml:"replica_stickiness"`
 }
 
 type listenConfig struct {
@@ -47,9 +132,96 @@ type listenConfig struct {
 	Ipv6    bool `yaml:"ipv6"`
 }
 
+// Per-request deadlines, carried down to every database call
+type timeoutConfig struct {
+	// For routes without an entry in Routes
+	Default Duration `reload:"true"`
+	// Keyed by route, e.g. "GET /api/person". Zero disables the deadline
+	Routes map[string]Duration `yaml:",omitempty" reload:"true"`
+}
+
+// Cache of the users that authenticate requests
+type authCacheConfig struct {
+	Disabled bool
+	// Most users kept, the least recently used are dropped first
+	Size int
+	// How long a user is kept, so changes made elsewhere show within this
+	Ttl Duration `yaml:"ttl"`
+}
+
+// Server log, including the access log
+type logConfig struct {
+	// One of debug, info, warn or error
+	Level string `reload:"true"`
+	// Each of "stdout", "stderr" or a file path, all written to
+	Outputs []string `yaml:",omitempty"`
+	// Rotate log files on reaching this many megabytes, 0 never
+	MaxSizeMb int `yaml:"max_size_mb"`
+	// Rotated files kept per log file
+	MaxBackups int `yaml:"max_backups"`
+}
+
+// Readiness checks and shutdown
+type healthConfig struct {
+	// Time limit for each readiness check without its own
+	Timeout Duration `reload:"true"`
+	// Keyed by check, database or schema
+	Checks map[string]Duration `yaml:",omitempty" reload:"true"`
+	// How long /readyz fails before the server stops on SIGTERM
+	DrainDelay Duration `yaml:"drain_delay"`
+}
+
+// Distributed tracing
+type traceConfig struct {
+	// One of none, stdout, file or otlp
+	Exporter string
+	// File the file exporter appends to
+	Path string
+	// OTLP/HTTP collector the otlp exporter posts to
+	Endpoint string
+	// Fraction of new traces kept, above 0 and at most 1
+	SampleRatio float64 `yaml:"sample_ratio"`
+	ServiceName string  `yaml:"service_name"`
+}
+
+// Cross-origin requests from browsers to one group of routes
+type corsGroupConfig struct {
+	// Such as "https://app.example.com", "https://*.example.com" or "*".
+	// None disables CORS for the group
+	Origins []string `yaml:",omitempty" reload:"true"`
+	// Allowed in preflights, every method of the route when empty
+	Methods []string `yaml:",omitempty" reload:"true"`
+	// Request headers allowed in preflights
+	Headers []string `yaml:",omitempty" reload:"true"`
+	// Allow credentials such as cookies. Cannot be used with origin "*"
+	Credentials bool `reload:"true"`
+	// How long browsers may cache a preflight, zero leaves it to them
+	MaxAge Duration `yaml:"max_age" reload:"true"`
+}
+
+// CORS, set separately for each group of routes
+type corsConfig struct {
+	// /auth, health and monitoring
+	Auth corsGroupConfig
+	// POST /api/user and the OpenAPI document
+	CreateUser corsGroupConfig `yaml:"create_user"`
+	// Everything else under /api, which needs an API key
+	Api corsGroupConfig
+}
+
 type appConfig struct {
-	DbConf     dbConfig     `yaml:"db"`
-	ListenConf listenConfig `yaml:"listen"`
+	DbConf        dbConfig        `yaml:"db"`
+	ListenConf    listenConfig    `yaml:"listen"`
+	TimeoutConf   timeoutConfig   `yaml:"timeouts"`
+	AuthCacheConf authCacheConfig `yaml:"auth_cache"`
+	LogConf       logConfig       `yaml:"log"`
+	// Serves only the monitoring endpoints when set, which the main listener then omits
+	AdminConf  listenConfig `yaml:"admin"`
+	HealthConf healthConfig `yaml:"health"`
+	TraceConf  traceConfig  `yaml:"trace"`
+	CorsConf   corsConfig   `yaml:"cors"`
+	// Show panic details in error responses. Never enable in production
+	DebugMode bool `yaml:"debug" reload:"true"`
 }
 
 func (ac *appConfig) DbType() string {
@@ -57,62 +229,239 @@ func (ac *appConfig) DbType() string {
 }
 
 func (ac *appConfig) DbCreds() string {
+	if ac.DbType() == SqliteDbType {
+		return sqliteDsn(defaultString(ac.DbConf.Path, DefaultSqlitePath))
+	}
+
 	configStrings := []string{}
 
-	hostStr := fmt.Sprintf(
-		KeyValTemplate, "host", defaultString(ac.DbConf.Host, DefaultDbHost))
+	hostStr := dbCredsPair("host", defaultString(ac.DbConf.Host, DefaultDbHost))
 
-	portStr := fmt.Sprintf(
-		KeyValTemplate, "port", defaultInt(ac.DbConf.Port, DefaultDbPort))
+	portStr := dbCredsPair("port", defaultInt(ac.DbConf.Port, DefaultDbPort))
 
 	configStrings = append(configStrings, hostStr, portStr)
 
 	if ac.DbConf.User != "" {
 		configStrings = append(configStrings,
-			fmt.Sprintf(KeyValTemplate, "user", ac.DbConf.User))
+			dbCredsPair("user", ac.DbConf.User))
 	}
 
 	if ac.DbConf.Password != "" {
 		configStrings = append(configStrings,
-			fmt.Sprintf(KeyValTemplate, "password", ac.DbConf.Password))
+			dbCredsPair("password", ac.DbConf.Password))
 	}
 
 	if ac.DbConf.DbName != "" {
 		configStrings = append(configStrings,
-			fmt.Sprintf(KeyValTemplate, "dbname", ac.DbConf.DbName))
+			dbCredsPair("dbname", ac.DbConf.DbName))
 	}
 
 	if ac.DbConf.SslMode != "" {
 		configStrings = append(configStrings,
-			fmt.Sprintf(KeyValTemplate, "sslmode", ac.DbConf.SslMode))
+			dbCredsPair("sslmode", ac.DbConf.SslMode))
 	}
 
-	appNameStr := fmt.Sprintf(
-		KeyValTemplate, "application_name", DbApplicationName)
+	// lib/pq passes unknown keys to the server as run-time parameters
+	if ac.DbConf.StatementTimeout > 0 {
+		timeoutMs := ac.DbConf.StatementTimeout.Duration() / time.Millisecond
+		configStrings = append(configStrings,
+			dbCredsPair("statement_timeout", int64(timeoutMs)))
+	}
+
+	appNameStr := dbCredsPair("application_name", DbApplicationName)
 
 	configStrings = append(configStrings, appNameStr)
 
 	return strings.Join(configStrings, " ")
 }
 
+/*
+A key=value pair of a Postgres connection string
+
+Values that are empty or hold spaces, quotes or backslashes are quoted,
+escaping the quotes and backslashes, so any password can be given
+*/
+func dbCredsPair(key string, val interface{}) string {
+	s := fmt.Sprint(val)
+	if s == "" || strings.ContainsAny(s, " \t\n\r\f\v'\\") {
+		s = "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+	}
+	return fmt.Sprintf(KeyValTemplate, key, s)
+}
+
+func (ac *appConfig) DbOptions() DbOptions {
+	connectTimeout := ac.DbConf.ConnectTimeout.Duration()
+	if connectTimeout == 0 {
+		connectTimeout = DefaultDbConnectTimeout
+	}
+
+	stickiness := ac.DbConf.ReplicaStickiness.Duration()
+	if stickiness == 0 {
+		stickiness = DefaultReplicaStickiness
+	}
+
+	return DbOptions{
+		MaxOpenConns:      ac.DbConf.MaxOpenConns,
+		MaxIdleConns:      ac.DbConf.MaxIdleConns,
+		ConnMaxLifetime:   ac.DbConf.ConnMaxLifetime.Duration(),
+		ConnectTimeout:    connectTimeout,
+		Replicas:          ac.DbConf.Replicas,
+		ReplicaStickiness: stickiness,
+	}
+}
+
+/*
+The deadline for requests to the given route key
+
+Falls back to the default timeout for routes without their own
+*/
+func (ac *appConfig) RequestTimeout(route string) time.Duration {
+	if timeout, ok := ac.TimeoutConf.Routes[route]; ok {
+		return timeout.Duration()
+	}
+	if ac.TimeoutConf.Default == 0 {
+		return DefaultRequestTimeout
+	}
+	return ac.TimeoutConf.Default.Duration()
+}
+
+func (ac *appConfig) AuthCacheOptions() AuthCacheOptions {
+	if ac.AuthCacheConf.Disabled {
+		return AuthCacheOptions{}
+	}
+
+	ttl := ac.AuthCacheConf.Ttl.Duration()
+	if ttl == 0 {
+		ttl = DefaultAuthCacheTtl
+	}
+
+	return AuthCacheOptions{
+		Size: defaultInt(ac.AuthCacheConf.Size, DefaultAuthCacheSize),
+		Ttl:  ttl,
+	}
+}
+
+// Log options, with an invalid level treated as the default
+func (ac *appConfig) LogOptions() LogOptions {
+	level, err := ParseLogLevel(ac.LogConf.Level)
+	if err != nil {
+		level, _ = ParseLogLevel(DefaultLogLevel)
+	}
+
+	outputs := ac.LogConf.Outputs
+	if len(outputs) == 0 {
+		outputs = []string{DefaultLogOutput}
+	}
+
+	return LogOptions{
+		Level:      level,
+		Outputs:    outputs,
+		MaxSize:    int64(ac.LogConf.MaxSizeMb) << 20,
+		MaxBackups: ac.LogConf.MaxBackups,
+	}
+}
+
+// The time limit for the named readiness check
+func (ac *appConfig) HealthCheckTimeout(check string) time.Duration {
+	if timeout, ok := ac.HealthConf.Checks[check]; ok {
+		return timeout.Duration()
+	}
+	if ac.HealthConf.Timeout == 0 {
+		return DefaultHealthCheckTimeout
+	}
+	return ac.HealthConf.Timeout.Duration()
+}
+
+func (ac *appConfig) DrainDelay() time.Duration {
+	if ac.HealthConf.DrainDelay == 0 {
+		return DefaultDrainDelay
+	}
+	return ac.HealthConf.DrainDelay.Duration()
+}
+
+func (ac *appConfig) TraceOptions() TraceOptions {
+	ratio := ac.TraceConf.SampleRatio
+	if ratio == 0 {
+		ratio = DefaultTraceSampleRatio
+	}
+	return TraceOptions{
+		Exporter:    defaultString(ac.TraceConf.Exporter, DefaultTraceExporter),
+		Path:        defaultString(ac.TraceConf.Path, DefaultTracePath),
+		Endpoint:    defaultString(ac.TraceConf.Endpoint, DefaultTraceEndpoint),
+		SampleRatio: ratio,
+		ServiceName: defaultString(ac.TraceConf.ServiceName, DefaultTraceServiceName),
+	}
+}
+
+// The settings of a group of routes, one of CorsGroups
+func (ac *appConfig) corsGroup(group string) corsGroupConfig {
+	switch group {
+	case CorsGroupAuth:
+		return ac.CorsConf.Auth
+	case CorsGroupCreateUser:
+		return ac.CorsConf.CreateUser
+	case CorsGroupApi:
+		return ac.CorsConf.Api
+	}
+	return corsGroupConfig{}
+}
+
+func (ac *appConfig) CorsOptions(group string) CorsOptions {
+	conf := ac.corsGroup(group)
+	if len(conf.Origins) == 0 {
+		return CorsOptions{}
+	}
+
+	headers := conf.Headers
+	if len(headers) == 0 {
+		headers = DefaultCorsHeaders
+	}
+	return CorsOptions{
+		Origins:     conf.Origins,
+		Methods:     conf.Methods,
+		Headers:     headers,
+		Credentials: conf.Credentials,
+		MaxAge:      conf.MaxAge.Duration(),
+	}
+}
+
+func (ac *appConfig) Debug() bool {
+	return ac.DebugMode
+}
+
 func (ac *appConfig) Listener() net.Listener {
-	var addrType string
-	var addr string
+	return listen(ac.ListenConf, DefaultPort)
+}
+
+func (ac *appConfig) adminEnabled() bool {
+	return ac.AdminConf != listenConfig{}
+}
 
-	if strings.HasPrefix(ac.ListenConf.Address, "/") {
-		addrType = "unix"
-		addr = ac.ListenConf.Address
-	} else {
-		addrStr := defaultString(ac.ListenConf.Address, DefaultAddress)
-		addrType = "tcp4"
-		if ac.ListenConf.Ipv6 {
-			addrType = "tcp6"
-		}
-		portStr := strconv.Itoa(defaultInt(ac.ListenConf.Port, DefaultPort))
-		addr = net.JoinHostPort(addrStr, portStr)
+// The listener for monitoring, or nil to serve it on the main listener
+func (ac *appConfig) AdminListener() net.Listener {
+	if !ac.adminEnabled() {
+		return nil
 	}
+	return listen(ac.AdminConf, DefaultAdminPort)
+}
 
-	l, err := net.Listen(addrType, addr)
+// Network and address to listen on, with defaults filled in
+func listenAddr(conf listenConfig, defaultPort int) (addrType, addr string) {
+	if strings.HasPrefix(conf.Address, "/") {
+		return "unix", conf.Address
+	}
+
+	addrStr := defaultString(conf.Address, DefaultAddress)
+	addrType = "tcp4"
+	if conf.Ipv6 {
+		addrType = "tcp6"
+	}
+	portStr := strconv.Itoa(defaultInt(conf.Port, defaultPort))
+	return addrType, net.JoinHostPort(addrStr, portStr)
+}
+
+func listen(conf listenConfig, defaultPort int) net.Listener {
+	l, err := net.Listen(listenAddr(conf, defaultPort))
 
 	if err != nil {
 		panic(err)
@@ -148,15 +497,26 @@ func ReadConfigFile(filename string) (*appConfig, error) {
 	if err != nil {
 		return nil, err
 	}
-	return ReadConfig(b)
+	return readConfig(b, filename)
 }
 
+/*
+Parse a YAML config
+
+Unknown keys and values of the wrong type are rejected, all of them
+reported together as ConfigErrors
+*/
 func ReadConfig(b []byte) (*appConfig, error) {
-	config := &appConfig{}
+	return readConfig(b, "")
+}
 
-	err := yaml.Unmarshal(b, config)
+func readConfig(b []byte, source string) (*appConfig, error) {
+	config, problems, err := parseConfig(b, source)
 	if err != nil {
 		return nil, err
 	}
+	if len(problems) > 0 {
+		return nil, problems
+	}
 	return config, nil
 }
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"encoding"
+	"errors"
+	"flag"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	DefaultConfigFile = "config.yml"
+	ConfigFileEnv     = "PEOPLE_CONFIG"
+	ConfigEnvPrefix   = "PEOPLE"
+	ConfigFileFlag    = "config"
+
+	SecretMask = "********"
+)
+
+var (
+	ConfigFieldTypeError = errors.New("Unsupported config field type")
+)
+
+// Looks up an environment variable, matching the signature of os.LookupEnv
+type EnvLookup func(key string) (string, bool)
+
+/*
+A single settable field of appConfig
+
+Path holds the YAML keys leading to the field, e.g. ["db", "password"].
+Fields tagged `secret:"true"` are masked when shown, fields tagged
+`reload:"true"` can change without restarting the server
+*/
+type configField struct {
+	Path   []string
+	Value  reflect.Value
+	Secret bool
+	Reload bool
+}
+
+// Name of the environment variable overriding this field, e.g. PEOPLE_DB_PASSWORD
+func (f configField) EnvName() string {
+	parts := append([]string{ConfigEnvPrefix}, f.Path...)
+	return strings.ToUpper(strings.Join(parts, "_"))
+}
+
+// Name of the command-line flag overriding this field, e.g. db.password
+func (f configField) FlagName() string {
+	return strings.Join(f.Path, ".")
+}
+
+// Set the field from its string representation
+func (f configField) Set(s string) error {
+	return setFieldString(f.Value, s)
+}
+
+// The YAML key for a struct field, following yaml.v2's naming rules
+func yamlFieldName(field reflect.StructField) string {
+	tag := field.Tag.Get("yaml")
+	if idx := strings.Index(tag, ","); idx >= 0 {
+		tag = tag[:idx]
+	}
+	if tag == "" {
+		return strings.ToLower(field.Name)
+	}
+	return tag
+}
+
+/*
+Collect every settable leaf field of a config struct
+
+v must be an addressable struct value. Nested structs are walked
+recursively, unexported and `yaml:"-"` fields are skipped
+*/
+func configFields(v reflect.Value, path []string) []configField {
+	fields := []configField{}
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		structField := t.Field(i)
+		if structField.PkgPath != "" {
+			continue
+		}
+		name := yamlFieldName(structField)
+		if name == "-" {
+			continue
+		}
+
+		fieldPath := append(append([]string{}, path...), name)
+		fieldVal := v.Field(i)
+
+		if fieldVal.Kind() == reflect.Struct {
+			fields = append(fields, configFields(fieldVal, fieldPath)...)
+			continue
+		}
+
+		fields = append(fields, configField{
+			Path:   fieldPath,
+			Value:  fieldVal,
+			Secret: structField.Tag.Get("secret") == "true",
+			Reload: structField.Tag.Get("reload") == "true",
+		})
+	}
+
+	return fields
+}
+
+/*
+Set a field from a string, as given in an environment variable or flag
+
+Maps are written as comma separated key=value pairs, e.g.
+"GET /api/person=5s,POST /api/person=10s", and lists as comma separated
+values
+*/
+func setFieldString(v reflect.Value, s string) error {
+	if u, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(s))
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Int:
+		i, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(i))
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(strings.TrimSpace(s))
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Map:
+		m := reflect.MakeMap(v.Type())
+		for _, pair := range strings.Split(s, ",") {
+			if strings.TrimSpace(pair) == "" {
+				continue
+			}
+			idx := strings.LastIndex(pair, "=")
+			if idx < 0 {
+				return fmt.Errorf(ConfigExpectedKeyValue, pair)
+			}
+			key := reflect.New(v.Type().Key()).Elem()
+			if err := setFieldString(key, strings.TrimSpace(pair[:idx])); err != nil {
+				return err
+			}
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err := setFieldString(elem, pair[idx+1:]); err != nil {
+				return err
+			}
+			m.SetMapIndex(key, elem)
+		}
+		v.Set(m)
+	case reflect.Slice:
+		list := reflect.MakeSlice(v.Type(), 0, 0)
+		for _, item := range strings.Split(s, ",") {
+			if strings.TrimSpace(item) == "" {
+				continue
+			}
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err := setFieldString(elem, strings.TrimSpace(item)); err != nil {
+				return err
+			}
+			list = reflect.Append(list, elem)
+		}
+		v.Set(list)
+	default:
+		return ConfigFieldTypeError
+	}
+	return nil
+}
+
+// Settable fields of this config
+func (ac *appConfig) fields() []configField {
+	return configFields(reflect.ValueOf(ac).Elem(), nil)
+}
+
+/*
+Override config values from PEOPLE_* environment variables
+
+Every field has a variable named after its YAML path, for example
+db.password is read from PEOPLE_DB_PASSWORD. Invalid values are
+returned together as ConfigErrors
+*/
+func (ac *appConfig) ApplyEnv(lookup EnvLookup) error {
+	problems := ConfigErrors{}
+
+	for _, field := range ac.fields() {
+		val, ok := lookup(field.EnvName())
+		if !ok {
+			continue
+		}
+		if err := field.Set(val); err != nil {
+			problems = append(problems, ConfigError{
+				Source:  field.EnvName(),
+				Path:    field.FlagName(),
+				Message: err.Error(),
+			})
+		}
+	}
+
+	if len(problems) > 0 {
+		return problems
+	}
+	return nil
+}
+
+/*
+Read secrets referenced by *_file settings
+
+A password_file takes precedence over a password given directly, so
+that a mounted secret can replace a placeholder from the config file
+*/
+func (ac *appConfig) ResolveSecrets() error {
+	if ac.DbConf.PasswordFile == "" {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(ac.DbConf.PasswordFile)
+	if err != nil {
+		return err
+	}
+	ac.DbConf.Password = strings.TrimRight(string(b), "\r\n")
+	return nil
+}
+
+// A copy of the config with defaults filled in for unset values
+func (ac *appConfig) withDefaults() *appConfig {
+	eff := *ac
+
+	eff.DbConf.Type = ac.DbType()
+	eff.DbConf.Host = defaultString(ac.DbConf.Host, DefaultDbHost)
+	eff.DbConf.Port = defaultInt(ac.DbConf.Port, DefaultDbPort)
+	eff.DbConf.SslMode = defaultString(ac.DbConf.SslMode, DefaultSslMode)
+	if eff.DbConf.Type == SqliteDbType {
+		eff.DbConf.Path = defaultString(ac.DbConf.Path, DefaultSqlitePath)
+	}
+	if len(ac.DbConf.Replicas) > 0 {
+		eff.DbConf.ReplicaStickiness = Duration(ac.DbOptions().ReplicaStickiness)
+	}
+	eff.DbConf.ConnectTimeout = Duration(ac.DbOptions().ConnectTimeout)
+	eff.TimeoutConf.Default = Duration(ac.RequestTimeout(""))
+	if !ac.AuthCacheConf.Disabled {
+		cacheOpts := ac.AuthCacheOptions()
+		eff.AuthCacheConf.Size = cacheOpts.Size
+		eff.AuthCacheConf.Ttl = Duration(cacheOpts.Ttl)
+	}
+	eff.HealthConf.Timeout = Duration(ac.HealthCheckTimeout(""))
+	eff.HealthConf.DrainDelay = Duration(ac.DrainDelay())
+	traceOpts := ac.TraceOptions()
+	eff.TraceConf.Exporter = traceOpts.Exporter
+	eff.TraceConf.SampleRatio = traceOpts.SampleRatio
+	eff.TraceConf.ServiceName = traceOpts.ServiceName
+	switch traceOpts.Exporter {
+	case TraceExporterFile:
+		eff.TraceConf.Path = traceOpts.Path
+	case TraceExporterOtlp:
+		eff.TraceConf.Endpoint = traceOpts.Endpoint
+	}
+	for _, group := range []*corsGroupConfig{&eff.CorsConf.Auth, &eff.CorsConf.CreateUser, &eff.CorsConf.Api} {
+		if len(group.Origins) > 0 && len(group.Headers) == 0 {
+			group.Headers = DefaultCorsHeaders
+		}
+	}
+	eff.LogConf.Level = ac.LogOptions().Level.String()
+	eff.LogConf.Outputs = ac.LogOptions().Outputs
+
+	if !strings.HasPrefix(ac.ListenConf.Address, "/") {
+		eff.ListenConf.Address = defaultString(ac.ListenConf.Address, DefaultAddress)
+		eff.ListenConf.Port = defaultInt(ac.ListenConf.Port, DefaultPort)
+	}
+	if ac.adminEnabled() && !strings.HasPrefix(ac.AdminConf.Address, "/") {
+		eff.AdminConf.Address = defaultString(ac.AdminConf.Address, DefaultAddress)
+		eff.AdminConf.Port = defaultInt(ac.AdminConf.Port, DefaultAdminPort)
+	}
+
+	return &eff
+}
+
+/*
+Render the effective config as YAML
+
+Defaults are filled in, and secrets are masked
+*/
+func (ac *appConfig) Print() (string, error) {
+	eff := ac.withDefaults()
+
+	for _, field := range eff.fields() {
+		if field.Secret {
+			maskSecret(field.Value)
+		}
+	}
+
+	b, err := yaml.Marshal(eff)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+/*
+Replace a set secret with SecretMask
+
+Lists get a new list of masks, since eff shares their backing arrays
+with the original config
+*/
+func maskSecret(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.String:
+		if v.Len() > 0 {
+			v.SetString(SecretMask)
+		}
+	case reflect.Slice:
+		masked := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			masked.Index(i).SetString(SecretMask)
+		}
+		v.Set(masked)
+	}
+}
+
+// Records the value of a field flag, applied after the environment
+type fieldFlag struct {
+	field configField
+	value string
+}
+
+func (f *fieldFlag) String() string {
+	return f.value
+}
+
+func (f *fieldFlag) Set(s string) error {
+	f.value = s
+	return nil
+}
+
+// Flags of type bool may be given without a value: -listen.ipv6
+func (f *fieldFlag) IsBoolFlag() bool {
+	return f.field.Value.Kind() == reflect.Bool
+}
+
+/*
+Build the effective config from all sources
+
+Precedence, lowest to highest: defaults, config file, PEOPLE_*
+environment variables, command-line flags.
+
+The config file is chosen by -config, then PEOPLE_CONFIG, then
+DefaultConfigFile. Every problem found in any source is returned
+together as ConfigErrors, each pointing at the source of the value
+*/
+func LoadConfig(fs *flag.FlagSet, args []string, lookup EnvLookup) (*appConfig, error) {
+	configFile := DefaultConfigFile
+	if envFile, ok := lookup(ConfigFileEnv); ok && envFile != "" {
+		configFile = envFile
+	}
+	fs.StringVar(&configFile, ConfigFileFlag, configFile, "Path to the YAML config file")
+
+	// Flags are bound to a scratch config, only their names matter here
+	fieldFlags := []*fieldFlag{}
+	for _, field := range new(appConfig).fields() {
+		if field.Secret {
+			// Secrets would be visible in the process list
+			continue
+		}
+		ff := &fieldFlag{field: field}
+		fieldFlags = append(fieldFlags, ff)
+		fs.Var(ff, field.FlagName(), "Overrides "+field.EnvName())
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	b, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config, problems, err := parseConfig(b, configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	// Where each value came from, for pointing at problems
+	lines := yamlKeyLines(b)
+	sources := map[string]ConfigError{}
+	for path, line := range lines {
+		sources[path] = ConfigError{Source: configFile, Line: line}
+	}
+
+	if err := config.ApplyEnv(lookup); err != nil {
+		problems = append(problems, err.(ConfigErrors)...)
+	}
+	for _, field := range config.fields() {
+		if _, ok := lookup(field.EnvName()); ok {
+			sources[field.FlagName()] = ConfigError{Source: field.EnvName()}
+		}
+	}
+
+	setFlags := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = true
+	})
+
+	fieldsByName := map[string]configField{}
+	for _, field := range config.fields() {
+		fieldsByName[field.FlagName()] = field
+	}
+
+	for _, ff := range fieldFlags {
+		name := ff.field.FlagName()
+		if !setFlags[name] {
+			continue
+		}
+		sources[name] = ConfigError{Source: "-" + name}
+		if err := fieldsByName[name].Set(ff.value); err != nil {
+			problems = append(problems, ConfigError{
+				Source:  "-" + name,
+				Path:    name,
+				Message: err.Error(),
+			})
+		}
+	}
+
+	// Read first, so a password from a file is used like one given directly.
+	// A file that cannot be read is reported by Validate
+	config.ResolveSecrets()
+
+	for _, problem := range config.Validate() {
+		// Map entries set from the environment or a flag share the map's source
+		path := problem.Path
+		source, ok := sources[path]
+		for !ok && strings.Contains(path, ".") {
+			path = path[:strings.LastIndex(path, ".")]
+			source, ok = sources[path]
+		}
+		problem.Source = source.Source
+		problem.Line = source.Line
+		problems = append(problems, problem)
+	}
+
+	if len(problems) > 0 {
+		return nil, problems
+	}
+
+	return config, nil
+}
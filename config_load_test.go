@@ -0,0 +1,399 @@
+package main
+
+import (
+	"flag"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func mapLookup(env map[string]string) EnvLookup {
+	return func(key string) (string, bool) {
+		val, ok := env[key]
+		return val, ok
+	}
+}
+
+func newTestFlagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	return fs
+}
+
+func writeTempFile(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "people-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestConfigFieldNames(t *testing.T) {
+	expected := map[string]string{
+		"db.type":                      "PEOPLE_DB_TYPE",
+		"db.host":                      "PEOPLE_DB_HOST",
+		"db.port":                      "PEOPLE_DB_PORT",
+		"db.user":                      "PEOPLE_DB_USER",
+		"db.password":                  "PEOPLE_DB_PASSWORD",
+		"db.password_file":             "PEOPLE_DB_PASSWORD_FILE",
+		"db.name":                      "PEOPLE_DB_NAME",
+		"db.sslmode":                   "PEOPLE_DB_SSLMODE",
+		"db.path":                      "PEOPLE_DB_PATH",
+		"db.max_open_conns":            "PEOPLE_DB_MAX_OPEN_CONNS",
+		"db.max_idle_conns":            "PEOPLE_DB_MAX_IDLE_CONNS",
+		"db.conn_max_lifetime":         "PEOPLE_DB_CONN_MAX_LIFETIME",
+		"db.statement_timeout":         "PEOPLE_DB_STATEMENT_TIMEOUT",
+		"db.connect_timeout":           "PEOPLE_DB_CONNECT_TIMEOUT",
+		"db.replicas":                  "PEOPLE_DB_REPLICAS",
+		"db.replica_stickiness":        "PEOPLE_DB_REPLICA_STICKINESS",
+		"listen.address":               "PEOPLE_LISTEN_ADDRESS",
+		"listen.port":                  "PEOPLE_LISTEN_PORT",
+		"listen.ipv6":                  "PEOPLE_LISTEN_IPV6",
+		"timeouts.default":             "PEOPLE_TIMEOUTS_DEFAULT",
+		"timeouts.routes":              "PEOPLE_TIMEOUTS_ROUTES",
+		"auth_cache.disabled":          "PEOPLE_AUTH_CACHE_DISABLED",
+		"auth_cache.size":              "PEOPLE_AUTH_CACHE_SIZE",
+		"auth_cache.ttl":               "PEOPLE_AUTH_CACHE_TTL",
+		"log.level":                    "PEOPLE_LOG_LEVEL",
+		"log.outputs":                  "PEOPLE_LOG_OUTPUTS",
+		"log.max_size_mb":              "PEOPLE_LOG_MAX_SIZE_MB",
+		"log.max_backups":              "PEOPLE_LOG_MAX_BACKUPS",
+		"debug":                        "PEOPLE_DEBUG",
+		"admin.address":                "PEOPLE_ADMIN_ADDRESS",
+		"admin.port":                   "PEOPLE_ADMIN_PORT",
+		"admin.ipv6":                   "PEOPLE_ADMIN_IPV6",
+		"health.timeout":               "PEOPLE_HEALTH_TIMEOUT",
+		"health.checks":                "PEOPLE_HEALTH_CHECKS",
+		"health.drain_delay":           "PEOPLE_HEALTH_DRAIN_DELAY",
+		"trace.exporter":               "PEOPLE_TRACE_EXPORTER",
+		"trace.path":                   "PEOPLE_TRACE_PATH",
+		"trace.endpoint":               "PEOPLE_TRACE_ENDPOINT",
+		"trace.sample_ratio":           "PEOPLE_TRACE_SAMPLE_RATIO",
+		"trace.service_name":           "PEOPLE_TRACE_SERVICE_NAME",
+		"cors.auth.origins":            "PEOPLE_CORS_AUTH_ORIGINS",
+		"cors.auth.methods":            "PEOPLE_CORS_AUTH_METHODS",
+		"cors.auth.headers":            "PEOPLE_CORS_AUTH_HEADERS",
+		"cors.auth.credentials":        "PEOPLE_CORS_AUTH_CREDENTIALS",
+		"cors.auth.max_age":            "PEOPLE_CORS_AUTH_MAX_AGE",
+		"cors.create_user.origins":     "PEOPLE_CORS_CREATE_USER_ORIGINS",
+		"cors.create_user.methods":     "PEOPLE_CORS_CREATE_USER_METHODS",
+		"cors.create_user.headers":     "PEOPLE_CORS_CREATE_USER_HEADERS",
+		"cors.create_user.credentials": "PEOPLE_CORS_CREATE_USER_CREDENTIALS",
+		"cors.create_user.max_age":     "PEOPLE_CORS_CREATE_USER_MAX_AGE",
+		"cors.api.origins":             "PEOPLE_CORS_API_ORIGINS",
+		"cors.api.methods":             "PEOPLE_CORS_API_METHODS",
+		"cors.api.headers":             "PEOPLE_CORS_API_HEADERS",
+		"cors.api.credentials":         "PEOPLE_CORS_API_CREDENTIALS",
+		"cors.api.max_age":             "PEOPLE_CORS_API_MAX_AGE",
+	}
+
+	actual := map[string]string{}
+	for _, field := range new(appConfig).fields() {
+		actual[field.FlagName()] = field.EnvName()
+	}
+
+	assert.Equal(t, expected, actual)
+}
+
+func TestConfigFieldsSecret(t *testing.T) {
+	for _, field := range new(appConfig).fields() {
+		secret := field.FlagName() == "db.password" || field.FlagName() == "db.replicas"
+		assert.Equal(t, secret, field.Secret, field.FlagName())
+	}
+}
+
+func TestAppConfigApplyEnv(t *testing.T) {
+	config := &appConfig{
+		DbConf: dbConfig{
+			Host: "filehost",
+			User: "fileuser",
+		},
+	}
+
+	env := map[string]string{
+		"PEOPLE_DB_HOST":     "envhost",
+		"PEOPLE_DB_PORT":     "6543",
+		"PEOPLE_DB_PASSWORD": "envpw",
+		"PEOPLE_LISTEN_IPV6": "true",
+		"UNRELATED":          "value",
+
+		"PEOPLE_DB_CONN_MAX_LIFETIME": "5m",
+		"PEOPLE_TIMEOUTS_ROUTES":      "GET /api/person=2s, POST /api/person=1m",
+		"PEOPLE_DB_REPLICAS":          "host=replica1 dbname=people, host=replica2 dbname=people",
+		"PEOPLE_TRACE_SAMPLE_RATIO":   "0.1",
+	}
+
+	err := config.ApplyEnv(mapLookup(env))
+	assert.Nil(t, err)
+
+	expected := &appConfig{
+		DbConf: dbConfig{
+			Host:     "envhost",
+			Port:     6543,
+			User:     "fileuser",
+			Password: "envpw",
+
+			ConnMaxLifetime: Duration(5 * time.Minute),
+			Replicas:        []string{"host=replica1 dbname=people", "host=replica2 dbname=people"},
+		},
+		ListenConf: listenConfig{
+			Ipv6: true,
+		},
+		TimeoutConf: timeoutConfig{
+			Routes: map[string]Duration{
+				"GET /api/person":  Duration(2 * time.Second),
+				"POST /api/person": Duration(time.Minute),
+			},
+		},
+		TraceConf: traceConfig{
+			SampleRatio: 0.1,
+		},
+	}
+	assert.Equal(t, expected, config)
+}
+
+func TestAppConfigApplyEnvInvalid(t *testing.T) {
+	invalidEnvs := []map[string]string{
+		{"PEOPLE_DB_PORT": "abc"},
+		{"PEOPLE_LISTEN_PORT": ""},
+		{"PEOPLE_LISTEN_IPV6": "maybe"},
+		{"PEOPLE_TRACE_SAMPLE_RATIO": "half"},
+		{"PEOPLE_DB_STATEMENT_TIMEOUT": "5"},
+		{"PEOPLE_TIMEOUTS_ROUTES": "GET /api/person"},
+		{"PEOPLE_TIMEOUTS_ROUTES": "GET /api/person=soon"},
+	}
+
+	for _, env := range invalidEnvs {
+		config := new(appConfig)
+		err := config.ApplyEnv(mapLookup(env))
+		assert.NotNil(t, err)
+	}
+}
+
+func TestAppConfigResolveSecrets(t *testing.T) {
+	pwFile := writeTempFile(t, "filepw\n")
+	defer os.Remove(pwFile)
+
+	config := &appConfig{
+		DbConf: dbConfig{
+			Password:     "placeholder",
+			PasswordFile: pwFile,
+		},
+	}
+
+	err := config.ResolveSecrets()
+	assert.Nil(t, err)
+	assert.Equal(t, "filepw", config.DbConf.Password)
+}
+
+func TestAppConfigResolveSecretsMissingFile(t *testing.T) {
+	config := &appConfig{
+		DbConf: dbConfig{
+			PasswordFile: testNonexistentConfigFile,
+		},
+	}
+
+	err := config.ResolveSecrets()
+	assert.NotNil(t, err)
+}
+
+func TestAppConfigPrint(t *testing.T) {
+	config := &appConfig{
+		DbConf: dbConfig{
+			User:     "test1",
+			Password: "test2",
+		},
+	}
+
+	out, err := config.Print()
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	assert.False(t, strings.Contains(out, "test2"), "Password should be masked")
+	assert.Equal(t, "test2", config.DbConf.Password, "Original should be untouched")
+
+	printed, err := ReadConfig([]byte(out))
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	expected := &appConfig{
+		DbConf: dbConfig{
+			Type:     DefaultDbType,
+			Host:     DefaultDbHost,
+			Port:     DefaultDbPort,
+			User:     "test1",
+			Password: SecretMask,
+			SslMode:  DefaultSslMode,
+
+			ConnectTimeout: Duration(DefaultDbConnectTimeout),
+		},
+		ListenConf: listenConfig{
+			Address: DefaultAddress,
+			Port:    DefaultPort,
+		},
+		TimeoutConf: timeoutConfig{
+			Default: Duration(DefaultRequestTimeout),
+		},
+		AuthCacheConf: authCacheConfig{
+			Size: DefaultAuthCacheSize,
+			Ttl:  Duration(DefaultAuthCacheTtl),
+		},
+		LogConf: logConfig{
+			Level:   DefaultLogLevel,
+			Outputs: []string{DefaultLogOutput},
+		},
+		HealthConf: healthConfig{
+			Timeout:    Duration(DefaultHealthCheckTimeout),
+			DrainDelay: Duration(DefaultDrainDelay),
+		},
+		TraceConf: traceConfig{
+			Exporter:    DefaultTraceExporter,
+			SampleRatio: DefaultTraceSampleRatio,
+			ServiceName: DefaultTraceServiceName,
+		},
+	}
+	assert.Equal(t, expected, printed)
+}
+
+func TestAppConfigPrintReplicas(t *testing.T) {
+	config := &appConfig{
+		DbConf: dbConfig{
+			Replicas: []string{"host=replica1 password=test2", "host=replica2 password=test2"},
+		},
+	}
+
+	out, err := config.Print()
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	assert.False(t, strings.Contains(out, "test2"), "Replicas should be masked")
+	assert.Equal(t, "host=replica1 password=test2", config.DbConf.Replicas[0], "Original should be untouched")
+
+	printed, err := ReadConfig([]byte(out))
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, []string{SecretMask, SecretMask}, printed.DbConf.Replicas)
+	assert.Equal(t, Duration(DefaultReplicaStickiness), printed.DbConf.ReplicaStickiness)
+}
+
+func TestAppConfigPrintUnixSocket(t *testing.T) {
+	config := &appConfig{
+		ListenConf: listenConfig{
+			Address: "/tmp/people-test.sock",
+		},
+	}
+
+	out, err := config.Print()
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	printed, err := ReadConfig([]byte(out))
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, 0, printed.ListenConf.Port)
+	assert.Equal(t, "", printed.DbConf.Password, "Empty secrets are not masked")
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	configFile := writeTempFile(t, `
+db:
+  host: filehost
+  port: 1111
+  user: fileuser
+listen:
+  port: 2222
+`)
+	defer os.Remove(configFile)
+
+	env := map[string]string{
+		"PEOPLE_DB_PORT":     "3333",
+		"PEOPLE_LISTEN_PORT": "4444",
+	}
+	args := []string{"-config", configFile, "-listen.port", "5555"}
+
+	config, err := LoadConfig(newTestFlagSet(), args, mapLookup(env))
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	assert.Equal(t, "filehost", config.DbConf.Host)
+	assert.Equal(t, "fileuser", config.DbConf.User)
+	assert.Equal(t, 3333, config.DbConf.Port)
+	assert.Equal(t, 5555, config.ListenConf.Port)
+	assert.Equal(t, "", config.DbConf.Type)
+}
+
+func TestLoadConfigFileFromEnv(t *testing.T) {
+	env := map[string]string{
+		ConfigFileEnv: testConfigFile,
+	}
+
+	config, err := LoadConfig(newTestFlagSet(), []string{}, mapLookup(env))
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, "dbhost", config.DbConf.Host)
+}
+
+func TestLoadConfigBoolFlag(t *testing.T) {
+	args := []string{"-config", testConfigFile, "-listen.address", "::1", "-listen.ipv6"}
+
+	config, err := LoadConfig(newTestFlagSet(), args, mapLookup(nil))
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.True(t, config.ListenConf.Ipv6)
+}
+
+func TestLoadConfigPasswordFile(t *testing.T) {
+	pwFile := writeTempFile(t, "secret pw")
+	defer os.Remove(pwFile)
+
+	env := map[string]string{
+		"PEOPLE_DB_PASSWORD_FILE": pwFile,
+	}
+	args := []string{"-config", testConfigFile}
+
+	config, err := LoadConfig(newTestFlagSet(), args, mapLookup(env))
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, "secret pw", config.DbConf.Password)
+	assert.Contains(t, config.DbCreds(), "password='secret pw'")
+}
+
+func TestLoadConfigNoPasswordFlag(t *testing.T) {
+	args := []string{"-config", testConfigFile, "-db.password", "visible"}
+
+	config, err := LoadConfig(newTestFlagSet(), args, mapLookup(nil))
+	assert.Nil(t, config)
+	assert.NotNil(t, err)
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	invalidArgs := [][]string{
+		{"-config", testNonexistentConfigFile},
+		{"-config", testConfigFile, "-db.port", "abc"},
+		{"-config", testConfigFile, "-unknown"},
+	}
+
+	for _, args := range invalidArgs {
+		config, err := LoadConfig(newTestFlagSet(), args, mapLookup(nil))
+		assert.Nil(t, config)
+		assert.NotNil(t, err)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"strconv"
 	"testing"
+	"time"
 )
 
 const (
@@ -462,3 +463,254 @@ func TestAppConfigListenerPanics(t *testing.T) {
 		}, strconv.Itoa(i))
 	}
 }
+
+func TestReadConfigDbPool(t *testing.T) {
+	in := `
+db:
+  max_open_conns: 20
+  max_idle_conns: 5
+  conn_max_lifetime: 30m
+  statement_timeout: 2.5s
+  connect_timeout: 1m
+`
+	expected := &appConfig{
+		DbConf: dbConfig{
+			MaxOpenConns:     20,
+			MaxIdleConns:     5,
+			ConnMaxLifetime:  Duration(30 * time.Minute),
+			StatementTimeout: Duration(2500 * time.Millisecond),
+			ConnectTimeout:   Duration(time.Minute),
+		},
+	}
+
+	actualOut, err := ReadConfig([]byte(in))
+	assert.Nil(t, err)
+	assert.Equal(t, expected, actualOut)
+}
+
+func TestAppConfigDbCredsQuoted(t *testing.T) {
+	config := appConfig{
+		DbConf: dbConfig{
+			User:     "a user",
+			Password: `it's a\pass word`,
+			DbName:   "people",
+		},
+	}
+
+	assert.Equal(t,
+		`host=localhost port=5432 user='a user' password='it\'s a\\pass word' dbname=people application_name=people-go`,
+		config.DbCreds())
+}
+
+func TestAppConfigDbCredsStatementTimeout(t *testing.T) {
+	config := appConfig{
+		DbConf: dbConfig{
+			SslMode:          "disable",
+			StatementTimeout: Duration(2500 * time.Millisecond),
+		},
+	}
+
+	assert.Equal(t,
+		"host=localhost port=5432 sslmode=disable statement_timeout=2500 application_name=people-go",
+		config.DbCreds())
+}
+
+func TestAppConfigDbOptions(t *testing.T) {
+	tests := []struct {
+		in  appConfig
+		out DbOptions
+	}{
+		{
+			in: appConfig{},
+			out: DbOptions{
+				ConnectTimeout:    DefaultDbConnectTimeout,
+				ReplicaStickiness: DefaultReplicaStickiness,
+			},
+		},
+		{
+			in: appConfig{
+				DbConf: dbConfig{
+					MaxOpenConns:    10,
+					MaxIdleConns:    2,
+					ConnMaxLifetime: Duration(time.Hour),
+					ConnectTimeout:  Duration(time.Second),
+
+					Replicas:          []string{"host=replica"},
+					ReplicaStickiness: Duration(time.Minute),
+				},
+			},
+			out: DbOptions{
+				MaxOpenConns:      10,
+				MaxIdleConns:      2,
+				ConnMaxLifetime:   time.Hour,
+				ConnectTimeout:    time.Second,
+				Replicas:          []string{"host=replica"},
+				ReplicaStickiness: time.Minute,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.out, test.in.DbOptions())
+	}
+}
+
+func TestDurationYaml(t *testing.T) {
+	d := Duration(90 * time.Second)
+
+	out, err := d.MarshalYAML()
+	assert.Nil(t, err)
+	assert.Equal(t, "1m30s", out)
+
+	err = d.UnmarshalText([]byte("forever"))
+	assert.NotNil(t, err)
+	assert.Equal(t, Duration(90*time.Second), d)
+}
+
+func TestReadConfigTimeouts(t *testing.T) {
+	in := `
+timeouts:
+  default: 10s
+  routes:
+    GET /api/person: 2s
+    POST /api/person: 0s
+`
+	expected := &appConfig{
+		TimeoutConf: timeoutConfig{
+			Default: Duration(10 * time.Second),
+			Routes: map[string]Duration{
+				"GET /api/person":  Duration(2 * time.Second),
+				"POST /api/person": 0,
+			},
+		},
+	}
+
+	actualOut, err := ReadConfig([]byte(in))
+	assert.Nil(t, err)
+	assert.Equal(t, expected, actualOut)
+}
+
+func TestAppConfigRequestTimeout(t *testing.T) {
+	config := appConfig{}
+	assert.Equal(t, DefaultRequestTimeout, config.RequestTimeout("GET /api/person"))
+
+	config.TimeoutConf = timeoutConfig{
+		Default: Duration(10 * time.Second),
+		Routes: map[string]Duration{
+			"GET /api/person":  Duration(2 * time.Second),
+			"POST /api/person": 0,
+		},
+	}
+	assert.Equal(t, 10*time.Second, config.RequestTimeout("GET /api/user"))
+	assert.Equal(t, 10*time.Second, config.RequestTimeout(""))
+	assert.Equal(t, 2*time.Second, config.RequestTimeout("GET /api/person"))
+	assert.Equal(t, time.Duration(0), config.RequestTimeout("POST /api/person"))
+}
+
+func TestAppConfigLogOptions(t *testing.T) {
+	config := appConfig{}
+	assert.Equal(t, LogOptions{Level: LevelInfo, Outputs: []string{DefaultLogOutput}}, config.LogOptions())
+
+	config.LogConf = logConfig{
+		Level:      "debug",
+		Outputs:    []string{"stderr", "/var/log/people.log"},
+		MaxSizeMb:  10,
+		MaxBackups: 3,
+	}
+	assert.Equal(t, LogOptions{
+		Level:      LevelDebug,
+		Outputs:    []string{"stderr", "/var/log/people.log"},
+		MaxSize:    10 << 20,
+		MaxBackups: 3,
+	}, config.LogOptions())
+}
+
+func TestAppConfigAdminListener(t *testing.T) {
+	config := appConfig{}
+	assert.Nil(t, config.AdminListener())
+
+	config.AdminConf = listenConfig{Port: 4041}
+	l := config.AdminListener()
+	if assert.NotNil(t, l) {
+		assert.Equal(t, "127.0.0.1:4041", l.Addr().String())
+		l.Close()
+	}
+}
+
+func TestAppConfigHealthCheckTimeout(t *testing.T) {
+	config := appConfig{}
+	assert.Equal(t, DefaultHealthCheckTimeout, config.HealthCheckTimeout(HealthCheckDatabase))
+
+	config.HealthConf = healthConfig{
+		Timeout: Duration(time.Second),
+		Checks: map[string]Duration{
+			HealthCheckSchema: Duration(5 * time.Second),
+		},
+	}
+	assert.Equal(t, time.Second, config.HealthCheckTimeout(HealthCheckDatabase))
+	assert.Equal(t, 5*time.Second, config.HealthCheckTimeout(HealthCheckSchema))
+}
+
+func TestAppConfigDrainDelay(t *testing.T) {
+	config := appConfig{}
+	assert.Equal(t, DefaultDrainDelay, config.DrainDelay())
+
+	config.HealthConf.DrainDelay = Duration(time.Second)
+	assert.Equal(t, time.Second, config.DrainDelay())
+}
+
+func TestAppConfigTraceOptions(t *testing.T) {
+	config := appConfig{}
+	assert.Equal(t, TraceOptions{
+		Exporter:    TraceExporterNone,
+		Path:        DefaultTracePath,
+		Endpoint:    DefaultTraceEndpoint,
+		SampleRatio: 1,
+		ServiceName: DefaultTraceServiceName,
+	}, config.TraceOptions())
+
+	config.TraceConf = traceConfig{
+		Exporter:    TraceExporterOtlp,
+		Endpoint:    "http://collector:4318",
+		SampleRatio: 0.25,
+		ServiceName: "people-eu",
+	}
+	assert.Equal(t, TraceOptions{
+		Exporter:    TraceExporterOtlp,
+		Path:        DefaultTracePath,
+		Endpoint:    "http://collector:4318",
+		SampleRatio: 0.25,
+		ServiceName: "people-eu",
+	}, config.TraceOptions())
+}
+
+func TestAppConfigCorsOptions(t *testing.T) {
+	config := appConfig{}
+	for _, group := range CorsGroups {
+		assert.Equal(t, CorsOptions{}, config.CorsOptions(group), group)
+	}
+
+	config.CorsConf.Api = corsGroupConfig{
+		Origins: []string{"https://*.example.com"},
+		MaxAge:  Duration(10 * time.Minute),
+	}
+	config.CorsConf.CreateUser = corsGroupConfig{
+		Origins:     []string{"https://app.example.com"},
+		Methods:     []string{"POST"},
+		Headers:     []string{"Content-Type"},
+		Credentials: true,
+	}
+	assert.Equal(t, CorsOptions{
+		Origins: []string{"https://*.example.com"},
+		Headers: DefaultCorsHeaders,
+		MaxAge:  10 * time.Minute,
+	}, config.CorsOptions(CorsGroupApi))
+	assert.Equal(t, CorsOptions{
+		Origins:     []string{"https://app.example.com"},
+		Methods:     []string{"POST"},
+		Headers:     []string{"Content-Type"},
+		Credentials: true,
+	}, config.CorsOptions(CorsGroupCreateUser))
+	assert.Equal(t, CorsOptions{}, config.CorsOptions(CorsGroupAuth))
+	assert.Equal(t, CorsOptions{}, config.CorsOptions("unknown"))
+}
@@ -0,0 +1,553 @@
+package main
+
+import (
+	"encoding"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	MaxPort = 65535
+
+	// Config problems
+	ConfigUnknownKey        = "Unknown setting"
+	ConfigExpectedMapping   = "Expected a mapping"
+	ConfigExpectedList      = "Expected a list"
+	ConfigExpectedString    = "Expected a string"
+	ConfigExpectedInteger   = "Expected an integer"
+	ConfigExpectedNumber    = "Expected a number"
+	ConfigExpectedBool      = "Expected true or false"
+	ConfigInvalidPort       = "Port must be between 1 and 65535"
+	ConfigInvalidDbType     = "Unsupported database type %q, expected one of: %s"
+	ConfigInvalidSslMode    = "Invalid sslmode %q, expected one of: %s"
+	ConfigContainsSpace     = "Cannot contain whitespace"
+	ConfigUnreadableFile    = "Cannot read file: %s"
+	ConfigSocketDirMissing  = "Socket directory %s does not exist"
+	ConfigDataDirMissing    = "Data directory %s does not exist"
+	ConfigIpv6Mismatch      = "ipv6 is set but %s is not an IPv6 address"
+	ConfigIpv4Mismatch      = "%s is an IPv6 address but ipv6 is not set"
+	ConfigNegative          = "Cannot be negative"
+	ConfigIdleExceedsOpen   = "Cannot exceed max_open_conns"
+	ConfigExpectedKeyValue  = "Expected key=value, got %q"
+	ConfigUnknownRoute      = "Unknown route %q, expected one of: %s"
+	ConfigReplicasNotPg     = "Replicas are only supported with postgres"
+	ConfigInvalidLogLevel   = "Invalid log level %q, expected one of: %s"
+	ConfigLogDirMissing     = "Log directory %s does not exist"
+	ConfigAdminSameAsListen = "Cannot use the same address as listen"
+	ConfigUnknownCheck      = "Unknown check %q, expected one of: %s"
+	ConfigInvalidExporter   = "Unknown exporter %q, expected one of: %s"
+	ConfigInvalidRatio      = "Must be above 0 and at most 1"
+	ConfigTraceDirMissing   = "Trace directory %s does not exist"
+	ConfigInvalidOrigin     = "Invalid origin %q, expected scheme://host[:port], *.host for subdomains, or *"
+	ConfigInvalidMethod     = "Unknown method %q, expected one of: %s"
+	ConfigCorsAnyCredential = "Cannot allow credentials from any origin"
+)
+
+var (
+	SupportedDbTypes = []string{"postgres", MemoryDbType, SqliteDbType}
+	SslModes         = []string{"disable", "allow", "prefer", "require", "verify-ca", "verify-full"}
+	HttpMethods      = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
+
+	// Matches "  key:" and "  key: value", keys may be quoted
+	yamlKeyRegexp = regexp.MustCompile(`^( *)("[^"]*"|'[^']*'|[^\s#'"\-][^:#]*?) *:(?:\s|$)`)
+)
+
+/*
+A single problem with the configuration
+
+Source says where the offending value came from: a config file, an
+environment variable or a flag. Line is set for values from a config
+file. Both are empty when the value is a default
+*/
+type ConfigError struct {
+	Source  string
+	Line    int
+	Path    string
+	Message string
+}
+
+func (e ConfigError) Error() string {
+	msg := fmt.Sprintf("%s: %s", e.Path, e.Message)
+	switch {
+	case e.Line > 0 && e.Source != "":
+		msg = fmt.Sprintf("%s:%d: %s", e.Source, e.Line, msg)
+	case e.Line > 0:
+		msg = fmt.Sprintf("line %d: %s", e.Line, msg)
+	case e.Source != "":
+		msg = fmt.Sprintf("%s: %s", e.Source, msg)
+	}
+	return msg
+}
+
+// All problems found with a configuration, reported together
+type ConfigErrors []ConfigError
+
+func (e ConfigErrors) Error() string {
+	lines := make([]string, len(e))
+	for i, configErr := range e {
+		lines[i] = configErr.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+type byLine ConfigErrors
+
+func (e byLine) Len() int           { return len(e) }
+func (e byLine) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+func (e byLine) Less(i, j int) bool { return e[i].Line < e[j].Line }
+
+type byPath ConfigErrors
+
+func (e byPath) Len() int           { return len(e) }
+func (e byPath) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+func (e byPath) Less(i, j int) bool { return e[i].Path < e[j].Path }
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Map the dotted path of each block-style key to its 1-based line number
+
+yaml.v2 does not expose node positions, so this is a line scanner
+rather than a parser. Keys in flow style ({a: b}) and inside sequences
+are not recorded
+*/
+func yamlKeyLines(b []byte) map[string]int {
+	type level struct {
+		indent int
+		key    string
+	}
+
+	lines := map[string]int{}
+	stack := []level{}
+
+	for i, line := range strings.Split(string(b), "\n") {
+		match := yamlKeyRegexp.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+
+		indent := len(match[1])
+		key := strings.Trim(match[2], `"'`)
+
+		for len(stack) > 0 && stack[len(stack)-1].indent >= indent {
+			stack = stack[:len(stack)-1]
+		}
+		stack = append(stack, level{indent, key})
+
+		keys := make([]string, len(stack))
+		for j, l := range stack {
+			keys[j] = l.key
+		}
+
+		path := strings.Join(keys, ".")
+		if _, seen := lines[path]; !seen {
+			lines[path] = i + 1
+		}
+	}
+
+	return lines
+}
+
+// Check a generically decoded YAML value against the type it will be decoded into
+func checkYamlValue(t reflect.Type, val interface{}, path string) ConfigErrors {
+	problems := ConfigErrors{}
+
+	if val == nil {
+		return problems
+	}
+
+	if u, ok := reflect.New(t).Interface().(encoding.TextUnmarshaler); ok {
+		switch val.(type) {
+		case map[interface{}]interface{}, []interface{}:
+			return append(problems, ConfigError{Path: path, Message: ConfigExpectedString})
+		}
+		if err := u.UnmarshalText([]byte(fmt.Sprint(val))); err != nil {
+			problems = append(problems, ConfigError{Path: path, Message: err.Error()})
+		}
+		return problems
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		m, ok := val.(map[interface{}]interface{})
+		if !ok {
+			return append(problems, ConfigError{Path: path, Message: ConfigExpectedMapping})
+		}
+		problems = append(problems, checkYamlMapping(t, m, path)...)
+	case reflect.Map:
+		m, ok := val.(map[interface{}]interface{})
+		if !ok {
+			return append(problems, ConfigError{Path: path, Message: ConfigExpectedMapping})
+		}
+		for k, v := range m {
+			problems = append(problems, checkYamlValue(t.Elem(), v, path+"."+fmt.Sprint(k))...)
+		}
+		sort.Sort(byPath(problems))
+	case reflect.Slice:
+		list, ok := val.([]interface{})
+		if !ok {
+			return append(problems, ConfigError{Path: path, Message: ConfigExpectedList})
+		}
+		for i, v := range list {
+			problems = append(problems, checkYamlValue(t.Elem(), v, fmt.Sprintf("%s.%d", path, i))...)
+		}
+	case reflect.String:
+		switch val.(type) {
+		case map[interface{}]interface{}, []interface{}:
+			problems = append(problems, ConfigError{Path: path, Message: ConfigExpectedString})
+		}
+	case reflect.Int:
+		switch val.(type) {
+		case int, int64, uint64:
+		default:
+			problems = append(problems, ConfigError{Path: path, Message: ConfigExpectedInteger})
+		}
+	case reflect.Float64:
+		switch val.(type) {
+		case int, int64, uint64, float64:
+		default:
+			problems = append(problems, ConfigError{Path: path, Message: ConfigExpectedNumber})
+		}
+	case reflect.Bool:
+		if _, ok := val.(bool); !ok {
+			problems = append(problems, ConfigError{Path: path, Message: ConfigExpectedBool})
+		}
+	}
+
+	return problems
+}
+
+// Find unknown keys and mistyped values in a YAML mapping destined for struct type t
+func checkYamlMapping(t reflect.Type, m map[interface{}]interface{}, prefix string) ConfigErrors {
+	problems := ConfigErrors{}
+
+	known := map[string]reflect.StructField{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		known[yamlFieldName(field)] = field
+	}
+
+	// Map iteration order is random, sort for stable output
+	keys := make([]string, 0, len(m))
+	values := map[string]interface{}{}
+	for k, v := range m {
+		key := fmt.Sprint(k)
+		keys = append(keys, key)
+		values[key] = v
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		path := key
+		if prefix != "" {
+			path = prefix + "." + key
+		}
+
+		field, ok := known[key]
+		if !ok || key == "-" {
+			problems = append(problems, ConfigError{Path: path, Message: ConfigUnknownKey})
+			continue
+		}
+		problems = append(problems, checkYamlValue(field.Type, values[key], path)...)
+	}
+
+	return problems
+}
+
+/*
+Decode a config, collecting unknown keys and mistyped values
+
+Syntax errors are returned as err. Other problems are returned as
+ConfigErrors in file order, alongside a config decoded as far as
+possible
+*/
+func parseConfig(b []byte, source string) (*appConfig, ConfigErrors, error) {
+	generic := map[interface{}]interface{}{}
+	if err := yaml.Unmarshal(b, &generic); err != nil {
+		return nil, nil, err
+	}
+
+	problems := checkYamlMapping(reflect.TypeOf(appConfig{}), generic, "")
+
+	config := &appConfig{}
+	err := yaml.Unmarshal(b, config)
+	if err != nil && len(problems) == 0 {
+		return nil, nil, err
+	}
+
+	lines := yamlKeyLines(b)
+	for i := range problems {
+		problems[i].Source = source
+		problems[i].Line = lines[problems[i].Path]
+	}
+	sort.Stable(byLine(problems))
+
+	return config, problems, nil
+}
+
+func checkPort(port int, path string) ConfigErrors {
+	if port < 0 || port > MaxPort {
+		return ConfigErrors{{Path: path, Message: ConfigInvalidPort}}
+	}
+	return ConfigErrors{}
+}
+
+func checkNotNegative(n int64, path string) ConfigErrors {
+	if n < 0 {
+		return ConfigErrors{{Path: path, Message: ConfigNegative}}
+	}
+	return ConfigErrors{}
+}
+
+func checkNoSpace(s string, path string) ConfigErrors {
+	if strings.IndexFunc(s, func(r rune) bool { return r == ' ' || r == '\t' || r == '\n' }) >= 0 {
+		return ConfigErrors{{Path: path, Message: ConfigContainsSpace}}
+	}
+	return ConfigErrors{}
+}
+
+/*
+Check the semantics of every setting
+
+Unset values are valid, since they fall back to defaults. All problems
+are returned, not just the first
+*/
+func (ac *appConfig) Validate() ConfigErrors {
+	problems := ConfigErrors{}
+
+	db := ac.DbConf
+	if db.Type != "" && !containsString(SupportedDbTypes, db.Type) {
+		problems = append(problems, ConfigError{
+			Path:    "db.type",
+			Message: fmt.Sprintf(ConfigInvalidDbType, db.Type, strings.Join(SupportedDbTypes, ", ")),
+		})
+	}
+	problems = append(problems, checkNoSpace(db.Host, "db.host")...)
+	problems = append(problems, checkPort(db.Port, "db.port")...)
+	if db.PasswordFile != "" {
+		if f, err := os.Open(db.PasswordFile); err != nil {
+			problems = append(problems, ConfigError{
+				Path:    "db.password_file",
+				Message: fmt.Sprintf(ConfigUnreadableFile, err),
+			})
+		} else {
+			f.Close()
+		}
+	}
+	if db.SslMode != "" && !containsString(SslModes, db.SslMode) {
+		problems = append(problems, ConfigError{
+			Path:    "db.sslmode",
+			Message: fmt.Sprintf(ConfigInvalidSslMode, db.SslMode, strings.Join(SslModes, ", ")),
+		})
+	}
+	if db.Type == SqliteDbType {
+		dir := filepath.Dir(defaultString(db.Path, DefaultSqlitePath))
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			problems = append(problems, ConfigError{
+				Path:    "db.path",
+				Message: fmt.Sprintf(ConfigDataDirMissing, dir),
+			})
+		}
+	}
+	problems = append(problems, checkNotNegative(int64(db.MaxOpenConns), "db.max_open_conns")...)
+	problems = append(problems, checkNotNegative(int64(db.MaxIdleConns), "db.max_idle_conns")...)
+	if db.MaxOpenConns > 0 && db.MaxIdleConns > db.MaxOpenConns {
+		problems = append(problems, ConfigError{Path: "db.max_idle_conns", Message: ConfigIdleExceedsOpen})
+	}
+	problems = append(problems, checkNotNegative(int64(db.ConnMaxLifetime), "db.conn_max_lifetime")...)
+	problems = append(problems, checkNotNegative(int64(db.StatementTimeout), "db.statement_timeout")...)
+	problems = append(problems, checkNotNegative(int64(db.ConnectTimeout), "db.connect_timeout")...)
+	if len(db.Replicas) > 0 && ac.DbType() != DefaultDbType {
+		problems = append(problems, ConfigError{Path: "db.replicas", Message: ConfigReplicasNotPg})
+	}
+	problems = append(problems, checkNotNegative(int64(db.ReplicaStickiness), "db.replica_stickiness")...)
+
+	timeouts := ac.TimeoutConf
+	problems = append(problems, checkNotNegative(int64(timeouts.Default), "timeouts.default")...)
+	if len(timeouts.Routes) > 0 {
+		known := routeKeys()
+		routes := make([]string, 0, len(timeouts.Routes))
+		for route := range timeouts.Routes {
+			routes = append(routes, route)
+		}
+		sort.Strings(routes)
+
+		for _, route := range routes {
+			path := "timeouts.routes." + route
+			if !containsString(known, route) {
+				problems = append(problems, ConfigError{
+					Path:    path,
+					Message: fmt.Sprintf(ConfigUnknownRoute, route, strings.Join(known, ", ")),
+				})
+			}
+			problems = append(problems, checkNotNegative(int64(timeouts.Routes[route]), path)...)
+		}
+	}
+
+	cache := ac.AuthCacheConf
+	problems = append(problems, checkNotNegative(int64(cache.Size), "auth_cache.size")...)
+	problems = append(problems, checkNotNegative(int64(cache.Ttl), "auth_cache.ttl")...)
+
+	health := ac.HealthConf
+	problems = append(problems, checkNotNegative(int64(health.Timeout), "health.timeout")...)
+	checks := make([]string, 0, len(health.Checks))
+	for check := range health.Checks {
+		checks = append(checks, check)
+	}
+	sort.Strings(checks)
+	for _, check := range checks {
+		path := "health.checks." + check
+		if !containsString(HealthChecks, check) {
+			problems = append(problems, ConfigError{
+				Path:    path,
+				Message: fmt.Sprintf(ConfigUnknownCheck, check, strings.Join(HealthChecks, ", ")),
+			})
+		}
+		problems = append(problems, checkNotNegative(int64(health.Checks[check]), path)...)
+	}
+	problems = append(problems, checkNotNegative(int64(health.DrainDelay), "health.drain_delay")...)
+
+	trace := ac.TraceConf
+	if trace.Exporter != "" && !containsString(TraceExporters, trace.Exporter) {
+		problems = append(problems, ConfigError{
+			Path:    "trace.exporter",
+			Message: fmt.Sprintf(ConfigInvalidExporter, trace.Exporter, strings.Join(TraceExporters, ", ")),
+		})
+	}
+	if trace.Exporter == TraceExporterFile {
+		dir := filepath.Dir(ac.TraceOptions().Path)
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			problems = append(problems, ConfigError{
+				Path:    "trace.path",
+				Message: fmt.Sprintf(ConfigTraceDirMissing, dir),
+			})
+		}
+	}
+	if trace.SampleRatio < 0 || trace.SampleRatio > 1 {
+		problems = append(problems, ConfigError{Path: "trace.sample_ratio", Message: ConfigInvalidRatio})
+	}
+
+	for _, group := range CorsGroups {
+		problems = append(problems, checkCors(ac.corsGroup(group), "cors."+group)...)
+	}
+
+	logConf := ac.LogConf
+	if logConf.Level != "" {
+		if _, err := ParseLogLevel(logConf.Level); err != nil {
+			problems = append(problems, ConfigError{
+				Path:    "log.level",
+				Message: fmt.Sprintf(ConfigInvalidLogLevel, logConf.Level, strings.Join(LogLevels, ", ")),
+			})
+		}
+	}
+	for i, output := range logConf.Outputs {
+		if output == LogOutputStdout || output == LogOutputStderr {
+			continue
+		}
+		dir := filepath.Dir(output)
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			problems = append(problems, ConfigError{
+				Path:    fmt.Sprintf("log.outputs.%d", i),
+				Message: fmt.Sprintf(ConfigLogDirMissing, dir),
+			})
+		}
+	}
+	problems = append(problems, checkNotNegative(int64(logConf.MaxSizeMb), "log.max_size_mb")...)
+	problems = append(problems, checkNotNegative(int64(logConf.MaxBackups), "log.max_backups")...)
+
+	problems = append(problems, checkListen(ac.ListenConf, "listen")...)
+	if ac.adminEnabled() {
+		problems = append(problems, checkListen(ac.AdminConf, "admin")...)
+		_, adminAddr := listenAddr(ac.AdminConf, DefaultAdminPort)
+		_, mainAddr := listenAddr(ac.ListenConf, DefaultPort)
+		if adminAddr == mainAddr {
+			problems = append(problems, ConfigError{Path: "admin", Message: ConfigAdminSameAsListen})
+		}
+	}
+
+	return problems
+}
+
+// Check the CORS settings of a group of routes, found under prefix
+func checkCors(cors corsGroupConfig, prefix string) ConfigErrors {
+	problems := ConfigErrors{}
+
+	for i, origin := range cors.Origins {
+		if !validCorsOrigin(origin) {
+			problems = append(problems, ConfigError{
+				Path:    fmt.Sprintf("%s.origins.%d", prefix, i),
+				Message: fmt.Sprintf(ConfigInvalidOrigin, origin),
+			})
+		}
+	}
+	for i, method := range cors.Methods {
+		if !containsString(HttpMethods, method) {
+			problems = append(problems, ConfigError{
+				Path:    fmt.Sprintf("%s.methods.%d", prefix, i),
+				Message: fmt.Sprintf(ConfigInvalidMethod, method, strings.Join(HttpMethods, ", ")),
+			})
+		}
+	}
+	for i, header := range cors.Headers {
+		problems = append(problems, checkNoSpace(header, fmt.Sprintf("%s.headers.%d", prefix, i))...)
+	}
+	if cors.Credentials && containsString(cors.Origins, CorsAnyOrigin) {
+		problems = append(problems, ConfigError{Path: prefix + ".credentials", Message: ConfigCorsAnyCredential})
+	}
+	problems = append(problems, checkNotNegative(int64(cors.MaxAge), prefix+".max_age")...)
+
+	return problems
+}
+
+// Check a listener's settings, found under prefix
+func checkListen(listen listenConfig, prefix string) ConfigErrors {
+	problems := ConfigErrors{}
+
+	if strings.HasPrefix(listen.Address, "/") {
+		dir := filepath.Dir(listen.Address)
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			problems = append(problems, ConfigError{
+				Path:    prefix + ".address",
+				Message: fmt.Sprintf(ConfigSocketDirMissing, dir),
+			})
+		}
+		return problems
+	}
+
+	problems = append(problems, checkPort(listen.Port, prefix+".port")...)
+
+	address := defaultString(listen.Address, DefaultAddress)
+	if ip := net.ParseIP(address); ip != nil {
+		isIpv4 := ip.To4() != nil
+		if listen.Ipv6 && isIpv4 {
+			problems = append(problems, ConfigError{
+				Path:    prefix + ".ipv6",
+				Message: fmt.Sprintf(ConfigIpv6Mismatch, address),
+			})
+		} else if !listen.Ipv6 && !isIpv4 {
+			problems = append(problems, ConfigError{
+				Path:    prefix + ".address",
+				Message: fmt.Sprintf(ConfigIpv4Mismatch, address),
+			})
+		}
+	}
+
+	return problems
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestConfigErrorString(t *testing.T) {
+	tests := []struct {
+		in  ConfigError
+		out string
+	}{
+		{ConfigError{"", 0, "db.port", "bad"}, "db.port: bad"},
+		{ConfigError{"", 3, "db.port", "bad"}, "line 3: db.port: bad"},
+		{ConfigError{"config.yml", 3, "db.port", "bad"}, "config.yml:3: db.port: bad"},
+		{ConfigError{"PEOPLE_DB_PORT", 0, "db.port", "bad"}, "PEOPLE_DB_PORT: db.port: bad"},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.out, test.in.Error())
+	}
+
+	errs := ConfigErrors{tests[0].in, tests[1].in}
+	assert.Equal(t, "db.port: bad\nline 3: db.port: bad", errs.Error())
+}
+
+func TestYamlKeyLines(t *testing.T) {
+	in := `---
+# comment
+db:
+  user: test1
+  "password": test2
+
+  # another: comment
+listen:
+    address: ::1
+    port: 3001
+other: {nested: value}
+`
+	expected := map[string]int{
+		"db":             3,
+		"db.user":        4,
+		"db.password":    5,
+		"listen":         8,
+		"listen.address": 9,
+		"listen.port":    10,
+		"other":          11,
+	}
+
+	assert.Equal(t, expected, yamlKeyLines([]byte(in)))
+}
+
+func TestReadConfigUnknownKeys(t *testing.T) {
+	in := `
+db:
+  user: test1
+  sslmod: disable
+listen:
+  port: abc
+  ipv6: yes please
+lsiten:
+  port: 3000
+`
+	expected := ConfigErrors{
+		{"", 4, "db.sslmod", ConfigUnknownKey},
+		{"", 6, "listen.port", ConfigExpectedInteger},
+		{"", 7, "listen.ipv6", ConfigExpectedBool},
+		{"", 8, "lsiten", ConfigUnknownKey},
+	}
+
+	actualOut, err := ReadConfig([]byte(in))
+	assert.Nil(t, actualOut)
+	assert.Equal(t, expected, err)
+}
+
+func TestReadConfigInvalidDuration(t *testing.T) {
+	actualOut, err := ReadConfig([]byte("db:\n  connect_timeout: 30\n  conn_max_lifetime: [1]\n"))
+	assert.Nil(t, actualOut)
+	assert.Equal(t, ConfigErrors{
+		{"", 2, "db.connect_timeout", `time: missing unit in duration "30"`},
+		{"", 3, "db.conn_max_lifetime", ConfigExpectedString},
+	}, err)
+}
+
+func TestReadConfigExpectedMapping(t *testing.T) {
+	actualOut, err := ReadConfig([]byte(`{db: postgres, listen: {port: [1]}}`))
+	assert.Nil(t, actualOut)
+	assert.Equal(t, ConfigErrors{
+		{"", 0, "db", ConfigExpectedMapping},
+		{"", 0, "listen.port", ConfigExpectedInteger},
+	}, err)
+}
+
+func TestReadConfigExpectedNumber(t *testing.T) {
+	actualOut, err := ReadConfig([]byte("trace:\n  sample_ratio: half\n"))
+	assert.Nil(t, actualOut)
+	assert.Equal(t, ConfigErrors{{"", 2, "trace.sample_ratio", ConfigExpectedNumber}}, err)
+
+	actualOut, err = ReadConfig([]byte("trace:\n  sample_ratio: 0.5\n"))
+	assert.Nil(t, err)
+	if assert.NotNil(t, actualOut) {
+		assert.Equal(t, 0.5, actualOut.TraceConf.SampleRatio)
+	}
+}
+
+func TestReadConfigExpectedList(t *testing.T) {
+	actualOut, err := ReadConfig([]byte("db:\n  replicas: host=replica\n---\n"))
+	assert.Nil(t, actualOut)
+	assert.Equal(t, ConfigErrors{{"", 2, "db.replicas", ConfigExpectedList}}, err)
+
+	actualOut, err = ReadConfig([]byte("db:\n  replicas:\n    - host=replica\n    - {host: replica}\n"))
+	assert.Nil(t, actualOut)
+	assert.Equal(t, ConfigErrors{{"", 0, "db.replicas.1", ConfigExpectedString}}, err)
+}
+
+func TestReadConfigFileUnknownKeySource(t *testing.T) {
+	configFile := writeTempFile(t, "db:\n  sslmod: disable\n")
+	defer os.Remove(configFile)
+
+	actualOut, err := ReadConfigFile(configFile)
+	assert.Nil(t, actualOut)
+	assert.Equal(t, ConfigErrors{{configFile, 2, "db.sslmod", ConfigUnknownKey}}, err)
+}
+
+func TestAppConfigValidateValid(t *testing.T) {
+	validConfigs := []appConfig{
+		{},
+		*MustReadConfigFile(testConfigFile),
+		{
+			DbConf: dbConfig{
+				Type:     "postgres",
+				Port:     MaxPort,
+				SslMode:  "verify-full",
+				Replicas: []string{"host=replica"},
+			},
+			ListenConf: listenConfig{
+				Address: "::1",
+				Port:    1,
+				Ipv6:    true,
+			},
+			LogConf: logConfig{
+				Level:   "WARN",
+				Outputs: []string{"stderr", os.TempDir() + "/people.log"},
+			},
+		},
+		{
+			ListenConf: listenConfig{
+				Address: "localhost",
+				Ipv6:    true,
+			},
+		},
+		{
+			ListenConf: listenConfig{
+				Address: os.TempDir() + "/people-test.sock",
+				Port:    -1,
+				Ipv6:    true,
+			},
+		},
+	}
+
+	for i, config := range validConfigs {
+		assert.Equal(t, ConfigErrors{}, config.Validate(), strconv.Itoa(i))
+	}
+}
+
+func TestAppConfigValidateInvalid(t *testing.T) {
+	invalidConfigs := []struct {
+		in    appConfig
+		paths []string
+	}{
+		{
+			in:    appConfig{DbConf: dbConfig{Type: "mysql"}},
+			paths: []string{"db.type"},
+		},
+		{
+			in:    appConfig{DbConf: dbConfig{Port: 99999}},
+			paths: []string{"db.port"},
+		},
+		{
+			in:    appConfig{DbConf: dbConfig{SslMode: "sometimes"}},
+			paths: []string{"db.sslmode"},
+		},
+		{
+			// The others are quoted in DbCreds
+			in: appConfig{DbConf: dbConfig{
+				Host:     "db host",
+				User:     "a user",
+				Password: "a password",
+				DbName:   "a\tdb",
+			}},
+			paths: []string{"db.host"},
+		},
+		{
+			in:    appConfig{DbConf: dbConfig{PasswordFile: testNonexistentConfigFile}},
+			paths: []string{"db.password_file"},
+		},
+		{
+			in: appConfig{DbConf: dbConfig{
+				MaxOpenConns:     -1,
+				MaxIdleConns:     -1,
+				ConnMaxLifetime:  -1,
+				StatementTimeout: -1,
+				ConnectTimeout:   -1,
+
+				ReplicaStickiness: -1,
+			}},
+			paths: []string{
+				"db.max_open_conns",
+				"db.max_idle_conns",
+				"db.conn_max_lifetime",
+				"db.statement_timeout",
+				"db.connect_timeout",
+				"db.replica_stickiness",
+			},
+		},
+		{
+			in:    appConfig{DbConf: dbConfig{Type: MemoryDbType, Replicas: []string{"host=replica"}}},
+			paths: []string{"db.replicas"},
+		},
+		{
+			in:    appConfig{DbConf: dbConfig{MaxOpenConns: 5, MaxIdleConns: 10}},
+			paths: []string{"db.max_idle_conns"},
+		},
+		{
+			in: appConfig{TimeoutConf: timeoutConfig{
+				Default: -1,
+				Routes: map[string]Duration{
+					"GET /api/person": -1,
+					"GET /nowhere":    1,
+				},
+			}},
+			paths: []string{
+				"timeouts.default",
+				"timeouts.routes.GET /api/person",
+				"timeouts.routes.GET /nowhere",
+			},
+		},
+		{
+			in:    appConfig{AuthCacheConf: authCacheConfig{Size: -1, Ttl: -1}},
+			paths: []string{"auth_cache.size", "auth_cache.ttl"},
+		},
+		{
+			in:    appConfig{TraceConf: traceConfig{Exporter: "zipkin", SampleRatio: 1.5}},
+			paths: []string{"trace.exporter", "trace.sample_ratio"},
+		},
+		{
+			in:    appConfig{TraceConf: traceConfig{Exporter: TraceExporterFile, Path: "/nonexistent/dir/traces.json", SampleRatio: -1}},
+			paths: []string{"trace.path", "trace.sample_ratio"},
+		},
+		{
+			in: appConfig{CorsConf: corsConfig{
+				Auth: corsGroupConfig{Origins: []string{"https://app.example.com", "app.example.com", "https://app.*.com"}},
+				Api: corsGroupConfig{
+					Origins:     []string{"*", "https://*.example.com:8443"},
+					Methods:     []string{"GET", "get"},
+					Headers:     []string{"X Custom"},
+					Credentials: true,
+					MaxAge:      -1,
+				},
+			}},
+			paths: []string{
+				"cors.auth.origins.1",
+				"cors.auth.origins.2",
+				"cors.api.methods.1",
+				"cors.api.headers.0",
+				"cors.api.credentials",
+				"cors.api.max_age",
+			},
+		},
+		{
+			in: appConfig{HealthConf: healthConfig{
+				Timeout: -1,
+				Checks: map[string]Duration{
+					HealthCheckDatabase: -1,
+					"disk":              1,
+				},
+				DrainDelay: -1,
+			}},
+			paths: []string{
+				"health.timeout",
+				"health.checks.database",
+				"health.checks.disk",
+				"health.drain_delay",
+			},
+		},
+		{
+			in: appConfig{LogConf: logConfig{
+				Level:      "verbose",
+				Outputs:    []string{"stdout", "/nonexistent/dir/people.log"},
+				MaxSizeMb:  -1,
+				MaxBackups: -1,
+			}},
+			paths: []string{"log.level", "log.outputs.1", "log.max_size_mb", "log.max_backups"},
+		},
+		{
+			in:    appConfig{ListenConf: listenConfig{Port: -1}},
+			paths: []string{"listen.port"},
+		},
+		{
+			in:    appConfig{AdminConf: listenConfig{Port: -1, Ipv6: true}},
+			paths: []string{"admin.port", "admin.ipv6"},
+		},
+		{
+			in:    appConfig{AdminConf: listenConfig{Port: DefaultPort}},
+			paths: []string{"admin"},
+		},
+		{
+			in:    appConfig{ListenConf: listenConfig{Ipv6: true}},
+			paths: []string{"listen.ipv6"},
+		},
+		{
+			in:    appConfig{ListenConf: listenConfig{Address: "::1"}},
+			paths: []string{"listen.address"},
+		},
+		{
+			in:    appConfig{ListenConf: listenConfig{Address: "/nonexistent/dir/people.sock"}},
+			paths: []string{"listen.address"},
+		},
+		{
+			in: appConfig{
+				DbConf: dbConfig{Port: 70000, SslMode: "maybe"},
+				ListenConf: listenConfig{
+					Address: "127.0.0.1",
+					Port:    70000,
+					Ipv6:    true,
+				},
+			},
+			paths: []string{"db.port", "db.sslmode", "listen.port", "listen.ipv6"},
+		},
+	}
+
+	for i, test := range invalidConfigs {
+		problems := test.in.Validate()
+		paths := []string{}
+		for _, problem := range problems {
+			paths = append(paths, problem.Path)
+		}
+		assert.Equal(t, test.paths, paths, strconv.Itoa(i))
+	}
+}
+
+func TestLoadConfigProblemSources(t *testing.T) {
+	configFile := writeTempFile(t, `
+db:
+  port: 99999
+  sslmod: disable
+listen:
+  port: 3001
+`)
+	defer os.Remove(configFile)
+
+	env := map[string]string{
+		"PEOPLE_DB_SSLMODE": "sometimes",
+		"PEOPLE_DB_TYPE":    "mysql",
+	}
+	args := []string{"-config", configFile, "-listen.port", "70000"}
+
+	config, err := LoadConfig(newTestFlagSet(), args, mapLookup(env))
+	assert.Nil(t, config)
+
+	expected := ConfigErrors{
+		{configFile, 4, "db.sslmod", ConfigUnknownKey},
+		{"PEOPLE_DB_TYPE", 0, "db.type", "Unsupported database type \"mysql\", expected one of: postgres, memory, sqlite"},
+		{configFile, 3, "db.port", ConfigInvalidPort},
+		{"PEOPLE_DB_SSLMODE", 0, "db.sslmode", "Invalid sslmode \"sometimes\", expected one of: disable, allow, prefer, require, verify-ca, verify-full"},
+		{"-listen.port", 0, "listen.port", ConfigInvalidPort},
+	}
+	assert.Equal(t, expected, err)
+}
+
+func TestLoadConfigUnknownRouteSource(t *testing.T) {
+	configFile := writeTempFile(t, "timeouts:\n  routes:\n    GET /api/persons: 5s\n")
+	defer os.Remove(configFile)
+
+	env := map[string]string{
+		"PEOPLE_TIMEOUTS_ROUTES": "DELETE /api/person=1s",
+	}
+	args := []string{"-config", configFile}
+
+	_, err := LoadConfig(newTestFlagSet(), args, mapLookup(env))
+	if !assert.NotNil(t, err) {
+		return
+	}
+
+	problems := err.(ConfigErrors)
+	if !assert.Equal(t, 1, len(problems)) {
+		return
+	}
+	assert.Equal(t, "PEOPLE_TIMEOUTS_ROUTES", problems[0].Source)
+	assert.Equal(t, "timeouts.routes.DELETE /api/person", problems[0].Path)
+
+	_, err = LoadConfig(newTestFlagSet(), args, mapLookup(nil))
+	if !assert.NotNil(t, err) {
+		return
+	}
+	problems = err.(ConfigErrors)
+	assert.Equal(t, configFile, problems[0].Source)
+	assert.Equal(t, 3, problems[0].Line)
+}
@@ -0,0 +1,568 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/lib/pq/hstore"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+/*
+Behaviour every DbService backend must share
+
+newService is called for each case and must return an empty service.
+Backends run this from their own test, e.g.
+
+	func TestMemDbServiceConformance(t *testing.T) {
+		DbServiceConformance(t, func(t *testing.T) DbService {
+			return NewMemDbService()
+		})
+	}
+
+Errors are only checked for their kind, since each backend words them
+differently
+*/
+func DbServiceConformance(t *testing.T, newService func(t *testing.T) DbService) {
+	cases := []struct {
+		name string
+		test func(*testing.T, DbService)
+	}{
+		{"GetUserUnknown", conformGetUserUnknown},
+		{"CreateUser", conformCreateUser},
+		{"CreateUserInvalid", conformCreateUserInvalid},
+		{"CreateUserDuplicateEmail", conformCreateUserDuplicateEmail},
+		{"UpdateUser", conformUpdateUser},
+		{"UpdateUserInvalid", conformUpdateUserInvalid},
+		{"CreatePerson", conformCreatePerson},
+		{"CreatePersonInvalid", conformCreatePersonInvalid},
+		{"CreatePersonDuplicateName", conformCreatePersonDuplicateName},
+		{"GetPersonOwnership", conformGetPersonOwnership},
+		{"GetPersonUnknown", conformGetPersonUnknown},
+		{"GetPeople", conformGetPeople},
+		{"UpdatePerson", conformUpdatePerson},
+		{"UpdatePersonInvalid", conformUpdatePersonInvalid},
+		{"UpdatePersonOwnership", conformUpdatePersonOwnership},
+		{"UpdatePersonDuplicateName", conformUpdatePersonDuplicateName},
+		{"DeletePerson", conformDeletePerson},
+		{"DeletePersonOwnership", conformDeletePersonOwnership},
+		{"PersonChanges", conformPersonChanges},
+		{"PersonChangesUnknownUser", conformPersonChangesUnknownUser},
+		{"Canceled", conformCanceled},
+		{"Health", conformHealth},
+		{"WithTxCommit", conformWithTxCommit},
+		{"WithTxRollback", conformWithTxRollback},
+		{"WithTxPanic", conformWithTxPanic},
+		{"WithTxNested", conformWithTxNested},
+	}
+
+	for _, c := range cases {
+		test := c.test
+		t.Run(c.name, func(t *testing.T) {
+			test(t, newService(t))
+		})
+	}
+}
+
+func conformUser(t *testing.T, s DbService, email string) *User {
+	user, err := s.CreateUser(context.Background(), email, "pwhash", "Test User", "apikey", defaultActive, defaultSuperuser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func conformMeta() hstore.Hstore {
+	return hstore.Hstore{map[string]sql.NullString{
+		"type":  {"friend", true},
+		"other": {"", true},
+	}}
+}
+
+func conformGetUserUnknown(t *testing.T, s DbService) {
+	u, err := s.GetUser(context.Background(), "nobody@example.com")
+	assert.Nil(t, u)
+	assert.NotNil(t, err)
+}
+
+func conformCreateUser(t *testing.T, s DbService) {
+	u, err := s.CreateUser(context.Background(), "test@example.com", "pwhash", "Test User", "apikey", false, true)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.True(t, u.Id > 0)
+
+	found, err := s.GetUser(context.Background(), "test@example.com")
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, u.Id, found.Id)
+	assert.Equal(t, "test@example.com", found.Email)
+	assert.Equal(t, "pwhash", found.Pwhash)
+	assert.Equal(t, "Test User", found.Name)
+	assert.Equal(t, "apikey", found.ApiKey)
+	assert.False(t, found.IsActive)
+	assert.True(t, found.IsSuperuser)
+
+	other := conformUser(t, s, "other@example.com")
+	assert.NotEqual(t, u.Id, other.Id)
+}
+
+func conformCreateUserInvalid(t *testing.T, s DbService) {
+	u, err := s.CreateUser(context.Background(), "not an email", "pwhash", "Test User", "apikey", true, false)
+	assert.Nil(t, u)
+	if verr, ok := err.(ValidationError); assert.True(t, ok, "Should be a ValidationError") {
+		assert.Equal(t, JsonErrors{"email": UserInvalidEmail}, verr.JsonErrors())
+	}
+}
+
+func conformCreateUserDuplicateEmail(t *testing.T, s DbService) {
+	conformUser(t, s, "test@example.com")
+
+	u, err := s.CreateUser(context.Background(), "test@example.com", "pwhash", "Again", "apikey", true, false)
+	assert.Nil(t, u)
+	assert.NotNil(t, err)
+}
+
+func conformUpdateUser(t *testing.T, s DbService) {
+	user := conformUser(t, s, "test@example.com")
+
+	user.Email = "changed@example.com"
+	user.Name = "Changed"
+	user.IsActive = false
+	if !assert.Nil(t, s.UpdateUser(context.Background(), user)) {
+		return
+	}
+
+	found, err := s.GetUser(context.Background(), "changed@example.com")
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, user.Id, found.Id)
+	assert.Equal(t, "Changed", found.Name)
+	assert.False(t, found.IsActive)
+
+	_, err = s.GetUser(context.Background(), "test@example.com")
+	assert.NotNil(t, err)
+}
+
+func conformUpdateUserInvalid(t *testing.T, s DbService) {
+	user := conformUser(t, s, "test@example.com")
+
+	user.Name = " "
+	_, ok := s.UpdateUser(context.Background(), user).(ValidationError)
+	assert.True(t, ok, "Should be a ValidationError")
+
+	found, _ := s.GetUser(context.Background(), "test@example.com")
+	assert.Equal(t, "Test User", found.Name)
+}
+
+func conformCreatePerson(t *testing.T, s DbService) {
+	user := conformUser(t, s, "test@example.com")
+	color := sql.NullInt64{3, true}
+
+	p, err := s.CreatePerson(context.Background(), user.Id, "Test Person", conformMeta(), color)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.True(t, p.Id > 0)
+
+	found, err := s.GetPerson(context.Background(), user.Id, p.Id)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, p.Id, found.Id)
+	assert.Equal(t, user.Id, found.UserId)
+	assert.Equal(t, "Test Person", found.Name)
+	assert.Equal(t, conformMeta().Map, found.Meta.Map)
+	assert.Equal(t, color, found.Color)
+
+	noColor, err := s.CreatePerson(context.Background(), user.Id, "No Color", hstore.Hstore{map[string]sql.NullString{}}, sql.NullInt64{})
+	if !assert.Nil(t, err) {
+		return
+	}
+	found, _ = s.GetPerson(context.Background(), user.Id, noColor.Id)
+	assert.False(t, found.Color.Valid)
+}
+
+func conformCreatePersonInvalid(t *testing.T, s DbService) {
+	user := conformUser(t, s, "test@example.com")
+
+	p, err := s.CreatePerson(context.Background(), user.Id, "  ", conformMeta(), sql.NullInt64{})
+	assert.Nil(t, p)
+	if verr, ok := err.(ValidationError); assert.True(t, ok, "Should be a ValidationError") {
+		assert.Equal(t, JsonErrors{"name": PersonNameEmpty}, verr.JsonErrors())
+	}
+}
+
+// uq_person_name_user_id: names are unique per user, not globally
+func conformCreatePersonDuplicateName(t *testing.T, s DbService) {
+	user := conformUser(t, s, "test@example.com")
+	other := conformUser(t, s, "other@example.com")
+
+	_, err := s.CreatePerson(context.Background(), user.Id, "Test Person", conformMeta(), sql.NullInt64{})
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	p, err := s.CreatePerson(context.Background(), user.Id, "Test Person", conformMeta(), sql.NullInt64{})
+	assert.Nil(t, p)
+	assert.True(t, isConflict(err), "Should be a conflict: %v", err)
+
+	_, err = s.CreatePerson(context.Background(), other.Id, "Test Person", conformMeta(), sql.NullInt64{})
+	assert.Nil(t, err)
+}
+
+func conformGetPersonOwnership(t *testing.T, s DbService) {
+	user := conformUser(t, s, "test@example.com")
+	other := conformUser(t, s, "other@example.com")
+
+	p, err := s.CreatePerson(context.Background(), user.Id, "Test Person", conformMeta(), sql.NullInt64{})
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	found, err := s.GetPerson(context.Background(), other.Id, p.Id)
+	assert.Nil(t, found)
+	assert.NotNil(t, err)
+}
+
+func conformGetPersonUnknown(t *testing.T, s DbService) {
+	user := conformUser(t, s, "test@example.com")
+
+	found, err := s.GetPerson(context.Background(), user.Id, 999999)
+	assert.Nil(t, found)
+	assert.NotNil(t, err)
+}
+
+func conformGetPeople(t *testing.T, s DbService) {
+	user := conformUser(t, s, "test@example.com")
+	other := conformUser(t, s, "other@example.com")
+
+	pp, err := s.GetPeople(context.Background(), user.Id)
+	assert.Nil(t, err)
+	assert.NotNil(t, pp)
+	assert.Equal(t, 0, len(pp))
+
+	people := []*Person{}
+	for _, name := range []string{"One", "Two"} {
+		person, err := s.CreatePerson(context.Background(), user.Id, name, conformMeta(), sql.NullInt64{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		people = append(people, person)
+	}
+	s.CreatePerson(context.Background(), other.Id, "Three", conformMeta(), sql.NullInt64{})
+	// Rewriting a row can move it in the table, but not in the list
+	people[0].Color = sql.NullInt64{3, true}
+	if err := s.UpdatePerson(context.Background(), people[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	pp, err = s.GetPeople(context.Background(), user.Id)
+	assert.Nil(t, err)
+	names := []string{}
+	for _, p := range pp {
+		assert.Equal(t, user.Id, p.UserId)
+		names = append(names, p.Name)
+	}
+	assert.Equal(t, []string{"One", "Two"}, names, "In id order")
+}
+
+func conformUpdatePerson(t *testing.T, s DbService) {
+	user := conformUser(t, s, "test@example.com")
+
+	p, err := s.CreatePerson(context.Background(), user.Id, "Test Person", conformMeta(), sql.NullInt64{3, true})
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	p.Name = "Changed"
+	p.Meta = hstore.Hstore{map[string]sql.NullString{"type": {"family", true}}}
+	p.Color = sql.NullInt64{}
+	if !assert.Nil(t, s.UpdatePerson(context.Background(), p)) {
+		return
+	}
+
+	found, err := s.GetPerson(context.Background(), user.Id, p.Id)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, "Changed", found.Name)
+	assert.Equal(t, p.Meta.Map, found.Meta.Map)
+	assert.False(t, found.Color.Valid)
+}
+
+func conformUpdatePersonInvalid(t *testing.T, s DbService) {
+	user := conformUser(t, s, "test@example.com")
+
+	p, err := s.CreatePerson(context.Background(), user.Id, "Test Person", conformMeta(), sql.NullInt64{})
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	p.Name = " "
+	_, ok := s.UpdatePerson(context.Background(), p).(ValidationError)
+	assert.True(t, ok, "Should be a ValidationError")
+
+	found, _ := s.GetPerson(context.Background(), user.Id, p.Id)
+	assert.Equal(t, "Test Person", found.Name)
+}
+
+// Another user's person, or one that does not exist, is not updated
+func conformUpdatePersonOwnership(t *testing.T, s DbService) {
+	user := conformUser(t, s, "test@example.com")
+	other := conformUser(t, s, "other@example.com")
+
+	p, err := s.CreatePerson(context.Background(), user.Id, "Test Person", conformMeta(), sql.NullInt64{})
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	stolen := *p
+	stolen.UserId = other.Id
+	stolen.Name = "Stolen"
+	assert.Equal(t, sql.ErrNoRows, s.UpdatePerson(context.Background(), &stolen))
+
+	unknown := *p
+	unknown.Id = 999999
+	assert.Equal(t, sql.ErrNoRows, s.UpdatePerson(context.Background(), &unknown))
+
+	found, _ := s.GetPerson(context.Background(), user.Id, p.Id)
+	assert.Equal(t, "Test Person", found.Name)
+}
+
+func conformUpdatePersonDuplicateName(t *testing.T, s DbService) {
+	user := conformUser(t, s, "test@example.com")
+
+	if _, err := s.CreatePerson(context.Background(), user.Id, "One", conformMeta(), sql.NullInt64{}); err != nil {
+		t.Fatal(err)
+	}
+	p, err := s.CreatePerson(context.Background(), user.Id, "Two", conformMeta(), sql.NullInt64{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.Name = "One"
+	err = s.UpdatePerson(context.Background(), p)
+	assert.True(t, isConflict(err), "Should be a conflict: %v", err)
+
+	// Keeping its own name is fine
+	p.Name = "Two"
+	assert.Nil(t, s.UpdatePerson(context.Background(), p))
+}
+
+func conformDeletePerson(t *testing.T, s DbService) {
+	user := conformUser(t, s, "test@example.com")
+
+	p, err := s.CreatePerson(context.Background(), user.Id, "Test Person", conformMeta(), sql.NullInt64{})
+	if !assert.Nil(t, err) {
+		return
+	}
+	if !assert.Nil(t, s.DeletePerson(context.Background(), user.Id, p.Id)) {
+		return
+	}
+
+	_, err = s.GetPerson(context.Background(), user.Id, p.Id)
+	assert.NotNil(t, err)
+	assert.Equal(t, sql.ErrNoRows, s.DeletePerson(context.Background(), user.Id, p.Id))
+
+	// The name is free again
+	_, err = s.CreatePerson(context.Background(), user.Id, "Test Person", conformMeta(), sql.NullInt64{})
+	assert.Nil(t, err)
+}
+
+// Another user's person, or one that does not exist, is not deleted
+func conformDeletePersonOwnership(t *testing.T, s DbService) {
+	user := conformUser(t, s, "test@example.com")
+	other := conformUser(t, s, "other@example.com")
+
+	p, err := s.CreatePerson(context.Background(), user.Id, "Test Person", conformMeta(), sql.NullInt64{})
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	assert.Equal(t, sql.ErrNoRows, s.DeletePerson(context.Background(), other.Id, p.Id))
+	assert.Equal(t, sql.ErrNoRows, s.DeletePerson(context.Background(), user.Id, 999999))
+
+	_, err = s.GetPerson(context.Background(), user.Id, p.Id)
+	assert.Nil(t, err)
+}
+
+func conformPersonChanges(t *testing.T, s DbService) {
+	ctx := context.Background()
+	user := conformUser(t, s, "test@example.com")
+	other := conformUser(t, s, "other@example.com")
+
+	changes, err := s.GetPersonChanges(ctx, user.Id, syncFromStart)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Empty(t, changes.People)
+	assert.Empty(t, changes.Deleted)
+	start := changes.Version
+
+	one, err := s.CreatePerson(ctx, user.Id, "One", conformMeta(), sql.NullInt64{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	two, err := s.CreatePerson(ctx, user.Id, "Two", conformMeta(), sql.NullInt64{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.CreatePerson(ctx, other.Id, "Other", conformMeta(), sql.NullInt64{}); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, start+1, one.Version)
+	assert.Equal(t, one.Version, one.CreatedVersion)
+	assert.Equal(t, start+2, two.Version)
+
+	changes, err = s.GetPersonChanges(ctx, user.Id, start)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, start+2, changes.Version)
+	if assert.Len(t, changes.People, 2) {
+		assert.Equal(t, "One", changes.People[0].Name)
+		assert.Equal(t, "Two", changes.People[1].Name)
+	}
+	token := changes.Version
+
+	one.Name = "Changed"
+	if !assert.Nil(t, s.UpdatePerson(ctx, one)) {
+		return
+	}
+	if !assert.Nil(t, s.DeletePerson(ctx, user.Id, two.Id)) {
+		return
+	}
+
+	changes, err = s.GetPersonChanges(ctx, user.Id, token)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, token+2, changes.Version)
+	if assert.Len(t, changes.People, 1) {
+		assert.Equal(t, "Changed", changes.People[0].Name)
+		assert.Equal(t, token+1, changes.People[0].Version)
+		assert.Equal(t, start+1, changes.People[0].CreatedVersion)
+	}
+	assert.Equal(t, []int{two.Id}, changes.Deleted)
+
+	// Nothing changed since the latest version
+	changes, err = s.GetPersonChanges(ctx, user.Id, changes.Version)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Empty(t, changes.People)
+	assert.Empty(t, changes.Deleted)
+}
+
+func conformPersonChangesUnknownUser(t *testing.T, s DbService) {
+	changes, err := s.GetPersonChanges(context.Background(), 999999, syncFromStart)
+	assert.Nil(t, changes)
+	assert.Equal(t, sql.ErrNoRows, err)
+}
+
+func conformCanceled(t *testing.T, s DbService) {
+	user := conformUser(t, s, "test@example.com")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := s.GetUser(ctx, user.Email)
+	assert.NotNil(t, err)
+
+	_, err = s.GetPeople(ctx, user.Id)
+	assert.NotNil(t, err)
+
+	_, err = s.CreatePerson(ctx, user.Id, "Test Person", conformMeta(), sql.NullInt64{})
+	assert.NotNil(t, err)
+
+	// Nothing was written
+	pp, _ := s.GetPeople(context.Background(), user.Id)
+	assert.Equal(t, 0, len(pp))
+}
+
+func conformHealth(t *testing.T, s DbService) {
+	assert.Nil(t, s.Ping(context.Background()))
+	assert.Nil(t, s.CheckSchema(context.Background()))
+}
+
+func conformWithTxCommit(t *testing.T, s DbService) {
+	var user *User
+	err := s.WithTx(context.Background(), func(tx DbService) error {
+		user = conformUser(t, tx, "test@example.com")
+		_, err := tx.CreatePerson(context.Background(), user.Id, "Test Person", conformMeta(), sql.NullInt64{})
+		return err
+	})
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	pp, err := s.GetPeople(context.Background(), user.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(pp))
+}
+
+func conformWithTxRollback(t *testing.T, s DbService) {
+	failed := errors.New("failed")
+
+	err := s.WithTx(context.Background(), func(tx DbService) error {
+		conformUser(t, tx, "test@example.com")
+		return failed
+	})
+	assert.Equal(t, failed, err)
+
+	u, _ := s.GetUser(context.Background(), "test@example.com")
+	assert.Nil(t, u)
+
+	// A failed write inside the unit rolls back the earlier ones too
+	user := conformUser(t, s, "other@example.com")
+	err = s.WithTx(context.Background(), func(tx DbService) error {
+		if _, err := tx.CreatePerson(context.Background(), user.Id, "Test Person", conformMeta(), sql.NullInt64{}); err != nil {
+			return err
+		}
+		_, err := tx.CreatePerson(context.Background(), user.Id, "", conformMeta(), sql.NullInt64{})
+		return err
+	})
+	assert.NotNil(t, err)
+
+	pp, _ := s.GetPeople(context.Background(), user.Id)
+	assert.Equal(t, 0, len(pp))
+}
+
+func conformWithTxPanic(t *testing.T, s DbService) {
+	assert.Panics(t, func() {
+		s.WithTx(context.Background(), func(tx DbService) error {
+			conformUser(t, tx, "test@example.com")
+			panic("failed")
+		})
+	})
+
+	u, _ := s.GetUser(context.Background(), "test@example.com")
+	assert.Nil(t, u)
+
+	// The service is still usable afterwards
+	conformUser(t, s, "test@example.com")
+}
+
+func conformWithTxNested(t *testing.T, s DbService) {
+	failed := errors.New("failed")
+
+	err := s.WithTx(context.Background(), func(tx DbService) error {
+		err := tx.WithTx(context.Background(), func(inner DbService) error {
+			conformUser(t, inner, "test@example.com")
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return failed
+	})
+	assert.Equal(t, failed, err)
+
+	// The inner unit is part of the outer one, so it is rolled back too
+	u, _ := s.GetUser(context.Background(), "test@example.com")
+	assert.Nil(t, u)
+}
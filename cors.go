@@ -0,0 +1,199 @@
+package main
+
+import (
+	"github.com/gocraft/web"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	OriginHeader           = "Origin"
+	AllowOriginHeader      = "Access-Control-Allow-Origin"
+	AllowMethodsHeader     = "Access-Control-Allow-Methods"
+	AllowHeadersHeader     = "Access-Control-Allow-Headers"
+	AllowCredentialsHeader = "Access-Control-Allow-Credentials"
+	ExposeHeadersHeader    = "Access-Control-Expose-Headers"
+	MaxAgeHeader           = "Access-Control-Max-Age"
+	RequestMethodHeader    = "Access-Control-Request-Method"
+	RequestHeadersHeader   = "Access-Control-Request-Headers"
+
+	CorsAnyOrigin         = "*"
+	corsWildcardSubdomain = "*."
+	corsPreflightMethod   = "OPTIONS"
+	corsAllowCredentials  = "true"
+
+	// Groups of routes sharing CORS settings, see corsConfig
+	CorsGroupAuth       = "auth"
+	CorsGroupCreateUser = "create_user"
+	CorsGroupApi        = "api"
+)
+
+var (
+	CorsGroups = []string{CorsGroupAuth, CorsGroupCreateUser, CorsGroupApi}
+
+	// Response headers cross-origin scripts may read
+	corsExposedHeaders = []string{RequestIdHeader, ETagHeader}
+)
+
+// CORS settings of a group of routes, disabled without Origins
+type CorsOptions struct {
+	Origins []string
+	// Every method of the route when empty
+	Methods     []string
+	Headers     []string
+	Credentials bool
+	MaxAge      time.Duration
+}
+
+/*
+Whether origin is allowed by one of patterns
+
+A pattern is an origin, "*" for any, or an origin whose host starts
+with "*." for any subdomain of the rest, such as "https://*.example.com"
+*/
+func corsOriginAllowed(patterns []string, origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if pattern == CorsAnyOrigin || pattern == origin {
+			return true
+		}
+
+		idx := strings.Index(pattern, "://"+corsWildcardSubdomain)
+		if idx < 0 {
+			continue
+		}
+		prefix := pattern[:idx+len("://")]
+		suffix := pattern[idx+len("://"+corsWildcardSubdomain)-1:]
+		if strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) {
+			subdomain := origin[len(prefix) : len(origin)-len(suffix)]
+			if subdomain != "" && !strings.ContainsAny(subdomain, "/:@") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Whether pattern is an origin corsOriginAllowed understands
+func validCorsOrigin(pattern string) bool {
+	if pattern == CorsAnyOrigin {
+		return true
+	}
+	u, err := url.Parse(strings.Replace(pattern, "://"+corsWildcardSubdomain, "://wildcard.", 1))
+	if err != nil || u.Scheme == "" || u.Host == "" || u.User != nil {
+		return false
+	}
+	return u.Path == "" && u.RawQuery == "" && u.Fragment == "" && !strings.Contains(u.Host, "*")
+}
+
+// The CORS group of the routes of r, from the nearest router that has one
+func (r *PrefixRouter) CorsGroup() string {
+	for ; r != nil; r = r.parent {
+		if r.corsGroup != "" {
+			return r.corsGroup
+		}
+	}
+	return ""
+}
+
+/*
+Middleware answering cross-origin requests from browsers
+
+The settings are those of the group of the route requested, read from
+the current config on every request. Preflights, OPTIONS requests
+naming the method to come, are answered here, as no route serves
+OPTIONS. A preflight for an origin, method or header that is not
+allowed gets no CORS headers, so the browser refuses the request.
+Other requests from an allowed origin get their CORS headers before
+going on, so scripts can read error responses too
+*/
+func (s *Server) CorsMiddleware(rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
+	origin := req.Header.Get(OriginHeader)
+	method := req.Method
+	preflight := req.Method == corsPreflightMethod && req.Header.Get(RequestMethodHeader) != ""
+	if preflight {
+		method = req.Header.Get(RequestMethodHeader)
+	}
+
+	route, ok := matchedRoute(req.Request)
+	if preflight {
+		route, ok = s.findRoute(routeMatchOf(req.Request).root, method, req.URL.Path)
+	}
+	if origin == "" || !ok {
+		next(rw, req)
+		return
+	}
+	opts := s.Config().CorsOptions(route.router.CorsGroup())
+	if len(opts.Origins) == 0 {
+		next(rw, req)
+		return
+	}
+
+	header := rw.Header()
+	header.Add("Vary", OriginHeader)
+	if !preflight {
+		if corsOriginAllowed(opts.Origins, origin) {
+			setCorsOrigin(header, opts, origin)
+			header.Set(ExposeHeadersHeader, strings.Join(corsExposedHeaders, ", "))
+		}
+		next(rw, req)
+		return
+	}
+
+	header.Add("Vary", RequestMethodHeader)
+	header.Add("Vary", RequestHeadersHeader)
+
+	methods := opts.Methods
+	if len(methods) == 0 {
+		methods = s.allowedMethods(route.router.Root(), req.URL.Path)
+	}
+	if corsPreflightAllowed(opts, methods, req, origin, method) {
+		setCorsOrigin(header, opts, origin)
+		header.Set(AllowMethodsHeader, strings.Join(methods, ", "))
+		header.Set(AllowHeadersHeader, strings.Join(opts.Headers, ", "))
+		if opts.MaxAge > 0 {
+			header.Set(MaxAgeHeader, strconv.Itoa(int(opts.MaxAge/time.Second)))
+		}
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// Whether a preflight may go ahead with method and the headers it asks for
+func corsPreflightAllowed(opts CorsOptions, methods []string, req *web.Request, origin, method string) bool {
+	if !corsOriginAllowed(opts.Origins, origin) || !containsString(methods, method) {
+		return false
+	}
+	for _, requested := range strings.Split(req.Header.Get(RequestHeadersHeader), ",") {
+		requested = strings.TrimSpace(requested)
+		if requested != "" && !containsFold(opts.Headers, requested) {
+			return false
+		}
+	}
+	return true
+}
+
+// Allow origin, and credentials if set
+func setCorsOrigin(header http.Header, opts CorsOptions, origin string) {
+	if containsString(opts.Origins, CorsAnyOrigin) && !opts.Credentials {
+		header.Set(AllowOriginHeader, CorsAnyOrigin)
+	} else {
+		header.Set(AllowOriginHeader, origin)
+	}
+	if opts.Credentials {
+		header.Set(AllowCredentialsHeader, corsAllowCredentials)
+	}
+}
+
+// Whether list holds s, ignoring case
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
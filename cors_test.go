@@ -0,0 +1,198 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type mockCorsConfig struct {
+	mockConfig
+	groups map[string]CorsOptions
+}
+
+func (mc *mockCorsConfig) CorsOptions(group string) CorsOptions {
+	return mc.groups[group]
+}
+
+func newCorsTestRouter(groups map[string]CorsOptions) http.Handler {
+	serv := NewServer(&mockCorsConfig{groups: groups})
+	serv.SetLogger(NewLogger(ioutil.Discard, LevelInfo))
+	return serv.setupRoutes()
+}
+
+func corsRequest(router http.Handler, method, path, origin string, headers map[string]string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, path, nil)
+	req.Header.Set(OriginHeader, origin)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestCorsOriginAllowed(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		origin   string
+		allowed  bool
+	}{
+		{[]string{"*"}, "https://anything.example", true},
+		{[]string{"https://app.example.com"}, "https://app.example.com", true},
+		{[]string{"https://app.example.com"}, "https://APP.example.com", true},
+		{[]string{"https://app.example.com"}, "http://app.example.com", false},
+		{[]string{"https://app.example.com"}, "https://app.example.com:8443", false},
+		{[]string{"https://*.example.com"}, "https://app.example.com", true},
+		{[]string{"https://*.example.com"}, "https://a.b.example.com", true},
+		{[]string{"https://*.example.com"}, "https://example.com", false},
+		{[]string{"https://*.example.com"}, "https://evilexample.com", false},
+		{[]string{"https://*.example.com"}, "http://app.example.com", false},
+		{[]string{"https://*.example.com"}, "https://app.example.com.evil.com", false},
+		{[]string{"https://*.example.com:8443"}, "https://app.example.com:8443", true},
+		{[]string{"https://*.example.com:8443"}, "https://app.example.com", false},
+		{[]string{"https://one.example", "https://two.example"}, "https://two.example", true},
+		{[]string{}, "https://app.example.com", false},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.allowed, corsOriginAllowed(test.patterns, test.origin), test.origin)
+	}
+}
+
+func TestValidCorsOrigin(t *testing.T) {
+	tests := []struct {
+		in    string
+		valid bool
+	}{
+		{"*", true},
+		{"https://app.example.com", true},
+		{"http://localhost:8080", true},
+		{"https://*.example.com", true},
+		{"app.example.com", false},
+		{"https://app.example.com/", false},
+		{"https://app.*.com", false},
+		{"https://*", false},
+		{"https://user@app.example.com", false},
+		{"", false},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.valid, validCorsOrigin(test.in), test.in)
+	}
+}
+
+func TestCorsPreflight(t *testing.T) {
+	router := newCorsTestRouter(map[string]CorsOptions{
+		CorsGroupApi: {
+			Origins: []string{"https://*.example.com"},
+			Headers: DefaultCorsHeaders,
+			MaxAge:  10 * time.Minute,
+		},
+	})
+
+	// No credentials needed for the preflight of an authenticated route
+	rec := corsRequest(router, "OPTIONS", "/api/person", "https://app.example.com", map[string]string{
+		RequestMethodHeader:  "POST",
+		RequestHeadersHeader: "authorization, content-type",
+	})
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Equal(t, "https://app.example.com", rec.Header().Get(AllowOriginHeader))
+	assert.Equal(t, "GET, POST", rec.Header().Get(AllowMethodsHeader))
+	assert.Equal(t, "Authorization, Content-Type, X-Request-ID, If-Match, If-None-Match", rec.Header().Get(AllowHeadersHeader))
+	assert.Equal(t, "600", rec.Header().Get(MaxAgeHeader))
+	assert.Equal(t, "", rec.Header().Get(AllowCredentialsHeader))
+	assert.Equal(t, []string{OriginHeader, RequestMethodHeader, RequestHeadersHeader}, rec.Header()["Vary"])
+
+	// Path parameters are matched like any request
+	rec = corsRequest(router, "OPTIONS", "/api/person/12", "https://app.example.com", map[string]string{
+		RequestMethodHeader: "GET",
+	})
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Equal(t, "GET, PUT, DELETE", rec.Header().Get(AllowMethodsHeader))
+
+	refused := []struct {
+		origin  string
+		method  string
+		headers string
+	}{
+		{"https://evil.com", "GET", ""},
+		{"https://app.example.com", "GET", "X-Custom"},
+	}
+	for _, test := range refused {
+		rec = corsRequest(router, "OPTIONS", "/api/person", test.origin, map[string]string{
+			RequestMethodHeader:  test.method,
+			RequestHeadersHeader: test.headers,
+		})
+		assert.Equal(t, http.StatusNoContent, rec.Code, test.origin)
+		assert.Equal(t, "", rec.Header().Get(AllowOriginHeader), test.origin)
+		assert.Equal(t, "", rec.Header().Get(AllowMethodsHeader), test.origin)
+	}
+
+	// Methods no route serves are refused like any other request
+	rec = corsRequest(router, "OPTIONS", "/api/person", "https://app.example.com", map[string]string{
+		RequestMethodHeader: "DELETE",
+	})
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	assert.Equal(t, "", rec.Header().Get(AllowOriginHeader))
+}
+
+// Each group has its own settings, chosen by the route the preflight is for
+func TestCorsPreflightGroups(t *testing.T) {
+	router := newCorsTestRouter(map[string]CorsOptions{
+		CorsGroupCreateUser: {
+			Origins:     []string{"https://app.example.com"},
+			Methods:     []string{"POST"},
+			Headers:     []string{"Content-Type"},
+			Credentials: true,
+		},
+	})
+
+	rec := corsRequest(router, "OPTIONS", "/api/user", "https://app.example.com", map[string]string{
+		RequestMethodHeader:  "POST",
+		RequestHeadersHeader: "Content-Type",
+	})
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Equal(t, "https://app.example.com", rec.Header().Get(AllowOriginHeader))
+	assert.Equal(t, "POST", rec.Header().Get(AllowMethodsHeader))
+	assert.Equal(t, "Content-Type", rec.Header().Get(AllowHeadersHeader))
+	assert.Equal(t, "true", rec.Header().Get(AllowCredentialsHeader))
+
+	// GET /api/user is in the api group, without CORS
+	rec = corsRequest(router, "OPTIONS", "/api/user", "https://app.example.com", map[string]string{
+		RequestMethodHeader: "GET",
+	})
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	assert.Equal(t, "", rec.Header().Get(AllowOriginHeader))
+}
+
+func TestCorsRequest(t *testing.T) {
+	router := newCorsTestRouter(map[string]CorsOptions{
+		CorsGroupApi:  {Origins: []string{"https://app.example.com"}, Headers: DefaultCorsHeaders},
+		CorsGroupAuth: {Origins: []string{"*"}, Headers: DefaultCorsHeaders},
+	})
+
+	// Errors can be read by the script too
+	rec := corsRequest(router, "GET", "/api/person", "https://app.example.com", nil)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Equal(t, "https://app.example.com", rec.Header().Get(AllowOriginHeader))
+	assert.Equal(t, "X-Request-ID, ETag", rec.Header().Get(ExposeHeadersHeader))
+	assert.Equal(t, OriginHeader, rec.Header().Get("Vary"))
+
+	rec = corsRequest(router, "GET", "/api/person", "https://evil.com", nil)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Equal(t, "", rec.Header().Get(AllowOriginHeader))
+	assert.Equal(t, OriginHeader, rec.Header().Get("Vary"))
+
+	rec = corsRequest(router, "GET", "/healthz", "https://anywhere.example", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, CorsAnyOrigin, rec.Header().Get(AllowOriginHeader))
+
+	// Same-origin requests are left alone
+	rec = corsRequest(router, "GET", "/healthz", "", nil)
+	assert.Equal(t, "", rec.Header().Get(AllowOriginHeader))
+	assert.Equal(t, "", rec.Header().Get("Vary"))
+}
@@ -0,0 +1,607 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"github.com/gocraft/web"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	csvMediaType   = "text/csv"
+	CsvContentType = csvMediaType + "; charset=utf-8"
+	// Sent by spreadsheets at the start of the file
+	csvByteOrderMark = "\ufeff"
+	// Cells starting with one of these are formulas to a spreadsheet, so
+	// export puts csvEscape before them and import takes it off
+	csvFormulaChars = "=+-@\t\r"
+	csvEscape       = "'"
+
+	// Query parameters of the export and import routes
+	CsvColumnsParam        = "columns"
+	ImportDryRunParam      = "dry_run"
+	ImportOnDuplicateParam = "on_duplicate"
+
+	// Fields of a person a column holds, other than meta keys
+	CsvNameField  = "name"
+	CsvColorField = "color"
+	CsvMetaPrefix = "meta."
+	// Import ignores a column mapped to it
+	CsvIgnoreField = "-"
+
+	// What import does with a row named like one of the user's people
+	ImportSkip   = "skip"
+	ImportUpdate = "update"
+	ImportRename = "rename"
+
+	// ImportRow.Action values
+	ImportCreated = "created"
+	ImportUpdated = "updated"
+	ImportSkipped = "skipped"
+	ImportRenamed = "renamed"
+	ImportInvalid = "invalid"
+
+	// Most rows in one import, after the header
+	MaxImportRows = 10000
+	// Largest file imported, room for the most rows with generous meta
+	MaxImportBodyBytes = 16 << 20
+
+	// A renamed person's name, its own and a number from 2 up
+	importRenameFormat = "%s (%d)"
+
+	// ExportPeopleApi and ImportPeopleApi errors
+	PersonExportError        = "Error exporting people"
+	PersonImportError        = "Error importing people"
+	CsvContentTypeError      = "Content-Type is not CSV"
+	CsvMalformedError        = "Malformed CSV: %s"
+	CsvHeaderMissing         = "the header row is missing"
+	CsvOptionsInvalid        = "CSV options are not valid"
+	CsvColumnsInvalid        = "Must be header:field pairs separated by commas, each field name, color, meta.<key> or -"
+	CsvColumnsNoName         = "A column must hold the name"
+	CsvColumnsDuplicate      = "Each field can only be in one column"
+	CsvColumnsMissing        = "The file has no column %q"
+	ImportDryRunInvalid      = "Must be true or false"
+	ImportOnDuplicateInvalid = "Must be skip, update or rename"
+	ImportTooManyRows        = "At most 10000 rows can be imported at once"
+	ImportColorInvalid       = "Must be an integer"
+)
+
+// Returned from the ImportPeopleApi unit of work to undo a dry run
+var errImportRollback = errors.New("Import rolled back")
+
+// A column of a CSV file and the field of a person it holds
+type csvColumn struct {
+	header string
+	// CsvNameField, CsvColorField, CsvMetaPrefix and a meta key, or CsvIgnoreField
+	field string
+}
+
+// What became of a row of an import
+type ImportRow struct {
+	// The row's number in a spreadsheet, the header being 1
+	Row  int    `json:"row"`
+	Name string `json:"name"`
+	// ImportCreated, ImportUpdated, ImportSkipped, ImportRenamed or ImportInvalid
+	Action string `json:"action"`
+	// The person created, updated or skipped, once imported
+	Id int `json:"id,omitempty"`
+	// Problems with the row's cells, keyed by column header
+	Errors JsonErrors `json:"errors,omitempty"`
+}
+
+// Body of the POST /api/person/import response
+type ImportResponse struct {
+	// Whether the changes were kept: not for a dry run, or when a row is invalid
+	Imported bool        `json:"imported"`
+	Created  int         `json:"created"`
+	Updated  int         `json:"updated"`
+	Skipped  int         `json:"skipped"`
+	Renamed  int         `json:"renamed"`
+	Invalid  int         `json:"invalid"`
+	Rows     []ImportRow `json:"rows"`
+}
+
+// Options of an import, from the query string
+type importOptions struct {
+	dryRun      bool
+	onDuplicate string
+	columns     []csvColumn
+}
+
+/*
+Parse a column mapping such as "Full name:name,Phone:meta.phone"
+
+Each pair is a header, then the field its column holds. No mapping
+gives nil
+*/
+func parseCsvColumns(mapping string) ([]csvColumn, error) {
+	if mapping == "" {
+		return nil, nil
+	}
+
+	columns := []csvColumn{}
+	for _, pair := range strings.Split(mapping, ",") {
+		i := strings.LastIndex(pair, ":")
+		if i < 0 {
+			return nil, errors.New(CsvColumnsInvalid)
+		}
+		column := csvColumn{strings.TrimSpace(pair[:i]), strings.TrimSpace(pair[i+1:])}
+		if column.header == "" || !validCsvField(column.field) {
+			return nil, errors.New(CsvColumnsInvalid)
+		}
+		columns = append(columns, column)
+	}
+	return columns, nil
+}
+
+func validCsvField(field string) bool {
+	switch field {
+	case CsvNameField, CsvColorField, CsvIgnoreField:
+		return true
+	}
+	return strings.HasPrefix(field, CsvMetaPrefix) && len(field) > len(CsvMetaPrefix)
+}
+
+/*
+The field a column holds when no mapping names it
+
+name and color hold those fields, and any other header a meta key. A
+header of a meta key such as meta.name is taken as the field itself
+*/
+func defaultCsvField(header string) string {
+	if header == "" {
+		return CsvIgnoreField
+	}
+	if validCsvField(header) {
+		return header
+	}
+	return CsvMetaPrefix + header
+}
+
+/*
+The header export writes for a field, the meta key alone unless import
+would take it as another field, such as name or meta.phone
+*/
+func defaultCsvHeader(field string) string {
+	key := strings.TrimPrefix(field, CsvMetaPrefix)
+	if defaultCsvField(key) != field {
+		return field
+	}
+	return key
+}
+
+// A cell a spreadsheet shows as written, rather than running as a formula
+func escapeCsvCell(cell string) string {
+	if csvFormula(cell) {
+		return csvEscape + cell
+	}
+	return cell
+}
+
+// The cell escapeCsvCell was given
+func unescapeCsvCell(cell string) string {
+	if rest := strings.TrimPrefix(cell, csvEscape); rest != cell && csvFormula(rest) {
+		return rest
+	}
+	return cell
+}
+
+// Whether cell starts a formula, or is one escaped, so escaped again to round-trip
+func csvFormula(cell string) bool {
+	if rest := strings.TrimPrefix(cell, csvEscape); rest != cell {
+		return csvFormula(rest)
+	}
+	return cell != "" && strings.ContainsRune(csvFormulaChars, rune(cell[0]))
+}
+
+// Columns for every field of people: name, color and each meta key in order
+func defaultCsvColumns(people []Person) []csvColumn {
+	keys := map[string]bool{}
+	for i := range people {
+		for key := range people[i].Meta.Map {
+			keys[key] = true
+		}
+	}
+	fields := []string{}
+	for key := range keys {
+		fields = append(fields, CsvMetaPrefix+key)
+	}
+	sort.Strings(fields)
+
+	columns := []csvColumn{{CsvNameField, CsvNameField}, {CsvColorField, CsvColorField}}
+	for _, field := range fields {
+		columns = append(columns, csvColumn{defaultCsvHeader(field), field})
+	}
+	return columns
+}
+
+// The cell of a person's field
+func csvValue(person *Person, field string) string {
+	switch field {
+	case CsvNameField:
+		return escapeCsvCell(person.Name)
+	case CsvColorField:
+		if !person.Color.Valid {
+			return ""
+		}
+		return strconv.FormatInt(person.Color.Int64, 10)
+	}
+	value := person.Meta.Map[strings.TrimPrefix(field, CsvMetaPrefix)]
+	return escapeCsvCell(value.String)
+}
+
+/*
+Handler for GET People Export API
+
+Writes the user's people as CSV, one row each, with a column for the
+name, the color and each meta key. The columns parameter picks the
+columns and their headers instead. Cells a spreadsheet would run as a
+formula are escaped with a leading '
+*/
+func (c *AuthContext) ExportPeopleApi(rw web.ResponseWriter, req *web.Request) {
+	columns, err := parseCsvColumns(req.URL.Query().Get(CsvColumnsParam))
+	for _, column := range columns {
+		if column.field == CsvIgnoreField {
+			err = errors.New(CsvColumnsInvalid)
+		}
+	}
+	if err != nil {
+		writeValidationError(rw, req.Request, CsvOptionsInvalid, JsonErrors{CsvColumnsParam: err.Error()})
+		return
+	}
+
+	people, err := c.DB.GetPeople(req.Context(), c.User.Id)
+
+	if writeUnavailable(rw, req, err) {
+		return
+	}
+	if err != nil {
+		writeError(rw, req.Request, http.StatusInternalServerError, ErrCodeInternal, PersonExportError)
+		return
+	}
+
+	sort.Slice(people, func(i, j int) bool {
+		return people[i].Id < people[j].Id
+	})
+	if columns == nil {
+		columns = defaultCsvColumns(people)
+	}
+
+	rw.Header().Set("Content-Type", CsvContentType)
+	rw.Header().Set("Content-Disposition", `attachment; filename="people.csv"`)
+
+	w := csv.NewWriter(rw)
+	record := make([]string, len(columns))
+	for i, column := range columns {
+		record[i] = escapeCsvCell(column.header)
+	}
+	w.Write(record)
+	for i := range people {
+		for j, column := range columns {
+			record[j] = csvValue(&people[i], column.field)
+		}
+		w.Write(record)
+	}
+	w.Flush()
+}
+
+/*
+Handler for POST People Import API
+
+Takes CSV with a header row, and creates a person from each further row,
+the columns mapped to fields as ExportPeopleApi writes them unless the
+columns parameter says otherwise. A row named like one of the user's
+people, or an earlier row, is skipped, updated or renamed as
+on_duplicate says.
+
+All rows are imported in one transaction, or none if any is invalid. A
+dry run reports what would become of each row, and keeps nothing. The '
+escaping formulas on export is taken off
+*/
+func (c *AuthContext) ImportPeopleApi(rw web.ResponseWriter, req *web.Request) {
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if mediaType != csvMediaType {
+		writeError(rw, req.Request, http.StatusBadRequest, ErrCodeContentType, CsvContentTypeError)
+		return
+	}
+
+	opts, errs := parseImportOptions(req.URL.Query())
+	if len(errs) > 0 {
+		writeValidationError(rw, req.Request, CsvOptionsInvalid, errs)
+		return
+	}
+
+	reader := csv.NewReader(http.MaxBytesReader(rw, req.Body, MaxImportBodyBytes))
+	records := [][]string{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if bodyTooLarge(err) {
+			writeError(rw, req.Request, http.StatusRequestEntityTooLarge, ErrCodeBodyTooLarge, fmt.Sprintf(BodyTooLargeError, MaxImportBodyBytes))
+			return
+		}
+		if err != nil {
+			writeError(rw, req.Request, http.StatusBadRequest, ErrCodeMalformedCsv, fmt.Sprintf(CsvMalformedError, err))
+			return
+		}
+		if len(records) > MaxImportRows {
+			writeError(rw, req.Request, http.StatusBadRequest, ErrCodeValidation, ImportTooManyRows)
+			return
+		}
+		if len(records) == 0 {
+			record[0] = strings.TrimPrefix(record[0], csvByteOrderMark)
+		}
+		for i := range record {
+			record[i] = unescapeCsvCell(record[i])
+		}
+		records = append(records, record)
+	}
+	if len(records) == 0 {
+		writeError(rw, req.Request, http.StatusBadRequest, ErrCodeMalformedCsv, fmt.Sprintf(CsvMalformedError, CsvHeaderMissing))
+		return
+	}
+
+	columns, err := importColumns(records[0], opts.columns)
+	if err != nil {
+		writeValidationError(rw, req.Request, CsvOptionsInvalid, JsonErrors{CsvColumnsParam: err.Error()})
+		return
+	}
+
+	resp := ImportResponse{Rows: make([]ImportRow, len(records)-1)}
+	people := make([]*Person, len(records)-1)
+	for i, record := range records[1:] {
+		people[i] = importPerson(record, columns)
+		resp.Rows[i] = ImportRow{Row: i + 2, Name: people[i].Name}
+		if errs := importErrors(record, columns, people[i]); len(errs) > 0 {
+			resp.Rows[i].Action = ImportInvalid
+			resp.Rows[i].Errors = errs
+			resp.Invalid++
+		}
+	}
+
+	err = c.DB.WithTx(req.Context(), func(tx DbService) error {
+		if err := c.importPeople(req, tx, opts.onDuplicate, columns, people, resp.Rows); err != nil {
+			return err
+		}
+		if opts.dryRun || resp.Invalid > 0 {
+			return errImportRollback
+		}
+		return nil
+	})
+	if err != nil && err != errImportRollback {
+		writePersonWriteError(rw, req, err, PersonImportError)
+		return
+	}
+
+	resp.Imported = err == nil
+	for i := range resp.Rows {
+		row := &resp.Rows[i]
+		switch row.Action {
+		case ImportCreated:
+			resp.Created++
+		case ImportUpdated:
+			resp.Updated++
+		case ImportSkipped:
+			resp.Skipped++
+		case ImportRenamed:
+			resp.Renamed++
+		}
+		// Rolled back with the rest
+		if !resp.Imported && (row.Action == ImportCreated || row.Action == ImportRenamed) {
+			row.Id = 0
+		}
+	}
+
+	jsonResponse(rw, resp)
+}
+
+// The options of an import, or the problems with them keyed by parameter
+func parseImportOptions(query url.Values) (importOptions, JsonErrors) {
+	opts := importOptions{onDuplicate: ImportSkip}
+	errs := JsonErrors{}
+
+	if dryRun := query.Get(ImportDryRunParam); dryRun != "" {
+		var err error
+		if opts.dryRun, err = strconv.ParseBool(dryRun); err != nil {
+			errs[ImportDryRunParam] = ImportDryRunInvalid
+		}
+	}
+
+	switch onDuplicate := query.Get(ImportOnDuplicateParam); onDuplicate {
+	case "":
+	case ImportSkip, ImportUpdate, ImportRename:
+		opts.onDuplicate = onDuplicate
+	default:
+		errs[ImportOnDuplicateParam] = ImportOnDuplicateInvalid
+	}
+
+	var err error
+	if opts.columns, err = parseCsvColumns(query.Get(CsvColumnsParam)); err != nil {
+		errs[CsvColumnsParam] = err.Error()
+	}
+
+	return opts, errs
+}
+
+/*
+The field of each column of a file with header, taken from mapping or
+defaultCsvField
+
+Every mapped header must be in the file, one column must hold the name,
+and no field can be in two columns
+*/
+func importColumns(header []string, mapping []csvColumn) ([]csvColumn, error) {
+	fields := map[string]string{}
+	for _, column := range mapping {
+		fields[column.header] = column.field
+	}
+
+	columns := make([]csvColumn, len(header))
+	used := map[string]bool{}
+	for i, h := range header {
+		h = strings.TrimSpace(h)
+		field, ok := fields[h]
+		if !ok {
+			field = defaultCsvField(h)
+		}
+		delete(fields, h)
+
+		if field != CsvIgnoreField && used[field] {
+			return nil, errors.New(CsvColumnsDuplicate)
+		}
+		used[field] = true
+		columns[i] = csvColumn{h, field}
+	}
+
+	for _, column := range mapping {
+		if _, missing := fields[column.header]; missing {
+			return nil, fmt.Errorf(CsvColumnsMissing, column.header)
+		}
+	}
+	if !used[CsvNameField] {
+		return nil, errors.New(CsvColumnsNoName)
+	}
+	return columns, nil
+}
+
+// The person in a row, with the cells its columns hold. Empty cells are left out
+func importPerson(record []string, columns []csvColumn) *Person {
+	person := &Person{}
+	person.Meta.Map = map[string]sql.NullString{}
+
+	for i, column := range columns {
+		value := record[i]
+		switch {
+		case column.field == CsvNameField:
+			person.Name = strings.TrimSpace(value)
+		case column.field == CsvColorField:
+			color, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+			person.Color = sql.NullInt64{color, err == nil}
+		case strings.HasPrefix(column.field, CsvMetaPrefix) && value != "":
+			person.Meta.Map[strings.TrimPrefix(column.field, CsvMetaPrefix)] = sql.NullString{value, true}
+		}
+	}
+	return person
+}
+
+// Problems with the cells of a row read into person, keyed by column header
+func importErrors(record []string, columns []csvColumn, person *Person) JsonErrors {
+	errs := JsonErrors{}
+	for i, column := range columns {
+		switch column.field {
+		case CsvNameField:
+			if !person.Validate() {
+				errs[column.header] = person.Errors()[CsvNameField]
+			}
+		case CsvColorField:
+			if strings.TrimSpace(record[i]) != "" && !person.Color.Valid {
+				errs[column.header] = ImportColorInvalid
+			}
+		}
+	}
+	return errs
+}
+
+/*
+Create, or deal with as onDuplicate says, the person of each valid row
+in tx, setting its action
+
+The user's people are locked first, so no other change to them can make
+a name taken after it was checked
+*/
+func (c *AuthContext) importPeople(req *web.Request, tx DbService, onDuplicate string, columns []csvColumn, people []*Person, rows []ImportRow) error {
+	ctx := req.Context()
+	if err := tx.LockPeople(ctx, c.User.Id); err != nil {
+		return err
+	}
+	existing, err := tx.GetPeople(ctx, c.User.Id)
+	if err != nil {
+		return err
+	}
+	byName := map[string]*Person{}
+	for i := range existing {
+		byName[existing[i].Name] = &existing[i]
+	}
+
+	for i, person := range people {
+		if rows[i].Action == ImportInvalid {
+			continue
+		}
+
+		current := byName[person.Name]
+		switch {
+		case current == nil:
+			rows[i].Action = ImportCreated
+		case onDuplicate == ImportSkip:
+			rows[i].Action, rows[i].Id = ImportSkipped, current.Id
+			continue
+		case onDuplicate == ImportUpdate:
+			updated := importUpdate(current, person, columns)
+			if err := tx.UpdatePerson(ctx, updated); err != nil {
+				return err
+			}
+			byName[updated.Name] = updated
+			rows[i].Action, rows[i].Id = ImportUpdated, updated.Id
+			continue
+		default:
+			person.Name = importRename(byName, person.Name)
+			rows[i].Action, rows[i].Name = ImportRenamed, person.Name
+		}
+
+		created, err := tx.CreatePerson(ctx, c.User.Id, person.Name, person.Meta, person.Color)
+		if err != nil {
+			return err
+		}
+		byName[created.Name] = created
+		rows[i].Id = created.Id
+	}
+	return nil
+}
+
+/*
+current with the fields of imported the file has columns for
+
+Meta keys without a column are kept, and those with an empty cell removed
+*/
+func importUpdate(current, imported *Person, columns []csvColumn) *Person {
+	updated := *current
+	updated.Meta.Map = map[string]sql.NullString{}
+	for key, value := range current.Meta.Map {
+		updated.Meta.Map[key] = value
+	}
+
+	for _, column := range columns {
+		switch {
+		case column.field == CsvColorField:
+			updated.Color = imported.Color
+		case strings.HasPrefix(column.field, CsvMetaPrefix):
+			key := strings.TrimPrefix(column.field, CsvMetaPrefix)
+			if value, ok := imported.Meta.Map[key]; ok {
+				updated.Meta.Map[key] = value
+			} else {
+				delete(updated.Meta.Map, key)
+			}
+		}
+	}
+	return &updated
+}
+
+// name with the lowest number from 2 up that no one in byName has
+func importRename(byName map[string]*Person, name string) string {
+	for n := 2; ; n++ {
+		renamed := fmt.Sprintf(importRenameFormat, name, n)
+		if byName[renamed] == nil {
+			return renamed
+		}
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/gocraft/web"
+	"github.com/lib/pq/hstore"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestParseCsvColumns(t *testing.T) {
+	tests := []struct {
+		mapping string
+		columns []csvColumn
+		valid   bool
+	}{
+		{"", nil, true},
+		{"Full name:name", []csvColumn{{"Full name", CsvNameField}}, true},
+		{"A:b:meta.x, Tel : meta.phone,Notes:-,Hue:color",
+			[]csvColumn{{"A:b", "meta.x"}, {"Tel", "meta.phone"}, {"Notes", CsvIgnoreField}, {"Hue", CsvColorField}}, true},
+		{"name", nil, false},
+		{":name", nil, false},
+		{"Phone:phone", nil, false},
+		{"Phone:meta.", nil, false},
+		{"Name:name,", nil, false},
+	}
+
+	for _, test := range tests {
+		columns, err := parseCsvColumns(test.mapping)
+		if test.valid {
+			assert.Nil(t, err, test.mapping)
+			assert.Equal(t, test.columns, columns, test.mapping)
+		} else {
+			assert.Equal(t, CsvColumnsInvalid, fmt.Sprint(err), test.mapping)
+		}
+	}
+}
+
+func TestImportColumns(t *testing.T) {
+	tests := []struct {
+		header  []string
+		mapping string
+		columns []csvColumn
+		err     string
+	}{
+		{[]string{"name", "color", "phone", "meta.name", ""}, "", []csvColumn{{"name", CsvNameField},
+			{"color", CsvColorField}, {"phone", "meta.phone"}, {"meta.name", "meta.name"}, {"", CsvIgnoreField}}, ""},
+		{[]string{"Who", " name ", "Notes"}, "Who:name,name:meta.alias,Notes:-",
+			[]csvColumn{{"Who", CsvNameField}, {"name", "meta.alias"}, {"Notes", CsvIgnoreField}}, ""},
+		{[]string{"name"}, "Who:name", nil, fmt.Sprintf(CsvColumnsMissing, "Who")},
+		{[]string{"phone"}, "", nil, CsvColumnsNoName},
+		{[]string{"name", "Who"}, "Who:name", nil, CsvColumnsDuplicate},
+		{[]string{"name", "phone", "meta.phone"}, "", nil, CsvColumnsDuplicate},
+	}
+
+	for _, test := range tests {
+		mapping, _ := parseCsvColumns(test.mapping)
+		columns, err := importColumns(test.header, mapping)
+		assert.Equal(t, test.columns, columns, test.mapping)
+		if test.err == "" {
+			assert.Nil(t, err, test.mapping)
+		} else {
+			assert.Equal(t, test.err, fmt.Sprint(err), test.mapping)
+		}
+	}
+}
+
+func TestDefaultCsvHeader(t *testing.T) {
+	tests := map[string]string{
+		"meta.phone":      "phone",
+		"meta.name":       "meta.name",
+		"meta.color":      "meta.color",
+		"meta.-":          "meta.-",
+		"meta.meta.phone": "meta.meta.phone",
+	}
+
+	for field, header := range tests {
+		assert.Equal(t, header, defaultCsvHeader(field), field)
+		assert.Equal(t, field, defaultCsvField(header), field)
+	}
+}
+
+func TestEscapeCsvCell(t *testing.T) {
+	tests := map[string]string{
+		"":            "",
+		"Ann":         "Ann",
+		"=SUM(A1:A2)": "'=SUM(A1:A2)",
+		"+1 555":      "'+1 555",
+		"-1":          "'-1",
+		"@home":       "'@home",
+		"\tx":         "'\tx",
+		"\rx":         "'\rx",
+		"'=x":         "''=x",
+		"'quoted'":    "'quoted'",
+	}
+
+	for cell, escaped := range tests {
+		assert.Equal(t, escaped, escapeCsvCell(cell), cell)
+		assert.Equal(t, cell, unescapeCsvCell(escaped), cell)
+	}
+}
+
+func mockCsvParams(method, contentType, body string, query url.Values) (web.ResponseWriter, *web.Request, *httptest.ResponseRecorder) {
+	rw, req, rec := mockHandlerParams(method, contentType, body)
+	req.URL.RawQuery = query.Encode()
+	return rw, req, rec
+}
+
+func TestExportPeopleApi(t *testing.T) {
+	ac, _ := bulkContext(t)
+	meta := hstore.Hstore{Map: map[string]sql.NullString{
+		"phone": {"555, ext 1", true},
+		"name":  {"Alias", true},
+		"gone":  {"", false},
+	}}
+	if _, err := ac.DB.CreatePerson(context.Background(), ac.User.Id, "Three", meta, sql.NullInt64{7, true}); err != nil {
+		t.Fatal(err)
+	}
+
+	rw, req, rec := mockCsvParams("GET", "", "", url.Values{})
+	(*AuthContext).ExportPeopleApi(ac, rw, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, CsvContentType, rec.Header().Get("Content-Type"))
+	assert.Equal(t, `attachment; filename="people.csv"`, rec.Header().Get("Content-Disposition"))
+	assert.Equal(t, "name,color,gone,meta.name,phone\nOne,,,,\nTwo,,,,\nThree,7,,Alias,\"555, ext 1\"\n",
+		rec.Body.String())
+
+	rw, req, rec = mockCsvParams("GET", "", "", url.Values{CsvColumnsParam: {"Tel:meta.phone,Who:name"}})
+	(*AuthContext).ExportPeopleApi(ac, rw, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "Tel,Who\n,One\n,Two\n\"555, ext 1\",Three\n", rec.Body.String())
+
+	rw, req, rec = mockCsvParams("GET", "", "", url.Values{CsvColumnsParam: {"Who:name,Notes:-"}})
+	(*AuthContext).ExportPeopleApi(ac, rw, req)
+
+	err := assertApiError(t, rec, http.StatusBadRequest, ErrCodeValidation, CsvOptionsInvalid)
+	assert.Equal(t, JsonErrors{CsvColumnsParam: CsvColumnsInvalid}, err.Errors)
+}
+
+func TestImportPeopleApiInvalid(t *testing.T) {
+	tests := []struct {
+		contentType string
+		body        string
+		query       url.Values
+		code        string
+		message     string
+	}{
+		{JsonContentType, "name\nAnn\n", url.Values{}, ErrCodeContentType, CsvContentTypeError},
+		{"text/csv", "name\nAnn\n", url.Values{ImportDryRunParam: {"maybe"}}, ErrCodeValidation, CsvOptionsInvalid},
+		{"text/csv", "name\nAnn\n", url.Values{ImportOnDuplicateParam: {"merge"}}, ErrCodeValidation, CsvOptionsInvalid},
+		{"text/csv", "name\nAnn\n", url.Values{CsvColumnsParam: {"Who"}}, ErrCodeValidation, CsvOptionsInvalid},
+		{"text/csv", "phone\n555\n", url.Values{}, ErrCodeValidation, CsvOptionsInvalid},
+		{"text/csv", "", url.Values{}, ErrCodeMalformedCsv, fmt.Sprintf(CsvMalformedError, CsvHeaderMissing)},
+		{"text/csv", "name,color\nAnn\n", url.Values{}, ErrCodeMalformedCsv,
+			"Malformed CSV: record on line 2: wrong number of fields"},
+		{"text/csv", "name\n" + strings.Repeat("Ann\n", MaxImportRows+1), url.Values{}, ErrCodeValidation,
+			ImportTooManyRows},
+	}
+
+	ac, _ := bulkContext(t)
+
+	for _, test := range tests {
+		rw, req, rec := mockCsvParams("POST", test.contentType, test.body, test.query)
+
+		(*AuthContext).ImportPeopleApi(ac, rw, req)
+
+		assertApiError(t, rec, http.StatusBadRequest, test.code, test.message)
+	}
+	assert.ElementsMatch(t, []string{"One", "Two"}, bulkNames(t, ac))
+}
+
+func TestImportPeopleApiTooLarge(t *testing.T) {
+	ac, _ := bulkContext(t)
+	// Few enough rows, but too many bytes
+	body := "name,notes\n" + strings.Repeat("Ann,"+strings.Repeat("x", 1<<20)+"\n", MaxImportBodyBytes>>20)
+	rw, req, rec := mockCsvParams("POST", CsvContentType, body, url.Values{})
+
+	(*AuthContext).ImportPeopleApi(ac, rw, req)
+
+	assertApiError(t, rec, http.StatusRequestEntityTooLarge, ErrCodeBodyTooLarge,
+		fmt.Sprintf(BodyTooLargeError, MaxImportBodyBytes))
+	assert.ElementsMatch(t, []string{"One", "Two"}, bulkNames(t, ac))
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	from, _ := bulkContext(t)
+	meta := hstore.Hstore{Map: map[string]sql.NullString{
+		"meta.phone": {"=HYPERLINK(\"http://example.com\")", true},
+		"phone":      {"+1 555", true},
+		"-":          {"@x", true},
+	}}
+	if _, err := from.DB.CreatePerson(context.Background(), from.User.Id, "-Three", meta, sql.NullInt64{-7, true}); err != nil {
+		t.Fatal(err)
+	}
+	rw, req, rec := mockCsvParams("GET", "", "", url.Values{})
+	(*AuthContext).ExportPeopleApi(from, rw, req)
+
+	assert.Equal(t, "name,color,meta.-,meta.meta.phone,phone\nOne,,,,\nTwo,,,,\n"+
+		"'-Three,-7,'@x,\"'=HYPERLINK(\"\"http://example.com\"\")\",'+1 555\n", rec.Body.String())
+
+	to, _ := bulkContext(t)
+	resp := importRequest(t, to, rec.Body.String(), url.Values{})
+
+	assert.Equal(t, []string{ImportSkipped, ImportSkipped, ImportCreated}, importActions(resp))
+	imported, err := to.DB.GetPerson(context.Background(), to.User.Id, resp.Rows[2].Id)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "-Three", imported.Name)
+		assert.Equal(t, sql.NullInt64{-7, true}, imported.Color)
+		assert.Equal(t, HstoreToMap(&meta), HstoreToMap(&imported.Meta))
+	}
+}
+
+func importRequest(t *testing.T, ac *AuthContext, body string, query url.Values) ImportResponse {
+	rw, req, rec := mockCsvParams("POST", CsvContentType, body, query)
+	(*AuthContext).ImportPeopleApi(ac, rw, req)
+
+	if !assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String()) {
+		t.FailNow()
+	}
+	var resp ImportResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func importActions(resp ImportResponse) []string {
+	actions := []string{}
+	for _, row := range resp.Rows {
+		actions = append(actions, row.Action)
+	}
+	return actions
+}
+
+func TestImportPeopleApi(t *testing.T) {
+	ac, people := bulkContext(t)
+
+	resp := importRequest(t, ac, "\ufeffname,color,phone,Notes\nAnn,3,555,x\n One ,,,\nBob,,,y\n",
+		url.Values{CsvColumnsParam: {"Notes:-"}})
+
+	assert.True(t, resp.Imported)
+	assert.Equal(t, []string{ImportCreated, ImportSkipped, ImportCreated}, importActions(resp))
+	assert.Equal(t, []int{2, 3, 4}, []int{resp.Rows[0].Row, resp.Rows[1].Row, resp.Rows[2].Row})
+	assert.Equal(t, 2, resp.Created)
+	assert.Equal(t, 1, resp.Skipped)
+	assert.Equal(t, people[0].Id, resp.Rows[1].Id)
+
+	ann, err := ac.DB.GetPerson(context.Background(), ac.User.Id, resp.Rows[0].Id)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "Ann", ann.Name)
+		assert.Equal(t, sql.NullInt64{3, true}, ann.Color)
+		assert.Equal(t, map[string]string{"phone": "555"}, HstoreToMap(&ann.Meta))
+	}
+	assert.ElementsMatch(t, []string{"One", "Two", "Ann", "Bob"}, bulkNames(t, ac))
+}
+
+func TestImportPeopleApiUpdate(t *testing.T) {
+	ac, people := bulkContext(t)
+	people[0].Meta = hstore.Hstore{Map: map[string]sql.NullString{"phone": {"555", true}, "email": {"a@b", true}}}
+	if err := ac.DB.UpdatePerson(context.Background(), people[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := importRequest(t, ac, "name,color,phone,city\nOne,5,,Oslo\nAnn,,,\nAnn,2,,\n",
+		url.Values{ImportOnDuplicateParam: {ImportUpdate}})
+
+	assert.True(t, resp.Imported)
+	assert.Equal(t, []string{ImportUpdated, ImportCreated, ImportUpdated}, importActions(resp))
+	assert.Equal(t, 2, resp.Updated)
+	assert.Equal(t, resp.Rows[1].Id, resp.Rows[2].Id)
+
+	one, err := ac.DB.GetPerson(context.Background(), ac.User.Id, people[0].Id)
+	if assert.Nil(t, err) {
+		assert.Equal(t, sql.NullInt64{5, true}, one.Color)
+		assert.Equal(t, map[string]string{"email": "a@b", "city": "Oslo"}, HstoreToMap(&one.Meta))
+	}
+	ann, err := ac.DB.GetPerson(context.Background(), ac.User.Id, resp.Rows[1].Id)
+	if assert.Nil(t, err) {
+		assert.Equal(t, sql.NullInt64{2, true}, ann.Color)
+	}
+}
+
+func TestImportPeopleApiRename(t *testing.T) {
+	ac, _ := bulkContext(t)
+	if _, err := ac.DB.CreatePerson(context.Background(), ac.User.Id, "One (2)", hstore.Hstore{}, sql.NullInt64{}); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := importRequest(t, ac, "name\nOne\nOne\nThree\n", url.Values{ImportOnDuplicateParam: {ImportRename}})
+
+	assert.Equal(t, []string{ImportRenamed, ImportRenamed, ImportCreated}, importActions(resp))
+	assert.Equal(t, "One (3)", resp.Rows[0].Name)
+	assert.Equal(t, "One (4)", resp.Rows[1].Name)
+	assert.Equal(t, 2, resp.Renamed)
+	assert.ElementsMatch(t, []string{"One", "Two", "One (2)", "One (3)", "One (4)", "Three"}, bulkNames(t, ac))
+}
+
+// A dry run, or an invalid row, keeps nothing but reports every row
+func TestImportPeopleApiRollback(t *testing.T) {
+	ac, people := bulkContext(t)
+
+	resp := importRequest(t, ac, "name,color\nAnn,1\nTwo,\n", url.Values{ImportDryRunParam: {"true"}})
+
+	assert.False(t, resp.Imported)
+	assert.Equal(t, []string{ImportCreated, ImportSkipped}, importActions(resp))
+	assert.Equal(t, 0, resp.Rows[0].Id)
+	assert.Equal(t, people[1].Id, resp.Rows[1].Id)
+
+	resp = importRequest(t, ac, "Who,Hue\nAnn,1\n ,\nBob,red\n", url.Values{CsvColumnsParam: {"Who:name,Hue:color"}})
+
+	assert.False(t, resp.Imported)
+	assert.Equal(t, []string{ImportCreated, ImportInvalid, ImportInvalid}, importActions(resp))
+	assert.Equal(t, 1, resp.Created)
+	assert.Equal(t, 2, resp.Invalid)
+	assert.Equal(t, JsonErrors{"Who": PersonNameEmpty}, resp.Rows[1].Errors)
+	assert.Equal(t, JsonErrors{"Hue": ImportColorInvalid}, resp.Rows[2].Errors)
+	assert.ElementsMatch(t, []string{"One", "Two"}, bulkNames(t, ac))
+}
@@ -1,12 +1,48 @@
 package main
 
 import (
-	_ "database/sql"
+	"context"
+	"database/sql"
+	"fmt"
 	_ "github.com/DATA-DOG/go-sqlmock"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
+	"log"
+	"sort"
+	"strings"
+	"time"
 )
 
+const (
+	connectRetryMin = 250 * time.Millisecond
+	connectRetryMax = 5 * time.Second
+
+	DbConnectError = "Could not connect to the %s database after %d attempt(s) over %s, check the db settings: %s"
+	DbConnectRetry = "Database not available yet, retrying in %s: %s"
+
+	DbSchemaMismatch = "Database schema does not match what the server expects:\n%s"
+	DbMissingTable   = "  table %q is missing"
+	DbMissingColumns = "  table %q is missing column(s): %s"
+
+	// Locks the rows a query reads until its transaction ends
+	forUpdateSql = ` FOR UPDATE`
+
+	schemaColumnsSql = `SELECT column_name FROM information_schema.columns
+	WHERE table_schema = ANY (current_schemas(true)) AND table_name = ?`
+)
+
+// Columns the queries need in each table
+var expectedSchema = map[string][]string{
+	"user":             append(strings.Split(UserColumns, ", "), "sync_version"),
+	"person":           strings.Split(PersonColumns, ", "),
+	"person_tombstone": {"id", "user_id", "version"},
+	// Deleted with their person
+	"person_tag":           {"id", "person_id"},
+	"location":             {"id", "person_id"},
+	"person_tag_tombstone": {"id", "user_id", "version"},
+	"location_tombstone":   {"id", "user_id", "version"},
+}
+
 /*
 Database service
 
@@ -15,25 +51,444 @@ Provides an abstraction wrapper around the database
 type DbService interface {
 	UserService
 	PersonService
+
+	// Run fn as a single unit of work: everything fn does through tx is
+	// committed if it returns nil, and rolled back if it returns an error
+	// or panics. WithTx on tx joins the same unit
+	WithTx(ctx context.Context, fn func(tx DbService) error) error
+
+	// Check the database can be reached
+	Ping(ctx context.Context) error
+	// Check the database has every table and column the queries use
+	CheckSchema(ctx context.Context) error
+}
+
+/*
+Connection pool settings and startup behaviour
+
+Zero values for the pool keep the database/sql defaults
+*/
+type DbOptions struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	// Total time to keep retrying the first connection
+	ConnectTimeout time.Duration
+	// Connection strings of read-only replicas, Postgres only
+	Replicas []string
+	// How long a user's reads stay on the primary after they write
+	ReplicaStickiness time.Duration
 }
 
 type pgDbService struct {
-	db *sqlx.DB
+	db    *sqlx.DB
+	stmts pgStatements
+	// Set on the service handed to a WithTx function
+	tx *sqlx.Tx
+	// Nil without replicas, in which case the primary serves everything
+	replicas *replicaSet
+}
+
+// Every query pgDbService runs, prepared once and reused
+type pgStatements struct {
+	getUser      *sqlx.Stmt
+	createUser   *sqlx.Stmt
+	updateUser   *sqlx.Stmt
+	getPerson    *sqlx.Stmt
+	getPeople    *sqlx.Stmt
+	createPerson *sqlx.Stmt
+	updatePerson *sqlx.Stmt
+	deletePerson *sqlx.Stmt
+	// Bound as getPerson in transactions
+	getPersonForUpdate *sqlx.Stmt
+	// Sync versions and tombstones, see PersonChanges
+	lockPeople       *sqlx.Stmt
+	nextSyncVersion  *sqlx.Stmt
+	getSyncVersion   *sqlx.Stmt
+	createTombstone  *sqlx.Stmt
+	getChangedPeople *sqlx.Stmt
+	getTombstones    *sqlx.Stmt
+	// Tombstones of tag links and locations, deleted with their person
+	createPersonTagTombstones *sqlx.Stmt
+	deletePersonTags          *sqlx.Stmt
+	createLocationTombstones  *sqlx.Stmt
+	deleteLocations           *sqlx.Stmt
+	getPersonTagTombstones    *sqlx.Stmt
+	getLocationTombstones     *sqlx.Stmt
+
+	// Set on statements for a transaction, see in
+	tx    *sqlx.Tx
+	bound map[*sqlx.Stmt]*sqlx.Stmt
+}
+
+/*
+Connect to the database service selected by dbType
+
+The memory type needs no connection, sqlite opens the data file given
+in creds, and any other type is opened as a SQL database with
+ConnectPgDbService
+*/
+func ConnectDbService(dbType, creds string, opts DbOptions, logger *log.Logger) (DbService, error) {
+	switch dbType {
+	case MemoryDbType:
+		return NewMemDbService(), nil
+	case SqliteDbType:
+		return ConnectSqliteDbService(creds, opts)
+	}
+	return ConnectPgDbService(dbType, creds, opts, logger)
 }
 
 func NewPgDbService(dbType, creds string) *pgDbService {
 	s := new(pgDbService)
 	s.dbInit(dbType, creds)
+	if err := s.prepare(); err != nil {
+		panic(err)
+	}
 	return s
 }
 
 /*
-Connect to the database, and set the database handle
+Connect to the database with the given pool settings
+
+Retries with exponential backoff until opts.ConnectTimeout has passed,
+logging each failed attempt, so the server can start before the
+database does. Once connected, database/sql replaces broken connections
+on its own, so a database restart does not need a server restart
+*/
+func ConnectPgDbService(dbType, creds string, opts DbOptions, logger *log.Logger) (*pgDbService, error) {
+	db, err := openDb(dbType, creds, opts)
+	if err != nil {
+		return nil, err
+	}
 
-This must be called before any database calls can happen
+	err = retryConnect(db.Ping, dbType, opts.ConnectTimeout, time.Sleep, logger)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	s := &pgDbService{db: db}
+	if err := s.CheckSchema(context.Background()); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := s.prepare(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if len(opts.Replicas) > 0 {
+		s.replicas, err = openReplicas(dbType, opts, logger)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		go s.replicas.watch(replicaCheckInterval)
+	}
+
+	return s, nil
+}
+
+/*
+Time a query in the metrics and trace it under the span in ctx
+
+system is the database it runs on, DbSystemPostgres or DbSystemSqlite.
+Call the returned function once the query is done
+*/
+func observeQuery(ctx context.Context, system, query string) func() {
+	start := time.Now()
+	_, span := StartSpan(ctx, "db "+query, SpanKindClient)
+	span.SetAttribute("db.system", system)
+	span.SetAttribute("db.operation", query)
+
+	return func() {
+		dbQueryDuration.ObserveSince(start, query)
+		span.Finish()
+	}
+}
+
+// The db.system of the database behind a driver
+func dbSystem(driverName string) string {
+	if driverName == sqliteDriver {
+		return DbSystemSqlite
+	}
+	return DbSystemPostgres
+}
+
+// The db.system of the database s runs queries on
+func (s *pgDbService) system() string {
+	return dbSystem(s.db.DriverName())
+}
+
+// Prepare every statement, so a broken query fails at startup
+func (s *pgDbService) prepare() (err error) {
+	s.stmts, err = prepareStatements(s.db, false)
+	return err
+}
+
+// A statement of pgStatements and the query it is prepared from
+type pgStatement struct {
+	stmt  **sqlx.Stmt
+	query string
+	write bool
+}
+
+// Prepare the statements on db, only those that read when readOnly is set
+func prepareStatements(db *sqlx.DB, readOnly bool) (pgStatements, error) {
+	stmts := pgStatements{}
+	for _, statement := range stmts.statements() {
+		if readOnly && statement.write {
+			continue
+		}
+		stmt, err := db.Preparex(db.Rebind(statement.query))
+		if err != nil {
+			return pgStatements{}, err
+		}
+		*statement.stmt = stmt
+	}
+	return stmts, nil
+}
+
+// Every statement of st, with whether it writes
+func (st *pgStatements) statements() []pgStatement {
+	return []pgStatement{
+		{&st.getUser, getUserSql, false},
+		{&st.createUser, createUserSql, true},
+		{&st.updateUser, updateUserSql, true},
+		{&st.getPerson, getPersonSql, false},
+		{&st.getPersonForUpdate, getPersonForUpdateSql, true},
+		{&st.getPeople, getPeopleSql, false},
+		{&st.createPerson, createPersonSql, true},
+		{&st.updatePerson, updatePersonSql, true},
+		{&st.deletePerson, deletePersonSql, true},
+		{&st.lockPeople, lockPeopleSql, true},
+		{&st.nextSyncVersion, nextSyncVersionSql, true},
+		{&st.getSyncVersion, getSyncVersionSql, true},
+		{&st.createTombstone, createTombstoneSql, true},
+		{&st.getChangedPeople, getChangedPeopleSql, true},
+		{&st.getTombstones, getTombstonesSql, true},
+		{&st.createPersonTagTombstones, createPersonTagTombstonesSql, true},
+		{&st.deletePersonTags, deletePersonTagsSql, true},
+		{&st.createLocationTombstones, createLocationTombstonesSql, true},
+		{&st.deleteLocations, deleteLocationsSql, true},
+		{&st.getPersonTagTombstones, getPersonTagTombstonesSql, true},
+		{&st.getLocationTombstones, getLocationTombstonesSql, true},
+	}
+}
+
+/*
+Run a read on a replica when one should serve it, otherwise the primary
+
+keys name what the read depends on, see replicaSet.pick. Reads in a
+transaction stay on it, as do those whose ctx is from withPrimaryReads. A
+replica that cannot be reached is taken out
+and the read retried on the primary
+*/
+func (s *pgDbService) read(ctx context.Context, keys []string, query func(stmts *pgStatements) error) error {
+	if s.tx == nil && s.replicas != nil && !primaryReads(ctx) {
+		if r := s.replicas.pick(keys...); r != nil {
+			err := query(r.stmts)
+			if !isConnError(err) {
+				return err
+			}
+			s.replicas.setHealth(r, err)
+		}
+	}
+	return query(&s.stmts)
+}
+
+// Connection pool counters of the primary
+func (s *pgDbService) Stats() sql.DBStats {
+	return s.db.Stats()
+}
+
+// Record a write to keys, so reads of them stay on the primary for a while
+func (s *pgDbService) wrote(keys ...string) {
+	if s.replicas != nil {
+		s.replicas.stick(keys...)
+	}
+}
+
+// sql.ErrNoRows if the statement that gave result changed nothing
+func checkRowsAffected(result sql.Result) error {
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+/*
+The statements for tx, valid until it ends
+
+Each is bound to tx by use the first time it runs, as binding can take a
+round trip to prepare it on the transaction's connection. A person read
+in tx is locked until it ends, so a check of the person and the update
+following it cannot interleave with another's
+*/
+func (st pgStatements) in(tx *sqlx.Tx) pgStatements {
+	st.getPerson = st.getPersonForUpdate
+	st.tx = tx
+	st.bound = map[*sqlx.Stmt]*sqlx.Stmt{}
+	return st
+}
+
+// stmt, bound to the transaction of st if it has one
+func (st *pgStatements) use(ctx context.Context, stmt *sqlx.Stmt) *sqlx.Stmt {
+	if st.tx == nil {
+		return stmt
+	}
+	bound, ok := st.bound[stmt]
+	if !ok {
+		bound = st.tx.StmtxContext(ctx, stmt)
+		st.bound[stmt] = bound
+	}
+	return bound
+}
+
+func (s *pgDbService) WithTx(ctx context.Context, fn func(tx DbService) error) error {
+	if s.tx != nil {
+		return fn(s)
+	}
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	return runTx(tx, func() error {
+		return fn(&pgDbService{db: s.db, stmts: s.stmts.in(tx), tx: tx, replicas: s.replicas})
+	})
+}
+
+/*
+Call fn, then commit tx if it returned nil and roll back otherwise
+
+A panic in fn rolls back and carries on panicking
+*/
+func runTx(tx *sqlx.Tx, fn func() error) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	return fn()
+}
+
+// Ping the primary. Replicas are checked in the background, and are not needed to serve
+func (s *pgDbService) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+/*
+Check the live schema has every column the queries use
+
+Extra columns are fine, since every query lists its columns. The error
+lists everything missing at once
+*/
+func (s *pgDbService) CheckSchema(ctx context.Context) error {
+	tables := make([]string, 0, len(expectedSchema))
+	for table := range expectedSchema {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+
+	problems := []string{}
+	for _, table := range tables {
+		columns := []string{}
+		err := s.db.SelectContext(ctx, &columns, s.db.Rebind(schemaColumnsSql), table)
+		if err != nil {
+			return err
+		}
+
+		if len(columns) == 0 {
+			problems = append(problems, fmt.Sprintf(DbMissingTable, table))
+			continue
+		}
+
+		missing := []string{}
+		for _, column := range expectedSchema[table] {
+			if !containsString(columns, column) {
+				missing = append(missing, column)
+			}
+		}
+		if len(missing) > 0 {
+			problems = append(problems, fmt.Sprintf(DbMissingColumns, table, strings.Join(missing, ", ")))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf(DbSchemaMismatch, strings.Join(problems, "\n"))
+	}
+	return nil
+}
+
+// Open a connection pool with the given settings, without connecting yet
+func openDb(dbType, creds string, opts DbOptions) (*sqlx.DB, error) {
+	db, err := sqlx.Open(dbType, creds)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(opts.MaxOpenConns)
+	}
+	if opts.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(opts.MaxIdleConns)
+	}
+	if opts.ConnMaxLifetime > 0 {
+		db.SetConnMaxLifetime(opts.ConnMaxLifetime)
+	}
+
+	return db, nil
+}
+
+/*
+Call connect until it succeeds or timeout has passed
+
+The delay between attempts doubles from connectRetryMin up to
+connectRetryMax. The returned error says how long was spent trying
+*/
+func retryConnect(connect func() error, dbType string, timeout time.Duration, sleep func(time.Duration), logger *log.Logger) error {
+	delay := connectRetryMin
+	var waited time.Duration
+
+	for attempt := 1; ; attempt++ {
+		err := connect()
+		if err == nil {
+			return nil
+		}
+
+		if waited+delay > timeout {
+			return fmt.Errorf(DbConnectError, dbType, attempt, waited, err)
+		}
+
+		logger.Printf(DbConnectRetry, delay, err)
+		sleep(delay)
+		waited += delay
+
+		delay *= 2
+		if delay > connectRetryMax {
+			delay = connectRetryMax
+		}
+	}
+}
+
+/*
+Connect to the database, and set the database handle
 
-Eventually, this should parse a given config file rather than using
-hardcoded values
+Panics if the database cannot be reached. Used where a failed
+connection is a programming error, such as with the mock driver
 */
 func (s *pgDbService) dbInit(dbType, creds string) {
 	s.db = sqlx.MustConnect(dbType, creds)
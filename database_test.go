@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq/hstore"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetryConnectFirstAttempt(t *testing.T) {
+	buf := new(bytes.Buffer)
+	sleeps := []time.Duration{}
+
+	err := retryConnect(func() error {
+		return nil
+	}, "postgres", time.Second, func(d time.Duration) {
+		sleeps = append(sleeps, d)
+	}, log.New(buf, "", 0))
+
+	assert.Nil(t, err)
+	assert.Equal(t, []time.Duration{}, sleeps)
+	assert.Equal(t, "", buf.String())
+}
+
+func TestRetryConnectBackoff(t *testing.T) {
+	buf := new(bytes.Buffer)
+	sleeps := []time.Duration{}
+	attempts := 0
+
+	err := retryConnect(func() error {
+		attempts++
+		if attempts < 6 {
+			return errors.New("connection refused")
+		}
+		return nil
+	}, "postgres", time.Minute, func(d time.Duration) {
+		sleeps = append(sleeps, d)
+	}, log.New(buf, "", 0))
+
+	assert.Nil(t, err)
+	assert.Equal(t, []time.Duration{
+		250 * time.Millisecond,
+		500 * time.Millisecond,
+		time.Second,
+		2 * time.Second,
+		4 * time.Second,
+	}, sleeps)
+	assert.Equal(t, 5, strings.Count(buf.String(), "connection refused"))
+}
+
+func TestRetryConnectBackoffCapped(t *testing.T) {
+	sleeps := []time.Duration{}
+
+	retryConnect(func() error {
+		return errors.New("connection refused")
+	}, "postgres", 30*time.Second, func(d time.Duration) {
+		sleeps = append(sleeps, d)
+	}, log.New(new(bytes.Buffer), "", 0))
+
+	assert.Equal(t, connectRetryMax, sleeps[len(sleeps)-1])
+}
+
+func TestRetryConnectTimeout(t *testing.T) {
+	var waited time.Duration
+
+	err := retryConnect(func() error {
+		return errors.New("connection refused")
+	}, "postgres", 2*time.Second, func(d time.Duration) {
+		waited += d
+	}, log.New(new(bytes.Buffer), "", 0))
+
+	if !assert.NotNil(t, err) {
+		return
+	}
+	assert.True(t, waited <= 2*time.Second)
+	assert.Equal(t,
+		"Could not connect to the postgres database after 4 attempt(s) over 1.75s, check the db settings: connection refused",
+		err.Error())
+}
+
+// Expect the schema check to find the given columns of each table
+func expectSchema(columns map[string][]string) {
+	tables := []string{}
+	for table := range expectedSchema {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	for _, table := range tables {
+		rows := sqlmock.NewRows([]string{"column_name"})
+		for _, column := range columns[table] {
+			rows.AddRow(column)
+		}
+		sqlmock.ExpectQuery(`SELECT column_name FROM information_schema.columns`).
+			WithArgs(table).
+			WillReturnRows(rows)
+	}
+}
+
+func TestConnectPgDbService(t *testing.T) {
+	opts := DbOptions{
+		MaxOpenConns:    4,
+		MaxIdleConns:    2,
+		ConnMaxLifetime: time.Minute,
+		ConnectTimeout:  time.Second,
+	}
+
+	columns := map[string][]string{
+		"user":             append(strings.Split(UserColumns, ", "), "sync_version", "created"),
+		"person":           strings.Split(PersonColumns, ", "),
+		"person_tombstone": {"id", "user_id", "version"},
+
+		"person_tag":           {"id", "person_id", "tag_id"},
+		"location":             {"id", "person_id", "address", "geog"},
+		"person_tag_tombstone": {"id", "user_id", "version"},
+		"location_tombstone":   {"id", "user_id", "version"},
+	}
+	expectSchema(columns)
+
+	s, err := ConnectPgDbService("mock", "", opts, log.New(new(bytes.Buffer), "", 0))
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, 4, s.db.Stats().MaxOpenConnections)
+	assert.NotNil(t, s.stmts.getUser)
+	assert.NotNil(t, s.stmts.createPerson)
+}
+
+func TestConnectPgDbServiceSchemaMismatch(t *testing.T) {
+	expectSchema(map[string][]string{
+		"user": {"id", "email", "name"},
+	})
+
+	s, err := ConnectPgDbService("mock", "", DbOptions{}, log.New(new(bytes.Buffer), "", 0))
+	assert.Nil(t, s)
+	if !assert.NotNil(t, err) {
+		return
+	}
+	assert.Equal(t, `Database schema does not match what the server expects:
+  table "location" is missing
+  table "location_tombstone" is missing
+  table "person" is missing
+  table "person_tag" is missing
+  table "person_tag_tombstone" is missing
+  table "person_tombstone" is missing
+  table "user" is missing column(s): pwhash, is_active, is_superuser, apikey, sync_version`, err.Error())
+}
+
+func TestPgWithTxCommit(t *testing.T) {
+	pgdbs := NewPgDbService("mock", "")
+
+	expectNextSyncVersion(1, 1)
+	sqlmock.ExpectQuery(`INSERT INTO "person"`).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	sqlmock.ExpectCommit()
+
+	err := pgdbs.WithTx(context.Background(), func(tx DbService) error {
+		assert.NotEqual(t, pgdbs, tx)
+		_, err := tx.CreatePerson(context.Background(), 1, "Test Person", hstore.Hstore{}, sql.NullInt64{})
+		return err
+	})
+	assert.Nil(t, err)
+}
+
+func TestPgWithTxRollback(t *testing.T) {
+	pgdbs := NewPgDbService("mock", "")
+	failed := errors.New("failed")
+
+	sqlmock.ExpectBegin()
+	sqlmock.ExpectRollback()
+
+	err := pgdbs.WithTx(context.Background(), func(tx DbService) error {
+		return failed
+	})
+	assert.Equal(t, failed, err)
+
+	sqlmock.ExpectBegin()
+	sqlmock.ExpectRollback()
+
+	assert.Panics(t, func() {
+		pgdbs.WithTx(context.Background(), func(tx DbService) error {
+			panic("failed")
+		})
+	})
+}
+
+func TestPgWithTxBeginError(t *testing.T) {
+	pgdbs := NewPgDbService("mock", "")
+	called := false
+
+	sqlmock.ExpectBegin().WillReturnError(errors.New("begin failed"))
+
+	err := pgdbs.WithTx(context.Background(), func(tx DbService) error {
+		called = true
+		return nil
+	})
+	assert.NotNil(t, err)
+	assert.False(t, called)
+}
+
+func TestConnectPgDbServiceUnknownDriver(t *testing.T) {
+	s, err := ConnectPgDbService("nodriver", "", DbOptions{}, log.New(new(bytes.Buffer), "", 0))
+	assert.Nil(t, s)
+	assert.NotNil(t, err)
+}
+
+/*
+Tables used by DbServiceConformance against Postgres
+
+Created as temporary tables on a single connection, so they shadow any
+real tables and disappear when the test ends
+*/
+const testPgSchema = `
+CREATE EXTENSION IF NOT EXISTS hstore;
+CREATE TEMPORARY TABLE "user" (
+    id serial PRIMARY KEY,
+    email character varying(254) NOT NULL CONSTRAINT uq_user_email UNIQUE,
+    pwhash text NOT NULL,
+    name character varying(45) NOT NULL,
+    is_active boolean NOT NULL,
+    is_superuser boolean NOT NULL,
+    apikey character varying(40) NOT NULL,
+    sync_version bigint DEFAULT 0 NOT NULL
+);
+CREATE TEMPORARY TABLE person (
+    id serial PRIMARY KEY,
+    user_id integer NOT NULL REFERENCES "user"(id),
+    name character varying(45) NOT NULL,
+    meta hstore DEFAULT ''::hstore NOT NULL,
+    color integer,
+    version bigint DEFAULT 0 NOT NULL,
+    created_version bigint DEFAULT 0 NOT NULL,
+    CONSTRAINT uq_person_name_user_id UNIQUE (user_id, name)
+);
+CREATE TEMPORARY TABLE person_tombstone (
+    id integer PRIMARY KEY,
+    user_id integer NOT NULL REFERENCES "user"(id),
+    version bigint NOT NULL
+);
+CREATE TEMPORARY TABLE person_tag (
+    id serial PRIMARY KEY,
+    person_id integer NOT NULL REFERENCES person(id),
+    tag_id integer NOT NULL
+);
+CREATE TEMPORARY TABLE location (
+    id serial PRIMARY KEY,
+    person_id integer NOT NULL REFERENCES person(id),
+    address character varying(512) NOT NULL
+);
+CREATE TEMPORARY TABLE person_tag_tombstone (
+    id integer PRIMARY KEY,
+    user_id integer NOT NULL REFERENCES "user"(id),
+    version bigint NOT NULL
+);
+CREATE TEMPORARY TABLE location_tombstone (
+    id integer PRIMARY KEY,
+    user_id integer NOT NULL REFERENCES "user"(id),
+    version bigint NOT NULL
+);
+`
+
+/*
+Run the conformance suite against a local Postgres
+
+Connects with PEOPLE_TEST_DB_CREDS, or to people_test on localhost by
+default. Skipped when no server is reachable
+*/
+func TestPgDbServiceConformance(t *testing.T) {
+	creds := os.Getenv("PEOPLE_TEST_DB_CREDS")
+	if creds == "" {
+		creds = "host=localhost dbname=people_test sslmode=disable connect_timeout=2"
+	}
+
+	db, err := sqlx.Connect("postgres", creds)
+	if err != nil {
+		t.Skipf("Postgres not available: %s", err)
+	}
+	defer db.Close()
+
+	// Temporary tables only exist on the connection that made them
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(testPgSchema); err != nil {
+		t.Skipf("Could not create test tables: %s", err)
+	}
+
+	s := &pgDbService{db: db}
+	if err := s.CheckSchema(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.prepare(); err != nil {
+		t.Fatal(err)
+	}
+
+	DbServiceConformance(t, func(t *testing.T) DbService {
+		db.MustExec(`TRUNCATE "user", person, person_tombstone, person_tag_tombstone, location_tombstone RESTART IDENTITY CASCADE`)
+		return s
+	})
+}
+
+func TestDbSystem(t *testing.T) {
+	assert.Equal(t, DbSystemPostgres, dbSystem("postgres"))
+	assert.Equal(t, DbSystemSqlite, dbSystem(sqliteDriver))
+}
+
+// A transaction only binds the statements it runs, once each
+func TestPgDbServiceWithTxBindsOnUse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "people-tx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, stmts := newTestReplicaDb(t, dir, "Primary")
+	defer db.Close()
+	s := &pgDbService{db: db, stmts: stmts}
+	ctx := context.Background()
+
+	err = s.WithTx(ctx, func(tx DbService) error {
+		user, err := tx.GetUser(ctx, "test@example.com")
+		if err != nil {
+			return err
+		}
+		user.Name = "Renamed"
+		if err := tx.UpdateUser(ctx, user); err != nil {
+			return err
+		}
+		if _, err := tx.GetUser(ctx, "test@example.com"); err != nil {
+			return err
+		}
+
+		bound := tx.(*pgDbService).stmts.bound
+		assert.Len(t, bound, 2)
+		assert.Contains(t, bound, stmts.getUser)
+		assert.Contains(t, bound, stmts.updateUser)
+		return nil
+	})
+	assert.Nil(t, err)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"code.google.com/p/go-uuid/uuid"
+	"fmt"
+	"net/http"
+)
+
+const (
+	RequestIdHeader = "X-Request-ID"
+	// Longer incoming request IDs are replaced
+	MaxRequestIdLength = 128
+
+	// Sent for bodies over a route's limit
+	BodyTooLargeError = "Request body is larger than %d bytes"
+	// What http.MaxBytesReader fails with past its limit
+	maxBytesError = "http: request body too large"
+)
+
+/*
+Error codes sent in ApiError.Code
+
+These are part of the API contract: clients match on them, so existing
+codes never change meaning. Messages may be reworded at any time
+*/
+const (
+	ErrCodeUnauthorized         = "unauthorized"
+	ErrCodeInvalidAuthParams    = "invalid_auth_params"
+	ErrCodeParamsRequired       = "params_required"
+	ErrCodeInvalidCredentials   = "invalid_credentials"
+	ErrCodeInvalidUser          = "invalid_user"
+	ErrCodeIncorrectApiKey      = "incorrect_api_key"
+	ErrCodeUserDisabled         = "user_disabled"
+	ErrCodeContentType          = "unsupported_content_type"
+	ErrCodeMalformedJson        = "malformed_json"
+	ErrCodeMalformedCsv         = "malformed_csv"
+	ErrCodeValidation           = "validation_failed"
+	ErrCodeInvalidPath          = "invalid_path"
+	ErrCodeInvalidId            = "invalid_id"
+	ErrCodeForbidden            = "forbidden"
+	ErrCodeNotFound             = "not_found"
+	ErrCodeMethodNotAllowed     = "method_not_allowed"
+	ErrCodeConflict             = "conflict"
+	ErrCodePreconditionFailed   = "precondition_failed"
+	ErrCodePreconditionRequired = "precondition_required"
+	ErrCodeBatchAborted         = "batch_aborted"
+	ErrCodeBodyTooLarge         = "body_too_large"
+	ErrCodeInvalidSyncToken     = "invalid_sync_token"
+	ErrCodeSyncTokenExpired     = "sync_token_expired"
+	ErrCodeInternal             = "internal_error"
+	ErrCodeTimeout              = "timeout"
+	ErrCodeUnavailable          = "unavailable"
+)
+
+/*
+Body of every error response, inside an "error" object:
+
+	{"error": {"code": "validation_failed", "message": "Invalid User data",
+	 "errors": {"email": "Email cannot be empty"}, "request_id": "..."}}
+
+Errors is only present for validation failures, keyed by field, and
+Detail only for server errors when the debug setting is on
+*/
+type ApiError struct {
+	Code      string     `json:"code"`
+	Message   string     `json:"message"`
+	Errors    JsonErrors `json:"errors,omitempty"`
+	RequestId string     `json:"request_id"`
+	// What went wrong internally, only sent in debug mode
+	Detail string `json:"detail,omitempty"`
+}
+
+type apiErrorEnvelope struct {
+	Error ApiError `json:"error"`
+}
+
+/*
+The ID of the request, as sent by the client in X-Request-ID
+
+Requests without a usable one are given a new ID. Either way it is
+echoed in the response header, so clients can quote it when reporting a
+problem
+*/
+func requestId(rw http.ResponseWriter, req *http.Request) string {
+	id := req.Header.Get(RequestIdHeader)
+	if !validRequestId(id) {
+		id = uuid.New()
+		req.Header.Set(RequestIdHeader, id)
+	}
+	rw.Header().Set(RequestIdHeader, id)
+	return id
+}
+
+// Whether err is from reading past the limit of an http.MaxBytesReader
+func bodyTooLarge(err error) bool {
+	return err != nil && err.Error() == maxBytesError
+}
+
+// Non-empty, not too long, and printable ASCII without spaces
+func validRequestId(id string) bool {
+	if id == "" || len(id) > MaxRequestIdLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// Respond with status and an ApiError
+func writeError(rw http.ResponseWriter, req *http.Request, status int, code, message string) {
+	writeApiError(rw, req, status, ApiError{Code: code, Message: message})
+}
+
+// Respond 400 Bad Request with the per-field problems in errors
+func writeValidationError(rw http.ResponseWriter, req *http.Request, message string, errors JsonErrors) {
+	writeApiError(rw, req, http.StatusBadRequest, ApiError{
+		Code:    ErrCodeValidation,
+		Message: message,
+		Errors:  errors,
+	})
+}
+
+func writeApiError(rw http.ResponseWriter, req *http.Request, status int, apiErr ApiError) {
+	apiErr.RequestId = requestId(rw, req)
+
+	rw.Header().Set("Content-Type", JsonContentType)
+	rw.Header().Set("X-Content-Type-Options", "nosniff")
+	rw.WriteHeader(status)
+	fmt.Fprint(rw, Jsonify(apiErrorEnvelope{apiErr}))
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestId(t *testing.T) {
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/user", nil)
+	req.Header.Set(RequestIdHeader, "abc-123")
+
+	assert.Equal(t, "abc-123", requestId(rec, req))
+	assert.Equal(t, "abc-123", rec.Header().Get(RequestIdHeader))
+
+	// A new one is made once, then kept for the request
+	rec = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/user", nil)
+	id := requestId(rec, req)
+	assert.Len(t, id, 36)
+	assert.Equal(t, id, requestId(rec, req))
+	assert.Equal(t, id, rec.Header().Get(RequestIdHeader))
+}
+
+func TestWriteError(t *testing.T) {
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/person/1", nil)
+	req.Header.Set(RequestIdHeader, "abc-123")
+
+	writeError(rec, req, http.StatusNotFound, ErrCodeNotFound, PersonNotFound)
+
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Equal(t, JsonContentType, rec.Header().Get("Content-Type"))
+	assert.Equal(t, `{
+  "error": {
+    "code": "not_found",
+    "message": "Person not found",
+    "request_id": "abc-123"
+  }
+}`, rec.Body.String())
+}
+
+func TestWriteValidationError(t *testing.T) {
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/person", nil)
+
+	writeValidationError(rec, req, PersonInvalid, JsonErrors{"name": PersonNameEmpty})
+
+	apiErr := assertApiError(t, rec, http.StatusBadRequest, ErrCodeValidation, PersonInvalid)
+	assert.Equal(t, JsonErrors{"name": PersonNameEmpty}, apiErr.Errors)
+}
+
+func TestRequestIdReplacesInvalid(t *testing.T) {
+	for _, id := range []string{"has space", "new\nline", "café", strings.Repeat("a", MaxRequestIdLength+1)} {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/user", nil)
+		req.Header.Set(RequestIdHeader, id)
+
+		assert.NotEqual(t, id, requestId(rec, req))
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/gocraft/web"
+	"net/http"
+	"strings"
+)
+
+const (
+	ETagHeader        = "ETag"
+	IfMatchHeader     = "If-Match"
+	IfNoneMatchHeader = "If-None-Match"
+
+	// Matches any current representation in If-Match and If-None-Match
+	etagAny        = "*"
+	etagWeakPrefix = "W/"
+	// Hex digits of the body hash kept in an ETag
+	etagLength = 32
+)
+
+/*
+Strong ETag of a JSON response body
+
+The hash of the body itself, so it changes whenever any field sent to
+the client does, and needs nothing stored
+*/
+func bodyETag(body string) string {
+	sum := sha256.Sum256([]byte(body))
+	return `"` + hex.EncodeToString(sum[:])[:etagLength] + `"`
+}
+
+// Strong ETag of data, as jsonResponse would send it
+func jsonETag(data interface{}) string {
+	return bodyETag(Jsonify(data))
+}
+
+/*
+Whether an If-Match or If-None-Match header value matches etag
+
+header is "*" or a comma separated list of ETags. The strong comparison
+If-Match uses never matches a weak ETag, while the weak one of
+If-None-Match ignores the W/ prefix
+*/
+func etagMatches(header, etag string, weak bool) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == etagAny {
+			return true
+		}
+		if weak {
+			tag = strings.TrimPrefix(tag, etagWeakPrefix)
+		}
+		if tag != "" && tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Respond with data as JSON and its ETag
+
+A client sending an ETag it already has in If-None-Match gets 304 Not
+Modified without a body instead
+*/
+func jsonResponseETag(rw web.ResponseWriter, req *web.Request, data interface{}) {
+	body := Jsonify(data)
+	etag := bodyETag(body)
+	rw.Header().Set(ETagHeader, etag)
+
+	if etagMatches(req.Header.Get(IfNoneMatchHeader), etag, true) {
+		rw.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	rw.Header().Set("Content-Type", JsonContentType)
+	fmt.Fprint(rw, body)
+}
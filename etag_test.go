@@ -0,0 +1,66 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+func TestBodyETag(t *testing.T) {
+	etag := bodyETag(`{"name":"Test"}`)
+	assert.Len(t, etag, etagLength+2)
+	assert.Equal(t, `"`, etag[:1])
+	assert.Equal(t, etag, bodyETag(`{"name":"Test"}`))
+	assert.NotEqual(t, etag, bodyETag(`{"name":"Changed"}`))
+	assert.Equal(t, bodyETag(Jsonify(newTestUser())), jsonETag(newTestUser()))
+}
+
+func TestETagMatches(t *testing.T) {
+	etag := `"abc"`
+	tests := []struct {
+		header string
+		weak   bool
+		match  bool
+	}{
+		{`"abc"`, false, true},
+		{`"abc"`, true, true},
+		{`"other", "abc"`, false, true},
+		{`"other"`, false, false},
+		{`W/"abc"`, true, true},
+		{`W/"abc"`, false, false},
+		{`*`, false, true},
+		{`*`, true, true},
+		{`abc`, false, false},
+		{``, false, false},
+		{``, true, false},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.match, etagMatches(test.header, etag, test.weak), test.header)
+	}
+}
+
+func TestJsonResponseETag(t *testing.T) {
+	person := newTestPerson(1)
+	etag := jsonETag(person)
+
+	rw, req, rec := mockHandlerParams("GET", "", "")
+	jsonResponseETag(rw, req, person)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, etag, rec.Header().Get(ETagHeader))
+	assert.Equal(t, JsonContentType, rec.Header().Get("Content-Type"))
+	assert.Equal(t, Jsonify(person), rec.Body.String())
+
+	rw, req, rec = mockHandlerParams("GET", "", "")
+	req.Header.Set(IfNoneMatchHeader, `"stale", `+etag)
+	jsonResponseETag(rw, req, person)
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+	assert.Equal(t, etag, rec.Header().Get(ETagHeader))
+	assert.Equal(t, "", rec.Body.String())
+
+	rw, req, rec = mockHandlerParams("GET", "", "")
+	req.Header.Set(IfNoneMatchHeader, `"stale"`)
+	jsonResponseETag(rw, req, person)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, Jsonify(person), rec.Body.String())
+}
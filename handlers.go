@@ -1,9 +1,15 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
 	"github.com/gocraft/web"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
 	"net/http"
 	"strconv"
 	"strings"
@@ -28,6 +34,38 @@ const (
 
 	// PersonCreateApi errors
 	PersonCreateError = "Error creating person"
+	PersonExistsError = "A person with this name already exists"
+
+	// UpdatePersonApi and DeletePersonApi errors
+	PersonUpdateError         = "Error updating person"
+	PersonDeleteError         = "Error deleting person"
+	PreconditionRequiredError = "If-Match is required"
+	PreconditionFailedError   = "Person was changed since it was read"
+
+	// GetPersonApi and GetPersonListApi errors
+	InvalidPathError = "Invalid Path"
+	InvalidIdError   = "id must be an integer"
+	PersonNotFound   = "Person not found"
+	PeopleNotFound   = "No people found"
+
+	// Deadline and availability errors
+	RequestTimedOutError    = "Request timed out"
+	ServiceUnavailableError = "Service unavailable"
+
+	// Postgres query_canceled, raised when statement_timeout is hit
+	pqQueryCanceled = "57014"
+	// Postgres unique_violation
+	pqUniqueViolation = "23505"
+)
+
+var (
+	// Returned from the CreateUserApi unit of work to roll it back
+	errUserExists = errors.New(UserExistsError)
+	// Returned from the UpdatePersonApi and DeletePersonApi units of work to roll them back
+	errPersonNotFound     = errors.New(PersonNotFound)
+	errPreconditionFailed = errors.New(PreconditionFailedError)
+	// An operation of BulkPersonApi without if_match
+	errPreconditionRequired = errors.New(PreconditionRequiredError)
 )
 
 // Basic Context available to all handlers
@@ -41,6 +79,11 @@ type AuthContext struct {
 	User *User
 }
 
+// Context of the administration API, whose User is a superuser
+type AdminContext struct {
+	*AuthContext
+}
+
 // Expected format of JSON data for creating a User
 type UserCreate struct {
 	Email    string `json:"email"`
@@ -102,7 +145,7 @@ type PersonJSON struct {
 	UserId int               `json:"user_id,omitempty"`
 	Name   string            `json:"name"`
 	Meta   map[string]string `json:"meta"`
-	Color  json.RawMessage   `json:"color"`
+	Color  json.RawMessage   `json:"color" openapi:"integer,nullable"`
 }
 
 func jsonResponse(rw web.ResponseWriter, data interface{}) {
@@ -110,6 +153,65 @@ func jsonResponse(rw web.ResponseWriter, data interface{}) {
 	fmt.Fprint(rw, Jsonify(data))
 }
 
+/*
+Whether err means the request ran out of time
+
+True for a deadline passed anywhere on the way down, including a
+statement cancelled by the server's statement_timeout
+*/
+func isTimeout(req *web.Request, err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || req.Context().Err() == context.DeadlineExceeded {
+		return true
+	}
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == pqQueryCanceled
+}
+
+// Whether err means the request was abandoned or the database could not be reached
+func isUnavailable(err error) bool {
+	return errors.Is(err, context.Canceled) || isConnError(err)
+}
+
+/*
+Whether err is a write refused by a uniqueness rule, such as a person's name
+
+Each backend reports it its own way
+*/
+func isConflict(err error) bool {
+	var constraintErr *ConstraintError
+	var pqErr *pq.Error
+	var sqliteErr sqlite3.Error
+	switch {
+	case errors.As(err, &constraintErr):
+		return constraintErr.Constraint == UqPersonNameUserId || constraintErr.Constraint == UqUserEmail
+	case errors.As(err, &pqErr):
+		return pqErr.Code == pqUniqueViolation
+	case errors.As(err, &sqliteErr):
+		return sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+	}
+	return false
+}
+
+/*
+Respond 504 Gateway Timeout or 503 Service Unavailable if err calls for it
+
+Returns false without writing anything for any other error, which the
+handler reports as usual
+*/
+func writeUnavailable(rw web.ResponseWriter, req *web.Request, err error) bool {
+	switch {
+	case err == nil:
+		return false
+	case isTimeout(req, err):
+		writeError(rw, req.Request, http.StatusGatewayTimeout, ErrCodeTimeout, RequestTimedOutError)
+	case isUnavailable(err):
+		writeError(rw, req.Request, http.StatusServiceUnavailable, ErrCodeUnavailable, ServiceUnavailableError)
+	default:
+		return false
+	}
+	return true
+}
+
 /*
 Handler to authenticate a user.
 
@@ -127,35 +229,55 @@ func (c *Context) ApiAuth(rw web.ResponseWriter, req *web.Request) {
 	emails, email_ok := form["email"]
 	passwords, password_ok := form["password"]
 	if !(email_ok && password_ok) {
-		status := http.StatusBadRequest
-		rw.WriteHeader(status)
-		fmt.Fprint(rw, ParamsRequired)
+		writeError(rw, req.Request, http.StatusBadRequest, ErrCodeParamsRequired, ParamsRequired)
 		return
 	}
 
 	email := emails[0]
 	password := passwords[0]
 
-	user, err := c.DB.GetUser(email)
+	user, err := c.DB.GetUser(req.Context(), email)
+	if writeUnavailable(rw, req, err) {
+		return
+	}
 	authed := err == nil && user != nil && user.CheckPassword(password)
 	if authed {
 		if user.IsActive {
+			authAttemptsTotal.Inc(AuthMethodPassword, AuthSuccess)
 			jsonResponse(rw, user)
 		} else {
-			http.Error(rw, "User disabled", http.StatusForbidden)
+			authAttemptsTotal.Inc(AuthMethodPassword, AuthFailure)
+			writeError(rw, req.Request, http.StatusForbidden, ErrCodeUserDisabled, InactiveUser)
 		}
 	} else {
-		http.Error(rw, InvalidCredentials, http.StatusForbidden)
+		authAttemptsTotal.Inc(AuthMethodPassword, AuthFailure)
+		writeError(rw, req.Request, http.StatusForbidden, ErrCodeInvalidCredentials, InvalidCredentials)
 	}
 }
 
+/*
+Handler for monitoring counters
+
+Serves every expvar variable as JSON, including the command line, so it
+is only registered on the admin listener
+*/
+func (c *Context) DebugVarsApi(rw web.ResponseWriter, req *web.Request) {
+	expvar.Handler().ServeHTTP(rw, req.Request)
+}
+
+// Handler for Prometheus, serving every metric in the text format
+func (c *Context) MetricsApi(rw web.ResponseWriter, req *web.Request) {
+	rw.Header().Set("Content-Type", MetricsContentType)
+	defaultMetrics.WriteTo(rw)
+}
+
 /*
 Handler for the GET User API
 
 Returns a JSON representation of the currently authenticated User
 */
 func (c *AuthContext) GetUserApi(rw web.ResponseWriter, req *web.Request) {
-	jsonResponse(rw, c.User)
+	jsonResponseETag(rw, req, c.User)
 }
 
 /*
@@ -168,7 +290,7 @@ Otherwise, if creation is successful return 201 Created
 func (c *Context) CreateUserApi(rw web.ResponseWriter, req *web.Request) {
 	ct, ctok := req.Header["Content-Type"]
 	if !ctok || len(ct) < 1 || (len(ct) >= 1 && ct[0] != "application/json") {
-		http.Error(rw, JsonContentTypeError, http.StatusBadRequest)
+		writeError(rw, req.Request, http.StatusBadRequest, ErrCodeContentType, JsonContentTypeError)
 		return
 	}
 
@@ -176,30 +298,55 @@ func (c *Context) CreateUserApi(rw web.ResponseWriter, req *web.Request) {
 	newUser := new(UserCreate)
 	err := dec.Decode(&newUser)
 	if err != nil {
-		http.Error(rw, JsonMalformedError, http.StatusBadRequest)
+		writeError(rw, req.Request, http.StatusBadRequest, ErrCodeMalformedJson, JsonMalformedError)
 		return
 	}
 
 	if !newUser.Validate() {
-		http.Error(rw, Jsonify(newUser.Errors()), http.StatusBadRequest)
+		writeValidationError(rw, req.Request, InvalidUserDataError, newUser.Errors())
 		return
 	}
 
-	if existing, _ := c.DB.GetUser(newUser.Email); existing != nil {
-		http.Error(rw, UserExistsError, http.StatusConflict)
+	// Hashed first, so the transaction is not held open while bcrypt runs
+	pwhash := GeneratePasswordHash(newUser.Password, c.DB.PasswordCost())
+
+	// The check answers most duplicates without attempting the insert. Two
+	// requests can both pass it before either inserts, and then the unique
+	// email constraint refuses the second
+	var user *User
+	err = c.DB.WithTx(req.Context(), func(tx DbService) error {
+		existing, err := tx.GetUser(req.Context(), newUser.Email)
+		if isTimeout(req, err) || isUnavailable(err) {
+			return err
+		}
+		if existing != nil {
+			return errUserExists
+		}
+
+		user, err = tx.CreateUser(
+			req.Context(),
+			newUser.Email,
+			pwhash,
+			newUser.Name,
+			GenerateApiKey(),
+			defaultActive,
+			defaultSuperuser)
+		return err
+	})
+
+	if writeUnavailable(rw, req, err) {
+		return
+	}
+	if err == errUserExists || isConflict(err) {
+		writeError(rw, req.Request, http.StatusConflict, ErrCodeConflict, UserExistsError)
+		return
+	}
+	if verr, ok := err.(ValidationError); ok {
+		writeValidationError(rw, req.Request, verr.Error(), verr.JsonErrors())
 		return
 	}
-
-	user, err := c.DB.CreateUser(
-		newUser.Email,
-		GeneratePasswordHash(newUser.Password, c.DB.PasswordCost()),
-		newUser.Name,
-		GenerateApiKey(),
-		defaultActive,
-		defaultSuperuser)
-
 	if err != nil {
-		http.Error(rw, UserCreateError, http.StatusInternalServerError)
+		writeError(rw, req.Request, http.StatusInternalServerError, ErrCodeInternal, UserCreateError)
 		return
 	}
 
@@ -207,34 +354,47 @@ func (c *Context) CreateUserApi(rw web.ResponseWriter, req *web.Request) {
 	jsonResponse(rw, user)
 }
 
-/*
-Handler for GET Person API
-
-Returns a single Person as JSON, or 404 if the user does not have access to that Person
-*/
-func (c *AuthContext) GetPersonApi(rw web.ResponseWriter, req *web.Request) {
+// The person id in the path, or false once a 400 has been written
+func personIdParam(rw web.ResponseWriter, req *web.Request) (int, bool) {
 	idStr, idExists := req.PathParams["id"]
 
 	if !idExists {
-		http.Error(rw, "Invalid Path", http.StatusBadRequest)
-		return
+		writeError(rw, req.Request, http.StatusBadRequest, ErrCodeInvalidPath, InvalidPathError)
+		return 0, false
 	}
 
 	id, err := strconv.Atoi(idStr)
 
 	if err != nil {
-		http.Error(rw, "id must be an integer", http.StatusBadRequest)
+		writeError(rw, req.Request, http.StatusBadRequest, ErrCodeInvalidId, InvalidIdError)
+		return 0, false
+	}
+
+	return id, true
+}
+
+/*
+Handler for GET Person API
+
+Returns a single Person as JSON, or 404 if the user does not have access to that Person
+*/
+func (c *AuthContext) GetPersonApi(rw web.ResponseWriter, req *web.Request) {
+	id, ok := personIdParam(rw, req)
+	if !ok {
 		return
 	}
 
-	person, err := c.DB.GetPerson(c.User.Id, id)
+	person, err := c.DB.GetPerson(req.Context(), c.User.Id, id)
 
+	if writeUnavailable(rw, req, err) {
+		return
+	}
 	if err != nil {
-		http.Error(rw, "Person not found", http.StatusNotFound)
+		writeError(rw, req.Request, http.StatusNotFound, ErrCodeNotFound, PersonNotFound)
 		return
 	}
 
-	jsonResponse(rw, person)
+	jsonResponseETag(rw, req, person)
 }
 
 /*
@@ -243,14 +403,17 @@ Handler for GET Person List API
 Returns all the Person objects associated with the current User
 */
 func (c *AuthContext) GetPersonListApi(rw web.ResponseWriter, req *web.Request) {
-	people, err := c.DB.GetPeople(c.User.Id)
+	people, err := c.DB.GetPeople(req.Context(), c.User.Id)
 
+	if writeUnavailable(rw, req, err) {
+		return
+	}
 	if err != nil {
-		http.Error(rw, "No people found", http.StatusNotFound)
+		writeError(rw, req.Request, http.StatusNotFound, ErrCodeNotFound, PeopleNotFound)
 		return
 	}
 
-	jsonResponse(rw, people)
+	jsonResponseETag(rw, req, people)
 }
 
 /*
@@ -261,7 +424,7 @@ Takes a JSON representation of a Person and creates it for the user logged in.
 func (c *AuthContext) CreatePersonApi(rw web.ResponseWriter, req *web.Request) {
 	ct, ctok := req.Header["Content-Type"]
 	if !ctok || len(ct) < 1 || (len(ct) >= 1 && ct[0] != "application/json") {
-		http.Error(rw, JsonContentTypeError, http.StatusBadRequest)
+		writeError(rw, req.Request, http.StatusBadRequest, ErrCodeContentType, JsonContentTypeError)
 		return
 	}
 
@@ -269,26 +432,181 @@ func (c *AuthContext) CreatePersonApi(rw web.ResponseWriter, req *web.Request) {
 	newPerson := new(Person)
 	err := dec.Decode(&newPerson)
 	if err != nil {
-		http.Error(rw, JsonMalformedError, http.StatusBadRequest)
+		writeError(rw, req.Request, http.StatusBadRequest, ErrCodeMalformedJson, JsonMalformedError)
 		return
 	}
 
 	if !newPerson.Validate() {
-		http.Error(rw, Jsonify(newPerson.Errors()), http.StatusBadRequest)
+		writeValidationError(rw, req.Request, PersonInvalid, newPerson.Errors())
 		return
 	}
 
 	person, err := c.DB.CreatePerson(
+		req.Context(),
 		c.User.Id,
 		newPerson.Name,
 		newPerson.Meta,
 		newPerson.Color)
 
-	if err != nil {
-		http.Error(rw, PersonCreateError, http.StatusInternalServerError)
+	if writePersonWriteError(rw, req, err, PersonCreateError) {
 		return
 	}
 
 	rw.WriteHeader(http.StatusCreated)
 	jsonResponse(rw, person)
 }
+
+/*
+Handler for PUT Person API
+
+Takes a JSON representation of a Person and saves its name, meta and
+color over the one with the id in the path. If-Match must hold the ETag
+the client last read the person with: if the person changed since,
+return 412 Precondition Failed rather than overwrite someone else's edit
+*/
+func (c *AuthContext) UpdatePersonApi(rw web.ResponseWriter, req *web.Request) {
+	id, ok := personIdParam(rw, req)
+	if !ok {
+		return
+	}
+
+	ifMatch, ok := ifMatchHeader(rw, req)
+	if !ok {
+		return
+	}
+
+	ct, ctok := req.Header["Content-Type"]
+	if !ctok || len(ct) < 1 || (len(ct) >= 1 && ct[0] != "application/json") {
+		writeError(rw, req.Request, http.StatusBadRequest, ErrCodeContentType, JsonContentTypeError)
+		return
+	}
+
+	dec := json.NewDecoder(req.Body)
+	person := new(Person)
+	err := dec.Decode(&person)
+	if err != nil {
+		writeError(rw, req.Request, http.StatusBadRequest, ErrCodeMalformedJson, JsonMalformedError)
+		return
+	}
+
+	if !person.Validate() {
+		writeValidationError(rw, req.Request, PersonInvalid, person.Errors())
+		return
+	}
+	person.Id = id
+	person.UserId = c.User.Id
+
+	// The check and the update happen together, or not at all
+	err = c.DB.WithTx(req.Context(), func(tx DbService) error {
+		if err := checkPersonETag(req, tx, c.User.Id, id, ifMatch); err != nil {
+			return err
+		}
+		return tx.UpdatePerson(req.Context(), person)
+	})
+
+	if writePersonWriteError(rw, req, err, PersonUpdateError) {
+		return
+	}
+
+	rw.Header().Set(ETagHeader, jsonETag(person))
+	jsonResponse(rw, person)
+}
+
+/*
+Handler for DELETE Person API
+
+Deletes the person with the id in the path, given the ETag it was last
+read with in If-Match like the PUT Person API. Returns 204 No Content
+*/
+func (c *AuthContext) DeletePersonApi(rw web.ResponseWriter, req *web.Request) {
+	id, ok := personIdParam(rw, req)
+	if !ok {
+		return
+	}
+
+	ifMatch, ok := ifMatchHeader(rw, req)
+	if !ok {
+		return
+	}
+
+	err := c.DB.WithTx(req.Context(), func(tx DbService) error {
+		if err := checkPersonETag(req, tx, c.User.Id, id, ifMatch); err != nil {
+			return err
+		}
+		return tx.DeletePerson(req.Context(), c.User.Id, id)
+	})
+
+	if writePersonWriteError(rw, req, err, PersonDeleteError) {
+		return
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// The If-Match header, required for changes, or false once a 428 has been written
+func ifMatchHeader(rw web.ResponseWriter, req *web.Request) (string, bool) {
+	ifMatch := req.Header.Get(IfMatchHeader)
+	if ifMatch == "" {
+		writeError(rw, req.Request, http.StatusPreconditionRequired, ErrCodePreconditionRequired, PreconditionRequiredError)
+		return "", false
+	}
+	return ifMatch, true
+}
+
+/*
+Check in tx that the person still has an ETag in ifMatch
+
+Returns errPersonNotFound or errPreconditionFailed to roll tx back
+*/
+func checkPersonETag(req *web.Request, tx DbService, userId, id int, ifMatch string) error {
+	if err := tx.LockPeople(req.Context(), userId); err != nil {
+		return err
+	}
+	current, err := tx.GetPerson(req.Context(), userId, id)
+	if isTimeout(req, err) || isUnavailable(err) {
+		return err
+	}
+	if err != nil {
+		return errPersonNotFound
+	}
+	if !etagMatches(ifMatch, jsonETag(current), false) {
+		return errPreconditionFailed
+	}
+	return nil
+}
+
+/*
+Respond to a failed change to a person, with message for unexpected errors
+
+Returns false without writing anything if err is nil
+*/
+func writePersonWriteError(rw web.ResponseWriter, req *web.Request, err error, message string) bool {
+	if err == nil {
+		return false
+	}
+	status, apiErr := personWriteError(req, err, message)
+	writeApiError(rw, req.Request, status, apiErr)
+	return true
+}
+
+// The status and ApiError a failed change to a person is answered with
+func personWriteError(req *web.Request, err error, message string) (int, ApiError) {
+	if verr, ok := err.(ValidationError); ok {
+		return http.StatusBadRequest, ApiError{Code: ErrCodeValidation, Message: verr.Error(), Errors: verr.JsonErrors()}
+	}
+	switch {
+	case isTimeout(req, err):
+		return http.StatusGatewayTimeout, ApiError{Code: ErrCodeTimeout, Message: RequestTimedOutError}
+	case isUnavailable(err):
+		return http.StatusServiceUnavailable, ApiError{Code: ErrCodeUnavailable, Message: ServiceUnavailableError}
+	case isConflict(err):
+		return http.StatusConflict, ApiError{Code: ErrCodeConflict, Message: PersonExistsError}
+	case err == errPersonNotFound || err == sql.ErrNoRows:
+		return http.StatusNotFound, ApiError{Code: ErrCodeNotFound, Message: PersonNotFound}
+	case err == errPreconditionFailed:
+		return http.StatusPreconditionFailed, ApiError{Code: ErrCodePreconditionFailed, Message: PreconditionFailedError}
+	case err == errPreconditionRequired:
+		return http.StatusPreconditionRequired, ApiError{Code: ErrCodePreconditionRequired, Message: PreconditionRequiredError}
+	}
+	return http.StatusInternalServerError, ApiError{Code: ErrCodeInternal, Message: message}
+}
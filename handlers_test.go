@@ -2,17 +2,26 @@ package main
 
 import (
 	"code.google.com/p/go.crypto/bcrypt"
+	"context"
 	"database/sql"
+	"database/sql/driver"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"github.com/gocraft/web"
+	"github.com/lib/pq"
 	"github.com/lib/pq/hstore"
+	"github.com/mattn/go-sqlite3"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"reflect"
 	"strconv"
 	"testing"
+	"time"
 )
 
 func TestGetUserApi(t *testing.T) {
@@ -53,12 +62,14 @@ func TestApiAuth(t *testing.T) {
 	ac, dbs := mockAuthContext(user)
 
 	dbs.Mock.On("GetUser", user.Email).Return(user, nil)
+	successes := authAttemptsTotal.Value(AuthMethodPassword, AuthSuccess)
 
 	(*AuthContext).ApiAuth(ac, rw, req)
 
 	dbs.Mock.AssertExpectations(t)
 	assert.Equal(t, rec.Code, http.StatusOK)
 	assert.Equal(t, rec.Body.String(), Jsonify(user))
+	assert.Equal(t, successes+1, authAttemptsTotal.Value(AuthMethodPassword, AuthSuccess))
 
 	ct, ctok := rec.HeaderMap["Content-Type"]
 	if !assert.True(t, ctok, "No Content-Type header") {
@@ -84,8 +95,7 @@ func TestApiAuthInvalidForm(t *testing.T) {
 		(*AuthContext).ApiAuth(ac, rw, req)
 
 		dbs.Mock.AssertNotCalled(t, "GetUser")
-		assert.Equal(t, rec.Code, http.StatusBadRequest)
-		assert.Equal(t, rec.Body.String(), ParamsRequired)
+		assertApiError(t, rec, http.StatusBadRequest, ErrCodeParamsRequired, ParamsRequired)
 	}
 }
 
@@ -108,12 +118,13 @@ func TestApiAuthNoUser(t *testing.T) {
 	ac, dbs := mockAuthContext(user)
 
 	dbs.Mock.On("GetUser", user.Email).Return(nil, errors.New("No user"))
+	failures := authAttemptsTotal.Value(AuthMethodPassword, AuthFailure)
 
 	(*AuthContext).ApiAuth(ac, rw, req)
 
 	dbs.Mock.AssertExpectations(t)
-	assert.Equal(t, rec.Code, http.StatusForbidden)
-	assert.Equal(t, rec.Body.String(), InvalidCredentials+"\n")
+	assertApiError(t, rec, http.StatusForbidden, ErrCodeInvalidCredentials, InvalidCredentials)
+	assert.Equal(t, failures+1, authAttemptsTotal.Value(AuthMethodPassword, AuthFailure))
 }
 
 func TestApiAuthWrongPassword(t *testing.T) {
@@ -139,8 +150,7 @@ func TestApiAuthWrongPassword(t *testing.T) {
 	(*AuthContext).ApiAuth(ac, rw, req)
 
 	dbs.Mock.AssertExpectations(t)
-	assert.Equal(t, rec.Code, http.StatusForbidden)
-	assert.Equal(t, rec.Body.String(), InvalidCredentials+"\n")
+	assertApiError(t, rec, http.StatusForbidden, ErrCodeInvalidCredentials, InvalidCredentials)
 }
 
 func TestApiAuthInactiveUser(t *testing.T) {
@@ -167,8 +177,7 @@ func TestApiAuthInactiveUser(t *testing.T) {
 	(*AuthContext).ApiAuth(ac, rw, req)
 
 	dbs.Mock.AssertExpectations(t)
-	assert.Equal(t, rec.Code, http.StatusForbidden)
-	assert.Equal(t, rec.Body.String(), InactiveUser+"\n")
+	assertApiError(t, rec, http.StatusForbidden, ErrCodeUserDisabled, InactiveUser)
 }
 
 func TestUserCreateFields(t *testing.T) {
@@ -419,8 +428,7 @@ func TestCreateUserApiJsonOnly(t *testing.T) {
 
 	(*Context).CreateUserApi(c, rw, req)
 
-	assert.Equal(t, rec.Code, http.StatusBadRequest)
-	assert.Equal(t, rec.Body.String(), JsonContentTypeError+"\n")
+	assertApiError(t, rec, http.StatusBadRequest, ErrCodeContentType, JsonContentTypeError)
 }
 
 // CreateUserApi does not allow invalid/malformed JSON
@@ -533,12 +541,8 @@ func TestCreateUserApiInvalidUserDataJson(t *testing.T) {
 
 		(*Context).CreateUserApi(c, rw, req)
 
-		assert.Equal(t, rec.Code, http.StatusBadRequest)
-
-		dec := json.NewDecoder(rec.Body)
-		var actualOutJson map[string]string
-		dec.Decode(&actualOutJson)
-		assert.Equal(t, actualOutJson, test.out)
+		apiErr := assertApiError(t, rec, http.StatusBadRequest, ErrCodeValidation, InvalidUserDataError)
+		assert.Equal(t, JsonErrors(test.out), apiErr.Errors)
 	}
 }
 
@@ -562,8 +566,7 @@ func TestCreateUserApiMalformedJson(t *testing.T) {
 
 		(*Context).CreateUserApi(c, rw, req)
 
-		assert.Equal(t, rec.Code, http.StatusBadRequest)
-		assert.Equal(t, rec.Body.String(), JsonMalformedError+"\n")
+		assertApiError(t, rec, http.StatusBadRequest, ErrCodeMalformedJson, JsonMalformedError)
 	}
 }
 
@@ -580,8 +583,22 @@ func TestCreateUserApiUserExists(t *testing.T) {
 
 	(*Context).CreateUserApi(c, rw, req)
 
-	assert.Equal(t, rec.Code, http.StatusConflict)
-	assert.Equal(t, rec.Body.String(), UserExistsError+"\n")
+	assertApiError(t, rec, http.StatusConflict, ErrCodeConflict, UserExistsError)
+}
+
+// Another request inserting the same email after the check is a conflict too
+func TestCreateUserApiInsertConflict(t *testing.T) {
+	newUser := UserCreate{"test@example.com", "asdf", "Test User", nil}
+	rw, req, rec := mockHandlerParams("POST", JsonContentType, Jsonify(newUser))
+
+	c, dbs := mockDbContext(nil)
+	dbs.Mock.On("GetUser", newUser.Email).Return(nil, errors.New("No user found"))
+	dbs.Mock.On("CreateUser", newUser.Email, mock.Anything, newUser.Name, mock.Anything, defaultActive, defaultSuperuser).
+		Return(nil, &ConstraintError{UqUserEmail})
+
+	(*Context).CreateUserApi(c, rw, req)
+
+	assertApiError(t, rec, http.StatusConflict, ErrCodeConflict, UserExistsError)
 }
 
 func TestCreateUserApiInsertError(t *testing.T) {
@@ -602,8 +619,23 @@ func TestCreateUserApiInsertError(t *testing.T) {
 
 	(*Context).CreateUserApi(c, rw, req)
 
-	assert.Equal(t, rec.Code, http.StatusInternalServerError)
-	assert.Equal(t, rec.Body.String(), UserCreateError+"\n")
+	assertApiError(t, rec, http.StatusInternalServerError, ErrCodeInternal, UserCreateError)
+}
+
+// Validation failures from the database service keep their field errors
+func TestCreateUserApiValidationError(t *testing.T) {
+	newUser := UserCreate{"test@example.com", "asdf", "Test User", nil}
+	rw, req, rec := mockHandlerParams("POST", JsonContentType, Jsonify(newUser))
+
+	c, dbs := mockDbContext(nil)
+	dbs.Mock.On("GetUser", newUser.Email).Return(nil, errors.New("No user found"))
+	verr := NewValidationError(UserInvalid, JsonErrors{"email": UserInvalidEmail})
+	dbs.Mock.On("CreateUser", newUser.Email, mock.Anything, newUser.Name, mock.Anything, defaultActive, defaultSuperuser).Return(nil, verr)
+
+	(*Context).CreateUserApi(c, rw, req)
+
+	apiErr := assertApiError(t, rec, http.StatusBadRequest, ErrCodeValidation, UserInvalid)
+	assert.Equal(t, JsonErrors{"email": UserInvalidEmail}, apiErr.Errors)
 }
 
 func TestCreateUserApi(t *testing.T) {
@@ -631,6 +663,7 @@ func TestCreateUserApi(t *testing.T) {
 	assert.Equal(t, rec.Body.String(), Jsonify(user))
 	assert.True(t, user.CheckPassword(userPassword))
 	assert.Len(t, user.ApiKey, 40)
+	assert.Equal(t, 1, dbs.txCount)
 }
 
 func TestGetPersonApiNoId(t *testing.T) {
@@ -647,7 +680,7 @@ func TestGetPersonApiNoId(t *testing.T) {
 	(*AuthContext).GetPersonApi(ac, rw, req)
 
 	dbs.Mock.AssertNotCalled(t, "GetPerson", userId, personId)
-	assert.Equal(t, rec.Code, http.StatusBadRequest)
+	assertApiError(t, rec, http.StatusBadRequest, ErrCodeInvalidPath, InvalidPathError)
 }
 
 func TestGetPersonApiInvalidId(t *testing.T) {
@@ -665,7 +698,7 @@ func TestGetPersonApiInvalidId(t *testing.T) {
 	(*AuthContext).GetPersonApi(ac, rw, req)
 
 	dbs.Mock.AssertNotCalled(t, "GetPerson", userId, personId)
-	assert.Equal(t, rec.Code, http.StatusBadRequest)
+	assertApiError(t, rec, http.StatusBadRequest, ErrCodeInvalidId, InvalidIdError)
 }
 
 func TestGetPersonApiNonExisting(t *testing.T) {
@@ -685,7 +718,7 @@ func TestGetPersonApiNonExisting(t *testing.T) {
 	(*AuthContext).GetPersonApi(ac, rw, req)
 
 	dbs.Mock.AssertExpectations(t)
-	assert.Equal(t, rec.Code, http.StatusNotFound)
+	assertApiError(t, rec, http.StatusNotFound, ErrCodeNotFound, PersonNotFound)
 }
 
 func TestGetPersonApi(t *testing.T) {
@@ -725,7 +758,7 @@ func TestGetPersonListApiError(t *testing.T) {
 	(*AuthContext).GetPersonListApi(ac, rw, req)
 
 	dbs.Mock.AssertExpectations(t)
-	assert.Equal(t, rec.Code, http.StatusNotFound)
+	assertApiError(t, rec, http.StatusNotFound, ErrCodeNotFound, PeopleNotFound)
 }
 
 func TestGetPersonListApiEmpty(t *testing.T) {
@@ -785,8 +818,7 @@ func TestCreatePersonApiJsonOnly(t *testing.T) {
 
 	(*AuthContext).CreatePersonApi(ac, rw, req)
 
-	assert.Equal(t, rec.Code, http.StatusBadRequest)
-	assert.Equal(t, rec.Body.String(), JsonContentTypeError+"\n")
+	assertApiError(t, rec, http.StatusBadRequest, ErrCodeContentType, JsonContentTypeError)
 }
 
 func TestCreatePersonApiMalformedJson(t *testing.T) {
@@ -804,8 +836,7 @@ func TestCreatePersonApiMalformedJson(t *testing.T) {
 		rw, req, rec := mockHandlerParams("POST", JsonContentType, test)
 		(*AuthContext).CreatePersonApi(ac, rw, req)
 
-		assert.Equal(t, rec.Code, http.StatusBadRequest)
-		assert.Equal(t, rec.Body.String(), JsonMalformedError+"\n")
+		assertApiError(t, rec, http.StatusBadRequest, ErrCodeMalformedJson, JsonMalformedError)
 	}
 }
 
@@ -846,12 +877,8 @@ func TestCreatePersonApiInvalidPerson(t *testing.T) {
 		rw, req, rec := mockHandlerParams("POST", JsonContentType, test.in)
 		(*AuthContext).CreatePersonApi(ac, rw, req)
 
-		assert.Equal(t, rec.Code, http.StatusBadRequest)
-
-		dec := json.NewDecoder(rec.Body)
-		var actualOutJson map[string]string
-		dec.Decode(&actualOutJson)
-		assert.Equal(t, actualOutJson, test.out)
+		apiErr := assertApiError(t, rec, http.StatusBadRequest, ErrCodeValidation, PersonInvalid)
+		assert.Equal(t, JsonErrors(test.out), apiErr.Errors)
 	}
 }
 
@@ -873,8 +900,7 @@ func TestCreatePersonApiInsertError(t *testing.T) {
 
 	(*AuthContext).CreatePersonApi(ac, rw, req)
 
-	assert.Equal(t, rec.Code, http.StatusInternalServerError)
-	assert.Equal(t, rec.Body.String(), PersonCreateError+"\n")
+	assertApiError(t, rec, http.StatusInternalServerError, ErrCodeInternal, PersonCreateError)
 }
 
 func TestCreatePersonApi(t *testing.T) {
@@ -887,7 +913,7 @@ func TestCreatePersonApi(t *testing.T) {
 	personColor := sql.NullInt64{1, true}
 
 	newPerson := Person{Name: personName, Meta: personMeta, Color: personColor}
-	person := &Person{personId, user.Id, personName, personMeta, personColor, nil}
+	person := &Person{personId, user.Id, personName, personMeta, personColor, 0, 0, nil}
 
 	rw, req, rec := mockHandlerParams("POST", JsonContentType, Jsonify(&newPerson))
 
@@ -901,3 +927,404 @@ func TestCreatePersonApi(t *testing.T) {
 	assert.Equal(t, rec.Code, http.StatusCreated)
 	assert.Equal(t, rec.Body.String(), Jsonify(person))
 }
+
+func TestGetPersonApiNotModified(t *testing.T) {
+	userId := 2
+	personId := 1
+	person := newTestPerson(userId)
+
+	rw, req, rec := mockHandlerParams("GET", "", "")
+	req.PathParams = map[string]string{"id": strconv.Itoa(personId)}
+	req.Header.Set(IfNoneMatchHeader, jsonETag(person))
+
+	user := newTestUser()
+	user.Id = userId
+
+	ac, dbs := mockAuthContext(user)
+
+	dbs.Mock.On("GetPerson", userId, personId).Return(person, nil)
+
+	(*AuthContext).GetPersonApi(ac, rw, req)
+
+	dbs.Mock.AssertExpectations(t)
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+	assert.Equal(t, jsonETag(person), rec.Header().Get(ETagHeader))
+	assert.Equal(t, "", rec.Body.String())
+}
+
+// The list's ETag changes when any person in it does
+func TestGetPersonListApiETag(t *testing.T) {
+	userId := 1
+	pp := []Person{*newTestPerson(userId)}
+	etag := jsonETag(pp)
+
+	user := newTestUser()
+	user.Id = userId
+
+	rw, req, rec := mockHandlerParams("GET", "", "")
+	req.Header.Set(IfNoneMatchHeader, etag)
+	ac, dbs := mockAuthContext(user)
+	dbs.Mock.On("GetPeople", userId).Return(pp, nil)
+
+	(*AuthContext).GetPersonListApi(ac, rw, req)
+
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+
+	changed := []Person{*newTestPerson(userId)}
+	changed[0].Name = "Changed"
+
+	rw, req, rec = mockHandlerParams("GET", "", "")
+	req.Header.Set(IfNoneMatchHeader, etag)
+	ac, dbs = mockAuthContext(user)
+	dbs.Mock.On("GetPeople", userId).Return(changed, nil)
+
+	(*AuthContext).GetPersonListApi(ac, rw, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, jsonETag(changed), rec.Header().Get(ETagHeader))
+	assert.Equal(t, Jsonify(changed), rec.Body.String())
+}
+
+func TestGetUserApiNotModified(t *testing.T) {
+	user := newTestUser()
+
+	rw, req, rec := mockHandlerParams("GET", "", "")
+	req.Header.Set(IfNoneMatchHeader, jsonETag(user))
+
+	ac, _ := mockAuthContext(user)
+
+	(*AuthContext).GetUserApi(ac, rw, req)
+
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+	assert.Equal(t, jsonETag(user), rec.Header().Get(ETagHeader))
+}
+
+func mockUpdatePersonParams(ifMatch, content string) (web.ResponseWriter, *web.Request, *httptest.ResponseRecorder) {
+	rw, req, rec := mockHandlerParams("PUT", JsonContentType, content)
+	req.PathParams = map[string]string{"id": "1"}
+	if ifMatch != "" {
+		req.Header.Set(IfMatchHeader, ifMatch)
+	}
+	return rw, req, rec
+}
+
+func TestUpdatePersonApiPreconditionRequired(t *testing.T) {
+	user := newTestUser()
+	rw, req, rec := mockUpdatePersonParams("", `{"name": "Changed"}`)
+
+	ac, dbs := mockAuthContext(user)
+
+	(*AuthContext).UpdatePersonApi(ac, rw, req)
+
+	dbs.Mock.AssertNotCalled(t, "GetPerson", user.Id, 1)
+	assertApiError(t, rec, http.StatusPreconditionRequired, ErrCodePreconditionRequired, PreconditionRequiredError)
+}
+
+func TestUpdatePersonApiInvalid(t *testing.T) {
+	tests := []struct {
+		contentType string
+		content     string
+		code        string
+		message     string
+	}{
+		{"text/plain", `{"name": "Changed"}`, ErrCodeContentType, JsonContentTypeError},
+		{JsonContentType, `{"name": `, ErrCodeMalformedJson, JsonMalformedError},
+		{JsonContentType, `{"name": " "}`, ErrCodeValidation, PersonInvalid},
+	}
+
+	ac, dbs := mockAuthContext(newTestUser())
+
+	for _, test := range tests {
+		rw, req, rec := mockUpdatePersonParams(`"etag"`, test.content)
+		req.Header.Set("Content-Type", test.contentType)
+
+		(*AuthContext).UpdatePersonApi(ac, rw, req)
+
+		assertApiError(t, rec, http.StatusBadRequest, test.code, test.message)
+	}
+	assert.Equal(t, 0, dbs.txCount)
+}
+
+func TestUpdatePersonApiNotFound(t *testing.T) {
+	user := newTestUser()
+	rw, req, rec := mockUpdatePersonParams(`"etag"`, `{"name": "Changed"}`)
+
+	ac, dbs := mockAuthContext(user)
+	dbs.Mock.On("GetPerson", user.Id, 1).Return(nil, sql.ErrNoRows)
+
+	(*AuthContext).UpdatePersonApi(ac, rw, req)
+
+	dbs.Mock.AssertNotCalled(t, "UpdatePerson", mock.Anything)
+	assertApiError(t, rec, http.StatusNotFound, ErrCodeNotFound, PersonNotFound)
+}
+
+// Another device saved the person after this client read it
+func TestUpdatePersonApiPreconditionFailed(t *testing.T) {
+	user := newTestUser()
+	current := newTestPerson(user.Id)
+	read := newTestPerson(user.Id)
+	read.Name = "Before"
+
+	rw, req, rec := mockUpdatePersonParams(jsonETag(read), `{"name": "Changed"}`)
+
+	ac, dbs := mockAuthContext(user)
+	dbs.Mock.On("GetPerson", user.Id, 1).Return(current, nil)
+
+	(*AuthContext).UpdatePersonApi(ac, rw, req)
+
+	dbs.Mock.AssertNotCalled(t, "UpdatePerson", mock.Anything)
+	assertApiError(t, rec, http.StatusPreconditionFailed, ErrCodePreconditionFailed, PreconditionFailedError)
+}
+
+func TestUpdatePersonApiUpdateError(t *testing.T) {
+	user := newTestUser()
+	current := newTestPerson(user.Id)
+
+	rw, req, rec := mockUpdatePersonParams(jsonETag(current), `{"name": "Changed"}`)
+
+	ac, dbs := mockAuthContext(user)
+	dbs.Mock.On("GetPerson", user.Id, 1).Return(current, nil)
+	dbs.Mock.On("UpdatePerson", mock.AnythingOfType("*main.Person")).Return(errors.New("Could not execute"))
+
+	(*AuthContext).UpdatePersonApi(ac, rw, req)
+
+	assertApiError(t, rec, http.StatusInternalServerError, ErrCodeInternal, PersonUpdateError)
+}
+
+func TestUpdatePersonApi(t *testing.T) {
+	user := newTestUser()
+	current := newTestPerson(user.Id)
+
+	rw, req, rec := mockUpdatePersonParams(jsonETag(current), `{"id": 7, "user_id": 9, "name": "Changed", "meta": {"type": "family"}, "color": null}`)
+
+	ac, dbs := mockAuthContext(user)
+	dbs.Mock.On("GetPerson", user.Id, 1).Return(current, nil)
+	dbs.Mock.On("UpdatePerson", mock.AnythingOfType("*main.Person")).Return(nil)
+
+	(*AuthContext).UpdatePersonApi(ac, rw, req)
+
+	dbs.Mock.AssertExpectations(t)
+	assert.Equal(t, 1, dbs.txCount)
+	assert.Equal(t, []int{user.Id}, dbs.lockedUsers)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	// The id and user come from the path and the API key, not the body
+	saved := dbs.Mock.Calls[1].Arguments.Get(0).(*Person)
+	assert.Equal(t, 1, saved.Id)
+	assert.Equal(t, user.Id, saved.UserId)
+	assert.Equal(t, "Changed", saved.Name)
+	assert.False(t, saved.Color.Valid)
+	assert.Equal(t, Jsonify(saved), rec.Body.String())
+	assert.Equal(t, jsonETag(saved), rec.Header().Get(ETagHeader))
+	assert.NotEqual(t, jsonETag(current), rec.Header().Get(ETagHeader))
+}
+
+func TestDeletePersonApiPreconditionRequired(t *testing.T) {
+	rw, req, rec := mockUpdatePersonParams("", "")
+
+	ac, dbs := mockAuthContext(newTestUser())
+
+	(*AuthContext).DeletePersonApi(ac, rw, req)
+
+	assert.Equal(t, 0, dbs.txCount)
+	assertApiError(t, rec, http.StatusPreconditionRequired, ErrCodePreconditionRequired, PreconditionRequiredError)
+}
+
+func TestDeletePersonApiPreconditionFailed(t *testing.T) {
+	user := newTestUser()
+	rw, req, rec := mockUpdatePersonParams(`"stale"`, "")
+
+	ac, dbs := mockAuthContext(user)
+	dbs.Mock.On("GetPerson", user.Id, 1).Return(newTestPerson(user.Id), nil)
+
+	(*AuthContext).DeletePersonApi(ac, rw, req)
+
+	dbs.Mock.AssertNotCalled(t, "DeletePerson", user.Id, 1)
+	assertApiError(t, rec, http.StatusPreconditionFailed, ErrCodePreconditionFailed, PreconditionFailedError)
+}
+
+func TestDeletePersonApiError(t *testing.T) {
+	user := newTestUser()
+	current := newTestPerson(user.Id)
+	rw, req, rec := mockUpdatePersonParams(jsonETag(current), "")
+
+	ac, dbs := mockAuthContext(user)
+	dbs.Mock.On("GetPerson", user.Id, 1).Return(current, nil)
+	dbs.Mock.On("DeletePerson", user.Id, 1).Return(errors.New("Could not execute"))
+
+	(*AuthContext).DeletePersonApi(ac, rw, req)
+
+	assertApiError(t, rec, http.StatusInternalServerError, ErrCodeInternal, PersonDeleteError)
+}
+
+func TestDeletePersonApi(t *testing.T) {
+	user := newTestUser()
+	current := newTestPerson(user.Id)
+	rw, req, rec := mockUpdatePersonParams(etagAny, "")
+
+	ac, dbs := mockAuthContext(user)
+	dbs.Mock.On("GetPerson", user.Id, 1).Return(current, nil)
+	dbs.Mock.On("DeletePerson", user.Id, 1).Return(nil)
+
+	(*AuthContext).DeletePersonApi(ac, rw, req)
+
+	dbs.Mock.AssertExpectations(t)
+	assert.Equal(t, 1, dbs.txCount)
+	assert.Equal(t, []int{user.Id}, dbs.lockedUsers)
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Equal(t, "", rec.Body.String())
+}
+
+func TestCreatePersonApiConflict(t *testing.T) {
+	user := newTestUser()
+	rw, req, rec := mockHandlerParams("POST", JsonContentType, `{"name": "Test Person", "meta": {}, "color": null}`)
+
+	ac, dbs := mockAuthContext(user)
+	dbs.Mock.On("CreatePerson", user.Id, "Test Person", mock.Anything, mock.Anything).
+		Return(nil, &ConstraintError{UqPersonNameUserId})
+
+	(*AuthContext).CreatePersonApi(ac, rw, req)
+
+	assertApiError(t, rec, http.StatusConflict, ErrCodeConflict, PersonExistsError)
+}
+
+func TestIsConflict(t *testing.T) {
+	tests := []struct {
+		err      error
+		conflict bool
+	}{
+		{nil, false},
+		{errors.New("Could not insert"), false},
+		{&ConstraintError{UqPersonNameUserId}, true},
+		{&ConstraintError{FkPersonUserId}, false},
+		{&pq.Error{Code: pqUniqueViolation}, true},
+		{&pq.Error{Code: pqQueryCanceled}, false},
+		{fmt.Errorf("Could not insert: %w", &pq.Error{Code: pqUniqueViolation}), true},
+		{sqlite3.Error{Code: sqlite3.ErrConstraint, ExtendedCode: sqlite3.ErrConstraintUnique}, true},
+		{sqlite3.Error{Code: sqlite3.ErrConstraint, ExtendedCode: sqlite3.ErrConstraintForeignKey}, false},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.conflict, isConflict(test.err), fmt.Sprint(test.err))
+	}
+}
+
+func TestWriteUnavailable(t *testing.T) {
+	tests := []struct {
+		err     error
+		written bool
+		code    int
+		errCode string
+	}{
+		{nil, false, http.StatusOK, ""},
+		{errors.New("Not found"), false, http.StatusOK, ""},
+		{context.DeadlineExceeded, true, http.StatusGatewayTimeout, ErrCodeTimeout},
+		{fmt.Errorf("User could not be found: %w", context.DeadlineExceeded), true, http.StatusGatewayTimeout, ErrCodeTimeout},
+		{&pq.Error{Code: pqQueryCanceled}, true, http.StatusGatewayTimeout, ErrCodeTimeout},
+		{context.Canceled, true, http.StatusServiceUnavailable, ErrCodeUnavailable},
+		{driver.ErrBadConn, true, http.StatusServiceUnavailable, ErrCodeUnavailable},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, true, http.StatusServiceUnavailable, ErrCodeUnavailable},
+	}
+
+	for _, test := range tests {
+		rw, req, rec := mockHandlerParams("GET", "", "")
+
+		assert.Equal(t, test.written, writeUnavailable(rw, req, test.err), fmt.Sprint(test.err))
+		assert.Equal(t, test.code, rec.Code, fmt.Sprint(test.err))
+		if test.written {
+			var envelope apiErrorEnvelope
+			json.Unmarshal(rec.Body.Bytes(), &envelope)
+			assert.Equal(t, test.errCode, envelope.Error.Code, fmt.Sprint(test.err))
+		} else {
+			assert.Equal(t, "", rec.Body.String(), fmt.Sprint(test.err))
+		}
+	}
+}
+
+// Any error counts as a timeout once the request deadline has passed
+func TestWriteUnavailableRequestDeadline(t *testing.T) {
+	rw, req, rec := mockHandlerParams("GET", "", "")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+	req.Request = req.Request.WithContext(ctx)
+
+	assert.True(t, writeUnavailable(rw, req, errors.New("driver: bad connection")))
+	assert.Equal(t, http.StatusGatewayTimeout, rec.Code)
+}
+
+func TestGetPersonApiTimeout(t *testing.T) {
+	userId := 2
+	personId := 1
+
+	rw, req, rec := mockHandlerParams("GET", "", "")
+	req.PathParams = map[string]string{"id": strconv.Itoa(personId)}
+
+	user := newTestUser()
+	user.Id = userId
+
+	ac, dbs := mockAuthContext(user)
+
+	dbs.Mock.On("GetPerson", userId, personId).Return(nil, context.DeadlineExceeded)
+
+	(*AuthContext).GetPersonApi(ac, rw, req)
+
+	dbs.Mock.AssertExpectations(t)
+	assertApiError(t, rec, http.StatusGatewayTimeout, ErrCodeTimeout, RequestTimedOutError)
+}
+
+func TestGetPersonListApiUnavailable(t *testing.T) {
+	userId := 1
+
+	rw, req, rec := mockHandlerParams("GET", "", "")
+
+	user := newTestUser()
+	user.Id = userId
+
+	ac, dbs := mockAuthContext(user)
+
+	dbs.Mock.On("GetPeople", userId).Return(nil, driver.ErrBadConn)
+
+	(*AuthContext).GetPersonListApi(ac, rw, req)
+
+	dbs.Mock.AssertExpectations(t)
+	assertApiError(t, rec, http.StatusServiceUnavailable, ErrCodeUnavailable, ServiceUnavailableError)
+}
+
+func TestCreateUserApiTimeout(t *testing.T) {
+	newUser := UserCreate{"test@example.com", "asdf", "Test User", nil}
+
+	rw, req, rec := mockHandlerParams("POST", JsonContentType, Jsonify(newUser))
+
+	c, dbs := mockDbContext(nil)
+
+	dbs.Mock.On("GetUser", newUser.Email).Return(nil, context.DeadlineExceeded)
+
+	(*Context).CreateUserApi(c, rw, req)
+
+	dbs.Mock.AssertNotCalled(t, "CreateUser")
+	assertApiError(t, rec, http.StatusGatewayTimeout, ErrCodeTimeout, RequestTimedOutError)
+}
+
+func TestDebugVarsApi(t *testing.T) {
+	rw, req, rec := mockHandlerParams("GET", "", "")
+	c, _ := mockDbContext(nil)
+
+	(*Context).DebugVarsApi(c, rw, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"memstats"`)
+}
+
+func TestMetricsApi(t *testing.T) {
+	rw, req, rec := mockHandlerParams("GET", "", "")
+	c, _ := mockDbContext(nil)
+
+	(*Context).MetricsApi(c, rw, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, MetricsContentType, rec.Header().Get("Content-Type"))
+	assert.Contains(t, rec.Body.String(), "# TYPE people_http_requests_total counter\n")
+	assert.Contains(t, rec.Body.String(), "# TYPE people_panics_total counter\n")
+}
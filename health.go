@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gocraft/web"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Readiness checks, as named in /readyz and the health.checks config
+const (
+	HealthCheckDatabase = "database"
+	HealthCheckSchema   = "schema"
+	HealthCheckDraining = "draining"
+
+	HealthOk          = "ok"
+	HealthFailed      = "failed"
+	HealthReady       = "ready"
+	HealthUnavailable = "unavailable"
+
+	DrainingError = "Server is shutting down"
+
+	// HealthCheckResult.Error of a failed check. The error itself is only
+	// logged, as /readyz is public and it can name hosts, users or tables
+	HealthErrorUnreachable = "unreachable"
+	HealthErrorSchema      = "schema mismatch"
+	HealthErrorTimeout     = "timeout"
+
+	LogHealthCheckFailed = "Readiness check failed"
+)
+
+var (
+	// Checks with a configurable timeout, in the order they are reported
+	HealthChecks = []string{HealthCheckDatabase, HealthCheckSchema}
+
+	// HealthCheckResult.Error of each check failing other than by timing out
+	healthCheckErrors = map[string]string{
+		HealthCheckDatabase: HealthErrorUnreachable,
+		HealthCheckSchema:   HealthErrorSchema,
+	}
+
+	errDraining = errors.New(DrainingError)
+)
+
+// Outcome of one readiness check
+type HealthCheckResult struct {
+	Status     string  `json:"status"`
+	DurationMs float64 `json:"duration_ms"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// Body of /readyz, and of /healthz without the checks
+type HealthStatus struct {
+	Status string                       `json:"status"`
+	Checks map[string]HealthCheckResult `json:"checks,omitempty"`
+}
+
+/*
+Handler for the liveness probe
+
+Answers as long as the process is serving requests, without touching
+the database, so a database outage does not get the server restarted
+*/
+func (c *Context) HealthzApi(rw web.ResponseWriter, req *web.Request) {
+	jsonResponse(rw, HealthStatus{Status: HealthOk})
+}
+
+/*
+Handler for the readiness probe
+
+Pings the database through DbService, checks its schema, and fails once
+the server has started draining. The checks run concurrently, each
+within its own timeout from the health config. Responds 200 when all
+pass and 503 otherwise, with the result of each check. Why a check
+failed is logged with the request ID
+*/
+func (s *Server) ReadyzApi(c *Context, rw web.ResponseWriter, req *web.Request) {
+	conf := s.Config()
+	checks := map[string]func(ctx context.Context) error{
+		HealthCheckDatabase: c.DB.Ping,
+		HealthCheckSchema:   c.DB.CheckSchema,
+	}
+
+	// Read once, as requestId sets a header the checks cannot set concurrently
+	id := requestId(rw, req.Request)
+	status := HealthStatus{Status: HealthReady, Checks: map[string]HealthCheckResult{}}
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check func(ctx context.Context) error) {
+			defer wg.Done()
+			result, err := runHealthCheck(req.Context(), conf.HealthCheckTimeout(name), check)
+			if err != nil {
+				result.Error = healthCheckErrors[name]
+				if errors.Is(err, context.DeadlineExceeded) {
+					result.Error = HealthErrorTimeout
+				}
+				s.logger.Warn(LogHealthCheckFailed, Fields{
+					"request_id": id,
+					"check":      name,
+					"error":      err,
+				})
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+			status.Checks[name] = result
+		}(name, check)
+	}
+	wg.Wait()
+
+	draining := HealthCheckResult{Status: HealthOk}
+	if s.Draining() {
+		draining = HealthCheckResult{Status: HealthFailed, Error: errDraining.Error()}
+	}
+	status.Checks[HealthCheckDraining] = draining
+
+	for _, result := range status.Checks {
+		if result.Status != HealthOk {
+			status.Status = HealthUnavailable
+		}
+	}
+
+	rw.Header().Set("Content-Type", JsonContentType)
+	if status.Status != HealthReady {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}
+	fmt.Fprint(rw, Jsonify(status))
+}
+
+// Run check within timeout, returning its result without an Error, and the error
+func runHealthCheck(ctx context.Context, timeout time.Duration, check func(ctx context.Context) error) (HealthCheckResult, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	err := check(ctx)
+	result := HealthCheckResult{
+		Status:     HealthOk,
+		DurationMs: float64(time.Since(start)) / float64(time.Millisecond),
+	}
+	if err != nil {
+		result.Status = HealthFailed
+	}
+	return result, err
+}
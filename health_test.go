@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+type mockHealthConfig struct {
+	mockConfig
+	timeout time.Duration
+}
+
+func (mc *mockHealthConfig) HealthCheckTimeout(check string) time.Duration {
+	return mc.timeout
+}
+
+// A DbService whose Ping blocks until its context is done
+type slowPingDbService struct {
+	*MockDbService
+}
+
+func (s slowPingDbService) Ping(ctx context.Context) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func decodeHealthStatus(t *testing.T, body []byte) HealthStatus {
+	var status HealthStatus
+	assert.Nil(t, json.Unmarshal(body, &status), string(body))
+	return status
+}
+
+func TestHealthzApi(t *testing.T) {
+	c, dbs := mockDbContext(nil)
+	rw, req, rec := mockHandlerParams("GET", "", "")
+
+	c.HealthzApi(rw, req)
+
+	// The database is not touched
+	dbs.Mock.AssertExpectations(t)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, JsonContentType, rec.Header().Get("Content-Type"))
+	assert.Equal(t, HealthStatus{Status: HealthOk}, decodeHealthStatus(t, rec.Body.Bytes()))
+}
+
+func TestReadyzApi(t *testing.T) {
+	serv := NewServer(newTestConfig())
+	c, dbs := mockDbContext(nil)
+	dbs.Mock.On("Ping").Return(nil)
+	dbs.Mock.On("CheckSchema").Return(nil)
+	rw, req, rec := mockHandlerParams("GET", "", "")
+
+	serv.ReadyzApi(c, rw, req)
+
+	dbs.Mock.AssertExpectations(t)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, JsonContentType, rec.Header().Get("Content-Type"))
+
+	status := decodeHealthStatus(t, rec.Body.Bytes())
+	assert.Equal(t, HealthReady, status.Status)
+	assert.Equal(t, 3, len(status.Checks))
+	for name, result := range status.Checks {
+		assert.Equal(t, HealthOk, result.Status, name)
+		assert.Equal(t, "", result.Error, name)
+	}
+}
+
+func TestReadyzApiFailed(t *testing.T) {
+	serv := NewServer(newTestConfig())
+	logger, buf := newTestLogger(LevelInfo)
+	serv.SetLogger(logger)
+	c, dbs := mockDbContext(nil)
+	dbs.Mock.On("Ping").Return(errors.New("dial tcp db.internal:5432: connection refused"))
+	dbs.Mock.On("CheckSchema").Return(errors.New(`Missing column "user".apikey`))
+	rw, req, rec := mockHandlerParams("GET", "", "")
+	req.Header.Set(RequestIdHeader, "req-1")
+
+	serv.ReadyzApi(c, rw, req)
+
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, JsonContentType, rec.Header().Get("Content-Type"))
+
+	status := decodeHealthStatus(t, rec.Body.Bytes())
+	assert.Equal(t, HealthUnavailable, status.Status)
+	assert.Equal(t, HealthFailed, status.Checks[HealthCheckDatabase].Status)
+	assert.Equal(t, HealthErrorUnreachable, status.Checks[HealthCheckDatabase].Error)
+	assert.Equal(t, HealthFailed, status.Checks[HealthCheckSchema].Status)
+	assert.Equal(t, HealthErrorSchema, status.Checks[HealthCheckSchema].Error)
+	assert.Equal(t, HealthOk, status.Checks[HealthCheckDraining].Status)
+	assert.NotContains(t, rec.Body.String(), "db.internal")
+
+	// The errors themselves are only logged
+	assert.Contains(t, buf.String(), `"check":"database","error":"dial tcp db.internal:5432: connection refused"`)
+	assert.Contains(t, buf.String(), `"msg":"Readiness check failed","check":"schema"`)
+	assert.Contains(t, buf.String(), `"request_id":"req-1"`)
+}
+
+func TestReadyzApiTimeout(t *testing.T) {
+	serv := NewServer(&mockHealthConfig{timeout: 10 * time.Millisecond})
+	serv.SetLogger(NewLogger(ioutil.Discard, LevelInfo))
+	c, dbs := mockDbContext(nil)
+	dbs.Mock.On("CheckSchema").Return(nil)
+	c.DB = slowPingDbService{dbs}
+	rw, req, rec := mockHandlerParams("GET", "", "")
+
+	serv.ReadyzApi(c, rw, req)
+
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	status := decodeHealthStatus(t, rec.Body.Bytes())
+	assert.Equal(t, HealthFailed, status.Checks[HealthCheckDatabase].Status)
+	assert.Equal(t, HealthErrorTimeout, status.Checks[HealthCheckDatabase].Error)
+	assert.Equal(t, HealthOk, status.Checks[HealthCheckSchema].Status)
+}
+
+func TestReadyzApiDraining(t *testing.T) {
+	serv := NewServer(newTestConfig())
+	serv.SetLogger(NewLogger(ioutil.Discard, LevelInfo))
+	assert.Nil(t, serv.Shutdown(context.Background(), 0))
+	assert.True(t, serv.Draining())
+
+	c, dbs := mockDbContext(nil)
+	dbs.Mock.On("Ping").Return(nil)
+	dbs.Mock.On("CheckSchema").Return(nil)
+	rw, req, rec := mockHandlerParams("GET", "", "")
+
+	serv.ReadyzApi(c, rw, req)
+
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	status := decodeHealthStatus(t, rec.Body.Bytes())
+	assert.Equal(t, HealthFailed, status.Checks[HealthCheckDraining].Status)
+	assert.Equal(t, DrainingError, status.Checks[HealthCheckDraining].Error)
+}
+
+func TestServerShutdown(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.Nil(t, err) {
+		return
+	}
+	serv := NewServer(&mockConfig{MemoryDbType, "", listener})
+	serv.SetLogger(NewLogger(ioutil.Discard, LevelInfo))
+
+	served := make(chan error, 1)
+	go func() {
+		served <- serv.Serve()
+	}()
+
+	url := "http://" + listener.Addr().String() + "/readyz"
+	var resp *http.Response
+	for i := 0; i < 100; i++ {
+		if resp, err = http.Get(url); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !assert.Nil(t, err) {
+		return
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Not ready while draining, but still serving
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- serv.Shutdown(context.Background(), 200*time.Millisecond)
+	}()
+	for !serv.Draining() {
+		time.Sleep(time.Millisecond)
+	}
+	resp, err = http.Get(url)
+	if assert.Nil(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	}
+
+	assert.Nil(t, <-shutdown)
+	assert.Nil(t, <-served)
+	_, err = http.Get(url)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	LogOutputStdout = "stdout"
+	LogOutputStderr = "stderr"
+
+	// Log messages
+	LogStartingServer = "Starting server"
+	LogStartingAdmin  = "Starting admin listener"
+	LogDraining       = "Draining before shutdown"
+	LogRequest        = "Request"
+)
+
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var (
+	LogLevels = []string{"debug", "info", "warn", "error"}
+
+	LogLevelError = errors.New("Unknown log level")
+)
+
+func (l LogLevel) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return LogLevels[l]
+}
+
+func ParseLogLevel(s string) (LogLevel, error) {
+	for i, name := range LogLevels {
+		if strings.EqualFold(strings.TrimSpace(s), name) {
+			return LogLevel(i), nil
+		}
+	}
+	return 0, LogLevelError
+}
+
+// Extra values logged with a message, keyed by name
+type Fields map[string]interface{}
+
+// Level and outputs of the server log
+type LogOptions struct {
+	Level LogLevel
+	// LogOutputStdout, LogOutputStderr or a file path
+	Outputs []string
+	// Rotate log files on reaching this many bytes, 0 never
+	MaxSize int64
+	// Rotated files kept alongside each log file
+	MaxBackups int
+}
+
+/*
+Leveled logger writing one JSON object per line
+
+Every line has "time", "level" and "msg", followed by the fields given
+in name order:
+
+	{"time":"2014-01-01T00:00:00Z","level":"info","msg":"Request","status":200}
+
+Safe for concurrent use
+*/
+type Logger struct {
+	lock sync.Mutex
+	out  io.Writer
+	// A LogLevel, atomic so a reload can change it while requests log
+	level   int32
+	closers []io.Closer
+	now     func() time.Time
+}
+
+func NewLogger(out io.Writer, level LogLevel) *Logger {
+	return &Logger{out: out, level: int32(level), now: time.Now}
+}
+
+// Log only at level and above from now on
+func (l *Logger) SetLevel(level LogLevel) {
+	atomic.StoreInt32(&l.level, int32(level))
+}
+
+/*
+Open the outputs in opts and return a Logger writing to all of them
+
+Files are appended to, and rotated when MaxSize is set
+*/
+func OpenLogger(opts LogOptions) (*Logger, error) {
+	writers := []io.Writer{}
+	closers := []io.Closer{}
+
+	for _, output := range opts.Outputs {
+		switch output {
+		case LogOutputStdout:
+			writers = append(writers, os.Stdout)
+		case LogOutputStderr:
+			writers = append(writers, os.Stderr)
+		default:
+			f, err := openRotatingFile(output, opts.MaxSize, opts.MaxBackups)
+			if err != nil {
+				for _, c := range closers {
+					c.Close()
+				}
+				return nil, err
+			}
+			writers = append(writers, f)
+			closers = append(closers, f)
+		}
+	}
+
+	logger := NewLogger(io.MultiWriter(writers...), opts.Level)
+	logger.closers = closers
+	return logger, nil
+}
+
+// Close any files the logger writes to
+func (l *Logger) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	var err error
+	for _, c := range l.closers {
+		if closeErr := c.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	l.closers = nil
+	return err
+}
+
+// Write msg with fields, unless level is below the logger's
+func (l *Logger) Log(level LogLevel, msg string, fields Fields) {
+	if int32(level) < atomic.LoadInt32(&l.level) {
+		return
+	}
+
+	buf := new(bytes.Buffer)
+	buf.WriteString(`{"time":`)
+	writeJsonValue(buf, l.now().UTC().Format(time.RFC3339Nano))
+	buf.WriteString(`,"level":`)
+	writeJsonValue(buf, level.String())
+	buf.WriteString(`,"msg":`)
+	writeJsonValue(buf, msg)
+
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		buf.WriteByte(',')
+		writeJsonValue(buf, name)
+		buf.WriteByte(':')
+		writeJsonValue(buf, fields[name])
+	}
+	buf.WriteString("}\n")
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.out.Write(buf.Bytes())
+}
+
+// Errors are logged as their message, values JSON cannot encode as fmt prints them
+func writeJsonValue(buf *bytes.Buffer, v interface{}) {
+	if err, ok := v.(error); ok {
+		v = err.Error()
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(b)
+}
+
+func (l *Logger) Debug(msg string, fields Fields) { l.Log(LevelDebug, msg, fields) }
+func (l *Logger) Info(msg string, fields Fields)  { l.Log(LevelInfo, msg, fields) }
+func (l *Logger) Warn(msg string, fields Fields)  { l.Log(LevelWarn, msg, fields) }
+func (l *Logger) Error(msg string, fields Fields) { l.Log(LevelError, msg, fields) }
+
+/*
+A standard library logger writing into this one at level
+
+For code taking a *log.Logger, such as the database retries. Each
+line it prints becomes the msg of one entry
+*/
+func (l *Logger) StdLogger(level LogLevel) *log.Logger {
+	return log.New(stdLogWriter{l, level}, "", 0)
+}
+
+type stdLogWriter struct {
+	logger *Logger
+	level  LogLevel
+}
+
+func (w stdLogWriter) Write(p []byte) (int, error) {
+	w.logger.Log(w.level, strings.TrimRight(string(p), "\n"), nil)
+	return len(p), nil
+}
+
+/*
+Log file rotated by size
+
+Once a write would take the file past maxSize, it is renamed to
+path.1, any path.1 to path.2 and so on, keeping maxBackups of them,
+and a new file is started. Not safe for concurrent use; Logger
+serializes its writes
+*/
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		// A failed rotation leaves the current file open, and is tried again
+		// on the next write; losing the line would be worse than a big file
+		f.rotate()
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+/*
+Move the file aside and start a new one
+
+The old file stays open until the new one is, so whatever fails, there
+is still a file to write to
+*/
+func (f *rotatingFile) rotate() error {
+	for i := f.maxBackups; i > 1; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", f.path, i-1), fmt.Sprintf("%s.%d", f.path, i))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	var err error
+	if f.maxBackups > 0 {
+		err = os.Rename(f.path, f.path+".1")
+	} else {
+		err = os.Remove(f.path)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	old := f.file
+	if err := f.open(); err != nil {
+		return err
+	}
+	return old.Close()
+}
+
+func (f *rotatingFile) Close() error {
+	return f.file.Close()
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestLogger(level LogLevel) (*Logger, *bytes.Buffer) {
+	buf := new(bytes.Buffer)
+	logger := NewLogger(buf, level)
+	logger.now = func() time.Time { return time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC) }
+	return logger, buf
+}
+
+func TestParseLogLevel(t *testing.T) {
+	for i, name := range LogLevels {
+		level, err := ParseLogLevel(name)
+		assert.Nil(t, err)
+		assert.Equal(t, LogLevel(i), level)
+		assert.Equal(t, name, level.String())
+	}
+
+	level, err := ParseLogLevel(" Warn ")
+	assert.Nil(t, err)
+	assert.Equal(t, LevelWarn, level)
+
+	_, err = ParseLogLevel("verbose")
+	assert.Equal(t, LogLevelError, err)
+}
+
+func TestLoggerLog(t *testing.T) {
+	logger, buf := newTestLogger(LevelInfo)
+
+	logger.Info("Request", Fields{"status": 200, "route": "/api/person", "err": errors.New("boom")})
+	assert.Equal(t,
+		`{"time":"2014-01-01T00:00:00Z","level":"info","msg":"Request","err":"boom","route":"/api/person","status":200}`+"\n",
+		buf.String())
+
+	// Below the logger's level
+	buf.Reset()
+	logger.Debug("Hidden", nil)
+	assert.Equal(t, "", buf.String())
+
+	// Values JSON cannot encode are printed
+	logger.Error("Odd", Fields{"fn": func() {}})
+	var line map[string]interface{}
+	if assert.Nil(t, json.Unmarshal(buf.Bytes(), &line)) {
+		assert.Equal(t, "error", line["level"])
+		assert.IsType(t, "", line["fn"])
+	}
+}
+
+func TestLoggerSetLevel(t *testing.T) {
+	logger, buf := newTestLogger(LevelWarn)
+
+	logger.Info("Hidden", nil)
+	logger.SetLevel(LevelDebug)
+	logger.Debug("Shown", nil)
+
+	assert.Equal(t, `{"time":"2014-01-01T00:00:00Z","level":"debug","msg":"Shown"}`+"\n", buf.String())
+}
+
+func TestLoggerStdLogger(t *testing.T) {
+	logger, buf := newTestLogger(LevelInfo)
+
+	logger.StdLogger(LevelWarn).Printf("Replica %d is up", 1)
+	assert.Equal(t, `{"time":"2014-01-01T00:00:00Z","level":"warn","msg":"Replica 1 is up"}`+"\n", buf.String())
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "people-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "people.log")
+	f, err := openRotatingFile(path, 10, 2)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer f.Close()
+
+	for _, line := range []string{"one\n", "two\n", "three\n", "four\n", "five\n"} {
+		_, err := f.Write([]byte(line))
+		assert.Nil(t, err)
+	}
+
+	read := func(name string) string {
+		b, _ := ioutil.ReadFile(filepath.Join(dir, name))
+		return string(b)
+	}
+	assert.Equal(t, "four\nfive\n", read("people.log"))
+	assert.Equal(t, "three\n", read("people.log.1"))
+	assert.Equal(t, "one\ntwo\n", read("people.log.2"))
+
+	// Only maxBackups are kept
+	f.Write([]byte("six\n"))
+	assert.Equal(t, "six\n", read("people.log"))
+	assert.Equal(t, "four\nfive\n", read("people.log.1"))
+	assert.Equal(t, "three\n", read("people.log.2"))
+	_, err = os.Stat(filepath.Join(dir, "people.log.3"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+// A rotation that fails keeps writing to the current file
+func TestRotatingFileRotateFails(t *testing.T) {
+	dir, err := ioutil.TempDir("", "people-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "people.log")
+	f, err := openRotatingFile(path, 5, 1)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer f.Close()
+
+	// The backup's name is taken by a directory that cannot be replaced
+	blocker := filepath.Join(dir, "people.log.1", "keep")
+	if err := os.MkdirAll(blocker, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{"one\n", "two\n"} {
+		_, err := f.Write([]byte(line))
+		assert.Nil(t, err)
+	}
+	b, _ := ioutil.ReadFile(path)
+	assert.Equal(t, "one\ntwo\n", string(b))
+
+	// Once the name is free it rotates again
+	os.RemoveAll(filepath.Dir(blocker))
+	_, err = f.Write([]byte("three\n"))
+	assert.Nil(t, err)
+	b, _ = ioutil.ReadFile(path)
+	assert.Equal(t, "three\n", string(b))
+	b, _ = ioutil.ReadFile(path + ".1")
+	assert.Equal(t, "one\ntwo\n", string(b))
+}
+
+func TestOpenLogger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "people-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "people.log")
+	logger, err := OpenLogger(LogOptions{Level: LevelWarn, Outputs: []string{path}})
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	logger.Info("Hidden", nil)
+	logger.Warn("Shown", nil)
+	assert.Nil(t, logger.Close())
+
+	b, _ := ioutil.ReadFile(path)
+	assert.Contains(t, string(b), `"msg":"Shown"`)
+	assert.NotContains(t, string(b), "Hidden")
+
+	_, err = OpenLogger(LogOptions{Outputs: []string{filepath.Join(dir, "missing", "people.log")}})
+	assert.NotNil(t, err)
+}
@@ -1,5 +1,9 @@
 package main
 
+import (
+	"os"
+)
+
 func main() {
-	NewServer(MustReadConfigFile("config.yml")).Serve()
+	os.Exit(runCommand(os.Args[1:], os.LookupEnv, os.Stdout, os.Stderr))
 }
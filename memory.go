@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/lib/pq/hstore"
+	"sort"
+	"sync"
+)
+
+const (
+	MemoryDbType = "memory"
+
+	// Constraint names, matching people_schema.sql
+	UqUserEmail         = "uq_user_email"
+	UqPersonNameUserId  = "uq_person_name_user_id"
+	FkPersonUserId      = "fk_person_user_id"
+	DbConstraintMessage = "Violates constraint %s"
+)
+
+/*
+A write rejected by a uniqueness or foreign key rule
+
+Constraint names the rule as it is named in the schema
+*/
+type ConstraintError struct {
+	Constraint string
+}
+
+func (e *ConstraintError) Error() string {
+	return fmt.Sprintf(DbConstraintMessage, e.Constraint)
+}
+
+/*
+In-memory database service
+
+Keeps users and people in maps, applying the same validation and
+constraints as the schema. Safe for concurrent use. Everything is lost
+when the process exits, so it suits local development and tests
+*/
+type memDbService struct {
+	lock         sync.RWMutex
+	users        map[int]*User
+	people       map[int]*Person
+	lastUserId   int
+	lastPersonId int
+	// Sync version of each user, and the people deleted in the order they were
+	syncVersions map[int]int64
+	tombstones   []memTombstone
+}
+
+// A deleted person, as "person_tombstone" keeps it
+type memTombstone struct {
+	id      int
+	userId  int
+	version int64
+}
+
+func NewMemDbService() *memDbService {
+	return &memDbService{
+		users:        map[int]*User{},
+		people:       map[int]*Person{},
+		syncVersions: map[int]int64{},
+	}
+}
+
+// A copy of the user safe to hand out, without the validation state
+func copyUser(u *User) *User {
+	c := *u
+	c.errors = nil
+	return &c
+}
+
+// A copy of the person safe to hand out, with its own meta map
+func copyPerson(p *Person) *Person {
+	c := *p
+	c.errors = nil
+	c.Meta = hstore.Hstore{Map: map[string]sql.NullString{}}
+	for key, val := range p.Meta.Map {
+		c.Meta.Map[key] = val
+	}
+	return &c
+}
+
+// Always reachable, being in process
+func (s *memDbService) Ping(ctx context.Context) error {
+	return nil
+}
+
+// No schema to drift, the structs are the schema
+func (s *memDbService) CheckSchema(ctx context.Context) error {
+	return nil
+}
+
+/*
+Run fn against a copy of the data, kept only if fn succeeds
+
+Holds the write lock throughout, so units of work run one at a time and
+nothing else sees their writes before they finish
+*/
+func (s *memDbService) WithTx(ctx context.Context, fn func(tx DbService) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// Stored values are replaced rather than changed, so copying the maps is enough
+	tx := &memDbService{
+		users:        make(map[int]*User, len(s.users)),
+		people:       make(map[int]*Person, len(s.people)),
+		lastUserId:   s.lastUserId,
+		lastPersonId: s.lastPersonId,
+		syncVersions: make(map[int]int64, len(s.syncVersions)),
+		tombstones:   append([]memTombstone(nil), s.tombstones...),
+	}
+	for id, user := range s.users {
+		tx.users[id] = user
+	}
+	for id, person := range s.people {
+		tx.people[id] = person
+	}
+	for id, version := range s.syncVersions {
+		tx.syncVersions[id] = version
+	}
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	s.users, s.people = tx.users, tx.people
+	s.lastUserId, s.lastPersonId = tx.lastUserId, tx.lastPersonId
+	s.syncVersions, s.tombstones = tx.syncVersions, tx.tombstones
+	return nil
+}
+
+func (s *memDbService) userByEmail(email string) *User {
+	for _, user := range s.users {
+		if user.Email == email {
+			return user
+		}
+	}
+	return nil
+}
+
+func (s *memDbService) GetUser(ctx context.Context, email string) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	user := s.userByEmail(email)
+	if user == nil {
+		return nil, fmt.Errorf("User could not be found: %w", sql.ErrNoRows)
+	}
+	return copyUser(user), nil
+}
+
+func (s *memDbService) PasswordCost() int {
+	return passwordCost
+}
+
+func (s *memDbService) CreateUser(ctx context.Context, email, pwhash, name, apikey string, isActive, isSuperuser bool) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	newUser := &User{
+		Email:       email,
+		Pwhash:      pwhash,
+		Name:        name,
+		IsActive:    isActive,
+		IsSuperuser: isSuperuser,
+		ApiKey:      apikey,
+	}
+
+	if !newUser.Validate() {
+		return nil, NewValidationError(UserInvalid, newUser.Errors())
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.userByEmail(email) != nil {
+		return nil, &ConstraintError{UqUserEmail}
+	}
+
+	s.lastUserId++
+	newUser.Id = s.lastUserId
+	s.users[newUser.Id] = copyUser(newUser)
+
+	return copyUser(newUser), nil
+}
+
+func (s *memDbService) UpdateUser(ctx context.Context, user *User) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if !user.Validate() {
+		return NewValidationError(UserInvalid, user.Errors())
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// Like an UPDATE matching no rows, a missing user is not an error
+	if _, ok := s.users[user.Id]; !ok {
+		return nil
+	}
+	if existing := s.userByEmail(user.Email); existing != nil && existing.Id != user.Id {
+		return &ConstraintError{UqUserEmail}
+	}
+
+	s.users[user.Id] = copyUser(user)
+	return nil
+}
+
+func (s *memDbService) GetPerson(ctx context.Context, userId, id int) (*Person, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	person, ok := s.people[id]
+	if !ok || person.UserId != userId {
+		return nil, sql.ErrNoRows
+	}
+	return copyPerson(person), nil
+}
+
+// People are listed in the order they were created
+func (s *memDbService) GetPeople(ctx context.Context, userId int) ([]Person, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	people := []Person{}
+	for _, person := range s.people {
+		if person.UserId == userId {
+			people = append(people, *copyPerson(person))
+		}
+	}
+	sort.Slice(people, func(i, j int) bool {
+		return people[i].Id < people[j].Id
+	})
+
+	return people, nil
+}
+
+func (s *memDbService) CreatePerson(ctx context.Context, userId int, name string, meta hstore.Hstore, color sql.NullInt64) (*Person, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	newPerson := &Person{
+		UserId: userId,
+		Name:   name,
+		Meta:   meta,
+		Color:  color,
+	}
+
+	if !newPerson.Validate() {
+		return nil, NewValidationError(PersonInvalid, newPerson.Errors())
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.users[userId]; !ok {
+		return nil, &ConstraintError{FkPersonUserId}
+	}
+	for _, person := range s.people {
+		if person.UserId == userId && person.Name == name {
+			return nil, &ConstraintError{UqPersonNameUserId}
+		}
+	}
+
+	s.lastPersonId++
+	newPerson.Id = s.lastPersonId
+	newPerson.Version = s.nextSyncVersion(userId)
+	newPerson.CreatedVersion = newPerson.Version
+	s.people[newPerson.Id] = copyPerson(newPerson)
+
+	return copyPerson(newPerson), nil
+}
+
+func (s *memDbService) UpdatePerson(ctx context.Context, person *Person) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if !person.Validate() {
+		return NewValidationError(PersonInvalid, person.Errors())
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	existing, ok := s.people[person.Id]
+	if !ok || existing.UserId != person.UserId {
+		return sql.ErrNoRows
+	}
+	for _, other := range s.people {
+		if other.UserId == person.UserId && other.Name == person.Name && other.Id != person.Id {
+			return &ConstraintError{UqPersonNameUserId}
+		}
+	}
+
+	person.Version = s.nextSyncVersion(person.UserId)
+	person.CreatedVersion = existing.CreatedVersion
+	s.people[person.Id] = copyPerson(person)
+	return nil
+}
+
+func (s *memDbService) DeletePerson(ctx context.Context, userId, id int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if person, ok := s.people[id]; !ok || person.UserId != userId {
+		return sql.ErrNoRows
+	}
+
+	delete(s.people, id)
+	s.tombstones = append(s.tombstones, memTombstone{id, userId, s.nextSyncVersion(userId)})
+	return nil
+}
+
+// Raise the user's sync version, with the lock held
+func (s *memDbService) nextSyncVersion(userId int) int64 {
+	s.syncVersions[userId]++
+	return s.syncVersions[userId]
+}
+
+func (s *memDbService) GetPersonChanges(ctx context.Context, userId int, since int64) (*PersonChanges, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if _, ok := s.users[userId]; !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	// No tags or locations are kept, so none are deleted
+	changes := newPersonChanges()
+	changes.Version = s.syncVersions[userId]
+	for _, person := range s.people {
+		if person.UserId == userId && person.Version > since {
+			changes.People = append(changes.People, *copyPerson(person))
+		}
+	}
+	sort.Slice(changes.People, func(i, j int) bool {
+		return changes.People[i].Version < changes.People[j].Version
+	})
+	for _, tombstone := range s.tombstones {
+		if tombstone.userId == userId && tombstone.version > since {
+			changes.Deleted = append(changes.Deleted, tombstone.id)
+		}
+	}
+
+	return changes, nil
+}
+
+// Transactions already run one at a time
+func (s *memDbService) LockPeople(ctx context.Context, userId int) error {
+	return ctx.Err()
+}
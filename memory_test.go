@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lib/pq/hstore"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func newTestMemDbService(t *testing.T) (*memDbService, *User) {
+	mdbs := NewMemDbService()
+	user, err := mdbs.CreateUser(context.Background(), "test@example.com", "pwhash", "Test User", "apikey", defaultActive, defaultSuperuser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mdbs, user
+}
+
+func TestMemDbServiceIsDbService(t *testing.T) {
+	var _ DbService = NewMemDbService()
+}
+
+func TestMemGetUser(t *testing.T) {
+	mdbs, user := newTestMemDbService(t)
+
+	u, err := mdbs.GetUser(context.Background(), user.Email)
+	assert.Nil(t, err)
+	assert.Equal(t, user, u)
+
+	u, err = mdbs.GetUser(context.Background(), "nobody@example.com")
+	assert.Nil(t, u)
+	assert.True(t, errors.Is(err, sql.ErrNoRows))
+}
+
+func TestMemCreateUser(t *testing.T) {
+	mdbs, user := newTestMemDbService(t)
+	assert.Equal(t, 1, user.Id)
+
+	u, err := mdbs.CreateUser(context.Background(), "other@example.com", "pwhash", "Other", "key", false, true)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, u.Id)
+	assert.False(t, u.IsActive)
+	assert.True(t, u.IsSuperuser)
+
+	u, err = mdbs.CreateUser(context.Background(), user.Email, "pwhash", "Again", "key", true, false)
+	assert.Nil(t, u)
+	assert.Equal(t, &ConstraintError{UqUserEmail}, err)
+
+	u, err = mdbs.CreateUser(context.Background(), "", "", "", "", true, false)
+	assert.Nil(t, u)
+	if verr, ok := err.(ValidationError); assert.True(t, ok) {
+		assert.Equal(t, UserInvalid, verr.Error())
+	}
+}
+
+func TestMemUpdateUser(t *testing.T) {
+	mdbs, user := newTestMemDbService(t)
+	other, _ := mdbs.CreateUser(context.Background(), "other@example.com", "pwhash", "Other", "key", true, false)
+
+	user.Name = "Renamed"
+	assert.Nil(t, mdbs.UpdateUser(context.Background(), user))
+
+	u, _ := mdbs.GetUser(context.Background(), user.Email)
+	assert.Equal(t, "Renamed", u.Name)
+
+	other.Email = user.Email
+	assert.Equal(t, &ConstraintError{UqUserEmail}, mdbs.UpdateUser(context.Background(), other))
+
+	other.Email = ""
+	_, ok := mdbs.UpdateUser(context.Background(), other).(ValidationError)
+	assert.True(t, ok)
+}
+
+// Changing a returned user must not change the stored one
+func TestMemUserCopies(t *testing.T) {
+	mdbs, user := newTestMemDbService(t)
+
+	user.Name = "Changed"
+	u, _ := mdbs.GetUser(context.Background(), user.Email)
+	assert.Equal(t, "Test User", u.Name)
+}
+
+func TestMemCreatePerson(t *testing.T) {
+	mdbs, user := newTestMemDbService(t)
+
+	meta := hstore.Hstore{map[string]sql.NullString{"type": {"friend", true}}}
+	color := sql.NullInt64{3, true}
+
+	p, err := mdbs.CreatePerson(context.Background(), user.Id, "Person", meta, color)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, p.Id)
+	assert.Equal(t, user.Id, p.UserId)
+	assert.Equal(t, meta, p.Meta)
+	assert.Equal(t, color, p.Color)
+
+	p, err = mdbs.CreatePerson(context.Background(), user.Id, "Person", meta, color)
+	assert.Nil(t, p)
+	assert.Equal(t, &ConstraintError{UqPersonNameUserId}, err)
+
+	p, err = mdbs.CreatePerson(context.Background(), 99, "Person", meta, color)
+	assert.Nil(t, p)
+	assert.Equal(t, &ConstraintError{FkPersonUserId}, err)
+
+	p, err = mdbs.CreatePerson(context.Background(), user.Id, " ", meta, color)
+	assert.Nil(t, p)
+	_, ok := err.(ValidationError)
+	assert.True(t, ok)
+}
+
+func TestMemGetPerson(t *testing.T) {
+	mdbs, user := newTestMemDbService(t)
+	other, _ := mdbs.CreateUser(context.Background(), "other@example.com", "pwhash", "Other", "key", true, false)
+
+	meta := hstore.Hstore{map[string]sql.NullString{"type": {"friend", true}}}
+	created, _ := mdbs.CreatePerson(context.Background(), user.Id, "Person", meta, sql.NullInt64{})
+
+	// The caller's meta map is not shared with the store
+	meta.Map["type"] = sql.NullString{"enemy", true}
+
+	p, err := mdbs.GetPerson(context.Background(), user.Id, created.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, "friend", p.Meta.Map["type"].String)
+
+	p, err = mdbs.GetPerson(context.Background(), other.Id, created.Id)
+	assert.Nil(t, p)
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	p, err = mdbs.GetPerson(context.Background(), user.Id, 99)
+	assert.Nil(t, p)
+	assert.Equal(t, sql.ErrNoRows, err)
+}
+
+func TestMemGetPeople(t *testing.T) {
+	mdbs, user := newTestMemDbService(t)
+	other, _ := mdbs.CreateUser(context.Background(), "other@example.com", "pwhash", "Other", "key", true, false)
+
+	pp, err := mdbs.GetPeople(context.Background(), user.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, []Person{}, pp)
+
+	for i := 1; i <= 3; i++ {
+		mdbs.CreatePerson(context.Background(), user.Id, fmt.Sprintf("Person %d", i), hstore.Hstore{}, sql.NullInt64{})
+	}
+	mdbs.CreatePerson(context.Background(), other.Id, "Person 1", hstore.Hstore{}, sql.NullInt64{})
+
+	pp, err = mdbs.GetPeople(context.Background(), user.Id)
+	assert.Nil(t, err)
+	if assert.Equal(t, 3, len(pp)) {
+		assert.Equal(t, "Person 1", pp[0].Name)
+		assert.Equal(t, "Person 3", pp[2].Name)
+	}
+}
+
+func TestMemCanceled(t *testing.T) {
+	mdbs, user := newTestMemDbService(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := mdbs.GetUser(ctx, user.Email)
+	assert.Equal(t, context.Canceled, err)
+
+	_, err = mdbs.GetPeople(ctx, user.Id)
+	assert.Equal(t, context.Canceled, err)
+
+	_, err = mdbs.CreatePerson(ctx, user.Id, "Person", hstore.Hstore{}, sql.NullInt64{})
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestMemConcurrentCreatePerson(t *testing.T) {
+	mdbs, user := newTestMemDbService(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// Every name is tried twice, only one of each can win
+			name := fmt.Sprintf("Person %d", i/2)
+			mdbs.CreatePerson(context.Background(), user.Id, name, hstore.Hstore{}, sql.NullInt64{})
+			mdbs.GetPeople(context.Background(), user.Id)
+		}(i)
+	}
+	wg.Wait()
+
+	pp, _ := mdbs.GetPeople(context.Background(), user.Id)
+	assert.Equal(t, 25, len(pp))
+}
+
+// The full server, routing and auth included, runs against the memory service
+func TestMemServer(t *testing.T) {
+	serv := NewServer(newTestConfig())
+	router := serv.setupRoutes()
+	router.Middleware(DbMiddleware(NewMemDbService()))
+
+	newUser := `{"email": "test@example.com", "password": "asdf", "name": "Test User"}`
+	req, _ := http.NewRequest("POST", "/api/user", strings.NewReader(newUser))
+	req.Header.Set("Content-Type", JsonContentType)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if !assert.Equal(t, http.StatusCreated, rec.Code) {
+		return
+	}
+
+	var user User
+	json.Unmarshal(rec.Body.Bytes(), &user)
+	auth := fmt.Sprintf("Apikey %s:%s", user.Email, user.ApiKey)
+
+	req, _ = http.NewRequest("POST", "/api/person", strings.NewReader(`{"name": "Test Person", "meta": {"a": "b"}, "color": 2}`))
+	req.Header.Set("Content-Type", JsonContentType)
+	req.Header.Set("Authorization", auth)
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+
+	req, _ = http.NewRequest("GET", "/api/person/1", nil)
+	req.Header.Set("Authorization", auth)
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var person map[string]interface{}
+	json.Unmarshal(rec.Body.Bytes(), &person)
+	assert.Equal(t, "Test Person", person["name"])
+	assert.Equal(t, map[string]interface{}{"a": "b"}, person["meta"])
+}
+
+func TestMemDbServiceConformance(t *testing.T) {
+	DbServiceConformance(t, func(t *testing.T) DbService {
+		return NewMemDbService()
+	})
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	MetricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+	// Route label of requests matching no registered route
+	MetricsUnmatchedRoute = "unmatched"
+	// Method label of those requests, since any method can be sent
+	MetricsOtherMethod = "OTHER"
+
+	AuthMethodApiKey   = "apikey"
+	AuthMethodPassword = "password"
+	AuthSuccess        = "success"
+	AuthFailure        = "failure"
+
+	// db.system span attributes of queries
+	DbSystemPostgres = "postgresql"
+	DbSystemSqlite   = "sqlite"
+
+	// Query labels of people_db_query_duration_seconds
+	QueryGetUser      = "get_user"
+	QueryCreateUser   = "create_user"
+	QueryUpdateUser   = "update_user"
+	QueryGetPerson    = "get_person"
+	QueryGetPeople    = "get_people"
+	QueryCreatePerson = "create_person"
+	QueryUpdatePerson = "update_person"
+	QueryDeletePerson = "delete_person"
+	// Read by GET /api/sync
+	QueryGetPersonChanges = "get_person_changes"
+)
+
+var (
+	// Upper bounds in seconds, from 1ms to 10s
+	DefaultMetricBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+	defaultMetrics = NewMetrics()
+
+	httpRequestsTotal = defaultMetrics.NewCounterVec(
+		"people_http_requests_total", "Requests served, by route pattern and status",
+		"method", "route", "status")
+	httpRequestDuration = defaultMetrics.NewHistogramVec(
+		"people_http_request_duration_seconds", "Time to serve requests, by route pattern",
+		DefaultMetricBuckets, "method", "route")
+	dbQueryDuration = defaultMetrics.NewHistogramVec(
+		"people_db_query_duration_seconds", "Time taken by database queries, including failed ones",
+		DefaultMetricBuckets, "query")
+	authAttemptsTotal = defaultMetrics.NewCounterVec(
+		"people_auth_attempts_total", "Authentication attempts, by method and result",
+		"method", "result")
+)
+
+func init() {
+	defaultMetrics.NewCounterFunc("people_panics_total", "Panics recovered while serving requests", func() float64 {
+		return float64(panicCount.Value())
+	})
+}
+
+type metricCollector interface {
+	writeMetrics(buf *bytes.Buffer)
+}
+
+/*
+Metrics in the Prometheus text exposition format
+
+Holds counters and histograms updated as requests are served, and
+gauges read when the metrics are written. Safe for concurrent use
+*/
+type Metrics struct {
+	lock       sync.Mutex
+	collectors []metricCollector
+}
+
+func NewMetrics() *Metrics {
+	return new(Metrics)
+}
+
+func (m *Metrics) register(c metricCollector) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.collectors = append(m.collectors, c)
+}
+
+// Write every metric, in the order they were created
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.lock.Lock()
+	collectors := append([]metricCollector{}, m.collectors...)
+	m.lock.Unlock()
+
+	buf := new(bytes.Buffer)
+	for _, c := range collectors {
+		c.writeMetrics(buf)
+	}
+	return buf.WriteTo(w)
+}
+
+func writeMetricHeader(buf *bytes.Buffer, name, help, metricType string) {
+	buf.WriteString("# HELP " + name + " " + help + "\n")
+	buf.WriteString("# TYPE " + name + " " + metricType + "\n")
+}
+
+// A sample line, with labels paired to values and any extra label appended
+func writeSample(buf *bytes.Buffer, name string, labels, values []string, extra string, value float64) {
+	buf.WriteString(name)
+	if len(labels) > 0 || extra != "" {
+		pairs := make([]string, len(labels))
+		for i, label := range labels {
+			pairs[i] = label + `="` + escapeLabelValue(values[i]) + `"`
+		}
+		if extra != "" {
+			pairs = append(pairs, extra)
+		}
+		buf.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+	buf.WriteString(" " + formatMetricValue(value) + "\n")
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(s string) string {
+	return labelValueEscaper.Replace(s)
+}
+
+func formatMetricValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+type counterValue struct {
+	values []string
+	count  float64
+}
+
+// Counters keyed by the values of labels
+type CounterVec struct {
+	name   string
+	help   string
+	labels []string
+	lock   sync.Mutex
+	values map[string]*counterValue
+}
+
+func (m *Metrics) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{name: name, help: help, labels: labels, values: map[string]*counterValue{}}
+	m.register(c)
+	return c
+}
+
+// Add one to the counter for values, given in the order of the labels
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+func (c *CounterVec) Add(n float64, values ...string) {
+	key := strings.Join(values, "\xff")
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	v, ok := c.values[key]
+	if !ok {
+		v = &counterValue{values: values}
+		c.values[key] = v
+	}
+	v.count += n
+}
+
+// The current count for values, for tests
+func (c *CounterVec) Value(values ...string) float64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if v, ok := c.values[strings.Join(values, "\xff")]; ok {
+		return v.count
+	}
+	return 0
+}
+
+func (c *CounterVec) writeMetrics(buf *bytes.Buffer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	writeMetricHeader(buf, c.name, c.help, "counter")
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		writeSample(buf, c.name, c.labels, c.values[key].values, "", c.values[key].count)
+	}
+}
+
+type histogramValue struct {
+	values []string
+	// Observations in each bucket, not cumulative
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+// Histograms keyed by the values of labels
+type HistogramVec struct {
+	name   string
+	help   string
+	labels []string
+	bounds []float64
+	lock   sync.Mutex
+	values map[string]*histogramValue
+}
+
+func (m *Metrics) NewHistogramVec(name, help string, bounds []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{name: name, help: help, labels: labels, bounds: bounds, values: map[string]*histogramValue{}}
+	m.register(h)
+	return h
+}
+
+// Record an observation, such as a duration in seconds, for values
+func (h *HistogramVec) Observe(observed float64, values ...string) {
+	key := strings.Join(values, "\xff")
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	v, ok := h.values[key]
+	if !ok {
+		v = &histogramValue{values: values, buckets: make([]uint64, len(h.bounds))}
+		h.values[key] = v
+	}
+	if i := sort.SearchFloat64s(h.bounds, observed); i < len(h.bounds) {
+		v.buckets[i]++
+	}
+	v.sum += observed
+	v.count++
+}
+
+// Record the time since start in seconds
+func (h *HistogramVec) ObserveSince(start time.Time, values ...string) {
+	h.Observe(time.Since(start).Seconds(), values...)
+}
+
+// Number of observations for values, for tests
+func (h *HistogramVec) Count(values ...string) uint64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if v, ok := h.values[strings.Join(values, "\xff")]; ok {
+		return v.count
+	}
+	return 0
+}
+
+func (h *HistogramVec) writeMetrics(buf *bytes.Buffer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	writeMetricHeader(buf, h.name, h.help, "histogram")
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		v := h.values[key]
+		var cumulative uint64
+		for i, bound := range h.bounds {
+			cumulative += v.buckets[i]
+			writeSample(buf, h.name+"_bucket", h.labels, v.values, `le="`+formatMetricValue(bound)+`"`, float64(cumulative))
+		}
+		writeSample(buf, h.name+"_bucket", h.labels, v.values, `le="+Inf"`, float64(v.count))
+		writeSample(buf, h.name+"_sum", h.labels, v.values, "", v.sum)
+		writeSample(buf, h.name+"_count", h.labels, v.values, "", float64(v.count))
+	}
+}
+
+// A single value read each time the metrics are written
+type metricFunc struct {
+	name       string
+	help       string
+	metricType string
+	fn         func() float64
+}
+
+func (m *Metrics) NewGaugeFunc(name, help string, fn func() float64) {
+	m.register(&metricFunc{name, help, "gauge", fn})
+}
+
+// For totals kept elsewhere, which only go up
+func (m *Metrics) NewCounterFunc(name, help string, fn func() float64) {
+	m.register(&metricFunc{name, help, "counter", fn})
+}
+
+func (f *metricFunc) writeMetrics(buf *bytes.Buffer) {
+	writeMetricHeader(buf, f.name, f.help, f.metricType)
+	writeSample(buf, f.name, nil, nil, "", f.fn())
+}
+
+// A DbService backed by a database/sql connection pool
+type poolStatser interface {
+	Stats() sql.DBStats
+}
+
+// Export the connection pool stats of db, read on each scrape
+func (m *Metrics) RegisterPool(db poolStatser) {
+	m.NewGaugeFunc("people_db_connections_max_open", "Most connections the pool may open, 0 for no limit", func() float64 {
+		return float64(db.Stats().MaxOpenConnections)
+	})
+	m.NewGaugeFunc("people_db_connections_open", "Connections open, in use or idle", func() float64 {
+		return float64(db.Stats().OpenConnections)
+	})
+	m.NewGaugeFunc("people_db_connections_in_use", "Connections running a query", func() float64 {
+		return float64(db.Stats().InUse)
+	})
+	m.NewGaugeFunc("people_db_connections_idle", "Connections waiting in the pool", func() float64 {
+		return float64(db.Stats().Idle)
+	})
+	m.NewCounterFunc("people_db_connection_waits_total", "Queries that waited for a free connection", func() float64 {
+		return float64(db.Stats().WaitCount)
+	})
+	m.NewCounterFunc("people_db_connection_wait_seconds_total", "Time spent waiting for a free connection", func() float64 {
+		return db.Stats().WaitDuration.Seconds()
+	})
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestMetricsWriteTo(t *testing.T) {
+	m := NewMetrics()
+	counter := m.NewCounterVec("test_requests_total", "Requests", "route", "status")
+	hist := m.NewHistogramVec("test_duration_seconds", "Durations", []float64{.1, 1}, "route")
+	m.NewGaugeFunc("test_open", "Open things", func() float64 { return 3 })
+
+	counter.Inc("/b", "200")
+	counter.Inc("/a", "200")
+	counter.Add(2, "/a", "200")
+	counter.Inc(`say "hi"\`+"\n", "500")
+	hist.Observe(.05, "/a")
+	hist.Observe(.5, "/a")
+	hist.Observe(5, "/a")
+
+	buf := new(bytes.Buffer)
+	_, err := m.WriteTo(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, `# HELP test_requests_total Requests
+# TYPE test_requests_total counter
+test_requests_total{route="/a",status="200"} 3
+test_requests_total{route="/b",status="200"} 1
+test_requests_total{route="say \"hi\"\\\n",status="500"} 1
+# HELP test_duration_seconds Durations
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{route="/a",le="0.1"} 1
+test_duration_seconds_bucket{route="/a",le="1"} 2
+test_duration_seconds_bucket{route="/a",le="+Inf"} 3
+test_duration_seconds_sum{route="/a"} 5.55
+test_duration_seconds_count{route="/a"} 3
+# HELP test_open Open things
+# TYPE test_open gauge
+test_open 3
+`, buf.String())
+
+	assert.Equal(t, float64(3), counter.Value("/a", "200"))
+	assert.Equal(t, float64(0), counter.Value("/c", "200"))
+	assert.Equal(t, uint64(3), hist.Count("/a"))
+}
+
+type mockPool struct {
+	stats sql.DBStats
+}
+
+func (p mockPool) Stats() sql.DBStats {
+	return p.stats
+}
+
+func TestMetricsRegisterPool(t *testing.T) {
+	m := NewMetrics()
+	m.RegisterPool(mockPool{sql.DBStats{
+		MaxOpenConnections: 20,
+		OpenConnections:    5,
+		InUse:              2,
+		Idle:               3,
+		WaitCount:          7,
+		WaitDuration:       1500 * time.Millisecond,
+	}})
+
+	buf := new(bytes.Buffer)
+	m.WriteTo(buf)
+	for _, line := range []string{
+		"people_db_connections_max_open 20\n",
+		"people_db_connections_open 5\n",
+		"people_db_connections_in_use 2\n",
+		"people_db_connections_idle 3\n",
+		"# TYPE people_db_connection_waits_total counter\npeople_db_connection_waits_total 7\n",
+		"people_db_connection_wait_seconds_total 1.5\n",
+	} {
+		assert.Contains(t, buf.String(), line)
+	}
+}
+
+func TestPgDbServiceQueryMetrics(t *testing.T) {
+	pgdbs := NewPgDbService("mock", "")
+	before := dbQueryDuration.Count(QueryGetUser)
+
+	sqlmock.ExpectQuery(`SELECT (.+) FROM "user" WHERE email=?`).
+		WithArgs("test@example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).FromCSVString("1"))
+	pgdbs.GetUser(context.Background(), "test@example.com")
+
+	// Failed queries are timed too
+	pgdbs.GetUser(context.Background(), "test@example.com")
+
+	assert.Equal(t, before+2, dbQueryDuration.Count(QueryGetUser))
+}
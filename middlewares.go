@@ -5,6 +5,32 @@ import (
 	"net/http"
 )
 
+/*
+Middleware giving each request an ID
+
+An X-Request-ID sent by the client is kept, so a request can be traced
+across services. It is echoed in the response, and logged with the
+request
+*/
+func RequestIdMiddleware(rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
+	requestId(rw, req.Request)
+	next(rw, req)
+}
+
+type requestLogKey struct{}
+
+// Details the access log learns as a request is handled
+type requestLog struct {
+	userId int
+}
+
+// Record the authenticated user of req for the access log
+func logRequestUser(req *http.Request, user *User) {
+	if entry, ok := req.Context().Value(requestLogKey{}).(*requestLog); ok {
+		entry.userId = user.Id
+	}
+}
+
 /*
 Middleware to hook in the database service
 
@@ -27,28 +53,45 @@ If successful, sets a User to the current AuthContext
 func (c *AuthContext) AuthRequired(rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
 	_, creds, err := GetAuthHeader(req.Request.Header)
 	if err != nil {
-		UnauthorizedHeader(rw)
+		UnauthorizedHeader(rw, req.Request)
 		return
 	}
 
 	email, apikey, err := ParseCredentials(creds)
 	if err != nil {
-		http.Error(rw, "Invalid authentication params", http.StatusBadRequest)
+		authAttemptsTotal.Inc(AuthMethodApiKey, AuthFailure)
+		writeError(rw, req.Request, http.StatusBadRequest, ErrCodeInvalidAuthParams, InvalidAuthParams)
 		return
 	}
 
-	user, err := c.DB.GetUser(email)
+	user, err := c.DB.GetUser(req.Context(), email)
+	if writeUnavailable(rw, req, err) {
+		return
+	}
 	if err != nil {
-		http.Error(rw, "Invalid user", http.StatusForbidden)
+		authAttemptsTotal.Inc(AuthMethodApiKey, AuthFailure)
+		writeError(rw, req.Request, http.StatusForbidden, ErrCodeInvalidUser, InvalidUser)
 		return
 	}
 
 	if !user.CheckApiKey(apikey) {
-		http.Error(rw, "Incorrect API key", http.StatusForbidden)
+		authAttemptsTotal.Inc(AuthMethodApiKey, AuthFailure)
+		writeError(rw, req.Request, http.StatusForbidden, ErrCodeIncorrectApiKey, IncorrectApiKey)
 		return
 	}
 
+	authAttemptsTotal.Inc(AuthMethodApiKey, AuthSuccess)
 	c.User = user
+	logRequestUser(req.Request, user)
 
 	next(rw, req)
 }
+
+// Middleware to refuse users who are not superusers, after AuthRequired
+func (c *AdminContext) SuperuserRequired(rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
+	if !c.User.IsSuperuser {
+		writeError(rw, req.Request, http.StatusForbidden, ErrCodeForbidden, SuperuserRequiredError)
+		return
+	}
+	next(rw, req)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/stretchr/testify/assert"
@@ -29,6 +30,23 @@ func TestDbMiddleware(t *testing.T) {
 	assert.Equal(t, c.DB, dbs)
 }
 
+func TestRequestIdMiddleware(t *testing.T) {
+	rw, req, next, rec := mockMiddlewareParams()
+	req.Header.Set(RequestIdHeader, "abc-123")
+
+	RequestIdMiddleware(rw, req, next.Next)
+
+	next.Mock.AssertExpectations(t)
+	assert.Equal(t, "abc-123", rec.Header().Get(RequestIdHeader))
+
+	rw, req, next, rec = mockMiddlewareParams()
+	RequestIdMiddleware(rw, req, next.Next)
+
+	id := rec.Header().Get(RequestIdHeader)
+	assert.Len(t, id, 36)
+	assert.Equal(t, id, req.Header.Get(RequestIdHeader), "Kept for the rest of the request")
+}
+
 func TestAuthRequiredAuthorizesValid(t *testing.T) {
 	user := newTestUser()
 
@@ -44,6 +62,7 @@ func TestAuthRequiredAuthorizesValid(t *testing.T) {
 
 	ac := new(AuthContext)
 	ac.Context = c
+	successes := authAttemptsTotal.Value(AuthMethodApiKey, AuthSuccess)
 
 	// Call the middleware
 	(*AuthContext).AuthRequired(ac, rw, req, next.Next)
@@ -58,6 +77,8 @@ func TestAuthRequiredAuthorizesValid(t *testing.T) {
 	assert.Equal(t, ac.User, user)
 	// Nothing was written to the responsewriter
 	assert.Equal(t, rec.Body.String(), "")
+	// The success was counted
+	assert.Equal(t, successes+1, authAttemptsTotal.Value(AuthMethodApiKey, AuthSuccess))
 }
 
 func TestAuthRequiredNoHeader(t *testing.T) {
@@ -76,8 +97,7 @@ func TestAuthRequiredNoHeader(t *testing.T) {
 	next.Mock.AssertNotCalled(t, "Next", rw, req)
 	dbs.Mock.AssertNotCalled(t, "GetUser", user.Email)
 	assert.Nil(t, ac.User)
-	assert.Equal(t, rec.Code, http.StatusUnauthorized)
-	assert.Equal(t, rec.Body.String(), ApiKeyRequiredError+"\n")
+	assertApiError(t, rec, http.StatusUnauthorized, ErrCodeUnauthorized, ApiKeyRequiredError)
 }
 
 func TestAuthRequiredInvalidAuthScheme(t *testing.T) {
@@ -98,8 +118,7 @@ func TestAuthRequiredInvalidAuthScheme(t *testing.T) {
 	next.Mock.AssertNotCalled(t, "Next", rw, req)
 	dbs.Mock.AssertNotCalled(t, "GetUser", user.Email)
 	assert.Nil(t, ac.User)
-	assert.Equal(t, rec.Code, http.StatusUnauthorized)
-	assert.Equal(t, rec.Body.String(), ApiKeyRequiredError+"\n")
+	assertApiError(t, rec, http.StatusUnauthorized, ErrCodeUnauthorized, ApiKeyRequiredError)
 }
 
 func TestAuthRequiredBadCreds(t *testing.T) {
@@ -120,8 +139,7 @@ func TestAuthRequiredBadCreds(t *testing.T) {
 	next.Mock.AssertNotCalled(t, "Next", rw, req)
 	dbs.Mock.AssertNotCalled(t, "GetUser", user.Email)
 	assert.Nil(t, ac.User)
-	assert.Equal(t, rec.Code, http.StatusBadRequest)
-	assert.Equal(t, rec.Body.String(), "Invalid authentication params\n")
+	assertApiError(t, rec, http.StatusBadRequest, ErrCodeInvalidAuthParams, InvalidAuthParams)
 }
 
 func TestAuthRequiredInvalidUser(t *testing.T) {
@@ -142,8 +160,27 @@ func TestAuthRequiredInvalidUser(t *testing.T) {
 	next.Mock.AssertNotCalled(t, "Next", rw, req)
 	dbs.Mock.AssertCalled(t, "GetUser", user.Email)
 	assert.Nil(t, ac.User)
-	assert.Equal(t, rec.Code, http.StatusForbidden)
-	assert.Equal(t, rec.Body.String(), "Invalid user\n")
+	assertApiError(t, rec, http.StatusForbidden, ErrCodeInvalidUser, InvalidUser)
+}
+
+func TestAuthRequiredTimeout(t *testing.T) {
+	user := newTestUser()
+
+	rw, req, next, rec := mockMiddlewareParams()
+	authHeader := fmt.Sprintf("Apikey %s:%s", user.Email, user.ApiKey)
+	req.Request.Header.Add("Authorization", authHeader)
+
+	c, dbs := mockDbContext(user)
+	dbs.Mock.On("GetUser", user.Email).Return(nil, context.DeadlineExceeded)
+
+	ac := new(AuthContext)
+	ac.Context = c
+
+	(*AuthContext).AuthRequired(ac, rw, req, next.Next)
+
+	next.Mock.AssertNotCalled(t, "Next", rw, req)
+	assert.Nil(t, ac.User)
+	assertApiError(t, rec, http.StatusGatewayTimeout, ErrCodeTimeout, RequestTimedOutError)
 }
 
 func TestAuthRequiredInvalidApikey(t *testing.T) {
@@ -158,12 +195,38 @@ func TestAuthRequiredInvalidApikey(t *testing.T) {
 
 	ac := new(AuthContext)
 	ac.Context = c
+	failures := authAttemptsTotal.Value(AuthMethodApiKey, AuthFailure)
 
 	(*AuthContext).AuthRequired(ac, rw, req, next.Next)
 
 	next.Mock.AssertNotCalled(t, "Next", rw, req)
 	dbs.Mock.AssertCalled(t, "GetUser", user.Email)
 	assert.Nil(t, ac.User)
-	assert.Equal(t, rec.Code, http.StatusForbidden)
-	assert.Equal(t, rec.Body.String(), "Incorrect API key\n")
+	assertApiError(t, rec, http.StatusForbidden, ErrCodeIncorrectApiKey, IncorrectApiKey)
+	assert.Equal(t, failures+1, authAttemptsTotal.Value(AuthMethodApiKey, AuthFailure))
+}
+
+func TestSuperuserRequired(t *testing.T) {
+	user := newTestUser()
+	user.IsSuperuser = true
+
+	rw, req, next, rec := mockMiddlewareParams()
+	ac, _ := mockAuthContext(user)
+
+	(*AdminContext).SuperuserRequired(&AdminContext{ac}, rw, req, next.Next)
+
+	next.Mock.AssertCalled(t, "Next", rw, req)
+	assert.Equal(t, "", rec.Body.String())
+}
+
+func TestSuperuserRequiredNotSuperuser(t *testing.T) {
+	user := newTestUser()
+
+	rw, req, next, rec := mockMiddlewareParams()
+	ac, _ := mockAuthContext(user)
+
+	(*AdminContext).SuperuserRequired(&AdminContext{ac}, rw, req, next.Next)
+
+	next.Mock.AssertNotCalled(t, "Next", rw, req)
+	assertApiError(t, rec, http.StatusForbidden, ErrCodeForbidden, SuperuserRequiredError)
 }
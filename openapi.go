@@ -0,0 +1,351 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gocraft/web"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	OpenApiVersion = "3.0.3"
+	OpenApiTitle   = "People server"
+	// Version of the API described, raised whenever it changes
+	ApiVersion = "1.4.0"
+
+	FormContentType = "application/x-www-form-urlencoded"
+
+	// How a route authenticates its caller, see RouteSpec.Auth
+	RouteAuthNone   = ""
+	RouteAuthApiKey = "apikey"
+	// An API key of a superuser
+	RouteAuthSuperuser = "superuser"
+
+	openApiSchemaRef = "#/components/schemas/"
+)
+
+// Body of POST /auth, sent as a form
+type AuthForm struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+/*
+What a route takes and returns, for the OpenAPI document
+
+Request and Response hold a value of the type sent in the body, such as
+UserCreate{}, whose JSON encoding is described from its fields
+*/
+type RouteSpec struct {
+	Summary string
+	// RouteAuthNone, RouteAuthApiKey or RouteAuthSuperuser
+	Auth string
+	// Names of the optional query string parameters, all strings
+	Query []string
+	// Nil without a body
+	Request interface{}
+	// JsonContentType unless set
+	RequestType string
+	// Status of a successful response, 200 unless set
+	Status   int
+	Response interface{}
+	// JsonContentType unless set
+	ResponseType string
+	// Other statuses the route may respond with
+	Errors []int
+	// Body sent with the Errors statuses, the error envelope unless set
+	ErrorResponse interface{}
+}
+
+// An OpenAPI 3 document, with the parts this server uses
+type OpenApiDoc struct {
+	OpenApi    string                           `json:"openapi"`
+	Info       OpenApiInfo                      `json:"info"`
+	Paths      map[string]map[string]*Operation `json:"paths"`
+	Components OpenApiComponents                `json:"components"`
+}
+
+type OpenApiInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type OpenApiComponents struct {
+	Schemas         map[string]*Schema        `json:"schemas"`
+	SecuritySchemes map[string]SecurityScheme `json:"securitySchemes"`
+}
+
+type SecurityScheme struct {
+	Type        string `json:"type"`
+	In          string `json:"in"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+type Operation struct {
+	OperationId string                `json:"operationId"`
+	Summary     string                `json:"summary"`
+	Parameters  []Parameter           `json:"parameters,omitempty"`
+	RequestBody *RequestBody          `json:"requestBody,omitempty"`
+	Responses   map[string]*Response  `json:"responses"`
+	Security    []map[string][]string `json:"security,omitempty"`
+}
+
+type Parameter struct {
+	Name     string  `json:"name"`
+	In       string  `json:"in"`
+	Required bool    `json:"required"`
+	Schema   *Schema `json:"schema"`
+}
+
+type RequestBody struct {
+	Required bool                 `json:"required"`
+	Content  map[string]MediaType `json:"content"`
+}
+
+type Response struct {
+	Description string               `json:"description"`
+	Content     map[string]MediaType `json:"content,omitempty"`
+}
+
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+// A JSON schema, as OpenAPI 3.0 writes them
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Pattern              string             `json:"pattern,omitempty"`
+	Nullable             bool               `json:"nullable,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+}
+
+// Matches a gocraft/web path parameter, ":name" or ":name:regex"
+var pathParamRegexp = regexp.MustCompile(`^:([^:]+)(?::(.*))?$`)
+
+/*
+Generate the OpenAPI document describing routes
+
+Every type named in a RouteSpec becomes a schema under components,
+named after the Go type
+*/
+func NewOpenApiDoc(routes []PathRoute) *OpenApiDoc {
+	doc := &OpenApiDoc{
+		OpenApi: OpenApiVersion,
+		Info:    OpenApiInfo{Title: OpenApiTitle, Version: ApiVersion},
+		Paths:   map[string]map[string]*Operation{},
+		Components: OpenApiComponents{
+			Schemas: map[string]*Schema{},
+			SecuritySchemes: map[string]SecurityScheme{
+				RouteAuthApiKey: {
+					Type:        "apiKey",
+					In:          "header",
+					Name:        AuthHeaderKey,
+					Description: `Apikey email="<email>" key="<api_key>", or Apikey <email>:<api_key>`,
+				},
+			},
+		},
+	}
+
+	for _, route := range routes {
+		path, params := openApiPath(route.Path)
+		if doc.Paths[path] == nil {
+			doc.Paths[path] = map[string]*Operation{}
+		}
+		doc.Paths[path][strings.ToLower(route.Method.name)] = doc.operation(route, params)
+	}
+	return doc
+}
+
+func (doc *OpenApiDoc) operation(route PathRoute, params []Parameter) *Operation {
+	spec := route.Spec
+	name := handlerName(route.Handler)
+	op := &Operation{
+		OperationId: name[strings.LastIndex(name, ".")+1:],
+		Summary:     spec.Summary,
+		Parameters:  params,
+		Responses:   map[string]*Response{},
+	}
+	for _, query := range spec.Query {
+		op.Parameters = append(op.Parameters, Parameter{Name: query, In: "query", Schema: &Schema{Type: "string"}})
+	}
+
+	if spec.Auth != RouteAuthNone {
+		// Superusers authenticate with their API key like anyone else
+		op.Security = []map[string][]string{{RouteAuthApiKey: {}}}
+	}
+
+	if spec.Request != nil {
+		op.RequestBody = &RequestBody{
+			Required: true,
+			Content:  doc.content(defaultString(spec.RequestType, JsonContentType), spec.Request),
+		}
+	}
+
+	status := spec.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	op.Responses[strconv.Itoa(status)] = &Response{
+		Description: http.StatusText(status),
+		Content:     doc.content(defaultString(spec.ResponseType, JsonContentType), spec.Response),
+	}
+
+	errorResponse := spec.ErrorResponse
+	if errorResponse == nil {
+		errorResponse = apiErrorEnvelope{}
+	}
+	for _, status := range spec.Errors {
+		op.Responses[strconv.Itoa(status)] = &Response{
+			Description: http.StatusText(status),
+			Content:     doc.content(JsonContentType, errorResponse),
+		}
+	}
+	return op
+}
+
+// Content of a body of v's type, nil without a body
+func (doc *OpenApiDoc) content(contentType string, v interface{}) map[string]MediaType {
+	if v == nil {
+		return nil
+	}
+	return map[string]MediaType{contentType: {doc.schema(reflect.TypeOf(v))}}
+}
+
+/*
+Describe the JSON encoding of t
+
+Named structs are added to the components once and referred to
+*/
+func (doc *OpenApiDoc) schema(t reflect.Type) *Schema {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if t == reflect.TypeOf(json.RawMessage{}) {
+		// Any JSON value
+		return &Schema{}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.Slice, reflect.Array:
+		return &Schema{Type: "array", Items: doc.schema(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: doc.schema(t.Elem())}
+	case reflect.Struct:
+		name := schemaName(t)
+		if _, ok := doc.Components.Schemas[name]; !ok {
+			// Claim the name first, so a type referring to itself ends
+			doc.Components.Schemas[name] = nil
+			doc.Components.Schemas[name] = doc.structSchema(t)
+		}
+		return &Schema{Ref: openApiSchemaRef + name}
+	}
+	return &Schema{}
+}
+
+// The properties of a struct, as encoding/json would write them
+func (doc *OpenApiDoc) structSchema(t reflect.Type) *Schema {
+	s := &Schema{Type: "object", Properties: map[string]*Schema{}}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		name := field.Name
+		if tag := field.Tag.Get("json"); tag != "" {
+			if tag == "-" {
+				continue
+			}
+			if parts := strings.Split(tag, ","); parts[0] != "" {
+				name = parts[0]
+			}
+		}
+
+		fieldSchema := doc.schema(field.Type)
+		if override := field.Tag.Get("openapi"); override != "" {
+			parts := strings.Split(override, ",")
+			fieldSchema = &Schema{Type: parts[0], Nullable: containsString(parts[1:], "nullable")}
+		}
+		s.Properties[name] = fieldSchema
+	}
+	return s
+}
+
+// A Go type name usable as a schema name, such as ApiErrorEnvelope
+func schemaName(t reflect.Type) string {
+	name := t.Name()
+	if name == "" {
+		return "Object"
+	}
+	return strings.ToUpper(name[:1]) + name[1:]
+}
+
+/*
+Turn a gocraft/web route path into an OpenAPI one and its parameters
+
+"/api/person/:id:\d+" becomes "/api/person/{id}", with id an integer
+*/
+func openApiPath(routePath string) (string, []Parameter) {
+	segments := strings.Split(routePath, "/")
+	params := []Parameter{}
+	for i, segment := range segments {
+		match := pathParamRegexp.FindStringSubmatch(segment)
+		if match == nil {
+			continue
+		}
+		name, pattern := match[1], match[2]
+		schema := &Schema{Type: "string"}
+		switch pattern {
+		case "":
+		case `\d+`:
+			schema = &Schema{Type: "integer"}
+		default:
+			schema.Pattern = "^" + pattern + "$"
+		}
+		params = append(params, Parameter{Name: name, In: "path", Required: true, Schema: schema})
+		segments[i] = "{" + name + "}"
+	}
+	if len(params) == 0 {
+		params = nil
+	}
+	return strings.Join(segments, "/"), params
+}
+
+// The OpenAPI document of every route the server serves, as indented JSON
+func openApiJson() ([]byte, error) {
+	s := new(Server)
+	s.setupRoutes()
+
+	out, err := json.MarshalIndent(NewOpenApiDoc(s.routes), "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(out, '\n'), nil
+}
+
+// Handler serving the OpenAPI document of the API
+func (s *Server) OpenApiApi(c *Context, rw web.ResponseWriter, req *web.Request) {
+	out, err := json.Marshal(NewOpenApiDoc(s.routes))
+	if err != nil {
+		writeError(rw, req.Request, http.StatusInternalServerError, ErrCodeInternal, InternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", JsonContentType)
+	rw.Write(out)
+}
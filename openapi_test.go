@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const openApiFile = "openapi.json"
+
+func TestOpenApiDocInSync(t *testing.T) {
+	generated, err := openApiJson()
+	if !assert.Nil(t, err) {
+		return
+	}
+	committed, err := ioutil.ReadFile(openApiFile)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	assert.Equal(t, string(generated), string(committed),
+		openApiFile+" is out of date, regenerate it with: go run . openapi > "+openApiFile)
+}
+
+func TestOpenApiDocRoutes(t *testing.T) {
+	s := new(Server)
+	s.setupRoutes()
+	doc := NewOpenApiDoc(s.routes)
+
+	assert.Equal(t, OpenApiVersion, doc.OpenApi)
+	for _, route := range s.routes {
+		assert.NotEqual(t, "", route.Spec.Summary, route.Key())
+
+		path, _ := openApiPath(route.Path)
+		op := doc.Paths[path][strings.ToLower(route.Method.name)]
+		if !assert.NotNil(t, op, route.Key()) {
+			continue
+		}
+		assert.Equal(t, route.Spec.Auth != RouteAuthNone, len(op.Security) > 0, route.Key())
+		assert.NotEqual(t, 0, len(op.Responses), route.Key())
+	}
+
+	// Every schema referred to is described
+	for name, schema := range doc.Components.Schemas {
+		assert.NotNil(t, schema, name)
+	}
+}
+
+func TestOpenApiPath(t *testing.T) {
+	tests := []struct {
+		in     string
+		path   string
+		params []Parameter
+	}{
+		{"/api/person", "/api/person", nil},
+		{`/api/person/:id:\d+`, "/api/person/{id}", []Parameter{
+			{Name: "id", In: "path", Required: true, Schema: &Schema{Type: "integer"}},
+		}},
+		{"/api/:name", "/api/{name}", []Parameter{
+			{Name: "name", In: "path", Required: true, Schema: &Schema{Type: "string"}},
+		}},
+		{"/api/:name:[a-z]+", "/api/{name}", []Parameter{
+			{Name: "name", In: "path", Required: true, Schema: &Schema{Type: "string", Pattern: "^[a-z]+$"}},
+		}},
+	}
+
+	for _, test := range tests {
+		path, params := openApiPath(test.in)
+		assert.Equal(t, test.path, path, test.in)
+		assert.Equal(t, test.params, params, test.in)
+	}
+}
+
+func TestOpenApiSchema(t *testing.T) {
+	doc := NewOpenApiDoc(nil)
+
+	ref := doc.schema(reflect.TypeOf([]PersonJSON{}))
+	assert.Equal(t, "array", ref.Type)
+	assert.Equal(t, openApiSchemaRef+"PersonJSON", ref.Items.Ref)
+
+	person := doc.Components.Schemas["PersonJSON"]
+	if assert.NotNil(t, person) {
+		assert.Equal(t, &Schema{Type: "integer", Nullable: true}, person.Properties["color"])
+		assert.Equal(t, &Schema{Type: "string"}, person.Properties["name"])
+		assert.Equal(t, "object", person.Properties["meta"].Type)
+	}
+
+	doc.schema(reflect.TypeOf(&User{}))
+	user := doc.Components.Schemas["User"]
+	if assert.NotNil(t, user) {
+		_, hasPwhash := user.Properties["pwhash"]
+		assert.False(t, hasPwhash)
+		assert.Equal(t, &Schema{Type: "string"}, user.Properties["email"])
+	}
+}
+
+func TestOpenApiApi(t *testing.T) {
+	s := new(Server)
+	s.setupRoutes()
+	c, _ := mockDbContext(nil)
+	rw, req, rec := mockHandlerParams("GET", "", "")
+
+	s.OpenApiApi(c, rw, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, JsonContentType, rec.Header().Get("Content-Type"))
+
+	var doc OpenApiDoc
+	if assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &doc), rec.Body.String()) {
+		assert.Equal(t, OpenApiVersion, doc.OpenApi)
+		assert.NotNil(t, doc.Paths["/api/person/{id}"]["get"])
+	}
+}
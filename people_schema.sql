@@ -118,6 +118,17 @@ CREATE TABLE location (
 );
 
 
+--
+-- Name: location_tombstone; Type: TABLE; Schema: public; Owner: -; Tablespace: 
+--
+
+CREATE TABLE location_tombstone (
+    id integer NOT NULL,
+    user_id integer NOT NULL,
+    version bigint NOT NULL
+);
+
+
 --
 -- Name: location_id_seq; Type: SEQUENCE; Schema: public; Owner: -
 --
@@ -145,7 +156,10 @@ CREATE TABLE person (
     id integer NOT NULL,
     user_id integer NOT NULL,
     name character varying(45) NOT NULL,
-    meta hstore DEFAULT ''::hstore NOT NULL
+    meta hstore DEFAULT ''::hstore NOT NULL,
+    color integer,
+    version bigint DEFAULT 0 NOT NULL,
+    created_version bigint DEFAULT 0 NOT NULL
 );
 
 
@@ -168,6 +182,17 @@ CREATE SEQUENCE person_id_seq
 ALTER SEQUENCE person_id_seq OWNED BY person.id;
 
 
+--
+-- Name: person_tombstone; Type: TABLE; Schema: public; Owner: -; Tablespace: 
+--
+
+CREATE TABLE person_tombstone (
+    id integer NOT NULL,
+    user_id integer NOT NULL,
+    version bigint NOT NULL
+);
+
+
 --
 -- Name: person_tag; Type: TABLE; Schema: public; Owner: -; Tablespace: 
 --
@@ -179,6 +204,17 @@ CREATE TABLE person_tag (
 );
 
 
+--
+-- Name: person_tag_tombstone; Type: TABLE; Schema: public; Owner: -; Tablespace: 
+--
+
+CREATE TABLE person_tag_tombstone (
+    id integer NOT NULL,
+    user_id integer NOT NULL,
+    version bigint NOT NULL
+);
+
+
 --
 -- Name: person_tag_id_seq; Type: SEQUENCE; Schema: public; Owner: -
 --
@@ -268,7 +304,12 @@ ALTER SEQUENCE tag_type_id_seq OWNED BY tag_type.id;
 CREATE TABLE "user" (
     id integer NOT NULL,
     email character varying(254) NOT NULL,
-    name character varying(45) NOT NULL
+    pwhash text NOT NULL,
+    name character varying(45) NOT NULL,
+    is_active boolean NOT NULL,
+    is_superuser boolean NOT NULL,
+    apikey character varying(40) NOT NULL,
+    sync_version bigint DEFAULT 0 NOT NULL
 );
 
 
@@ -349,6 +390,14 @@ ALTER TABLE ONLY location
     ADD CONSTRAINT pk_location_id PRIMARY KEY (id);
 
 
+--
+-- Name: pk_location_tombstone_id; Type: CONSTRAINT; Schema: public; Owner: -; Tablespace: 
+--
+
+ALTER TABLE ONLY location_tombstone
+    ADD CONSTRAINT pk_location_tombstone_id PRIMARY KEY (id);
+
+
 --
 -- Name: pk_person_id; Type: CONSTRAINT; Schema: public; Owner: -; Tablespace: 
 --
@@ -357,6 +406,14 @@ ALTER TABLE ONLY person
     ADD CONSTRAINT pk_person_id PRIMARY KEY (id);
 
 
+--
+-- Name: pk_person_tombstone_id; Type: CONSTRAINT; Schema: public; Owner: -; Tablespace: 
+--
+
+ALTER TABLE ONLY person_tombstone
+    ADD CONSTRAINT pk_person_tombstone_id PRIMARY KEY (id);
+
+
 --
 -- Name: pk_person_tag_id; Type: CONSTRAINT; Schema: public; Owner: -; Tablespace: 
 --
@@ -365,6 +422,14 @@ ALTER TABLE ONLY person_tag
     ADD CONSTRAINT pk_person_tag_id PRIMARY KEY (id);
 
 
+--
+-- Name: pk_person_tag_tombstone_id; Type: CONSTRAINT; Schema: public; Owner: -; Tablespace: 
+--
+
+ALTER TABLE ONLY person_tag_tombstone
+    ADD CONSTRAINT pk_person_tag_tombstone_id PRIMARY KEY (id);
+
+
 --
 -- Name: pk_tag_id; Type: CONSTRAINT; Schema: public; Owner: -; Tablespace: 
 --
@@ -413,6 +478,48 @@ ALTER TABLE ONLY "user"
     ADD CONSTRAINT uq_user_email UNIQUE (email);
 
 
+--
+-- Name: ix_location_person_id; Type: INDEX; Schema: public; Owner: -; Tablespace: 
+--
+
+CREATE INDEX ix_location_person_id ON location USING btree (person_id);
+
+
+--
+-- Name: ix_location_tombstone_user_id_version; Type: INDEX; Schema: public; Owner: -; Tablespace: 
+--
+
+CREATE INDEX ix_location_tombstone_user_id_version ON location_tombstone USING btree (user_id, version);
+
+
+--
+-- Name: ix_person_tag_person_id; Type: INDEX; Schema: public; Owner: -; Tablespace: 
+--
+
+CREATE INDEX ix_person_tag_person_id ON person_tag USING btree (person_id);
+
+
+--
+-- Name: ix_person_tag_tombstone_user_id_version; Type: INDEX; Schema: public; Owner: -; Tablespace: 
+--
+
+CREATE INDEX ix_person_tag_tombstone_user_id_version ON person_tag_tombstone USING btree (user_id, version);
+
+
+--
+-- Name: ix_person_user_id_version; Type: INDEX; Schema: public; Owner: -; Tablespace: 
+--
+
+CREATE INDEX ix_person_user_id_version ON person USING btree (user_id, version);
+
+
+--
+-- Name: ix_person_tombstone_user_id_version; Type: INDEX; Schema: public; Owner: -; Tablespace: 
+--
+
+CREATE INDEX ix_person_tombstone_user_id_version ON person_tombstone USING btree (user_id, version);
+
+
 --
 -- Name: fk_api_key_user_id; Type: FK CONSTRAINT; Schema: public; Owner: -
 --
@@ -429,6 +536,14 @@ ALTER TABLE ONLY location
     ADD CONSTRAINT fk_location_person_id FOREIGN KEY (person_id) REFERENCES person(id);
 
 
+--
+-- Name: fk_location_tombstone_user_id; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY location_tombstone
+    ADD CONSTRAINT fk_location_tombstone_user_id FOREIGN KEY (user_id) REFERENCES "user"(id);
+
+
 --
 -- Name: fk_person_tag_person_id; Type: FK CONSTRAINT; Schema: public; Owner: -
 --
@@ -445,6 +560,14 @@ ALTER TABLE ONLY person_tag
     ADD CONSTRAINT fk_person_tag_user_id FOREIGN KEY (tag_id) REFERENCES tag(id);
 
 
+--
+-- Name: fk_person_tag_tombstone_user_id; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY person_tag_tombstone
+    ADD CONSTRAINT fk_person_tag_tombstone_user_id FOREIGN KEY (user_id) REFERENCES "user"(id);
+
+
 --
 -- Name: fk_person_user_id; Type: FK CONSTRAINT; Schema: public; Owner: -
 --
@@ -453,6 +576,14 @@ ALTER TABLE ONLY person
     ADD CONSTRAINT fk_person_user_id FOREIGN KEY (user_id) REFERENCES "user"(id);
 
 
+--
+-- Name: fk_person_tombstone_user_id; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY person_tombstone
+    ADD CONSTRAINT fk_person_tombstone_user_id FOREIGN KEY (user_id) REFERENCES "user"(id);
+
+
 --
 -- Name: fk_tag_type_id; Type: FK CONSTRAINT; Schema: public; Owner: -
 --
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"github.com/lib/pq/hstore"
@@ -10,15 +11,45 @@ import (
 
 const (
 	PersonInvalid = "Person is not valid"
+
+	// Every column of "person" read into a Person, in order
+	PersonColumns = "id, user_id, name, meta, color, version, created_version"
+
 	// Person.Validate errors
 	PersonNameEmpty = "Name cannot be empty"
 )
 
+const (
+	getPersonSql = `SELECT ` + PersonColumns + ` FROM "person" WHERE id=? AND user_id=?`
+	// Read in a transaction, so the person cannot change before it ends
+	getPersonForUpdateSql = getPersonSql + forUpdateSql
+	// In a fixed order, as the response's ETag is taken from it
+	getPeopleSql    = `SELECT ` + PersonColumns + ` FROM "person" WHERE user_id=? ORDER BY id`
+	createPersonSql = `INSERT INTO "person" (
+		user_id,
+		name,
+		meta,
+		color,
+		version,
+		created_version
+	) VALUES (?, ?, ?, ?, ?, ?) RETURNING id;`
+	updatePersonSql = `UPDATE "person" SET name = ?, meta = ?, color = ?, version = ? WHERE id=? AND user_id=?;`
+	deletePersonSql = `DELETE FROM "person" WHERE id=? AND user_id=?;`
+)
+
 type PersonService interface {
 	// People related methods
-	GetPerson(userId, id int) (*Person, error)
-	GetPeople(userId int) ([]Person, error)
-	CreatePerson(userId int, name string, meta hstore.Hstore, color sql.NullInt64) (*Person, error)
+	GetPerson(ctx context.Context, userId, id int) (*Person, error)
+	GetPeople(ctx context.Context, userId int) ([]Person, error)
+	CreatePerson(ctx context.Context, userId int, name string, meta hstore.Hstore, color sql.NullInt64) (*Person, error)
+	// Save the name, meta and color of person, sql.ErrNoRows if its user has no such person
+	UpdatePerson(ctx context.Context, person *Person) error
+	// Delete a person, leaving a tombstone for sync. sql.ErrNoRows if the user has no such person
+	DeletePerson(ctx context.Context, userId, id int) error
+	// What changed in the user's people after the since version, see PersonChanges
+	GetPersonChanges(ctx context.Context, userId int, since int64) (*PersonChanges, error)
+	// In a transaction, lock the user's people before reading one to change it
+	LockPeople(ctx context.Context, userId int) error
 }
 
 type Person struct {
@@ -27,23 +58,30 @@ type Person struct {
 	Name   string
 	Meta   hstore.Hstore
 	Color  sql.NullInt64
-	errors JsonErrors
+	// The user's sync version of the last change to the person, and of its creation
+	Version        int64
+	CreatedVersion int64 `db:"created_version"`
+	errors         JsonErrors
 }
 
-func (p *Person) MarshalJSON() ([]byte, error) {
+// The JSON representation of p
+func (p *Person) JSON() PersonJSON {
 	colorVal, _ := p.Color.Value()
 	colorJSON := []byte(Jsonify(colorVal))
 
 	metaVal := HstoreToMap(&p.Meta)
 
-	pJson := PersonJSON{
+	return PersonJSON{
 		Id:     p.Id,
 		UserId: p.UserId,
 		Name:   p.Name,
 		Meta:   metaVal,
 		Color:  colorJSON,
 	}
+}
 
+func (p *Person) MarshalJSON() ([]byte, error) {
+	pJson := p.JSON()
 	return json.Marshal(&pJson)
 }
 
@@ -55,6 +93,12 @@ func (p *Person) UnmarshalJSON(b []byte) error {
 		return err
 	}
 
+	p.setJSON(pJson)
+	return nil
+}
+
+// Set the fields of p sent in pJson
+func (p *Person) setJSON(pJson *PersonJSON) {
 	p.Id = pJson.Id
 	p.UserId = pJson.UserId
 	p.Name = pJson.Name
@@ -68,8 +112,6 @@ func (p *Person) UnmarshalJSON(b []byte) error {
 		json.Unmarshal(pJson.Color, &colorVal)
 		p.Color = sql.NullInt64{colorVal, true}
 	}
-
-	return nil
 }
 
 func (p *Person) Errors() JsonErrors {
@@ -95,10 +137,13 @@ func (p *Person) Validate() bool {
 /*
 Fetch a Person by id from the database
 */
-func (s *pgDbService) GetPerson(userId, id int) (*Person, error) {
+func (s *pgDbService) GetPerson(ctx context.Context, userId, id int) (*Person, error) {
+	defer observeQuery(ctx, s.system(), QueryGetPerson)()
 	person := new(Person)
 
-	err := s.db.Get(person, s.db.Rebind(`SELECT * FROM "person" WHERE id=? AND user_id=?`), id, userId)
+	err := s.read(ctx, []string{userKey(userId)}, func(stmts *pgStatements) error {
+		return stmts.use(ctx, stmts.getPerson).GetContext(ctx, person, id, userId)
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -108,10 +153,14 @@ func (s *pgDbService) GetPerson(userId, id int) (*Person, error) {
 /*
 Fetch all Person objects related to the user
 */
-func (s *pgDbService) GetPeople(userId int) ([]Person, error) {
-	people := []Person{}
-
-	err := s.db.Select(&people, s.db.Rebind(`SELECT * FROM "person" WHERE user_id=?`), userId)
+func (s *pgDbService) GetPeople(ctx context.Context, userId int) ([]Person, error) {
+	defer observeQuery(ctx, s.system(), QueryGetPeople)()
+	var people []Person
+
+	err := s.read(ctx, []string{userKey(userId)}, func(stmts *pgStatements) error {
+		people = []Person{}
+		return stmts.use(ctx, stmts.getPeople).SelectContext(ctx, &people, userId)
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -121,12 +170,13 @@ func (s *pgDbService) GetPeople(userId int) ([]Person, error) {
 
 /*
 Create a Person in the database with the given userId, name, meta and color
+
+The person is created at the user's next sync version
 */
-func (s *pgDbService) CreatePerson(userId int, name string, meta hstore.Hstore, color sql.NullInt64) (*Person, error) {
+func (s *pgDbService) CreatePerson(ctx context.Context, userId int, name string, meta hstore.Hstore, color sql.NullInt64) (*Person, error) {
+	defer observeQuery(ctx, s.system(), QueryCreatePerson)()
 	newPerson := new(Person)
 
-	var personId int
-
 	newPerson.UserId = userId
 	newPerson.Name = name
 	newPerson.Meta = meta
@@ -136,24 +186,109 @@ func (s *pgDbService) CreatePerson(userId int, name string, meta hstore.Hstore,
 		return nil, NewValidationError(PersonInvalid, newPerson.Errors())
 	}
 
-	insertSql := s.db.Rebind(`INSERT INTO "person" (
-		user_id,
-		name,
-		meta,
-		color
-	) VALUES (?, ?, ?, ?) RETURNING id;`)
-
-	err := s.db.QueryRowx(insertSql,
-		newPerson.UserId,
-		newPerson.Name,
-		newPerson.Meta,
-		newPerson.Color).Scan(&personId)
+	err := s.inTx(ctx, func(tx *pgDbService) error {
+		version, err := tx.nextSyncVersion(ctx, userId)
+		if err != nil {
+			return err
+		}
+		newPerson.Version = version
+		newPerson.CreatedVersion = version
+
+		return tx.stmts.use(ctx, tx.stmts.createPerson).QueryRowxContext(ctx,
+			newPerson.UserId,
+			newPerson.Name,
+			newPerson.Meta,
+			newPerson.Color,
+			newPerson.Version,
+			newPerson.CreatedVersion).Scan(&newPerson.Id)
+	})
 
 	if err != nil {
 		return nil, err
 	}
-
-	newPerson.Id = personId
+	s.wrote(userKey(userId))
 
 	return newPerson, nil
 }
+
+/*
+Save the name, meta and color of a Person
+
+The person is matched on both its id and user id, and moved to the
+user's next sync version
+*/
+func (s *pgDbService) UpdatePerson(ctx context.Context, person *Person) error {
+	defer observeQuery(ctx, s.system(), QueryUpdatePerson)()
+	if !person.Validate() {
+		return NewValidationError(PersonInvalid, person.Errors())
+	}
+
+	err := s.inTx(ctx, func(tx *pgDbService) error {
+		version, err := tx.nextSyncVersion(ctx, person.UserId)
+		if err != nil {
+			return err
+		}
+
+		result, err := tx.stmts.use(ctx, tx.stmts.updatePerson).ExecContext(ctx,
+			person.Name,
+			person.Meta,
+			person.Color,
+			version,
+			person.Id,
+			person.UserId)
+		if err != nil {
+			return err
+		}
+		if err := checkRowsAffected(result); err != nil {
+			return err
+		}
+
+		person.Version = version
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+	s.wrote(userKey(person.UserId))
+
+	return nil
+}
+
+/*
+Delete a Person, matched on both its id and user id
+
+A tombstone at the user's next sync version takes its place, and those
+of its tag links and locations, deleted with it
+*/
+func (s *pgDbService) DeletePerson(ctx context.Context, userId, id int) error {
+	defer observeQuery(ctx, s.system(), QueryDeletePerson)()
+
+	err := s.inTx(ctx, func(tx *pgDbService) error {
+		version, err := tx.nextSyncVersion(ctx, userId)
+		if err != nil {
+			return err
+		}
+
+		if err := tx.deletePersonRelated(ctx, userId, id, version); err != nil {
+			return err
+		}
+		result, err := tx.stmts.use(ctx, tx.stmts.deletePerson).ExecContext(ctx, id, userId)
+		if err != nil {
+			return err
+		}
+		if err := checkRowsAffected(result); err != nil {
+			return err
+		}
+
+		_, err = tx.stmts.use(ctx, tx.stmts.createTombstone).ExecContext(ctx, id, userId, version)
+		return err
+	})
+
+	if err != nil {
+		return err
+	}
+	s.wrote(userKey(userId))
+
+	return nil
+}
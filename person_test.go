@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"github.com/DATA-DOG/go-sqlmock"
@@ -14,13 +15,15 @@ func TestPersonFields(t *testing.T) {
 	personType := reflect.TypeOf(Person{})
 
 	fieldCount := personType.NumField()
-	assert.Equal(t, fieldCount, 6)
+	assert.Equal(t, fieldCount, 8)
 
 	_, idExists := personType.FieldByName("Id")
 	_, userIdExists := personType.FieldByName("UserId")
 	_, nameExists := personType.FieldByName("Name")
 	_, metaExists := personType.FieldByName("Meta")
 	_, colorExists := personType.FieldByName("Color")
+	_, versionExists := personType.FieldByName("Version")
+	_, createdVersionExists := personType.FieldByName("CreatedVersion")
 	_, errorsExists := personType.FieldByName("errors")
 
 	assert.True(t, idExists)
@@ -28,6 +31,8 @@ func TestPersonFields(t *testing.T) {
 	assert.True(t, nameExists)
 	assert.True(t, metaExists)
 	assert.True(t, colorExists)
+	assert.True(t, versionExists)
+	assert.True(t, createdVersionExists)
 	assert.True(t, errorsExists)
 }
 
@@ -39,12 +44,25 @@ func TestPersonFieldsDb(t *testing.T) {
 	nameField, _ := personType.FieldByName("Name")
 	metaField, _ := personType.FieldByName("Meta")
 	colorField, _ := personType.FieldByName("Color")
+	createdVersionField, _ := personType.FieldByName("CreatedVersion")
 
 	assert.Equal(t, idField.Tag.Get("db"), "")
 	assert.Equal(t, userIdField.Tag.Get("db"), "user_id")
 	assert.Equal(t, nameField.Tag.Get("db"), "")
 	assert.Equal(t, metaField.Tag.Get("db"), "")
 	assert.Equal(t, colorField.Tag.Get("db"), "")
+	assert.Equal(t, createdVersionField.Tag.Get("db"), "created_version")
+}
+
+// Expect a write to begin its transaction by taking the user's next sync version
+func expectNextSyncVersion(userId int, version int64) {
+	sqlmock.ExpectBegin()
+	sqlmock.ExpectExec(`UPDATE "user" SET sync_version = sync_version \+ 1 WHERE id=\?;`).
+		WithArgs(userId).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	sqlmock.ExpectQuery(`SELECT sync_version FROM "user" WHERE id=\?`).
+		WithArgs(userId).
+		WillReturnRows(sqlmock.NewRows([]string{"sync_version"}).AddRow(version))
 }
 
 func TestGetPersonNotFound(t *testing.T) {
@@ -53,11 +71,11 @@ func TestGetPersonNotFound(t *testing.T) {
 	personId := 1
 	userId := 2
 
-	sqlmock.ExpectQuery(`SELECT \* FROM "person" WHERE id=\? AND user_id=\?`).
+	sqlmock.ExpectQuery(`SELECT id, user_id, name, meta, color, version, created_version FROM "person" WHERE id=\? AND user_id=\?`).
 		WithArgs(personId, userId).
 		WillReturnError(errors.New("Could not find person"))
 
-	p, err := pgdbs.GetPerson(userId, personId)
+	p, err := pgdbs.GetPerson(context.Background(), userId, personId)
 	if !assert.Nil(t, p, "Person should be nil") {
 		return
 	}
@@ -74,7 +92,7 @@ func TestGetPerson(t *testing.T) {
 
 	personId := 1
 	userId := 2
-	cols := []string{"id", "user_id", "name", "meta", "color"}
+	cols := []string{"id", "user_id", "name", "meta", "color", "version", "created_version"}
 
 	meta := hstore.Hstore{map[string]sql.NullString{"type": {"asdf", true}}}
 	metaVal, _ := meta.Value()
@@ -82,11 +100,11 @@ func TestGetPerson(t *testing.T) {
 	color := sql.NullInt64{1, true}
 	colorVal, _ := color.Value()
 
-	sqlmock.ExpectQuery(`SELECT \* FROM "person" WHERE id=\? AND user_id=\?`).
+	sqlmock.ExpectQuery(`SELECT id, user_id, name, meta, color, version, created_version FROM "person" WHERE id=\? AND user_id=\?`).
 		WithArgs(personId, userId).
-		WillReturnRows(sqlmock.NewRows(cols).AddRow(1, userId, "Person 1", metaVal, colorVal))
+		WillReturnRows(sqlmock.NewRows(cols).AddRow(1, userId, "Person 1", metaVal, colorVal, 3, 2))
 
-	p, err := pgdbs.GetPerson(userId, personId)
+	p, err := pgdbs.GetPerson(context.Background(), userId, personId)
 	if !assert.Nil(t, err, "Query should not error") {
 		return
 	}
@@ -98,6 +116,8 @@ func TestGetPerson(t *testing.T) {
 	assert.Equal(t, p.Id, personId)
 	assert.Equal(t, p.Meta, meta)
 	assert.Equal(t, p.Color, color)
+	assert.Equal(t, int64(3), p.Version)
+	assert.Equal(t, int64(2), p.CreatedVersion)
 }
 
 func TestGetPeopleError(t *testing.T) {
@@ -105,11 +125,11 @@ func TestGetPeopleError(t *testing.T) {
 
 	userId := 1
 
-	sqlmock.ExpectQuery(`SELECT \* FROM "person" WHERE user_id=\?`).
+	sqlmock.ExpectQuery(`SELECT id, user_id, name, meta, color, version, created_version FROM "person" WHERE user_id=\? ORDER BY id`).
 		WithArgs(userId).
 		WillReturnError(errors.New("Could not find person (list)"))
 
-	pp, err := pgdbs.GetPeople(userId)
+	pp, err := pgdbs.GetPeople(context.Background(), userId)
 	if !assert.Nil(t, pp, "Person list should be null") {
 		return
 	}
@@ -121,6 +141,17 @@ func TestGetPeopleError(t *testing.T) {
 	assert.Equal(t, err.Error(), "Could not find person (list)")
 }
 
+func TestGetPeopleCanceled(t *testing.T) {
+	pgdbs := NewPgDbService("mock", "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	pp, err := pgdbs.GetPeople(ctx, 1)
+	assert.Nil(t, pp)
+	assert.Equal(t, context.Canceled, err)
+}
+
 func TestGetPeople(t *testing.T) {
 	pgdbs := NewPgDbService("mock", "")
 
@@ -128,7 +159,7 @@ func TestGetPeople(t *testing.T) {
 	personId1 := 2
 	personId2 := 3
 
-	cols := []string{"id", "user_id", "name", "meta", "color"}
+	cols := []string{"id", "user_id", "name", "meta", "color", "version", "created_version"}
 
 	name1 := "Person 1"
 	name2 := "Person 2"
@@ -145,13 +176,13 @@ func TestGetPeople(t *testing.T) {
 	colorVal1, _ := color1.Value()
 	colorVal2, _ := color2.Value()
 
-	sqlmock.ExpectQuery(`SELECT \* FROM "person" WHERE user_id=\?`).
+	sqlmock.ExpectQuery(`SELECT id, user_id, name, meta, color, version, created_version FROM "person" WHERE user_id=\?`).
 		WithArgs(userId).
 		WillReturnRows(sqlmock.NewRows(cols).
-		AddRow(personId1, userId, name1, metaVal1, colorVal1).
-		AddRow(personId2, userId, name2, metaVal2, colorVal2))
+		AddRow(personId1, userId, name1, metaVal1, colorVal1, 1, 1).
+		AddRow(personId2, userId, name2, metaVal2, colorVal2, 2, 2))
 
-	pp, err := pgdbs.GetPeople(userId)
+	pp, err := pgdbs.GetPeople(context.Background(), userId)
 	if !assert.Nil(t, err, "Query should not error") {
 		return
 	}
@@ -338,7 +369,7 @@ func TestCreatePersonEmptyName(t *testing.T) {
 	names := []string{"", " ", "\t", "\n"}
 
 	for _, name := range names {
-		_, err := pgdbs.CreatePerson(userId, name, meta, color)
+		_, err := pgdbs.CreatePerson(context.Background(), userId, name, meta, color)
 
 		if verr, ok := err.(ValidationError); assert.True(t, ok) {
 			assert.Error(t, verr, "Empty name should cause error")
@@ -357,11 +388,13 @@ func TestCreatePersonQueryError(t *testing.T) {
 	MapToHstore(map[string]string{}, &meta)
 	color := sql.NullInt64{0, false}
 
-	sqlmock.ExpectQuery(`INSERT INTO "person" \( user_id, name, meta, color \) VALUES \(\?, \?, \?, \?\) RETURNING id;`).
-		WithArgs(userId, name, meta, color).
+	expectNextSyncVersion(userId, 4)
+	sqlmock.ExpectQuery(`INSERT INTO "person" \( user_id, name, meta, color, version, created_version \) VALUES \(\?, \?, \?, \?, \?, \?\) RETURNING id;`).
+		WithArgs(userId, name, meta, color, 4, 4).
 		WillReturnError(errors.New("Could not insert"))
+	sqlmock.ExpectRollback()
 
-	p, err := pgdbs.CreatePerson(userId, name, meta, color)
+	p, err := pgdbs.CreatePerson(context.Background(), userId, name, meta, color)
 
 	if !assert.Nil(t, p, "Person should be nil") {
 		return
@@ -387,11 +420,13 @@ func TestCreatePerson(t *testing.T) {
 	metaVal, _ := meta.Value()
 	colorVal, _ := color.Value()
 
-	sqlmock.ExpectQuery(`INSERT INTO "person" \( user_id, name, meta, color \) VALUES \(\?, \?, \?, \?\) RETURNING id;`).
-		WithArgs(userId, name, metaVal, colorVal).
+	expectNextSyncVersion(userId, 4)
+	sqlmock.ExpectQuery(`INSERT INTO "person" \( user_id, name, meta, color, version, created_version \) VALUES \(\?, \?, \?, \?, \?, \?\) RETURNING id;`).
+		WithArgs(userId, name, metaVal, colorVal, 4, 4).
 		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(personNewId))
+	sqlmock.ExpectCommit()
 
-	p, err := pgdbs.CreatePerson(userId, name, meta, color)
+	p, err := pgdbs.CreatePerson(context.Background(), userId, name, meta, color)
 
 	if !assert.Nil(t, err, "Error should be nil") {
 		return
@@ -402,6 +437,122 @@ func TestCreatePerson(t *testing.T) {
 	}
 
 	assert.Equal(t, p.Id, personNewId)
+	assert.Equal(t, int64(4), p.Version)
+	assert.Equal(t, int64(4), p.CreatedVersion)
+}
+
+func TestUpdatePersonInvalidPerson(t *testing.T) {
+	pgdbs := NewPgDbService("mock", "")
+
+	person := newTestPerson(1)
+	person.Name = ""
+
+	err := pgdbs.UpdatePerson(context.Background(), person)
+
+	if verr, ok := err.(ValidationError); assert.True(t, ok) {
+		assert.Equal(t, JsonErrors{"name": PersonNameEmpty}, verr.JsonErrors())
+	}
+}
+
+func TestUpdatePersonNotFound(t *testing.T) {
+	pgdbs := NewPgDbService("mock", "")
+
+	person := newTestPerson(1)
+	MapToHstore(map[string]string{"a": "b"}, &person.Meta)
+	metaVal, _ := person.Meta.Value()
+	colorVal, _ := person.Color.Value()
+
+	expectNextSyncVersion(person.UserId, 5)
+	sqlmock.ExpectExec(`UPDATE "person" SET name = \?, meta = \?, color = \?, version = \? WHERE id=\? AND user_id=\?;`).
+		WithArgs(person.Name, metaVal, colorVal, 5, person.Id, person.UserId).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	sqlmock.ExpectRollback()
+
+	err := pgdbs.UpdatePerson(context.Background(), person)
+
+	assert.Equal(t, sql.ErrNoRows, err)
+}
+
+func TestUpdatePerson(t *testing.T) {
+	pgdbs := NewPgDbService("mock", "")
+
+	person := newTestPerson(1)
+	MapToHstore(map[string]string{"a": "b"}, &person.Meta)
+	metaVal, _ := person.Meta.Value()
+	colorVal, _ := person.Color.Value()
+
+	expectNextSyncVersion(person.UserId, 5)
+	sqlmock.ExpectExec(`UPDATE "person" SET name = \?, meta = \?, color = \?, version = \? WHERE id=\? AND user_id=\?;`).
+		WithArgs(person.Name, metaVal, colorVal, 5, person.Id, person.UserId).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	sqlmock.ExpectCommit()
+
+	err := pgdbs.UpdatePerson(context.Background(), person)
+
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), person.Version)
+}
+
+// The tag links and locations of the user's person with id are deleted, leaving tombstones at version
+func expectDeletePersonRelated(userId, id int, version int64) {
+	for _, table := range []string{"person_tag", "location"} {
+		sqlmock.ExpectExec(`INSERT INTO "`+table+`_tombstone" \(id, user_id, version\)\s+SELECT id, \?, \? FROM "`+table+`" `+
+			`WHERE person_id IN \(SELECT id FROM "person" WHERE id=\? AND user_id=\?\)`).
+			WithArgs(userId, version, id, userId).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		sqlmock.ExpectExec(`DELETE FROM "`+table+`" WHERE person_id IN \(SELECT id FROM "person" WHERE id=\? AND user_id=\?\)`).
+			WithArgs(id, userId).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+}
+
+func TestDeletePersonNotFound(t *testing.T) {
+	pgdbs := NewPgDbService("mock", "")
+
+	expectNextSyncVersion(1, 6)
+	expectDeletePersonRelated(1, 2, 6)
+	sqlmock.ExpectExec(`DELETE FROM "person" WHERE id=\? AND user_id=\?;`).
+		WithArgs(2, 1).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	sqlmock.ExpectRollback()
+
+	err := pgdbs.DeletePerson(context.Background(), 1, 2)
+
+	assert.Equal(t, sql.ErrNoRows, err)
+}
+
+func TestDeletePerson(t *testing.T) {
+	pgdbs := NewPgDbService("mock", "")
+
+	expectNextSyncVersion(1, 6)
+	expectDeletePersonRelated(1, 2, 6)
+	sqlmock.ExpectExec(`DELETE FROM "person" WHERE id=\? AND user_id=\?;`).
+		WithArgs(2, 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	sqlmock.ExpectExec(`INSERT INTO "person_tombstone" \(id, user_id, version\) VALUES \(\?, \?, \?\);`).
+		WithArgs(2, 1, 6).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	sqlmock.ExpectCommit()
+
+	err := pgdbs.DeletePerson(context.Background(), 1, 2)
+
+	assert.Nil(t, err)
+}
+
+func TestLockPeople(t *testing.T) {
+	pgdbs := NewPgDbService("mock", "")
+
+	sqlmock.ExpectBegin()
+	sqlmock.ExpectExec(`SELECT id FROM "user" WHERE id=\? FOR UPDATE`).
+		WithArgs(1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	sqlmock.ExpectCommit()
+
+	err := pgdbs.WithTx(context.Background(), func(tx DbService) error {
+		return tx.LockPeople(context.Background(), 1)
+	})
+
+	assert.Nil(t, err)
 }
 
 func TestPersonErrors(t *testing.T) {
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+const (
+	ReloadFailed    = "Config reload failed, keeping the current config:\n%s"
+	ReloadUnchanged = "Config reloaded, nothing changed"
+	ReloadApplied   = "Config reloaded, %d setting(s) applied, %d need a restart"
+	ReloadChange    = "  %s: %s -> %s"
+	ReloadRestart   = "  %s: %s -> %s (requires restart, not applied)"
+)
+
+// A setting that differs between two configs
+type configChange struct {
+	Path    string
+	Old     string
+	New     string
+	Restart bool
+}
+
+func (c configChange) String() string {
+	tmpl := ReloadChange
+	if c.Restart {
+		tmpl = ReloadRestart
+	}
+	return fmt.Sprintf(tmpl, c.Path, c.Old, c.New)
+}
+
+func showConfigValue(field configField) string {
+	if field.Secret && field.Value.Len() > 0 {
+		return SecretMask
+	}
+	if field.Value.Kind() == reflect.String {
+		return fmt.Sprintf("%q", field.Value.String())
+	}
+	return fmt.Sprint(field.Value.Interface())
+}
+
+// List every setting that differs from old to new, in field order
+func diffConfig(old, new *appConfig) []configChange {
+	changes := []configChange{}
+
+	newFields := new.fields()
+	for i, oldField := range old.fields() {
+		newField := newFields[i]
+		if reflect.DeepEqual(oldField.Value.Interface(), newField.Value.Interface()) {
+			continue
+		}
+		changes = append(changes, configChange{
+			Path:    oldField.FlagName(),
+			Old:     showConfigValue(oldField),
+			New:     showConfigValue(newField),
+			Restart: !oldField.Reload,
+		})
+	}
+
+	return changes
+}
+
+/*
+A copy of next with every setting that needs a restart kept from current
+
+The result describes what the running server actually uses
+*/
+func mergeReloadable(current, next *appConfig) *appConfig {
+	merged := *next
+
+	currentFields := current.fields()
+	for i, field := range merged.fields() {
+		if !field.Reload {
+			field.Value.Set(currentFields[i].Value)
+		}
+	}
+
+	return &merged
+}
+
+/*
+Reloads the config on demand, normally on SIGHUP
+
+Load reads the config from the same sources used at startup. Apply
+receives each accepted config; a config that fails to load or validate
+is rejected and the current one stays in place
+*/
+type ConfigReloader struct {
+	current *appConfig
+	load    func() (*appConfig, error)
+	apply   func(*appConfig)
+	logger  *log.Logger
+	lock    sync.Mutex
+}
+
+func NewConfigReloader(current *appConfig, load func() (*appConfig, error), apply func(*appConfig), logger *log.Logger) *ConfigReloader {
+	return &ConfigReloader{
+		current: current,
+		load:    load,
+		apply:   apply,
+		logger:  logger,
+	}
+}
+
+// The config currently in effect
+func (r *ConfigReloader) Current() *appConfig {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.current
+}
+
+/*
+Load the config again and apply the settings that can change at runtime
+
+Logs what changed, and which changes were not applied because they
+need a restart
+*/
+func (r *ConfigReloader) Reload() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	next, err := r.load()
+	if err != nil {
+		r.logger.Printf(ReloadFailed, err)
+		return err
+	}
+
+	changes := diffConfig(r.current, next)
+	if len(changes) == 0 {
+		r.logger.Print(ReloadUnchanged)
+		return nil
+	}
+
+	applied, restart := 0, 0
+	lines := []string{}
+	for _, change := range changes {
+		if change.Restart {
+			restart++
+		} else {
+			applied++
+		}
+		lines = append(lines, change.String())
+	}
+	r.logger.Printf(ReloadApplied+"\n%s", applied, restart, strings.Join(lines, "\n"))
+
+	if applied > 0 {
+		r.current = mergeReloadable(r.current, next)
+		r.apply(r.current)
+	}
+
+	return nil
+}
+
+// Reload on every signal received, until signals is closed
+func (r *ConfigReloader) Watch(signals <-chan os.Signal) {
+	for range signals {
+		r.Reload()
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"log"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func newTestReloader(current *appConfig, next *appConfig, err error) (*ConfigReloader, *[]*appConfig, *bytes.Buffer) {
+	applied := []*appConfig{}
+	buf := new(bytes.Buffer)
+
+	load := func() (*appConfig, error) {
+		return next, err
+	}
+	apply := func(conf *appConfig) {
+		applied = append(applied, conf)
+	}
+
+	return NewConfigReloader(current, load, apply, log.New(buf, "", 0)), &applied, buf
+}
+
+func TestDiffConfig(t *testing.T) {
+	old := &appConfig{
+		DbConf: dbConfig{
+			Host:     "oldhost",
+			Password: "oldpw",
+		},
+	}
+	new := &appConfig{
+		DbConf: dbConfig{
+			Host:     "newhost",
+			Password: "newpw",
+		},
+		ListenConf: listenConfig{
+			Port: 4000,
+		},
+	}
+
+	expected := []configChange{
+		{"db.host", `"oldhost"`, `"newhost"`, true},
+		{"db.password", SecretMask, SecretMask, true},
+		{"listen.port", "0", "4000", true},
+	}
+
+	assert.Equal(t, expected, diffConfig(old, new))
+	assert.Equal(t, []configChange{}, diffConfig(old, old))
+}
+
+func TestConfigChangeString(t *testing.T) {
+	change := configChange{"listen.port", "0", "4000", true}
+	assert.Equal(t, "  listen.port: 0 -> 4000 (requires restart, not applied)", change.String())
+
+	change.Restart = false
+	assert.Equal(t, "  listen.port: 0 -> 4000", change.String())
+}
+
+func TestMergeReloadableKeepsRestartSettings(t *testing.T) {
+	current := &appConfig{DbConf: dbConfig{Type: "postgres"}}
+	next := &appConfig{DbConf: dbConfig{Type: "other"}}
+
+	merged := mergeReloadable(current, next)
+	assert.Equal(t, current, merged)
+	assert.Equal(t, "other", next.DbConf.Type, "next should be untouched")
+}
+
+func TestConfigReloaderRejectsInvalid(t *testing.T) {
+	current := &appConfig{}
+	reloader, applied, buf := newTestReloader(current, nil, errors.New("broken config"))
+
+	err := reloader.Reload()
+
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, len(*applied))
+	assert.Equal(t, current, reloader.Current())
+	assert.True(t, strings.Contains(buf.String(), "keeping the current config"))
+	assert.True(t, strings.Contains(buf.String(), "broken config"))
+}
+
+func TestConfigReloaderUnchanged(t *testing.T) {
+	current := &appConfig{}
+	reloader, applied, buf := newTestReloader(current, &appConfig{}, nil)
+
+	err := reloader.Reload()
+
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(*applied))
+	assert.Equal(t, ReloadUnchanged+"\n", buf.String())
+}
+
+func TestConfigReloaderRestartRequired(t *testing.T) {
+	current := &appConfig{}
+	next := &appConfig{
+		DbConf: dbConfig{
+			Type: "postgres",
+		},
+		ListenConf: listenConfig{
+			Address: "0.0.0.0",
+		},
+	}
+	reloader, applied, buf := newTestReloader(current, next, nil)
+
+	err := reloader.Reload()
+
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(*applied), "Nothing reloadable changed")
+	assert.Equal(t, current, reloader.Current())
+	assert.True(t, strings.Contains(buf.String(), "0 setting(s) applied, 2 need a restart"))
+	assert.True(t, strings.Contains(buf.String(), `db.type: "" -> "postgres" (requires restart, not applied)`))
+	assert.True(t, strings.Contains(buf.String(), `listen.address: "" -> "0.0.0.0" (requires restart, not applied)`))
+}
+
+func TestConfigReloaderWatch(t *testing.T) {
+	loads := 0
+	reloader := NewConfigReloader(&appConfig{}, func() (*appConfig, error) {
+		loads++
+		return &appConfig{}, nil
+	}, func(*appConfig) {}, log.New(new(bytes.Buffer), "", 0))
+
+	signals := make(chan os.Signal, 2)
+	signals <- syscall.SIGHUP
+	signals <- syscall.SIGHUP
+	close(signals)
+
+	reloader.Watch(signals)
+	assert.Equal(t, 2, loads)
+}
+
+func TestConfigReloaderAppliesTimeouts(t *testing.T) {
+	current := &appConfig{DbConf: dbConfig{Host: "oldhost"}}
+	next := &appConfig{
+		DbConf: dbConfig{Host: "newhost"},
+		TimeoutConf: timeoutConfig{
+			Default: Duration(5 * time.Second),
+		},
+	}
+	reloader, applied, buf := newTestReloader(current, next, nil)
+
+	err := reloader.Reload()
+
+	assert.Nil(t, err)
+	if !assert.Equal(t, 1, len(*applied)) {
+		return
+	}
+	assert.Equal(t, "oldhost", (*applied)[0].DbConf.Host)
+	assert.Equal(t, 5*time.Second, (*applied)[0].RequestTimeout("GET /api/person"))
+	assert.True(t, strings.Contains(buf.String(), "1 setting(s) applied, 1 need a restart"))
+	assert.True(t, strings.Contains(buf.String(), "  timeouts.default: 0s -> 5s\n"))
+}
+
+func TestConfigReloaderAppliesLogLevel(t *testing.T) {
+	current := &appConfig{LogConf: logConfig{Level: "info"}}
+	next := &appConfig{LogConf: logConfig{Level: "debug"}}
+	reloader, applied, buf := newTestReloader(current, next, nil)
+
+	err := reloader.Reload()
+
+	assert.Nil(t, err)
+	if !assert.Equal(t, 1, len(*applied)) {
+		return
+	}
+	assert.Equal(t, LevelDebug, (*applied)[0].LogOptions().Level)
+	assert.True(t, strings.Contains(buf.String(), "1 setting(s) applied, 0 need a restart"))
+}
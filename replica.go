@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// How often replicas are pinged, and how long each ping may take
+	replicaCheckInterval = 5 * time.Second
+	replicaCheckTimeout  = 2 * time.Second
+
+	DbReplicaDown = "Replica %d is down, reading from the primary: %s"
+	DbReplicaUp   = "Replica %d is up"
+)
+
+// Whether err means the connection to the database was lost or never made
+func isConnError(err error) bool {
+	var netErr *net.OpError
+	return errors.Is(err, driver.ErrBadConn) || errors.As(err, &netErr)
+}
+
+// Keys for the reads a write makes stale, see replicaSet.stick
+func userKey(id int) string {
+	return fmt.Sprintf("user %d", id)
+}
+
+func emailKey(email string) string {
+	return "email " + email
+}
+
+// A read-only copy of the database
+type pgReplica struct {
+	db *sqlx.DB
+	// Read statements, prepared once the replica is first reachable
+	stmts   *pgStatements
+	healthy bool
+}
+
+/*
+Read-only replicas for pgDbService
+
+Reads are spread round-robin over the healthy replicas. A replica is
+taken out when a ping or a query cannot reach it, and put back once a
+ping succeeds.
+
+After a write, reads for the same user go to the primary for the
+stickiness window, so users see their own writes despite replication
+lag. Safe for concurrent use
+*/
+type replicaSet struct {
+	lock       sync.Mutex
+	replicas   []*pgReplica
+	next       int
+	stickiness time.Duration
+	// When each key stops being read from the primary
+	sticky map[string]time.Time
+	now    func() time.Time
+	logger *log.Logger
+}
+
+/*
+Open the replicas with the same pool settings as the primary
+
+A replica that is down is only logged, it is used once it comes up
+*/
+func openReplicas(dbType string, opts DbOptions, logger *log.Logger) (*replicaSet, error) {
+	rs := &replicaSet{
+		stickiness: opts.ReplicaStickiness,
+		sticky:     map[string]time.Time{},
+		now:        time.Now,
+		logger:     logger,
+	}
+
+	for _, dsn := range opts.Replicas {
+		db, err := openDb(dbType, dsn, opts)
+		if err != nil {
+			rs.close()
+			return nil, err
+		}
+		rs.replicas = append(rs.replicas, &pgReplica{db: db})
+	}
+
+	rs.check(context.Background())
+	return rs, nil
+}
+
+/*
+The next healthy replica to read keys from
+
+Returns nil when the primary should serve the read: one of keys was
+written to within the stickiness window, or no replica is healthy
+*/
+func (rs *replicaSet) pick(keys ...string) *pgReplica {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+
+	now := rs.now()
+	for _, key := range keys {
+		if until, ok := rs.sticky[key]; ok {
+			if now.Before(until) {
+				return nil
+			}
+			delete(rs.sticky, key)
+		}
+	}
+
+	for range rs.replicas {
+		r := rs.replicas[rs.next]
+		rs.next = (rs.next + 1) % len(rs.replicas)
+		if r.healthy {
+			return r
+		}
+	}
+	return nil
+}
+
+type primaryReadsKey struct{}
+
+// ctx with every read sent to the primary, for callers that cannot take replication lag
+func withPrimaryReads(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryReadsKey{}, true)
+}
+
+func primaryReads(ctx context.Context) bool {
+	primary, _ := ctx.Value(primaryReadsKey{}).(bool)
+	return primary
+}
+
+// Send reads for keys to the primary for the stickiness window
+func (rs *replicaSet) stick(keys ...string) {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+
+	until := rs.now().Add(rs.stickiness)
+	for _, key := range keys {
+		rs.sticky[key] = until
+	}
+}
+
+// Record the outcome of reaching r, logging when it changes
+func (rs *replicaSet) setHealth(r *pgReplica, err error) {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+
+	healthy := err == nil
+	if healthy == r.healthy {
+		return
+	}
+	r.healthy = healthy
+
+	for i, replica := range rs.replicas {
+		if replica != r {
+			continue
+		}
+		if healthy {
+			rs.logger.Printf(DbReplicaUp, i+1)
+		} else {
+			rs.logger.Printf(DbReplicaDown, i+1, err)
+		}
+	}
+}
+
+/*
+Ping every replica and update its health
+
+Statements are prepared on a replica the first time it is reachable.
+Expired stickiness entries are dropped along the way
+*/
+func (rs *replicaSet) check(ctx context.Context) {
+	for _, r := range rs.replicas {
+		pingCtx, cancel := context.WithTimeout(ctx, replicaCheckTimeout)
+		err := r.db.PingContext(pingCtx)
+		cancel()
+
+		// Only this goroutine sets stmts, and only before it is healthy
+		if err == nil && r.stmts == nil {
+			var stmts pgStatements
+			if stmts, err = prepareStatements(r.db, true); err == nil {
+				r.stmts = &stmts
+			}
+		}
+		rs.setHealth(r, err)
+	}
+
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+
+	now := rs.now()
+	for key, until := range rs.sticky {
+		if !now.Before(until) {
+			delete(rs.sticky, key)
+		}
+	}
+}
+
+// Check the replicas every interval, for the life of the process
+func (rs *replicaSet) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		rs.check(context.Background())
+	}
+}
+
+func (rs *replicaSet) close() {
+	for _, r := range rs.replicas {
+		r.db.Close()
+	}
+}
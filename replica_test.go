@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestReplicaSet(replicas ...*pgReplica) (*replicaSet, *time.Time, *bytes.Buffer) {
+	now := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	buf := new(bytes.Buffer)
+	rs := &replicaSet{
+		replicas:   replicas,
+		stickiness: 5 * time.Second,
+		sticky:     map[string]time.Time{},
+		now:        func() time.Time { return now },
+		logger:     log.New(buf, "", 0),
+	}
+	return rs, &now, buf
+}
+
+// Tables of the tag links and locations deleted with people, which sqlite does not keep
+const testRelatedSchema = `
+CREATE TABLE person_tag (id INTEGER PRIMARY KEY, person_id INTEGER NOT NULL REFERENCES person(id), tag_id INTEGER NOT NULL);
+CREATE TABLE location (id INTEGER PRIMARY KEY, person_id INTEGER NOT NULL REFERENCES person(id), address TEXT NOT NULL);
+CREATE TABLE person_tag_tombstone (id INTEGER PRIMARY KEY, user_id INTEGER NOT NULL, version INTEGER NOT NULL);
+CREATE TABLE location_tombstone (id INTEGER PRIMARY KEY, user_id INTEGER NOT NULL, version INTEGER NOT NULL);
+`
+
+/*
+A sqlite database with the pg statements prepared, holding one user
+
+Stands in for a primary or replica, told apart by the user's name
+*/
+func newTestReplicaDb(t *testing.T, dir, name string) (*sqlx.DB, pgStatements) {
+	db, err := sqlx.Connect(sqliteDriver, sqliteDsn(filepath.Join(dir, name+".db")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.MustExec(sqliteSchema)
+	db.MustExec(testRelatedSchema)
+	db.MustExec(`INSERT INTO "user" (email, pwhash, name, is_active, is_superuser, apikey)
+		VALUES ('test@example.com', 'pwhash', ?, 1, 0, 'apikey')`, name)
+
+	// sqlite has no FOR UPDATE, it locks the whole database instead
+	stmts := pgStatements{}
+	for _, statement := range stmts.statements() {
+		query := strings.TrimSuffix(statement.query, forUpdateSql)
+		if *statement.stmt, err = db.Preparex(db.Rebind(query)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db, stmts
+}
+
+func TestReplicaSetPick(t *testing.T) {
+	one, two, three := &pgReplica{healthy: true}, &pgReplica{}, &pgReplica{healthy: true}
+	rs, _, _ := newTestReplicaSet(one, two, three)
+
+	picked := []*pgReplica{rs.pick(), rs.pick(), rs.pick(), rs.pick()}
+	assert.Equal(t, []*pgReplica{one, three, one, three}, picked)
+
+	one.healthy, three.healthy = false, false
+	assert.Nil(t, rs.pick())
+
+	rs, _, _ = newTestReplicaSet()
+	assert.Nil(t, rs.pick())
+}
+
+func TestReplicaSetStick(t *testing.T) {
+	replica := &pgReplica{healthy: true}
+	rs, now, _ := newTestReplicaSet(replica)
+
+	rs.stick(userKey(1))
+	assert.Nil(t, rs.pick(userKey(1)))
+	assert.Nil(t, rs.pick(emailKey("test@example.com"), userKey(1)))
+	assert.Equal(t, replica, rs.pick(userKey(2)))
+
+	*now = now.Add(5 * time.Second)
+	assert.Equal(t, replica, rs.pick(userKey(1)))
+	assert.Equal(t, 0, len(rs.sticky))
+}
+
+func TestReplicaSetCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "people-replica")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, _ := newTestReplicaDb(t, dir, "replica")
+	replica := &pgReplica{db: db}
+	rs, now, buf := newTestReplicaSet(replica)
+	rs.stick(userKey(1))
+
+	*now = now.Add(time.Minute)
+	rs.check(context.Background())
+	assert.True(t, replica.healthy)
+	if assert.NotNil(t, replica.stmts) {
+		assert.NotNil(t, replica.stmts.getPeople)
+		assert.Nil(t, replica.stmts.createPerson, "Replicas only prepare reads")
+	}
+	assert.Equal(t, 0, len(rs.sticky))
+	assert.Equal(t, "Replica 1 is up\n", buf.String())
+
+	db.Close()
+	rs.check(context.Background())
+	assert.False(t, replica.healthy)
+	assert.Contains(t, buf.String(), "Replica 1 is down, reading from the primary: ")
+
+	// No change, nothing more logged
+	lines := buf.String()
+	rs.check(context.Background())
+	assert.Equal(t, lines, buf.String())
+}
+
+func TestPgDbServiceReplicaReads(t *testing.T) {
+	dir, err := ioutil.TempDir("", "people-replica")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	primaryDb, primaryStmts := newTestReplicaDb(t, dir, "Primary")
+	defer primaryDb.Close()
+	replicaDb, replicaStmts := newTestReplicaDb(t, dir, "Replica")
+	defer replicaDb.Close()
+
+	rs, now, _ := newTestReplicaSet(&pgReplica{db: replicaDb, stmts: &replicaStmts, healthy: true})
+	s := &pgDbService{db: primaryDb, stmts: primaryStmts, replicas: rs}
+	ctx := context.Background()
+
+	user, err := s.GetUser(ctx, "test@example.com")
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, "Replica", user.Name)
+
+	// The write goes to the primary, and the user's own reads see it
+	user.Pwhash = "newhash"
+	assert.Nil(t, s.UpdateUser(ctx, user))
+	user, _ = s.GetUser(ctx, "test@example.com")
+	assert.Equal(t, "newhash", user.Pwhash)
+
+	// The replica has not caught up
+	*now = now.Add(time.Minute)
+	user, _ = s.GetUser(ctx, "test@example.com")
+	assert.Equal(t, "pwhash", user.Pwhash)
+
+	s.WithTx(ctx, func(tx DbService) error {
+		user, _ = tx.GetUser(ctx, "test@example.com")
+		return nil
+	})
+	assert.Equal(t, "newhash", user.Pwhash, "Transactions read from the primary")
+}
+
+// A replica that cannot be reached is taken out, and the read retried on the primary
+func TestPgDbServiceReplicaFallback(t *testing.T) {
+	replicaStmts := &pgStatements{}
+	replica := &pgReplica{stmts: replicaStmts, healthy: true}
+	rs, _, buf := newTestReplicaSet(replica)
+	s := &pgDbService{replicas: rs}
+
+	served := []*pgStatements{}
+	err := s.read(context.Background(), nil, func(stmts *pgStatements) error {
+		served = append(served, stmts)
+		if stmts == replicaStmts {
+			return &net.OpError{Op: "dial", Err: os.ErrDeadlineExceeded}
+		}
+		return nil
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, []*pgStatements{replicaStmts, &s.stmts}, served)
+	assert.False(t, replica.healthy)
+	assert.Contains(t, buf.String(), "Replica 1 is down")
+}
+
+func TestPgDbServicePrimaryReads(t *testing.T) {
+	replicaStmts := &pgStatements{}
+	rs, _, _ := newTestReplicaSet(&pgReplica{stmts: replicaStmts, healthy: true})
+	s := &pgDbService{replicas: rs}
+
+	served := []*pgStatements{}
+	read := func(stmts *pgStatements) error {
+		served = append(served, stmts)
+		return nil
+	}
+	s.read(withPrimaryReads(context.Background()), nil, read)
+	s.read(context.Background(), nil, read)
+
+	assert.Equal(t, []*pgStatements{&s.stmts, replicaStmts}, served)
+}
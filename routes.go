@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gocraft/web"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+const (
+	// Listeners a route is served on, see RouteInfo.Listener
+	RouteListenerMain  = "main"
+	RouteListenerAdmin = "admin"
+
+	// RouteInfo.Auth of a route anyone may call
+	RouteInfoAuthNone = "none"
+)
+
+// A registered route, as listed by /api/admin/routes and the routes command
+type RouteInfo struct {
+	Method string `json:"method"`
+	// Full path pattern, such as "/api/person/:id:\d+"
+	Path    string `json:"path"`
+	Handler string `json:"handler"`
+	// Names of the middleware a request runs through before the handler, in order
+	Middleware []string `json:"middleware"`
+	// "none", "apikey" or "superuser"
+	Auth     string `json:"auth"`
+	Listener string `json:"listener"`
+}
+
+// Every route the server serves, in the order they were registered
+func (s *Server) RouteInfos() []RouteInfo {
+	infos := make([]RouteInfo, len(s.routes))
+	for i, route := range s.routes {
+		listener := RouteListenerMain
+		if s.adminRouter != nil && route.router.Root().router == s.adminRouter {
+			listener = RouteListenerAdmin
+		}
+		infos[i] = RouteInfo{
+			Method:     route.Method.name,
+			Path:       route.Path,
+			Handler:    handlerName(route.Handler),
+			Middleware: route.router.MiddlewareStack(),
+			Auth:       defaultString(route.Spec.Auth, RouteInfoAuthNone),
+			Listener:   listener,
+		}
+	}
+	return infos
+}
+
+/*
+The routes a server would serve, without starting it
+
+With admin set, monitoring is served on its own listener
+*/
+func describeRoutes(admin bool) []RouteInfo {
+	s := new(Server)
+	if admin {
+		s.adminRouter = web.New(Context{})
+	}
+	s.setupRoutes()
+	return s.RouteInfos()
+}
+
+// Write routes as a table, one route per line
+func writeRouteTable(w io.Writer, routes []RouteInfo) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "METHOD\tPATH\tAUTH\tLISTENER\tHANDLER\tMIDDLEWARE")
+	for _, route := range routes {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", route.Method, route.Path, route.Auth,
+			route.Listener, route.Handler, strings.Join(route.Middleware, ","))
+	}
+	return tw.Flush()
+}
+
+// Handler listing every route, for superusers
+func (s *Server) RoutesApi(c *AdminContext, rw web.ResponseWriter, req *web.Request) {
+	jsonResponse(rw, s.RouteInfos())
+}
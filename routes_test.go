@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/gocraft/web"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// The RouteInfo of the route with key in routes
+func findRouteInfo(routes []RouteInfo, key string) RouteInfo {
+	for _, route := range routes {
+		if route.Method+" "+route.Path == key {
+			return route
+		}
+	}
+	return RouteInfo{}
+}
+
+func TestDescribeRoutes(t *testing.T) {
+	routes := describeRoutes(false)
+	// All but /debug/vars, which only the admin listener serves
+	assert.Equal(t, len(routeKeys())-1, len(routes))
+	assert.Equal(t, RouteInfo{}, findRouteInfo(routes, "GET /debug/vars"))
+
+	rootStack := []string{"route", "tracing", "request_id", "access_log", "metrics", "recover", "cors", "timeout", "db"}
+
+	auth := findRouteInfo(routes, "POST /auth")
+	assert.Equal(t, RouteInfoAuthNone, auth.Auth)
+	assert.Equal(t, RouteListenerMain, auth.Listener)
+	assert.Equal(t, "(*Context).ApiAuth", auth.Handler)
+	assert.Equal(t, append(rootStack, "handler_tracing"), auth.Middleware)
+
+	person := findRouteInfo(routes, `GET /api/person/:id:\d+`)
+	assert.Equal(t, RouteAuthApiKey, person.Auth)
+	assert.Equal(t, append(rootStack, "auth", "handler_tracing"), person.Middleware)
+
+	admin := findRouteInfo(routes, "GET /api/admin/routes")
+	assert.Equal(t, RouteAuthSuperuser, admin.Auth)
+	assert.Equal(t, append(rootStack, "auth", "handler_tracing", "superuser"), admin.Middleware)
+
+	metrics := findRouteInfo(routes, "GET /metrics")
+	assert.Equal(t, RouteListenerMain, metrics.Listener)
+}
+
+func TestDescribeRoutesAdmin(t *testing.T) {
+	routes := describeRoutes(true)
+	assert.Equal(t, len(routeKeys()), len(routes))
+	assert.Equal(t, RouteListenerAdmin, findRouteInfo(routes, "GET /debug/vars").Listener)
+
+	metrics := findRouteInfo(routes, "GET /metrics")
+
+	assert.Equal(t, RouteListenerAdmin, metrics.Listener)
+	assert.Equal(t, []string{"request_id", "recover"}, metrics.Middleware)
+}
+
+func TestWriteRouteTable(t *testing.T) {
+	out := new(bytes.Buffer)
+	routes := []RouteInfo{
+		{"GET", "/a", "(*Context).A", []string{"tracing", "db"}, RouteInfoAuthNone, RouteListenerMain},
+		{"POST", "/longer", "(*AuthContext).B", []string{"auth"}, RouteAuthApiKey, RouteListenerMain},
+	}
+
+	assert.Nil(t, writeRouteTable(out, routes))
+	assert.Equal(t, ""+
+		"METHOD  PATH     AUTH    LISTENER  HANDLER           MIDDLEWARE\n"+
+		"GET     /a       none    main      (*Context).A      tracing,db\n"+
+		"POST    /longer  apikey  main      (*AuthContext).B  auth\n", out.String())
+}
+
+func TestRoutesApi(t *testing.T) {
+	mdbs, _ := newTestMemDbService(t)
+	_, err := mdbs.CreateUser(context.Background(), "admin@example.com", "pwhash", "Admin", "adminkey", true, true)
+	if !assert.Nil(t, err) {
+		return
+	}
+	serv := NewServer(newTestConfig())
+	serv.SetLogger(NewLogger(ioutil.Discard, LevelInfo))
+	router := serv.setupRoutes()
+	router.Middleware(DbMiddleware(mdbs))
+
+	serve := func(auth string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/api/admin/routes", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := serve("Apikey admin@example.com:adminkey")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, JsonContentType, rec.Header().Get("Content-Type"))
+	var routes []RouteInfo
+	if assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &routes), rec.Body.String()) {
+		assert.Equal(t, serv.RouteInfos(), routes)
+	}
+
+	assertApiError(t, serve("Apikey test@example.com:apikey"), http.StatusForbidden, ErrCodeForbidden, SuperuserRequiredError)
+	assertApiError(t, serve(""), http.StatusUnauthorized, ErrCodeUnauthorized, ApiKeyRequiredError)
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	serv := NewServer(newTestConfig())
+	serv.SetLogger(NewLogger(ioutil.Discard, LevelInfo))
+	router := serv.setupRoutes()
+
+	tests := []struct {
+		method string
+		path   string
+		allow  string
+	}{
+		{"DELETE", "/api/person", "GET, POST"},
+		{"PATCH", "/api/person/12", "GET, PUT, DELETE"},
+		{"GET", "/auth", "POST"},
+		{"DELETE", "/api/user/", "POST, GET"},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest(test.method, test.path, nil)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		assertApiError(t, rec, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, MethodNotAllowed)
+		assert.Equal(t, test.allow, rec.Header().Get("Allow"), test.method+" "+test.path)
+	}
+
+	// Unknown paths, including ids the route pattern rejects, are still not found
+	for _, path := range []string{"/nowhere", "/api/person/abc"} {
+		req, _ := http.NewRequest("DELETE", path, nil)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		assertApiError(t, rec, http.StatusNotFound, ErrCodeNotFound, RouteNotFound)
+		assert.Equal(t, "", rec.Header().Get("Allow"), path)
+	}
+}
+
+// Each listener only allows the methods of its own routes
+func TestMethodNotAllowedAdmin(t *testing.T) {
+	serv := NewServer(newTestConfig())
+	serv.SetLogger(NewLogger(ioutil.Discard, LevelInfo))
+	serv.adminRouter = web.New(Context{})
+	router := serv.setupRoutes()
+
+	req, _ := http.NewRequest("POST", "/metrics", nil)
+	rec := httptest.NewRecorder()
+	serv.adminRouter.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	assert.Equal(t, "GET", rec.Header().Get("Allow"))
+
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.True(t, strings.Contains(rec.Body.String(), ErrCodeNotFound))
+}
@@ -1,22 +1,67 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"expvar"
 	"fmt"
 	"github.com/gocraft/web"
+	"net"
 	"net/http"
+	"os"
 	"path"
+	"regexp"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+const (
+	// Name of the recovered panic count in /debug/vars
+	PanicsVar = "panics"
+
+	InternalServerError = "Internal server error"
+	LogPanic            = "Panic serving request"
+	RouteNotFound       = "Not found"
+	MethodNotAllowed    = "Method not allowed"
+)
+
+// Panics recovered while serving requests
+var panicCount = expvar.NewInt(PanicsVar)
+
 type Server struct {
-	conf       Config
+	conf     Config
+	confLock sync.RWMutex
+	logger   *Logger
+	// Given to every request by DbMiddleware
+	db DbService
+	// Nil unless tracing is on
+	tracer     *Tracer
 	rootRouter *web.Router
-	routes     []PathRoute
+	// Serves monitoring when there is an admin listener, nil otherwise
+	adminRouter *web.Router
+	// Set once Shutdown starts, failing the readiness check
+	draining int32
+	// The running HTTP servers, for Shutdown
+	httpServers []*http.Server
+	serversLock sync.Mutex
+	routes      []PathRoute
+	// Compiled Path of each route, in the same order as routes
+	routePatterns []*regexp.Regexp
 }
 
 type PrefixRouter struct {
 	router     *web.Router
 	pathPrefix string
+	// Nil for a root router
+	parent *PrefixRouter
+	// Names of the middleware added to router, in order
+	middleware []string
+	// CORS settings applying to the routes, see CorsGroup
+	corsGroup string
 }
 
 type methodAction func(r *web.Router, path string, fn interface{}) *web.Router
@@ -30,17 +75,80 @@ type PathRoute struct {
 	Method  httpMethod
 	Path    string
 	Handler interface{}
+	// Describes the route in the OpenAPI document
+	Spec RouteSpec
+	// The router serving the route
+	router *PrefixRouter
+}
+
+// Identifies the route in config, e.g. "GET /api/person/:id:\d+"
+func (r PathRoute) Key() string {
+	return r.Method.name + " " + r.Path
 }
 
 func NewServer(conf Config) *Server {
 	serv := new(Server)
 	serv.conf = conf
+	serv.logger = NewLogger(os.Stdout, LevelInfo)
 	return serv
 }
 
-func NewPrefixSubrouter(root *web.Router, prefix string, context interface{}) *PrefixRouter {
-	subrouter := root.Subrouter(context, prefix)
-	return &PrefixRouter{subrouter, prefix}
+// Log to logger instead of stdout. Call before Serve
+func (s *Server) SetLogger(logger *Logger) {
+	s.logger = logger
+}
+
+// The current config, which a reload may replace at any time
+func (s *Server) Config() Config {
+	s.confLock.RLock()
+	defer s.confLock.RUnlock()
+	return s.conf
+}
+
+// Atomically replace the config. Anything reading Config() per request sees the new values
+func (s *Server) SetConfig(conf Config) {
+	s.confLock.Lock()
+	defer s.confLock.Unlock()
+	s.conf = conf
+}
+
+// Wrap a root router, such as one served on a listener
+func NewPrefixRouter(router *web.Router) *PrefixRouter {
+	return &PrefixRouter{router: router}
+}
+
+func NewPrefixSubrouter(parent *PrefixRouter, prefix string, context interface{}) *PrefixRouter {
+	subrouter := parent.router.Subrouter(context, prefix)
+	return &PrefixRouter{router: subrouter, pathPrefix: parent.pathPrefix + prefix, parent: parent}
+}
+
+// Add a middleware to the router, recording it under name
+func (r *PrefixRouter) Middleware(name string, fn interface{}) *PrefixRouter {
+	r.router.Middleware(fn)
+	r.middleware = append(r.middleware, name)
+	return r
+}
+
+// Add a middleware to the router, traced under name
+func (r *PrefixRouter) TracedMiddleware(name string, mw func(web.ResponseWriter, *web.Request, web.NextMiddlewareFunc)) *PrefixRouter {
+	return r.Middleware(name, traceMiddleware(name, mw))
+}
+
+// Names of the middleware a request to one of the router's routes runs through, in order
+func (r *PrefixRouter) MiddlewareStack() []string {
+	stack := []string{}
+	if r.parent != nil {
+		stack = r.parent.MiddlewareStack()
+	}
+	return append(stack, r.middleware...)
+}
+
+// The root router r is under
+func (r *PrefixRouter) Root() *PrefixRouter {
+	for r.parent != nil {
+		r = r.parent
+	}
+	return r
 }
 
 var (
@@ -52,55 +160,619 @@ var (
 )
 
 // Helper method to register a route with the router and server.routes
-func (s *Server) registerRoute(router *PrefixRouter, method httpMethod, routePath string, handler interface{}) {
+func (s *Server) registerRoute(router *PrefixRouter, method httpMethod, routePath string, handler interface{}, spec RouteSpec) {
 	action := method.action
 	action(router.router, routePath, handler)
-	s.routes = append(s.routes, PathRoute{method, path.Join(router.pathPrefix, routePath), handler})
+	route := PathRoute{method, path.Join(router.pathPrefix, routePath), handler, spec, router}
+	s.routes = append(s.routes, route)
+	s.routePatterns = append(s.routePatterns, routePattern(route.Path))
+}
+
+/*
+Compile a route path the way the router matches it
+
+":name" matches one path segment, ":name:regex" a segment matching
+regex, and "*" anything
+*/
+func routePattern(routePath string) *regexp.Regexp {
+	segments := strings.Split(routePath, "/")
+	for i, segment := range segments {
+		switch {
+		case segment == "*":
+			segments[i] = ".*"
+		case strings.HasPrefix(segment, ":"):
+			segments[i] = "[^/]+"
+			if idx := strings.Index(segment[1:], ":"); idx >= 0 {
+				segments[i] = "(?:" + segment[idx+2:] + ")"
+			}
+		default:
+			segments[i] = regexp.QuoteMeta(segment)
+		}
+	}
+	return regexp.MustCompile("^" + strings.Join(segments, "/") + "/?$")
+}
+
+// The route under root serving method and path, if there is one
+func (s *Server) findRoute(root *PrefixRouter, method, urlPath string) (PathRoute, bool) {
+	for i, route := range s.routes {
+		if route.Method.name == method && route.router.Root() == root && s.routePatterns[i].MatchString(urlPath) {
+			return route, true
+		}
+	}
+	return PathRoute{}, false
+}
+
+/*
+Methods of the routes under root matching urlPath, in the order they
+were registered
+
+Empty when no route matches urlPath at all
+*/
+func (s *Server) allowedMethods(root *PrefixRouter, urlPath string) []string {
+	methods := []string{}
+	for i, route := range s.routes {
+		if route.router.Root() != root || !s.routePatterns[i].MatchString(urlPath) {
+			continue
+		}
+		if !containsString(methods, route.Method.name) {
+			methods = append(methods, route.Method.name)
+		}
+	}
+	return methods
+}
+
+type routeKey struct{}
+
+// The route a request was matched to by RouteMiddleware
+type routeMatch struct {
+	// The root router of the listener serving the request
+	root  *PrefixRouter
+	route PathRoute
+	ok    bool
+}
+
+// What RouteMiddleware matched req to, the zero routeMatch if it has not run
+func routeMatchOf(req *http.Request) routeMatch {
+	match, _ := req.Context().Value(routeKey{}).(routeMatch)
+	return match
+}
+
+// The route matched to req, if there is one
+func matchedRoute(req *http.Request) (PathRoute, bool) {
+	match := routeMatchOf(req)
+	return match.route, match.ok
+}
+
+/*
+Middleware matching each request to a route under root
+
+Matches once, for the middleware after it to read with matchedRoute,
+and only against the routes of root, so a request on one listener
+never takes the route label, timeout or CORS settings of a route only
+another listener serves
+*/
+func (s *Server) RouteMiddleware(root *PrefixRouter) func(web.ResponseWriter, *web.Request, web.NextMiddlewareFunc) {
+	return func(rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
+		route, ok := s.findRoute(root, req.Method, req.URL.Path)
+		ctx := context.WithValue(req.Context(), routeKey{}, routeMatch{root: root, route: route, ok: ok})
+		req.Request = req.Request.WithContext(ctx)
+		next(rw, req)
+	}
+}
+
+// Keys of every route the server may serve, for checking config against
+func routeKeys() []string {
+	// With an admin listener, which adds the routes only it serves
+	s := &Server{adminRouter: web.New(Context{})}
+	s.setupRoutes()
+
+	keys := make([]string, len(s.routes))
+	for i, route := range s.routes {
+		keys[i] = route.Key()
+	}
+	return keys
+}
+
+/*
+Middleware giving each request a deadline
+
+The timeout for the matched route is read from the current config on
+every request, so a reload applies to the next request. The deadline
+reaches every database call made with the request context
+*/
+func (s *Server) TimeoutMiddleware(rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
+	key := ""
+	if route, ok := matchedRoute(req.Request); ok {
+		key = route.Key()
+	}
+	timeout := s.Config().RequestTimeout(key)
+	if timeout > 0 {
+		ctx, cancel := context.WithTimeout(req.Context(), timeout)
+		defer cancel()
+		req.Request = req.Request.WithContext(ctx)
+	}
+	next(rw, req)
+}
+
+/*
+Middleware logging each request once it has been served
+
+Logs the request ID, the route pattern matched, the status, the latency
+and the ID of the authenticated user, if any. Server errors are logged
+at error level, everything else at info
+*/
+func (s *Server) AccessLogMiddleware(rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
+	start := time.Now()
+	entry := &requestLog{}
+	req.Request = req.Request.WithContext(context.WithValue(req.Context(), requestLogKey{}, entry))
+
+	next(rw, req)
+
+	status := rw.StatusCode()
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	fields := Fields{
+		"request_id": req.Header.Get(RequestIdHeader),
+		"method":     req.Method,
+		"path":       req.URL.Path,
+		"status":     status,
+		"latency_ms": float64(time.Since(start)) / float64(time.Millisecond),
+		"remote":     req.RemoteAddr,
+	}
+	if route, ok := matchedRoute(req.Request); ok {
+		fields["route"] = route.Path
+	}
+	if entry.userId != 0 {
+		fields["user_id"] = entry.userId
+	}
+	if span := SpanFromContext(req.Context()); span != nil {
+		fields["trace_id"] = span.Context().TraceId.String()
+	}
+
+	level := LevelInfo
+	if status >= http.StatusInternalServerError {
+		level = LevelError
+	}
+	s.logger.Log(level, LogRequest, fields)
+}
+
+/*
+Middleware turning a panic in a handler into a 500 response
+
+The panic and its stack are logged with the request ID, and counted.
+Clients get the standard internal_error response; the panic value and
+stack are only included in it when the debug setting is on. Nothing is
+written if the handler had already started its response
+*/
+func (s *Server) RecoverMiddleware(rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
+	defer func() {
+		err := recover()
+		if err == nil {
+			return
+		}
+		// The handler asked for the connection to be dropped
+		if err == http.ErrAbortHandler {
+			panic(err)
+		}
+
+		panicCount.Add(1)
+		stack := string(debug.Stack())
+		s.logger.Error(LogPanic, Fields{
+			"request_id": requestId(rw, req.Request),
+			"method":     req.Method,
+			"path":       req.URL.Path,
+			"panic":      fmt.Sprint(err),
+			"stack":      stack,
+		})
+
+		if rw.Written() {
+			return
+		}
+		apiErr := ApiError{Code: ErrCodeInternal, Message: InternalServerError}
+		if s.Config().Debug() {
+			apiErr.Detail = fmt.Sprintf("%v\n%s", err, stack)
+		}
+		writeApiError(rw, req.Request, http.StatusInternalServerError, apiErr)
+	}()
+
+	next(rw, req)
+}
+
+/*
+Middleware tracing each request
+
+Starts the server span, named after the method and route pattern, and
+makes it current in the request context for the spans below it. A
+valid traceparent header continues the caller's trace. Does nothing
+unless tracing is on
+*/
+func (s *Server) TracingMiddleware(rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
+	if s.tracer == nil {
+		next(rw, req)
+		return
+	}
+
+	name := req.Method
+	route, matched := matchedRoute(req.Request)
+	if matched {
+		name += " " + route.Path
+	}
+	remote, _ := ParseTraceparent(req.Header.Get(TraceparentHeader))
+	ctx, span := s.tracer.StartRequestSpan(req.Context(), name, remote)
+	defer span.Finish()
+	req.Request = req.Request.WithContext(ctx)
+
+	span.SetAttribute("http.method", req.Method)
+	span.SetAttribute("http.target", req.URL.Path)
+	if matched {
+		span.SetAttribute("http.route", route.Path)
+	}
+
+	next(rw, req)
+
+	status := rw.StatusCode()
+	if status == 0 {
+		status = http.StatusOK
+	}
+	span.SetAttribute("http.status_code", status)
+	span.SetAttribute("request_id", req.Header.Get(RequestIdHeader))
+	if status >= http.StatusInternalServerError {
+		span.SetError(errors.New(http.StatusText(status)))
+	}
+}
+
+// Middleware tracing the handler of the matched route, named after it
+func (s *Server) HandlerTracingMiddleware(rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
+	route, ok := matchedRoute(req.Request)
+	if !ok || SpanFromContext(req.Context()) == nil {
+		next(rw, req)
+		return
+	}
+
+	ctx, span := StartSpan(req.Context(), "handler "+handlerName(route.Handler), SpanKindInternal)
+	defer span.Finish()
+	req.Request = req.Request.WithContext(ctx)
+	next(rw, req)
+}
+
+/*
+Middleware counting requests and timing them in the metrics
+
+Labelled by the route pattern matched rather than the URL, so ids in
+paths do not make a series per resource
+*/
+func (s *Server) MetricsMiddleware(rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
+	start := time.Now()
+	next(rw, req)
+
+	method, route := MetricsOtherMethod, MetricsUnmatchedRoute
+	if r, ok := matchedRoute(req.Request); ok {
+		method, route = req.Method, r.Path
+	}
+	status := rw.StatusCode()
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	httpRequestsTotal.Inc(method, route, strconv.Itoa(status))
+	httpRequestDuration.ObserveSince(start, method, route)
+}
+
+// Middleware giving the handlers the server's database
+func (s *Server) DbMiddleware(c *Context, rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
+	DbMiddleware(s.db)(c, rw, req, next)
+}
+
+/*
+Handler for requests no route under root serves
+
+A path served with other methods gets 405 Method Not Allowed, listing
+them in the Allow header, anything else 404
+*/
+func (s *Server) notFoundHandler(root *PrefixRouter) func(web.ResponseWriter, *web.Request) {
+	return func(rw web.ResponseWriter, req *web.Request) {
+		methods := s.allowedMethods(root, req.URL.Path)
+		if len(methods) == 0 {
+			writeError(rw, req.Request, http.StatusNotFound, ErrCodeNotFound, RouteNotFound)
+			return
+		}
+		rw.Header().Set("Allow", strings.Join(methods, ", "))
+		writeError(rw, req.Request, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, MethodNotAllowed)
+	}
 }
 
 func (s *Server) setupRoutes() *web.Router {
-	rootRouter := web.New(Context{})
-	rootRouter.Middleware(web.LoggerMiddleware)
-	rootRouter.Middleware(web.ShowErrorsMiddleware)
+	rootRouter := NewPrefixRouter(web.New(Context{}))
+	rootRouter.router.NotFound(s.notFoundHandler(rootRouter))
+	rootRouter.Middleware("route", s.RouteMiddleware(rootRouter))
+	rootRouter.Middleware("tracing", s.TracingMiddleware)
+	rootRouter.TracedMiddleware("request_id", RequestIdMiddleware)
+	rootRouter.TracedMiddleware("access_log", s.AccessLogMiddleware)
+	rootRouter.TracedMiddleware("metrics", s.MetricsMiddleware)
+	rootRouter.TracedMiddleware("recover", s.RecoverMiddleware)
+	rootRouter.TracedMiddleware("cors", s.CorsMiddleware)
+	rootRouter.TracedMiddleware("timeout", s.TimeoutMiddleware)
+	rootRouter.Middleware("db", s.DbMiddleware)
 
 	// Routers
 	authRouter := NewPrefixSubrouter(rootRouter, "", Context{})
+	authRouter.corsGroup = CorsGroupAuth
 
 	// CreateUser endpoint cannot require auth
 	createUserRouter := NewPrefixSubrouter(rootRouter, "", Context{})
+	createUserRouter.corsGroup = CorsGroupCreateUser
 
 	// API subrouter for all other API endpoints
 	apiRouter := NewPrefixSubrouter(rootRouter, "/api", AuthContext{})
-	apiRouter.router.Middleware((*AuthContext).AuthRequired)
+	apiRouter.corsGroup = CorsGroupApi
+	apiRouter.Middleware("auth", func(c *AuthContext, rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
+		traceMiddleware("auth", c.AuthRequired)(rw, req, next)
+	})
+
+	// Administration, for superusers only
+	adminApiRouter := NewPrefixSubrouter(apiRouter, "/admin", AdminContext{})
+	adminApiRouter.Middleware("superuser", func(c *AdminContext, rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
+		traceMiddleware("superuser", c.SuperuserRequired)(rw, req, next)
+	})
 
 	// Routes
-	s.registerRoute(authRouter, httpMethodPost, "/auth", (*Context).ApiAuth)
-	s.registerRoute(createUserRouter, httpMethodPost, "/api/user", (*Context).CreateUserApi)
+	s.registerRoute(authRouter, httpMethodPost, "/auth", (*Context).ApiAuth, RouteSpec{
+		Summary:     "Authenticate with email and password, returning the user and API key",
+		Request:     AuthForm{},
+		RequestType: FormContentType,
+		Response:    User{},
+		Errors:      []int{http.StatusBadRequest, http.StatusForbidden},
+	})
+	s.registerRoute(createUserRouter, httpMethodPost, "/api/user", (*Context).CreateUserApi, RouteSpec{
+		Summary:  "Create a user",
+		Request:  UserCreate{},
+		Status:   http.StatusCreated,
+		Response: User{},
+		Errors:   []int{http.StatusBadRequest, http.StatusConflict},
+	})
 
 	// User-related
-	s.registerRoute(apiRouter, httpMethodGet, "/user", (*AuthContext).GetUserApi)
+	s.registerRoute(apiRouter, httpMethodGet, "/user", (*AuthContext).GetUserApi, RouteSpec{
+		Summary:  "Get the authenticated user",
+		Auth:     RouteAuthApiKey,
+		Response: User{},
+		Errors:   []int{http.StatusUnauthorized, http.StatusForbidden},
+	})
 
 	// Person-related
-	s.registerRoute(apiRouter, httpMethodGet, "/person/:id:\\d+", (*AuthContext).GetPersonApi)
-	s.registerRoute(apiRouter, httpMethodGet, "/person", (*AuthContext).GetPersonListApi)
-	s.registerRoute(apiRouter, httpMethodPost, "/person", (*AuthContext).CreatePersonApi)
+	s.registerRoute(apiRouter, httpMethodGet, "/person/:id:\\d+", (*AuthContext).GetPersonApi, RouteSpec{
+		Summary:  "Get one of the user's people",
+		Auth:     RouteAuthApiKey,
+		Response: PersonJSON{},
+		Errors:   []int{http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound},
+	})
+	s.registerRoute(apiRouter, httpMethodGet, "/person", (*AuthContext).GetPersonListApi, RouteSpec{
+		Summary:  "List the user's people",
+		Auth:     RouteAuthApiKey,
+		Response: []PersonJSON{},
+		Errors:   []int{http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound},
+	})
+	s.registerRoute(apiRouter, httpMethodPost, "/person", (*AuthContext).CreatePersonApi, RouteSpec{
+		Summary:  "Create a person for the user",
+		Auth:     RouteAuthApiKey,
+		Request:  PersonJSON{},
+		Status:   http.StatusCreated,
+		Response: PersonJSON{},
+		Errors:   []int{http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusConflict},
+	})
+	s.registerRoute(apiRouter, httpMethodPut, "/person/:id:\\d+", (*AuthContext).UpdatePersonApi, RouteSpec{
+		Summary:  "Update one of the user's people, given the ETag it was read with in If-Match",
+		Auth:     RouteAuthApiKey,
+		Request:  PersonJSON{},
+		Response: PersonJSON{},
+		Errors: []int{http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound,
+			http.StatusConflict, http.StatusPreconditionFailed, http.StatusPreconditionRequired},
+	})
+	s.registerRoute(apiRouter, httpMethodDelete, "/person/:id:\\d+", (*AuthContext).DeletePersonApi, RouteSpec{
+		Summary: "Delete one of the user's people, given the ETag it was read with in If-Match",
+		Auth:    RouteAuthApiKey,
+		Status:  http.StatusNoContent,
+		Errors: []int{http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound,
+			http.StatusPreconditionFailed, http.StatusPreconditionRequired},
+	})
+	s.registerRoute(apiRouter, httpMethodPost, "/person/bulk", (*AuthContext).BulkPersonApi, RouteSpec{
+		Summary:  "Create, update and delete several of the user's people, all or none unless best_effort",
+		Auth:     RouteAuthApiKey,
+		Request:  BulkRequest{},
+		Response: BulkResponse{},
+		Errors:   []int{http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusRequestEntityTooLarge},
+	})
+	s.registerRoute(apiRouter, httpMethodGet, "/person/export.csv", (*AuthContext).ExportPeopleApi, RouteSpec{
+		Summary:      "The user's people as CSV, with a column for the name, the color and each meta key",
+		Auth:         RouteAuthApiKey,
+		Query:        []string{CsvColumnsParam},
+		Response:     "",
+		ResponseType: CsvContentType,
+		Errors:       []int{http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden},
+	})
+	s.registerRoute(apiRouter, httpMethodPost, "/person/import", (*AuthContext).ImportPeopleApi, RouteSpec{
+		Summary:     "Create people from CSV rows, all or none, reporting what became of each",
+		Auth:        RouteAuthApiKey,
+		Query:       []string{ImportDryRunParam, ImportOnDuplicateParam, CsvColumnsParam},
+		Request:     "",
+		RequestType: CsvContentType,
+		Response:    ImportResponse{},
+		Errors:      []int{http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusRequestEntityTooLarge},
+	})
+	s.registerRoute(apiRouter, httpMethodGet, "/sync", (*AuthContext).SyncApi, RouteSpec{
+		Summary:  "People created, updated and deleted since the sync whose token is given in since",
+		Auth:     RouteAuthApiKey,
+		Query:    []string{SyncSinceParam},
+		Response: SyncResponse{},
+		Errors:   []int{http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusGone},
+	})
+
+	// The API described, generated from these routes
+	s.registerRoute(createUserRouter, httpMethodGet, "/api/openapi.json", s.OpenApiApi, RouteSpec{
+		Summary:  "This OpenAPI document",
+		Response: map[string]interface{}{},
+	})
+
+	s.registerRoute(adminApiRouter, httpMethodGet, "/routes", s.RoutesApi, RouteSpec{
+		Summary:  "List every route with its middleware and the auth it requires",
+		Auth:     RouteAuthSuperuser,
+		Response: []RouteInfo{},
+		Errors:   []int{http.StatusUnauthorized, http.StatusForbidden},
+	})
+
+	// Health, for the orchestrator
+	s.registerRoute(authRouter, httpMethodGet, "/healthz", (*Context).HealthzApi, RouteSpec{
+		Summary:  "Liveness probe",
+		Response: HealthStatus{},
+	})
+	s.registerRoute(authRouter, httpMethodGet, "/readyz", s.ReadyzApi, RouteSpec{
+		Summary:       "Readiness probe, with the result of each check",
+		Response:      HealthStatus{},
+		Errors:        []int{http.StatusServiceUnavailable},
+		ErrorResponse: HealthStatus{},
+	})
+
+	// Monitoring, kept to the admin listener when there is one
+	monitorRouter := authRouter
+	if s.adminRouter != nil {
+		adminRoot := NewPrefixRouter(s.adminRouter)
+		adminRoot.router.NotFound(s.notFoundHandler(adminRoot))
+		adminRoot.Middleware("request_id", RequestIdMiddleware)
+		adminRoot.Middleware("recover", s.RecoverMiddleware)
+		monitorRouter = NewPrefixSubrouter(adminRoot, "", Context{})
+
+		// Holds the command line and memory stats, so never on the public listener
+		s.registerRoute(monitorRouter, httpMethodGet, "/debug/vars", (*Context).DebugVarsApi, RouteSpec{
+			Summary:  "Counters from expvar",
+			Response: map[string]interface{}{},
+		})
+	}
+	s.registerRoute(monitorRouter, httpMethodGet, "/metrics", (*Context).MetricsApi, RouteSpec{
+		Summary:      "Prometheus metrics",
+		Response:     "",
+		ResponseType: MetricsContentType,
+	})
 
-	return rootRouter
+	// Handler spans, after every other middleware but the superuser check
+	for _, router := range []*PrefixRouter{authRouter, createUserRouter, apiRouter} {
+		router.Middleware("handler_tracing", s.HandlerTracingMiddleware)
+	}
+
+	return rootRouter.router
 }
 
-func (s *Server) Serve() {
-	if s.conf == nil {
+/*
+Connect to the database and serve requests until the listener fails or
+Shutdown is called
+
+Returns an error if the database cannot be reached in time, and nil
+after a Shutdown
+*/
+func (s *Server) Serve() error {
+	conf := s.Config()
+	if conf == nil {
 		panic(errors.New("Config cannot be nil"))
 	}
-	fmt.Println("Starting server")
 
-	dbService := NewPgDbService(s.conf.DbType(), s.conf.DbCreds())
+	dbService, err := ConnectDbService(conf.DbType(), conf.DbCreds(), conf.DbOptions(), s.logger.StdLogger(LevelInfo))
+	if err != nil {
+		return err
+	}
+
+	s.tracer, err = OpenTracer(conf.TraceOptions(), s.logger)
+	if err != nil {
+		return err
+	}
+
+	if pool, ok := dbService.(poolStatser); ok {
+		defaultMetrics.RegisterPool(pool)
+	}
+
+	if cacheOpts := conf.AuthCacheOptions(); cacheOpts.Size > 0 {
+		cache := NewUserCache(cacheOpts.Size, cacheOpts.Ttl)
+		cache.RegisterMetrics(defaultMetrics)
+		dbService = NewCachedDbService(dbService, cache)
+	}
+	s.db = dbService
+
+	adminListener := conf.AdminListener()
+	if adminListener != nil {
+		s.adminRouter = web.New(Context{})
+	}
 
 	s.rootRouter = s.setupRoutes()
-	s.rootRouter.Middleware(DbMiddleware(dbService))
 
-	err := http.Serve(s.conf.Listener(), s.rootRouter)
-	if err != nil {
-		panic(err)
+	listener := conf.Listener()
+	errs := make(chan error, 2)
+
+	if adminListener != nil {
+		s.logger.Info(LogStartingAdmin, Fields{"address": adminListener.Addr().String()})
+		go s.serveHttp(adminListener, s.adminRouter, errs)
+	}
+
+	s.logger.Info(LogStartingServer, Fields{"address": listener.Addr().String()})
+	go s.serveHttp(listener, s.rootRouter, errs)
+
+	if err := <-errs; err != http.ErrServerClosed {
+		s.tracer.Close()
+		return err
+	}
+	return nil
+}
+
+func (s *Server) serveHttp(listener net.Listener, handler http.Handler, errs chan<- error) {
+	server := &http.Server{Handler: handler}
+
+	s.serversLock.Lock()
+	if s.Draining() {
+		s.serversLock.Unlock()
+		listener.Close()
+		errs <- http.ErrServerClosed
+		return
+	}
+	s.httpServers = append(s.httpServers, server)
+	s.serversLock.Unlock()
+
+	errs <- server.Serve(listener)
+}
+
+// Whether Shutdown has started
+func (s *Server) Draining() bool {
+	return atomic.LoadInt32(&s.draining) == 1
+}
+
+/*
+Stop serving, letting requests in flight finish
+
+/readyz fails from the start, so a load balancer stops sending traffic
+during drainDelay. Then the listeners close, and Shutdown waits for the
+requests still running until ctx is done
+*/
+func (s *Server) Shutdown(ctx context.Context, drainDelay time.Duration) error {
+	atomic.StoreInt32(&s.draining, 1)
+	s.logger.Info(LogDraining, Fields{"drain_delay": drainDelay.String()})
+
+	select {
+	case <-time.After(drainDelay):
+	case <-ctx.Done():
+	}
+
+	s.serversLock.Lock()
+	servers := s.httpServers
+	s.serversLock.Unlock()
+
+	var err error
+	for _, server := range servers {
+		if shutdownErr := server.Shutdown(ctx); shutdownErr != nil {
+			err = shutdownErr
+		}
+	}
+
+	// Only once no request can finish a span
+	if closeErr := s.tracer.Close(); closeErr != nil && err == nil {
+		err = closeErr
 	}
+	return err
 }
@@ -1,8 +1,14 @@
 package main
 
 import (
+	"encoding/json"
+	"github.com/gocraft/web"
 	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 )
 
 func TestServeNoConfig(t *testing.T) {
@@ -19,13 +25,360 @@ func TestSetupRoutes(t *testing.T) {
 	_ = serv.setupRoutes()
 
 	expectedRoutes := []PathRoute{
-		{httpMethodPost, "/auth", (*Context).ApiAuth},
-		{httpMethodPost, "/api/user", (*Context).CreateUserApi},
-		{httpMethodGet, "/api/user", (*AuthContext).GetUserApi},
-		{httpMethodGet, "/api/person/:id:\\d+", (*AuthContext).GetPersonApi},
-		{httpMethodGet, "/api/person", (*AuthContext).GetPersonListApi},
-		{httpMethodPost, "/api/person", (*AuthContext).CreatePersonApi},
+		{Method: httpMethodPost, Path: "/auth", Handler: (*Context).ApiAuth},
+		{Method: httpMethodPost, Path: "/api/user", Handler: (*Context).CreateUserApi},
+		{Method: httpMethodGet, Path: "/api/user", Handler: (*AuthContext).GetUserApi},
+		{Method: httpMethodGet, Path: "/api/person/:id:\\d+", Handler: (*AuthContext).GetPersonApi},
+		{Method: httpMethodGet, Path: "/api/person", Handler: (*AuthContext).GetPersonListApi},
+		{Method: httpMethodPost, Path: "/api/person", Handler: (*AuthContext).CreatePersonApi},
+		{Method: httpMethodPut, Path: "/api/person/:id:\\d+", Handler: (*AuthContext).UpdatePersonApi},
+		{Method: httpMethodDelete, Path: "/api/person/:id:\\d+", Handler: (*AuthContext).DeletePersonApi},
+		{Method: httpMethodPost, Path: "/api/person/bulk", Handler: (*AuthContext).BulkPersonApi},
+		{Method: httpMethodGet, Path: "/api/person/export.csv", Handler: (*AuthContext).ExportPeopleApi},
+		{Method: httpMethodPost, Path: "/api/person/import", Handler: (*AuthContext).ImportPeopleApi},
+		{Method: httpMethodGet, Path: "/api/sync", Handler: (*AuthContext).SyncApi},
+		{Method: httpMethodGet, Path: "/api/openapi.json", Handler: serv.OpenApiApi},
+		{Method: httpMethodGet, Path: "/api/admin/routes", Handler: serv.RoutesApi},
+		{Method: httpMethodGet, Path: "/healthz", Handler: (*Context).HealthzApi},
+		{Method: httpMethodGet, Path: "/readyz", Handler: serv.ReadyzApi},
+		{Method: httpMethodGet, Path: "/metrics", Handler: (*Context).MetricsApi},
 	}
 
-	assert.Equal(t, serv.routes, expectedRoutes)
+	// Specs are checked by the OpenAPI tests, routers by the route listing
+	actualRoutes := make([]PathRoute, len(serv.routes))
+	for i, route := range serv.routes {
+		route.Spec = RouteSpec{}
+		route.router = nil
+		actualRoutes[i] = route
+	}
+	assert.Equal(t, actualRoutes, expectedRoutes)
+}
+
+func TestServerSetConfig(t *testing.T) {
+	conf := newTestConfig()
+	serv := NewServer(conf)
+
+	assert.Equal(t, conf, serv.Config())
+
+	newConf := newTestConfig()
+	serv.SetConfig(newConf)
+	assert.True(t, newConf == serv.Config())
+}
+
+func TestPathRouteKey(t *testing.T) {
+	route := PathRoute{Method: httpMethodGet, Path: "/api/person/:id:\\d+"}
+	assert.Equal(t, "GET /api/person/:id:\\d+", route.Key())
+}
+
+// The root router serving the route with key
+func testRouteRoot(serv *Server, key string) *PrefixRouter {
+	for _, route := range serv.routes {
+		if route.Key() == key {
+			return route.router.Root()
+		}
+	}
+	return nil
+}
+
+// Run mw as the server does, after the route of req is matched under root
+func serveMatched(serv *Server, root *PrefixRouter, mw func(web.ResponseWriter, *web.Request, web.NextMiddlewareFunc), rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
+	serv.RouteMiddleware(root)(rw, req, func(rw web.ResponseWriter, req *web.Request) {
+		mw(rw, req, next)
+	})
+}
+
+func TestServerRouteMiddleware(t *testing.T) {
+	serv := NewServer(newTestConfig())
+	serv.adminRouter = web.New(Context{})
+	_ = serv.setupRoutes()
+	mainRoot := testRouteRoot(serv, "POST /auth")
+	adminRoot := testRouteRoot(serv, "GET /debug/vars")
+	assert.NotEqual(t, mainRoot, adminRoot)
+
+	tests := []struct {
+		root   *PrefixRouter
+		method string
+		path   string
+		key    string
+	}{
+		{mainRoot, "POST", "/auth", "POST /auth"},
+		{mainRoot, "GET", "/api/person", "GET /api/person"},
+		{mainRoot, "GET", "/api/person/", "GET /api/person"},
+		{mainRoot, "POST", "/api/person", "POST /api/person"},
+		{mainRoot, "GET", "/api/person/12", "GET /api/person/:id:\\d+"},
+		{mainRoot, "GET", "/api/person/abc", ""},
+		{mainRoot, "DELETE", "/api/person", ""},
+		{mainRoot, "GET", "/readyz", "GET /readyz"},
+		{mainRoot, "GET", "/nowhere", ""},
+		// Only on the admin listener
+		{mainRoot, "GET", "/debug/vars", ""},
+		{mainRoot, "GET", "/metrics", ""},
+		{adminRoot, "GET", "/debug/vars", "GET /debug/vars"},
+		{adminRoot, "GET", "/metrics", "GET /metrics"},
+		{adminRoot, "GET", "/api/person", ""},
+	}
+
+	for _, test := range tests {
+		rw, req, _ := mockHandlerParams(test.method, "", "")
+		req.URL.Path = test.path
+		key := ""
+		serv.RouteMiddleware(test.root)(rw, req, func(rw web.ResponseWriter, req *web.Request) {
+			if route, ok := matchedRoute(req.Request); ok {
+				key = route.Key()
+			}
+		})
+		assert.Equal(t, test.key, key, test.method+" "+test.path)
+	}
+}
+
+func TestRouteKeys(t *testing.T) {
+	keys := routeKeys()
+	assert.Equal(t, 18, len(keys))
+	assert.Equal(t, "POST /auth", keys[0])
+}
+
+type mockTimeoutConfig struct {
+	mockConfig
+	timeouts map[string]time.Duration
+}
+
+func (mc *mockTimeoutConfig) RequestTimeout(route string) time.Duration {
+	return mc.timeouts[route]
+}
+
+func TestTimeoutMiddleware(t *testing.T) {
+	serv := NewServer(&mockTimeoutConfig{timeouts: map[string]time.Duration{
+		"GET /api/person": time.Minute,
+	}})
+	_ = serv.setupRoutes()
+
+	var deadline time.Time
+	var hasDeadline bool
+	next := func(rw web.ResponseWriter, req *web.Request) {
+		deadline, hasDeadline = req.Context().Deadline()
+	}
+
+	root := testRouteRoot(serv, "GET /api/person")
+
+	rw, req, _ := mockHandlerParams("GET", "", "")
+	req.URL.Path = "/api/person"
+	serveMatched(serv, root, serv.TimeoutMiddleware, rw, req, next)
+
+	assert.True(t, hasDeadline)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), deadline, 5*time.Second)
+
+	// A zero timeout leaves the request without a deadline
+	rw, req, _ = mockHandlerParams("POST", "", "")
+	req.URL.Path = "/api/person"
+	serveMatched(serv, root, serv.TimeoutMiddleware, rw, req, next)
+
+	assert.False(t, hasDeadline)
+}
+
+// The timeout is read from the config on each request, so reloads apply immediately
+func TestTimeoutMiddlewareReload(t *testing.T) {
+	serv := NewServer(&mockTimeoutConfig{})
+	_ = serv.setupRoutes()
+
+	var hasDeadline bool
+	next := func(rw web.ResponseWriter, req *web.Request) {
+		_, hasDeadline = req.Context().Deadline()
+	}
+
+	rw, req, _ := mockHandlerParams("GET", "", "")
+	serv.TimeoutMiddleware(rw, req, next)
+	assert.False(t, hasDeadline)
+
+	serv.SetConfig(&mockTimeoutConfig{timeouts: map[string]time.Duration{"": time.Second}})
+
+	rw, req, _ = mockHandlerParams("GET", "", "")
+	serv.TimeoutMiddleware(rw, req, next)
+	assert.True(t, hasDeadline)
+}
+
+func TestAccessLogMiddleware(t *testing.T) {
+	mdbs, user := newTestMemDbService(t)
+	serv := NewServer(newTestConfig())
+	logger, buf := newTestLogger(LevelInfo)
+	serv.SetLogger(logger)
+	router := serv.setupRoutes()
+	router.Middleware(DbMiddleware(mdbs))
+
+	serve := func(path, auth, id string) map[string]interface{} {
+		buf.Reset()
+		req, _ := http.NewRequest("GET", path, nil)
+		req.Header.Set("Authorization", auth)
+		req.Header.Set(RequestIdHeader, id)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		var line map[string]interface{}
+		if !assert.Nil(t, json.Unmarshal(buf.Bytes(), &line), buf.String()) {
+			return nil
+		}
+		assert.Equal(t, rec.Header().Get(RequestIdHeader), line["request_id"])
+		assert.IsType(t, float64(0), line["latency_ms"])
+		return line
+	}
+
+	line := serve("/api/person/12", "Apikey test@example.com:apikey", "abc-123")
+	assert.Equal(t, "info", line["level"])
+	assert.Equal(t, LogRequest, line["msg"])
+	assert.Equal(t, "abc-123", line["request_id"])
+	assert.Equal(t, "GET", line["method"])
+	assert.Equal(t, "/api/person/12", line["path"])
+	assert.Equal(t, "/api/person/:id:\\d+", line["route"])
+	assert.Equal(t, float64(http.StatusNotFound), line["status"])
+	assert.Equal(t, float64(user.Id), line["user_id"])
+
+	// Unauthenticated, with an unusable request ID replaced
+	line = serve("/api/user", "", "bad id")
+	assert.Equal(t, float64(http.StatusUnauthorized), line["status"])
+	assert.Nil(t, line["user_id"])
+	assert.Len(t, line["request_id"], 36)
+
+	line = serve("/nowhere", "", "")
+	assert.Equal(t, float64(http.StatusNotFound), line["status"])
+	assert.Nil(t, line["route"])
+}
+
+type mockDebugConfig struct {
+	mockConfig
+}
+
+func (mc *mockDebugConfig) Debug() bool {
+	return true
+}
+
+func TestRecoverMiddleware(t *testing.T) {
+	serv := NewServer(newTestConfig())
+	logger, buf := newTestLogger(LevelInfo)
+	serv.SetLogger(logger)
+	before := panicCount.Value()
+
+	rw, req, rec := mockHandlerParams("GET", "", "")
+	req.Header.Set(RequestIdHeader, "abc-123")
+	serv.RecoverMiddleware(rw, req, func(rw web.ResponseWriter, req *web.Request) {
+		panic("secret detail")
+	})
+
+	apiErr := assertApiError(t, rec, http.StatusInternalServerError, ErrCodeInternal, InternalServerError)
+	assert.Equal(t, "", apiErr.Detail)
+	assert.NotContains(t, rec.Body.String(), "secret detail")
+	assert.Equal(t, before+1, panicCount.Value())
+
+	var line map[string]interface{}
+	if assert.Nil(t, json.Unmarshal(buf.Bytes(), &line)) {
+		assert.Equal(t, "error", line["level"])
+		assert.Equal(t, LogPanic, line["msg"])
+		assert.Equal(t, "abc-123", line["request_id"])
+		assert.Equal(t, "secret detail", line["panic"])
+		assert.Contains(t, line["stack"], "RecoverMiddleware")
+	}
+
+	// Without a panic nothing is logged
+	buf.Reset()
+	rw, req, rec = mockHandlerParams("GET", "", "")
+	serv.RecoverMiddleware(rw, req, func(rw web.ResponseWriter, req *web.Request) {
+		rw.WriteHeader(http.StatusNoContent)
+	})
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Equal(t, "", buf.String())
+}
+
+func TestRecoverMiddlewareDebug(t *testing.T) {
+	serv := NewServer(&mockDebugConfig{})
+	serv.SetLogger(NewLogger(ioutil.Discard, LevelInfo))
+
+	rw, req, rec := mockHandlerParams("GET", "", "")
+	serv.RecoverMiddleware(rw, req, func(rw web.ResponseWriter, req *web.Request) {
+		panic("secret detail")
+	})
+
+	apiErr := assertApiError(t, rec, http.StatusInternalServerError, ErrCodeInternal, InternalServerError)
+	assert.Contains(t, apiErr.Detail, "secret detail")
+	assert.Contains(t, apiErr.Detail, "RecoverMiddleware")
+}
+
+// A panic after the response started is logged, and the response left alone
+func TestRecoverMiddlewareWritten(t *testing.T) {
+	serv := NewServer(newTestConfig())
+	logger, buf := newTestLogger(LevelInfo)
+	serv.SetLogger(logger)
+
+	rw, req, rec := mockHandlerParams("GET", "", "")
+	serv.RecoverMiddleware(rw, req, func(rw web.ResponseWriter, req *web.Request) {
+		rw.WriteHeader(http.StatusOK)
+		panic("too late")
+	})
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "", rec.Body.String())
+	assert.Contains(t, buf.String(), "too late")
+}
+
+func TestRecoverMiddlewareAbort(t *testing.T) {
+	serv := NewServer(newTestConfig())
+	serv.SetLogger(NewLogger(ioutil.Discard, LevelInfo))
+
+	rw, req, _ := mockHandlerParams("GET", "", "")
+	assert.Panics(t, func() {
+		serv.RecoverMiddleware(rw, req, func(rw web.ResponseWriter, req *web.Request) {
+			panic(http.ErrAbortHandler)
+		})
+	})
+}
+
+func TestMetricsMiddleware(t *testing.T) {
+	mdbs, _ := newTestMemDbService(t)
+	serv := NewServer(newTestConfig())
+	serv.SetLogger(NewLogger(ioutil.Discard, LevelInfo))
+	router := serv.setupRoutes()
+	router.Middleware(DbMiddleware(mdbs))
+
+	serve := func(method, path string) {
+		req, _ := http.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Apikey test@example.com:apikey")
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	personRoute := "/api/person/:id:\\d+"
+	notFound := httpRequestsTotal.Value("GET", personRoute, "404")
+	unmatched := httpRequestsTotal.Value(MetricsOtherMethod, MetricsUnmatchedRoute, "404")
+	timed := httpRequestDuration.Count("GET", personRoute)
+
+	serve("GET", "/api/person/12")
+	serve("GET", "/api/person/13")
+	serve("BREW", "/coffee")
+
+	assert.Equal(t, notFound+2, httpRequestsTotal.Value("GET", personRoute, "404"))
+	assert.Equal(t, unmatched+1, httpRequestsTotal.Value(MetricsOtherMethod, MetricsUnmatchedRoute, "404"))
+	assert.Equal(t, timed+2, httpRequestDuration.Count("GET", personRoute))
+}
+
+// With an admin listener, monitoring is only served there
+func TestSetupRoutesAdmin(t *testing.T) {
+	serv := NewServer(newTestConfig())
+	serv.SetLogger(NewLogger(ioutil.Discard, LevelInfo))
+	serv.adminRouter = web.New(Context{})
+	router := serv.setupRoutes()
+
+	for _, path := range []string{"/metrics", "/debug/vars"} {
+		req, _ := http.NewRequest("GET", path, nil)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusNotFound, rec.Code, path)
+
+		rec = httptest.NewRecorder()
+		serv.adminRouter.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code, path)
+	}
+
+	assert.Equal(t, routeKeys(), func() []string {
+		keys := []string{}
+		for _, route := range serv.routes {
+			keys = append(keys, route.Key())
+		}
+		return keys
+	}())
 }
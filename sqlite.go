@@ -0,0 +1,527 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq/hstore"
+	_ "github.com/mattn/go-sqlite3"
+	"net/url"
+	"time"
+)
+
+const (
+	SqliteDbType = "sqlite"
+	sqliteDriver = "sqlite3"
+
+	// How long a write waits for another connection's lock
+	sqliteBusyTimeout = 5 * time.Second
+
+	SqliteMetaTypeError = "Cannot scan %T into person meta"
+)
+
+/*
+Tables for the sqlite backend, created when missing
+
+Mirrors people_schema.sql for the tables in use, with meta stored as a
+JSON object instead of hstore. Constraint names match the Postgres ones
+*/
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS "user" (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    email TEXT NOT NULL CONSTRAINT uq_user_email UNIQUE,
+    pwhash TEXT NOT NULL,
+    name TEXT NOT NULL,
+    is_active BOOLEAN NOT NULL,
+    is_superuser BOOLEAN NOT NULL,
+    apikey TEXT NOT NULL,
+    sync_version INTEGER NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS person (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL CONSTRAINT fk_person_user_id REFERENCES "user"(id),
+    name TEXT NOT NULL,
+    meta TEXT NOT NULL DEFAULT '{}',
+    color INTEGER,
+    version INTEGER NOT NULL DEFAULT 0,
+    created_version INTEGER NOT NULL DEFAULT 0,
+    CONSTRAINT uq_person_name_user_id UNIQUE (user_id, name)
+);
+CREATE TABLE IF NOT EXISTS person_tombstone (
+    id INTEGER PRIMARY KEY,
+    user_id INTEGER NOT NULL CONSTRAINT fk_person_tombstone_user_id REFERENCES "user"(id),
+    version INTEGER NOT NULL
+);
+`
+
+// Columns added to the tables since the first schema, added to older data files when opened
+var sqliteAddedColumns = []struct {
+	table, column, definition string
+}{
+	{"user", "sync_version", "INTEGER NOT NULL DEFAULT 0"},
+	{"person", "version", "INTEGER NOT NULL DEFAULT 0"},
+	{"person", "created_version", "INTEGER NOT NULL DEFAULT 0"},
+}
+
+/*
+Data source name for a sqlite data file, with foreign keys enforced
+
+Transactions take the write lock as they begin, so one that reads before
+it writes waits for another's lock, rather than failing as busy when it
+comes to write
+*/
+func sqliteDsn(path string) string {
+	return fmt.Sprintf("file:%s?_foreign_keys=on&_busy_timeout=%d&_txlock=immediate",
+		(&url.URL{Path: path}).EscapedPath(), int64(sqliteBusyTimeout/time.Millisecond))
+}
+
+/*
+Person meta as stored by sqlite: a JSON object of strings
+
+Null hstore values are kept as JSON nulls
+*/
+type sqliteMeta hstore.Hstore
+
+func (m sqliteMeta) Value() (driver.Value, error) {
+	obj := map[string]*string{}
+	for key, val := range m.Map {
+		if val.Valid {
+			s := val.String
+			obj[key] = &s
+		} else {
+			obj[key] = nil
+		}
+	}
+
+	b, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (m *sqliteMeta) Scan(src interface{}) error {
+	var b []byte
+	switch v := src.(type) {
+	case nil:
+		m.Map = nil
+		return nil
+	case string:
+		b = []byte(v)
+	case []byte:
+		b = v
+	default:
+		return fmt.Errorf(SqliteMetaTypeError, src)
+	}
+
+	obj := map[string]*string{}
+	if err := json.Unmarshal(b, &obj); err != nil {
+		return err
+	}
+
+	m.Map = map[string]sql.NullString{}
+	for key, val := range obj {
+		if val == nil {
+			m.Map[key] = sql.NullString{}
+		} else {
+			m.Map[key] = sql.NullString{*val, true}
+		}
+	}
+	return nil
+}
+
+// A person row as sqlite stores it
+type sqlitePerson struct {
+	Id             int
+	UserId         int `db:"user_id"`
+	Name           string
+	Meta           sqliteMeta
+	Color          sql.NullInt64
+	Version        int64
+	CreatedVersion int64 `db:"created_version"`
+}
+
+func (p *sqlitePerson) Person() *Person {
+	return &Person{
+		Id:             p.Id,
+		UserId:         p.UserId,
+		Name:           p.Name,
+		Meta:           hstore.Hstore(p.Meta),
+		Color:          p.Color,
+		Version:        p.Version,
+		CreatedVersion: p.CreatedVersion,
+	}
+}
+
+/*
+SQLite database service
+
+Keeps everything in a single local data file, for single-user and
+embedded deployments. Behaves like pgDbService
+*/
+type sqliteDbService struct {
+	db *sqlx.DB
+	// Set on the service handed to a WithTx function
+	tx *sqlx.Tx
+}
+
+// The query methods shared by *sqlx.DB and *sqlx.Tx
+type sqliteQuerier interface {
+	GetContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error
+	SelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// Check the data file can still be read
+func (s *sqliteDbService) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+// The schema is created when the data file is opened, so always matches
+func (s *sqliteDbService) CheckSchema(ctx context.Context) error {
+	return nil
+}
+
+// Connection pool counters
+func (s *sqliteDbService) Stats() sql.DBStats {
+	return s.db.Stats()
+}
+
+// Where queries go: the transaction if there is one
+func (s *sqliteDbService) conn() sqliteQuerier {
+	if s.tx != nil {
+		return s.tx
+	}
+	return s.db
+}
+
+/*
+Open the sqlite data source, creating the data file and tables if needed
+
+Unlike Postgres there is no server to wait for, so there are no retries
+*/
+func ConnectSqliteDbService(dsn string, opts DbOptions) (*sqliteDbService, error) {
+	db, err := openDb(sqliteDriver, dsn, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := sqliteAddColumns(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &sqliteDbService{db: db}, nil
+}
+
+// Add the columns a data file made with an older schema is missing
+func sqliteAddColumns(db *sqlx.DB) error {
+	for _, added := range sqliteAddedColumns {
+		var found int
+		err := db.Get(&found, `SELECT COUNT(*) FROM pragma_table_info(?) WHERE name=?`, added.table, added.column)
+		if err != nil {
+			return err
+		}
+		if found > 0 {
+			continue
+		}
+		_, err = db.Exec(fmt.Sprintf(`ALTER TABLE %q ADD COLUMN %s %s`, added.table, added.column, added.definition))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqliteDbService) WithTx(ctx context.Context, fn func(tx DbService) error) error {
+	if s.tx != nil {
+		return fn(s)
+	}
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	return runTx(tx, func() error {
+		return fn(&sqliteDbService{db: s.db, tx: tx})
+	})
+}
+
+func (s *sqliteDbService) GetUser(ctx context.Context, email string) (*User, error) {
+	defer observeQuery(ctx, DbSystemSqlite, QueryGetUser)()
+	user := new(User)
+
+	err := s.conn().GetContext(ctx, user, `SELECT `+UserColumns+` FROM "user" WHERE email=?`, email)
+	if err != nil {
+		return nil, fmt.Errorf("User could not be found: %w", err)
+	}
+
+	return user, nil
+}
+
+func (s *sqliteDbService) PasswordCost() int {
+	return passwordCost
+}
+
+func (s *sqliteDbService) CreateUser(ctx context.Context, email, pwhash, name, apikey string, isActive, isSuperuser bool) (*User, error) {
+	defer observeQuery(ctx, DbSystemSqlite, QueryCreateUser)()
+	newUser := &User{
+		Email:       email,
+		Pwhash:      pwhash,
+		Name:        name,
+		IsActive:    isActive,
+		IsSuperuser: isSuperuser,
+		ApiKey:      apikey,
+	}
+
+	if !newUser.Validate() {
+		return nil, NewValidationError(UserInvalid, newUser.Errors())
+	}
+
+	result, err := s.conn().ExecContext(ctx, `INSERT INTO "user" (
+		email,
+		pwhash,
+		name,
+		is_active,
+		is_superuser,
+		apikey
+	) VALUES (?, ?, ?, ?, ?, ?);`,
+		newUser.Email,
+		newUser.Pwhash,
+		newUser.Name,
+		newUser.IsActive,
+		newUser.IsSuperuser,
+		newUser.ApiKey)
+	if err != nil {
+		return nil, err
+	}
+
+	userId, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	newUser.Id = int(userId)
+
+	return newUser, nil
+}
+
+func (s *sqliteDbService) UpdateUser(ctx context.Context, user *User) error {
+	defer observeQuery(ctx, DbSystemSqlite, QueryUpdateUser)()
+	if !user.Validate() {
+		return NewValidationError(UserInvalid, user.Errors())
+	}
+
+	_, err := s.conn().ExecContext(ctx, `UPDATE "user" SET
+		email = ?,
+		pwhash = ?,
+		name = ?,
+		is_active = ?,
+		is_superuser = ?,
+		apikey = ?
+	WHERE id=?;`,
+		user.Email,
+		user.Pwhash,
+		user.Name,
+		user.IsActive,
+		user.IsSuperuser,
+		user.ApiKey,
+		user.Id)
+
+	return err
+}
+
+func (s *sqliteDbService) GetPerson(ctx context.Context, userId, id int) (*Person, error) {
+	defer observeQuery(ctx, DbSystemSqlite, QueryGetPerson)()
+	row := new(sqlitePerson)
+
+	err := s.conn().GetContext(ctx, row, `SELECT `+PersonColumns+` FROM person WHERE id=? AND user_id=?`, id, userId)
+	if err != nil {
+		return nil, err
+	}
+	return row.Person(), nil
+}
+
+func (s *sqliteDbService) GetPeople(ctx context.Context, userId int) ([]Person, error) {
+	defer observeQuery(ctx, DbSystemSqlite, QueryGetPeople)()
+	rows := []sqlitePerson{}
+
+	err := s.conn().SelectContext(ctx, &rows, `SELECT `+PersonColumns+` FROM person WHERE user_id=? ORDER BY id`, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	people := make([]Person, len(rows))
+	for i := range rows {
+		people[i] = *rows[i].Person()
+	}
+	return people, nil
+}
+
+func (s *sqliteDbService) CreatePerson(ctx context.Context, userId int, name string, meta hstore.Hstore, color sql.NullInt64) (*Person, error) {
+	defer observeQuery(ctx, DbSystemSqlite, QueryCreatePerson)()
+	newPerson := &Person{
+		UserId: userId,
+		Name:   name,
+		Meta:   meta,
+		Color:  color,
+	}
+
+	if !newPerson.Validate() {
+		return nil, NewValidationError(PersonInvalid, newPerson.Errors())
+	}
+
+	err := s.inTx(ctx, func(tx *sqliteDbService) error {
+		version, err := tx.nextSyncVersion(ctx, userId)
+		if err != nil {
+			return err
+		}
+		newPerson.Version = version
+		newPerson.CreatedVersion = version
+
+		result, err := tx.conn().ExecContext(ctx, `INSERT INTO person (
+			user_id,
+			name,
+			meta,
+			color,
+			version,
+			created_version
+		) VALUES (?, ?, ?, ?, ?, ?);`,
+			newPerson.UserId,
+			newPerson.Name,
+			sqliteMeta(newPerson.Meta),
+			newPerson.Color,
+			newPerson.Version,
+			newPerson.CreatedVersion)
+		if err != nil {
+			return err
+		}
+
+		personId, err := result.LastInsertId()
+		newPerson.Id = int(personId)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return newPerson, nil
+}
+
+func (s *sqliteDbService) UpdatePerson(ctx context.Context, person *Person) error {
+	defer observeQuery(ctx, DbSystemSqlite, QueryUpdatePerson)()
+	if !person.Validate() {
+		return NewValidationError(PersonInvalid, person.Errors())
+	}
+
+	return s.inTx(ctx, func(tx *sqliteDbService) error {
+		version, err := tx.nextSyncVersion(ctx, person.UserId)
+		if err != nil {
+			return err
+		}
+
+		result, err := tx.conn().ExecContext(ctx, `UPDATE person SET
+			name = ?,
+			meta = ?,
+			color = ?,
+			version = ?
+		WHERE id=? AND user_id=?;`,
+			person.Name,
+			sqliteMeta(person.Meta),
+			person.Color,
+			version,
+			person.Id,
+			person.UserId)
+		if err != nil {
+			return err
+		}
+		if err := checkRowsAffected(result); err != nil {
+			return err
+		}
+
+		person.Version = version
+		return nil
+	})
+}
+
+func (s *sqliteDbService) DeletePerson(ctx context.Context, userId, id int) error {
+	defer observeQuery(ctx, DbSystemSqlite, QueryDeletePerson)()
+	return s.inTx(ctx, func(tx *sqliteDbService) error {
+		version, err := tx.nextSyncVersion(ctx, userId)
+		if err != nil {
+			return err
+		}
+
+		result, err := tx.conn().ExecContext(ctx, `DELETE FROM person WHERE id=? AND user_id=?;`, id, userId)
+		if err != nil {
+			return err
+		}
+		if err := checkRowsAffected(result); err != nil {
+			return err
+		}
+
+		_, err = tx.conn().ExecContext(ctx, `INSERT INTO person_tombstone (id, user_id, version) VALUES (?, ?, ?);`,
+			id, userId, version)
+		return err
+	})
+}
+
+func (s *sqliteDbService) GetPersonChanges(ctx context.Context, userId int, since int64) (*PersonChanges, error) {
+	defer observeQuery(ctx, DbSystemSqlite, QueryGetPersonChanges)()
+	// sqlite has no tags or locations, so none are deleted
+	changes := newPersonChanges()
+
+	err := s.conn().GetContext(ctx, &changes.Version, `SELECT sync_version FROM "user" WHERE id=?`, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	rows := []sqlitePerson{}
+	err = s.conn().SelectContext(ctx, &rows, `SELECT `+PersonColumns+` FROM person
+	WHERE user_id=? AND version > ? AND version <= ? ORDER BY version`, userId, since, changes.Version)
+	if err != nil {
+		return nil, err
+	}
+	changes.People = make([]Person, len(rows))
+	for i := range rows {
+		changes.People[i] = *rows[i].Person()
+	}
+
+	err = s.conn().SelectContext(ctx, &changes.Deleted, `SELECT id FROM person_tombstone
+	WHERE user_id=? AND version > ? AND version <= ? ORDER BY version`, userId, since, changes.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	return changes, nil
+}
+
+// Run fn in a transaction, joining the current one if there is one
+func (s *sqliteDbService) inTx(ctx context.Context, fn func(tx *sqliteDbService) error) error {
+	return s.WithTx(ctx, func(tx DbService) error {
+		return fn(tx.(*sqliteDbService))
+	})
+}
+
+// Transactions already hold the write lock, see sqliteDsn
+func (s *sqliteDbService) LockPeople(ctx context.Context, userId int) error {
+	return ctx.Err()
+}
+
+// Raise the user's sync version in the transaction of s, and return it
+func (s *sqliteDbService) nextSyncVersion(ctx context.Context, userId int) (int64, error) {
+	_, err := s.conn().ExecContext(ctx, `UPDATE "user" SET sync_version = sync_version + 1 WHERE id=?;`, userId)
+	if err != nil {
+		return 0, err
+	}
+	var version int64
+	err = s.conn().GetContext(ctx, &version, `SELECT sync_version FROM "user" WHERE id=?`, userId)
+	return version, err
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq/hstore"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestSqliteDbService(t *testing.T) (*sqliteDbService, func()) {
+	dir, err := ioutil.TempDir("", "people-sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := ConnectSqliteDbService(sqliteDsn(filepath.Join(dir, "people.db")), DbOptions{})
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return s, func() {
+		s.db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestSqliteDbServiceConformance(t *testing.T) {
+	cleanups := []func(){}
+	defer func() {
+		for _, cleanup := range cleanups {
+			cleanup()
+		}
+	}()
+
+	DbServiceConformance(t, func(t *testing.T) DbService {
+		s, cleanup := newTestSqliteDbService(t)
+		cleanups = append(cleanups, cleanup)
+		return s
+	})
+}
+
+func TestSqliteMeta(t *testing.T) {
+	meta := sqliteMeta{map[string]sql.NullString{
+		"type":  {"friend", true},
+		"empty": {"", true},
+		"null":  {"", false},
+	}}
+
+	val, err := meta.Value()
+	assert.Nil(t, err)
+	assert.Equal(t, `{"empty":"","null":null,"type":"friend"}`, val)
+
+	scanned := sqliteMeta{}
+	assert.Nil(t, scanned.Scan(val))
+	assert.Equal(t, meta, scanned)
+
+	assert.Nil(t, scanned.Scan([]byte("{}")))
+	assert.Equal(t, map[string]sql.NullString{}, scanned.Map)
+
+	assert.NotNil(t, scanned.Scan(42))
+	assert.NotNil(t, scanned.Scan("not json"))
+}
+
+// Data written to the file is there when it is opened again
+func TestSqliteDbServiceReopen(t *testing.T) {
+	s, cleanup := newTestSqliteDbService(t)
+	defer cleanup()
+
+	user, err := s.CreateUser(context.Background(), "test@example.com", "pwhash", "Test User", "apikey", true, false)
+	if !assert.Nil(t, err) {
+		return
+	}
+	meta := hstore.Hstore{map[string]sql.NullString{"type": {"friend", true}}}
+	person, err := s.CreatePerson(context.Background(), user.Id, "Test Person", meta, sql.NullInt64{2, true})
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	var dsn string
+	s.db.Get(&dsn, "SELECT file FROM pragma_database_list WHERE name='main'")
+
+	reopened, err := ConnectSqliteDbService(sqliteDsn(dsn), DbOptions{})
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer reopened.db.Close()
+
+	found, err := reopened.GetPerson(context.Background(), user.Id, person.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, person.Name, found.Name)
+	assert.Equal(t, meta, found.Meta)
+	assert.Equal(t, person.Color, found.Color)
+}
+
+// A data file made before people had versions gets the columns on open
+func TestSqliteDbServiceUpgrade(t *testing.T) {
+	dir, err := ioutil.TempDir("", "people-sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dsn := sqliteDsn(filepath.Join(dir, "people.db"))
+
+	old, err := sqlx.Connect(sqliteDriver, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old.MustExec(`
+CREATE TABLE "user" (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    email TEXT NOT NULL CONSTRAINT uq_user_email UNIQUE,
+    pwhash TEXT NOT NULL,
+    name TEXT NOT NULL,
+    is_active BOOLEAN NOT NULL,
+    is_superuser BOOLEAN NOT NULL,
+    apikey TEXT NOT NULL
+);
+CREATE TABLE person (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL CONSTRAINT fk_person_user_id REFERENCES "user"(id),
+    name TEXT NOT NULL,
+    meta TEXT NOT NULL DEFAULT '{}',
+    color INTEGER,
+    CONSTRAINT uq_person_name_user_id UNIQUE (user_id, name)
+);
+INSERT INTO "user" (email, pwhash, name, is_active, is_superuser, apikey)
+    VALUES ('test@example.com', 'pwhash', 'Test User', 1, 0, 'apikey');
+INSERT INTO person (user_id, name) VALUES (1, 'Test Person');
+`)
+	old.Close()
+
+	s, err := ConnectSqliteDbService(dsn, DbOptions{})
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer s.db.Close()
+
+	// People from before are sent by a sync from the start
+	changes, err := s.GetPersonChanges(context.Background(), 1, syncFromStart)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, int64(0), changes.Version)
+	if assert.Len(t, changes.People, 1) {
+		assert.Equal(t, "Test Person", changes.People[0].Name)
+		assert.Equal(t, int64(0), changes.People[0].Version)
+	}
+
+	p, err := s.CreatePerson(context.Background(), 1, "New Person", hstore.Hstore{}, sql.NullInt64{})
+	if assert.Nil(t, err) {
+		assert.Equal(t, int64(1), p.Version)
+	}
+}
+
+// Columns added to person by a later schema are not read into people
+func TestSqliteDbServiceExtraColumn(t *testing.T) {
+	s, cleanup := newTestSqliteDbService(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	user, err := s.CreateUser(ctx, "test@example.com", "pwhash", "Test User", "apikey", true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.db.MustExec(`ALTER TABLE person ADD COLUMN nickname TEXT`)
+	person, err := s.CreatePerson(ctx, user.Id, "Test Person", hstore.Hstore{}, sql.NullInt64{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = s.GetPerson(ctx, user.Id, person.Id)
+	assert.Nil(t, err)
+	people, err := s.GetPeople(ctx, user.Id)
+	assert.Nil(t, err)
+	assert.Len(t, people, 1)
+	changes, err := s.GetPersonChanges(ctx, user.Id, syncFromStart)
+	if assert.Nil(t, err) {
+		assert.Len(t, changes.People, 1)
+	}
+}
+
+func TestSqliteDsnEscapesPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "people-sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "why?#100% people.db")
+
+	s, err := ConnectSqliteDbService(sqliteDsn(path), DbOptions{})
+	if !assert.Nil(t, err) {
+		return
+	}
+	s.db.Close()
+	_, err = os.Stat(path)
+	assert.Nil(t, err)
+}
+
+// Transactions reading before they write wait their turn rather than failing as busy
+func TestSqliteConcurrentTransactions(t *testing.T) {
+	s, cleanup := newTestSqliteDbService(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	user, err := s.CreateUser(ctx, "test@example.com", "pwhash", "Test User", "apikey", true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	person, err := s.CreatePerson(ctx, user.Id, "Test Person", hstore.Hstore{}, sql.NullInt64{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make(chan error, 4)
+	for i := 0; i < cap(errs); i++ {
+		go func(i int) {
+			errs <- s.WithTx(ctx, func(tx DbService) error {
+				current, err := tx.GetPerson(ctx, user.Id, person.Id)
+				if err != nil {
+					return err
+				}
+				time.Sleep(10 * time.Millisecond)
+				current.Color = sql.NullInt64{int64(i), true}
+				return tx.UpdatePerson(ctx, current)
+			})
+		}(i)
+	}
+	for i := 0; i < cap(errs); i++ {
+		assert.Nil(t, <-errs)
+	}
+}
+
+func TestSqliteForeignKeys(t *testing.T) {
+	s, cleanup := newTestSqliteDbService(t)
+	defer cleanup()
+
+	p, err := s.CreatePerson(context.Background(), 99, "Test Person", hstore.Hstore{}, sql.NullInt64{})
+	assert.Nil(t, p)
+	assert.NotNil(t, err)
+}
+
+func TestAppConfigDbCredsSqlite(t *testing.T) {
+	config := appConfig{DbConf: dbConfig{Type: SqliteDbType}}
+	assert.Equal(t, "file:people.db?_foreign_keys=on&_busy_timeout=5000&_txlock=immediate", config.DbCreds())
+
+	config.DbConf.Path = "/var/lib/people/data.db"
+	assert.Equal(t, "file:/var/lib/people/data.db?_foreign_keys=on&_busy_timeout=5000&_txlock=immediate", config.DbCreds())
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"github.com/gocraft/web"
+	"github.com/jmoiron/sqlx"
+	"net/http"
+	"strconv"
+)
+
+const (
+	// GET /api/sync parameter holding the token of the last sync
+	SyncSinceParam = "since"
+
+	// SyncApi errors
+	InvalidSyncTokenError = "Invalid sync token"
+	SyncTokenExpiredError = "Sync token is no longer valid, sync again without one"
+	SyncError             = "Error reading changes"
+
+	// Version a sync without a token starts after, so people from before
+	// versions were tracked, at version 0, are sent too
+	syncFromStart int64 = -1
+)
+
+const (
+	nextSyncVersionSql  = `UPDATE "user" SET sync_version = sync_version + 1 WHERE id=?;`
+	lockPeopleSql       = `SELECT id FROM "user" WHERE id=?` + forUpdateSql
+	getSyncVersionSql   = `SELECT sync_version FROM "user" WHERE id=?`
+	createTombstoneSql  = `INSERT INTO "person_tombstone" (id, user_id, version) VALUES (?, ?, ?);`
+	getChangedPeopleSql = `SELECT ` + PersonColumns + ` FROM "person"
+	WHERE user_id=? AND version > ? AND version <= ? ORDER BY version`
+	getTombstonesSql = `SELECT id FROM "person_tombstone"
+	WHERE user_id=? AND version > ? AND version <= ? ORDER BY version`
+
+	// A deleted person's tag links and locations go with it, each leaving a tombstone
+	ofUserPersonSql              = `person_id IN (SELECT id FROM "person" WHERE id=? AND user_id=?)`
+	createPersonTagTombstonesSql = `INSERT INTO "person_tag_tombstone" (id, user_id, version)
+	SELECT id, ?, ? FROM "person_tag" WHERE ` + ofUserPersonSql
+	deletePersonTagsSql         = `DELETE FROM "person_tag" WHERE ` + ofUserPersonSql
+	createLocationTombstonesSql = `INSERT INTO "location_tombstone" (id, user_id, version)
+	SELECT id, ?, ? FROM "location" WHERE ` + ofUserPersonSql
+	deleteLocationsSql        = `DELETE FROM "location" WHERE ` + ofUserPersonSql
+	getPersonTagTombstonesSql = `SELECT id FROM "person_tag_tombstone"
+	WHERE user_id=? AND version > ? AND version <= ? ORDER BY version, id`
+	getLocationTombstonesSql = `SELECT id FROM "location_tombstone"
+	WHERE user_id=? AND version > ? AND version <= ? ORDER BY version, id`
+)
+
+/*
+What changed in a user's people after a version
+
+Every change to a user's people takes the user's next version, and
+commits in version order, so the changes up to Version are complete
+*/
+type PersonChanges struct {
+	// People created or updated, in the order they last changed
+	People []Person
+	// Ids of the people deleted, in the order they were
+	Deleted []int
+	// Ids of the tag links and locations deleted with them, in the same order
+	DeletedPersonTags []int
+	DeletedLocations  []int
+	// The user's version, that of the last change included
+	Version int64
+}
+
+// Body of GET /api/sync
+type SyncResponse struct {
+	Created []PersonJSON `json:"created"`
+	Updated []PersonJSON `json:"updated"`
+	Deleted []int        `json:"deleted"`
+	// The deleted people's tag links and locations, which went with them
+	DeletedPersonTags []int `json:"deleted_person_tags"`
+	DeletedLocations  []int `json:"deleted_locations"`
+	// Sent back as since on the next sync
+	Token string `json:"token"`
+}
+
+// No changes, with empty rather than nil lists
+func newPersonChanges() *PersonChanges {
+	return &PersonChanges{People: []Person{}, Deleted: []int{}, DeletedPersonTags: []int{}, DeletedLocations: []int{}}
+}
+
+// Token for changes up to version
+func syncToken(version int64) string {
+	return strconv.FormatInt(version, 10)
+}
+
+// The version a token is for, syncFromStart without one
+func parseSyncToken(token string) (int64, error) {
+	if token == "" {
+		return syncFromStart, nil
+	}
+	version, err := strconv.ParseInt(token, 10, 64)
+	if err == nil && version < 0 {
+		err = strconv.ErrRange
+	}
+	return version, err
+}
+
+// Run fn in a transaction, joining the current one if there is one
+func (s *pgDbService) inTx(ctx context.Context, fn func(tx *pgDbService) error) error {
+	return s.WithTx(ctx, func(tx DbService) error {
+		return fn(tx.(*pgDbService))
+	})
+}
+
+/*
+Take the user's next sync version, in the transaction of s
+
+Raising it locks the user's row until the transaction ends, so changes
+to the user's people commit in the order of their versions
+*/
+func (s *pgDbService) nextSyncVersion(ctx context.Context, userId int) (int64, error) {
+	if _, err := s.stmts.use(ctx, s.stmts.nextSyncVersion).ExecContext(ctx, userId); err != nil {
+		return 0, err
+	}
+	var version int64
+	err := s.stmts.use(ctx, s.stmts.getSyncVersion).GetContext(ctx, &version, userId)
+	return version, err
+}
+
+/*
+Delete the tag links and locations of the user's person with id, in the
+transaction of s
+
+Each leaves a tombstone at version, that of the person's own
+*/
+func (s *pgDbService) deletePersonRelated(ctx context.Context, userId, id int, version int64) error {
+	related := []struct{ createTombstones, delete *sqlx.Stmt }{
+		{s.stmts.createPersonTagTombstones, s.stmts.deletePersonTags},
+		{s.stmts.createLocationTombstones, s.stmts.deleteLocations},
+	}
+	for _, r := range related {
+		if _, err := s.stmts.use(ctx, r.createTombstones).ExecContext(ctx, userId, version, id, userId); err != nil {
+			return err
+		}
+		if _, err := s.stmts.use(ctx, r.delete).ExecContext(ctx, id, userId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Lock the user's row until the transaction of s ends
+
+nextSyncVersion takes the same lock, so a transaction locking a person
+after this one cannot deadlock with another changing the user's people
+*/
+func (s *pgDbService) LockPeople(ctx context.Context, userId int) error {
+	_, err := s.stmts.use(ctx, s.stmts.lockPeople).ExecContext(ctx, userId)
+	return err
+}
+
+/*
+Fetch what changed in the user's people after the since version
+
+The user's version is read first, and changes after it left for the next
+sync, so writes committing meanwhile are neither missed nor sent twice.
+Always read from the primary, as a replica may be behind the token
+*/
+func (s *pgDbService) GetPersonChanges(ctx context.Context, userId int, since int64) (*PersonChanges, error) {
+	defer observeQuery(ctx, s.system(), QueryGetPersonChanges)()
+	changes := newPersonChanges()
+
+	if err := s.stmts.use(ctx, s.stmts.getSyncVersion).GetContext(ctx, &changes.Version, userId); err != nil {
+		return nil, err
+	}
+	err := s.stmts.use(ctx, s.stmts.getChangedPeople).SelectContext(ctx, &changes.People, userId, since, changes.Version)
+	if err != nil {
+		return nil, err
+	}
+	err = s.stmts.use(ctx, s.stmts.getTombstones).SelectContext(ctx, &changes.Deleted, userId, since, changes.Version)
+	if err != nil {
+		return nil, err
+	}
+	err = s.stmts.use(ctx, s.stmts.getPersonTagTombstones).SelectContext(ctx, &changes.DeletedPersonTags, userId, since, changes.Version)
+	if err != nil {
+		return nil, err
+	}
+	err = s.stmts.use(ctx, s.stmts.getLocationTombstones).SelectContext(ctx, &changes.DeletedLocations, userId, since, changes.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	return changes, nil
+}
+
+/*
+Handler for the GET Sync API
+
+Returns the people created, updated and deleted since the sync whose
+token is in since, and the token for the next sync. Without a token
+every person is sent as created. The tag links and locations deleted
+with people are sent with them
+*/
+func (c *AuthContext) SyncApi(rw web.ResponseWriter, req *web.Request) {
+	since, err := parseSyncToken(req.URL.Query().Get(SyncSinceParam))
+	if err != nil {
+		writeError(rw, req.Request, http.StatusBadRequest, ErrCodeInvalidSyncToken, InvalidSyncTokenError)
+		return
+	}
+
+	changes, err := c.DB.GetPersonChanges(req.Context(), c.User.Id, since)
+
+	if writeUnavailable(rw, req, err) {
+		return
+	}
+	if err != nil {
+		writeError(rw, req.Request, http.StatusInternalServerError, ErrCodeInternal, SyncError)
+		return
+	}
+	// From another database, or one restored from a backup
+	if since > changes.Version {
+		writeError(rw, req.Request, http.StatusGone, ErrCodeSyncTokenExpired, SyncTokenExpiredError)
+		return
+	}
+
+	resp := SyncResponse{
+		Created:           []PersonJSON{},
+		Updated:           []PersonJSON{},
+		Deleted:           changes.Deleted,
+		DeletedPersonTags: changes.DeletedPersonTags,
+		DeletedLocations:  changes.DeletedLocations,
+		Token:             syncToken(changes.Version),
+	}
+	// A client starting afresh has nothing to delete
+	if since == syncFromStart {
+		resp.Deleted, resp.DeletedPersonTags, resp.DeletedLocations = []int{}, []int{}, []int{}
+	}
+	for i := range changes.People {
+		person := &changes.People[i]
+		if person.CreatedVersion > since {
+			resp.Created = append(resp.Created, person.JSON())
+		} else {
+			resp.Updated = append(resp.Updated, person.JSON())
+		}
+	}
+
+	jsonResponse(rw, resp)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/gocraft/web"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+)
+
+func TestParseSyncToken(t *testing.T) {
+	tests := []struct {
+		token   string
+		version int64
+		valid   bool
+	}{
+		{"", syncFromStart, true},
+		{"0", 0, true},
+		{"42", 42, true},
+		{syncToken(1234567890123), 1234567890123, true},
+		{"-1", 0, false},
+		{"abc", 0, false},
+		{"1.5", 0, false},
+	}
+
+	for _, test := range tests {
+		version, err := parseSyncToken(test.token)
+		if test.valid {
+			assert.Nil(t, err, test.token)
+			assert.Equal(t, test.version, version, test.token)
+		} else {
+			assert.NotNil(t, err, test.token)
+		}
+	}
+}
+
+func mockSyncParams(since string) (web.ResponseWriter, *web.Request, *httptest.ResponseRecorder) {
+	rw, req, rec := mockHandlerParams("GET", "", "")
+	req.URL.RawQuery = url.Values{SyncSinceParam: {since}}.Encode()
+	return rw, req, rec
+}
+
+func TestSyncApiInvalidToken(t *testing.T) {
+	rw, req, rec := mockSyncParams("abc")
+	ac, dbs := mockAuthContext(newTestUser())
+
+	(*AuthContext).SyncApi(ac, rw, req)
+
+	dbs.Mock.AssertNotCalled(t, "GetPersonChanges", ac.User.Id, int64(0))
+	assertApiError(t, rec, http.StatusBadRequest, ErrCodeInvalidSyncToken, InvalidSyncTokenError)
+}
+
+func TestSyncApiError(t *testing.T) {
+	rw, req, rec := mockSyncParams("3")
+	ac, dbs := mockAuthContext(newTestUser())
+	dbs.Mock.On("GetPersonChanges", ac.User.Id, int64(3)).Return(nil, errors.New("Could not query"))
+
+	(*AuthContext).SyncApi(ac, rw, req)
+
+	assertApiError(t, rec, http.StatusInternalServerError, ErrCodeInternal, SyncError)
+}
+
+// A token from after the user's latest version was not handed out by this database
+func TestSyncApiTokenExpired(t *testing.T) {
+	rw, req, rec := mockSyncParams("9")
+	ac, dbs := mockAuthContext(newTestUser())
+	dbs.Mock.On("GetPersonChanges", ac.User.Id, int64(9)).
+		Return(&PersonChanges{People: []Person{}, Deleted: []int{}, DeletedPersonTags: []int{}, DeletedLocations: []int{}, Version: 4}, nil)
+
+	(*AuthContext).SyncApi(ac, rw, req)
+
+	assertApiError(t, rec, http.StatusGone, ErrCodeSyncTokenExpired, SyncTokenExpiredError)
+}
+
+func TestSyncApi(t *testing.T) {
+	created := newTestPerson(1)
+	created.Id, created.Version, created.CreatedVersion = 2, 6, 5
+	updated := newTestPerson(1)
+	updated.Version, updated.CreatedVersion = 7, 2
+
+	rw, req, rec := mockSyncParams("4")
+	ac, dbs := mockAuthContext(newTestUser())
+	dbs.Mock.On("GetPersonChanges", ac.User.Id, int64(4)).
+		Return(&PersonChanges{People: []Person{*created, *updated}, Deleted: []int{3},
+			DeletedPersonTags: []int{5, 6}, DeletedLocations: []int{9}, Version: 8}, nil)
+
+	(*AuthContext).SyncApi(ac, rw, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, Jsonify(SyncResponse{
+		Created:           []PersonJSON{created.JSON()},
+		Updated:           []PersonJSON{updated.JSON()},
+		Deleted:           []int{3},
+		DeletedPersonTags: []int{5, 6},
+		DeletedLocations:  []int{9},
+		Token:             "8",
+	}), rec.Body.String())
+}
+
+// Without a token everything is new and there is nothing to delete
+func TestSyncApiFromStart(t *testing.T) {
+	person := newTestPerson(1)
+
+	rw, req, rec := mockSyncParams("")
+	ac, dbs := mockAuthContext(newTestUser())
+	dbs.Mock.On("GetPersonChanges", ac.User.Id, syncFromStart).
+		Return(&PersonChanges{People: []Person{*person}, Deleted: []int{3},
+			DeletedPersonTags: []int{5}, DeletedLocations: []int{9}, Version: 8}, nil)
+
+	(*AuthContext).SyncApi(ac, rw, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, Jsonify(SyncResponse{
+		Created:           []PersonJSON{person.JSON()},
+		Updated:           []PersonJSON{},
+		Deleted:           []int{},
+		DeletedPersonTags: []int{},
+		DeletedLocations:  []int{},
+		Token:             "8",
+	}), rec.Body.String())
+}
+
+// A person's tag links and locations are deleted with it, and sent by the next sync
+func TestPgDbServiceDeletePersonRelated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "people-sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, stmts := newTestReplicaDb(t, dir, "Primary")
+	defer db.Close()
+	db.MustExec(`INSERT INTO person (id, user_id, name) VALUES (1, 1, 'One'), (2, 1, 'Two')`)
+	db.MustExec(`INSERT INTO person_tag (id, person_id, tag_id) VALUES (5, 1, 1), (6, 1, 2), (7, 2, 1)`)
+	db.MustExec(`INSERT INTO location (id, person_id, address) VALUES (9, 1, 'Home'), (10, 2, 'Work')`)
+	s := &pgDbService{db: db, stmts: stmts}
+	ctx := context.Background()
+
+	assert.Equal(t, sql.ErrNoRows, s.DeletePerson(ctx, 2, 1), "Another user's person")
+	if !assert.Nil(t, s.DeletePerson(ctx, 1, 1)) {
+		return
+	}
+
+	changes, err := s.GetPersonChanges(ctx, 1, 0)
+	if assert.Nil(t, err) {
+		assert.Equal(t, []int{1}, changes.Deleted)
+		assert.Equal(t, []int{5, 6}, changes.DeletedPersonTags)
+		assert.Equal(t, []int{9}, changes.DeletedLocations)
+	}
+	var left []int
+	db.Select(&left, `SELECT id FROM person_tag UNION ALL SELECT id FROM location ORDER BY id`)
+	assert.Equal(t, []int{7, 10}, left)
+}
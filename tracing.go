@@ -0,0 +1,700 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gocraft/web"
+	"io"
+	"io/ioutil"
+	mathrand "math/rand"
+	"net/http"
+	"os"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TraceparentHeader = "traceparent"
+
+	TraceExporterNone   = "none"
+	TraceExporterStdout = "stdout"
+	TraceExporterFile   = "file"
+	TraceExporterOtlp   = "otlp"
+
+	// Path the OTLP/HTTP receiver takes spans on
+	OtlpTracesPath = "/v1/traces"
+
+	// Spans waiting to be exported, beyond which new ones are dropped
+	traceQueueSize = 2048
+	// How often waiting spans are exported
+	traceFlushInterval = time.Second
+
+	LogTraceExportFailed = "Could not export spans"
+	OtlpExportError      = "OTLP collector responded %s"
+)
+
+var (
+	TraceExporters = []string{TraceExporterNone, TraceExporterStdout, TraceExporterFile, TraceExporterOtlp}
+
+	TraceExporterError = errors.New("Unknown trace exporter")
+)
+
+type TraceId [16]byte
+type SpanId [8]byte
+
+func (id TraceId) String() string { return hex.EncodeToString(id[:]) }
+func (id SpanId) String() string  { return hex.EncodeToString(id[:]) }
+
+func (id TraceId) IsZero() bool { return id == TraceId{} }
+func (id SpanId) IsZero() bool  { return id == SpanId{} }
+
+// What identifies a span across services
+type SpanContext struct {
+	TraceId TraceId
+	SpanId  SpanId
+	Sampled bool
+}
+
+func (sc SpanContext) Valid() bool {
+	return !sc.TraceId.IsZero() && !sc.SpanId.IsZero()
+}
+
+// The W3C traceparent header value for sc
+func (sc SpanContext) Traceparent() string {
+	flags := 0
+	if sc.Sampled {
+		flags = 1
+	}
+	return fmt.Sprintf("00-%s-%s-%02x", sc.TraceId, sc.SpanId, flags)
+}
+
+/*
+Parse a W3C traceparent header
+
+	00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+
+Versions after 00 are read the same way, ignoring anything they add.
+Returns false for anything malformed, which starts a new trace
+*/
+func ParseTraceparent(header string) (SpanContext, bool) {
+	header = strings.TrimSpace(header)
+	if len(header) < 55 || (len(header) > 55 && header[55] != '-') {
+		return SpanContext{}, false
+	}
+
+	version := header[0:2]
+	if version == "ff" || !isLowerHex(version) || header[2] != '-' || header[35] != '-' || header[52] != '-' {
+		return SpanContext{}, false
+	}
+	if version == "00" && len(header) != 55 {
+		return SpanContext{}, false
+	}
+
+	traceHex, spanHex, flagsHex := header[3:35], header[36:52], header[53:55]
+	if !isLowerHex(traceHex) || !isLowerHex(spanHex) || !isLowerHex(flagsHex) {
+		return SpanContext{}, false
+	}
+
+	var sc SpanContext
+	hex.Decode(sc.TraceId[:], []byte(traceHex))
+	hex.Decode(sc.SpanId[:], []byte(spanHex))
+	flags, _ := strconv.ParseUint(flagsHex, 16, 8)
+	sc.Sampled = flags&1 == 1
+
+	return sc, sc.Valid()
+}
+
+func isLowerHex(s string) bool {
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// Role of a span, numbered as in OTLP
+type SpanKind int
+
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindServer   SpanKind = 2
+	SpanKindClient   SpanKind = 3
+)
+
+func (k SpanKind) String() string {
+	switch k {
+	case SpanKindServer:
+		return "server"
+	case SpanKindClient:
+		return "client"
+	}
+	return "internal"
+}
+
+// A finished span, as handed to a SpanExporter
+type SpanData struct {
+	Name       string
+	Kind       SpanKind
+	TraceId    TraceId
+	SpanId     SpanId
+	ParentId   SpanId
+	Start      time.Time
+	End        time.Time
+	Attributes Fields
+	// Set when the operation failed
+	Error string
+}
+
+/*
+A timed operation in a trace
+
+Spans are started with StartSpan, or by the Tracer for each request,
+and exported once finished if their trace is sampled. A nil *Span,
+which StartSpan returns outside a trace, does nothing
+*/
+type Span struct {
+	tracer   *Tracer
+	context  SpanContext
+	lock     sync.Mutex
+	data     SpanData
+	finished bool
+}
+
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.context
+}
+
+// Set an attribute, until the span is finished
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.finished {
+		s.data.Attributes[key] = value
+	}
+}
+
+// Mark the span failed with err
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.data.Error = err.Error()
+}
+
+// End the span, only the first call counts
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	if s.finished {
+		s.lock.Unlock()
+		return
+	}
+	s.finished = true
+	s.data.End = s.tracer.now()
+	data := s.data
+	s.lock.Unlock()
+
+	if s.context.Sampled {
+		s.tracer.export(data)
+	}
+}
+
+type spanKey struct{}
+
+func withSpan(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+// The span current in ctx, nil outside a trace
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+/*
+Start a span as a child of the one in ctx
+
+Returns ctx with the new span current in it. Outside a trace nothing is
+started, and the span returned is nil
+*/
+func StartSpan(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	parent := SpanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	span := parent.tracer.newSpan(name, kind, parent.context.TraceId, parent.context.SpanId, parent.context.Sampled)
+	return withSpan(ctx, span), span
+}
+
+// Exports finished spans, in batches
+type SpanExporter interface {
+	ExportSpans(ctx context.Context, spans []SpanData) error
+	Close() error
+}
+
+// Where spans go and how many traces are kept
+type TraceOptions struct {
+	// One of TraceExporters, TraceExporterNone turns tracing off
+	Exporter string
+	// File written by TraceExporterFile
+	Path string
+	// Base URL of the collector for TraceExporterOtlp
+	Endpoint string
+	// Fraction of new traces sampled, from 0 to 1. Traces continued from
+	// a traceparent follow its sampled flag instead
+	SampleRatio float64
+	// Reported to the collector as service.name
+	ServiceName string
+}
+
+/*
+Starts spans for requests and exports the sampled ones
+
+Finished spans are queued and exported in batches from a background
+goroutine, so exporting never holds up a request. A nil *Tracer traces
+nothing
+*/
+type Tracer struct {
+	exporter    SpanExporter
+	sampleRatio float64
+	logger      *Logger
+	now         func() time.Time
+	random      func() float64
+
+	lock      sync.Mutex
+	queue     []SpanData
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func NewTracer(exporter SpanExporter, sampleRatio float64, logger *Logger) *Tracer {
+	t := &Tracer{
+		exporter:    exporter,
+		sampleRatio: sampleRatio,
+		logger:      logger,
+		now:         time.Now,
+		random:      mathrand.Float64,
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	go t.run(traceFlushInterval)
+	return t
+}
+
+/*
+Open the exporter chosen in opts and return a Tracer using it
+
+Returns nil without an exporter, which traces nothing
+*/
+func OpenTracer(opts TraceOptions, logger *Logger) (*Tracer, error) {
+	var exporter SpanExporter
+	switch opts.Exporter {
+	case "", TraceExporterNone:
+		return nil, nil
+	case TraceExporterStdout:
+		exporter = NewWriterExporter(os.Stdout)
+	case TraceExporterFile:
+		var err error
+		if exporter, err = OpenFileExporter(opts.Path); err != nil {
+			return nil, err
+		}
+	case TraceExporterOtlp:
+		exporter = NewOtlpExporter(opts.Endpoint, opts.ServiceName)
+	default:
+		return nil, TraceExporterError
+	}
+	return NewTracer(exporter, opts.SampleRatio, logger), nil
+}
+
+/*
+Start the server span of a request
+
+The span continues the trace of remote when it is valid, keeping its
+sampling decision. Otherwise a new trace is started, sampled at the
+tracer's ratio
+*/
+func (t *Tracer) StartRequestSpan(ctx context.Context, name string, remote SpanContext) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+
+	var span *Span
+	if remote.Valid() {
+		span = t.newSpan(name, SpanKindServer, remote.TraceId, remote.SpanId, remote.Sampled)
+	} else {
+		var traceId TraceId
+		rand.Read(traceId[:])
+		span = t.newSpan(name, SpanKindServer, traceId, SpanId{}, t.random() < t.sampleRatio)
+	}
+	return withSpan(ctx, span), span
+}
+
+func (t *Tracer) newSpan(name string, kind SpanKind, traceId TraceId, parentId SpanId, sampled bool) *Span {
+	var spanId SpanId
+	rand.Read(spanId[:])
+
+	return &Span{
+		tracer:  t,
+		context: SpanContext{TraceId: traceId, SpanId: spanId, Sampled: sampled},
+		data: SpanData{
+			Name:       name,
+			Kind:       kind,
+			TraceId:    traceId,
+			SpanId:     spanId,
+			ParentId:   parentId,
+			Start:      t.now(),
+			Attributes: Fields{},
+		},
+	}
+}
+
+func (t *Tracer) export(span SpanData) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if len(t.queue) < traceQueueSize {
+		t.queue = append(t.queue, span)
+	}
+}
+
+func (t *Tracer) run(interval time.Duration) {
+	defer close(t.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			t.flush()
+		case <-t.stop:
+			t.flush()
+			return
+		}
+	}
+}
+
+// Export every queued span, logging a failure
+func (t *Tracer) flush() {
+	t.lock.Lock()
+	spans := t.queue
+	t.queue = nil
+	t.lock.Unlock()
+
+	if len(spans) == 0 {
+		return
+	}
+	if err := t.exporter.ExportSpans(context.Background(), spans); err != nil {
+		t.logger.Error(LogTraceExportFailed, Fields{"spans": len(spans), "error": err})
+	}
+}
+
+// Export the spans still queued and close the exporter, only the first call counts
+func (t *Tracer) Close() error {
+	if t == nil {
+		return nil
+	}
+	var err error
+	t.closeOnce.Do(func() {
+		close(t.stop)
+		<-t.done
+		err = t.exporter.Close()
+	})
+	return err
+}
+
+/*
+Wrap a middleware in a span named after it
+
+The span covers the middleware's own work, ending when it calls next or
+returns, whichever is first. What runs after next is traced under the
+request span again
+*/
+func traceMiddleware(name string, mw func(web.ResponseWriter, *web.Request, web.NextMiddlewareFunc)) func(web.ResponseWriter, *web.Request, web.NextMiddlewareFunc) {
+	return func(rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
+		parent := SpanFromContext(req.Context())
+		if parent == nil {
+			mw(rw, req, next)
+			return
+		}
+
+		ctx, span := StartSpan(req.Context(), "middleware "+name, SpanKindInternal)
+		defer span.Finish()
+		req.Request = req.Request.WithContext(ctx)
+
+		mw(rw, req, func(rw web.ResponseWriter, req *web.Request) {
+			span.Finish()
+			req.Request = req.Request.WithContext(withSpan(req.Context(), parent))
+			next(rw, req)
+		})
+	}
+}
+
+// Name of a handler function, such as "(*AuthContext).GetPersonApi"
+func handlerName(handler interface{}) string {
+	fn := runtime.FuncForPC(reflect.ValueOf(handler).Pointer())
+	if fn == nil {
+		return ""
+	}
+	name := fn.Name()
+	if idx := strings.LastIndex(name, "/"); idx >= 0 {
+		name = name[idx+1:]
+	}
+	// Drop the package
+	if idx := strings.Index(name, "."); idx >= 0 {
+		name = name[idx+1:]
+	}
+	return strings.TrimSuffix(name, "-fm")
+}
+
+/*
+Exporter writing each span as a line of JSON
+
+	{"trace_id":"4bf9...","span_id":"00f0...","parent_id":"","name":"GET /api/person",
+	 "kind":"server","start":"2014-01-01T00:00:00Z","duration_ms":1.5,"attributes":{...}}
+*/
+type WriterExporter struct {
+	lock   sync.Mutex
+	out    io.Writer
+	closer io.Closer
+}
+
+func NewWriterExporter(out io.Writer) *WriterExporter {
+	return &WriterExporter{out: out}
+}
+
+// Append spans to the file at path
+func OpenFileExporter(path string) (*WriterExporter, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &WriterExporter{out: f, closer: f}, nil
+}
+
+type spanJson struct {
+	TraceId    string  `json:"trace_id"`
+	SpanId     string  `json:"span_id"`
+	ParentId   string  `json:"parent_id"`
+	Name       string  `json:"name"`
+	Kind       string  `json:"kind"`
+	Start      string  `json:"start"`
+	DurationMs float64 `json:"duration_ms"`
+	Attributes Fields  `json:"attributes"`
+	Error      string  `json:"error,omitempty"`
+}
+
+func (e *WriterExporter) ExportSpans(ctx context.Context, spans []SpanData) error {
+	buf := new(bytes.Buffer)
+	enc := json.NewEncoder(buf)
+	for _, span := range spans {
+		parentId := ""
+		if !span.ParentId.IsZero() {
+			parentId = span.ParentId.String()
+		}
+		err := enc.Encode(spanJson{
+			TraceId:    span.TraceId.String(),
+			SpanId:     span.SpanId.String(),
+			ParentId:   parentId,
+			Name:       span.Name,
+			Kind:       span.Kind.String(),
+			Start:      span.Start.UTC().Format(time.RFC3339Nano),
+			DurationMs: float64(span.End.Sub(span.Start)) / float64(time.Millisecond),
+			Attributes: span.Attributes,
+			Error:      span.Error,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	_, err := buf.WriteTo(e.out)
+	return err
+}
+
+func (e *WriterExporter) Close() error {
+	if e.closer == nil {
+		return nil
+	}
+	return e.closer.Close()
+}
+
+/*
+Exporter sending spans to an OpenTelemetry collector over OTLP/HTTP
+
+Spans are posted as JSON to the /v1/traces path of the endpoint, such
+as http://localhost:4318
+*/
+type OtlpExporter struct {
+	url         string
+	serviceName string
+	client      *http.Client
+}
+
+func NewOtlpExporter(endpoint, serviceName string) *OtlpExporter {
+	url := strings.TrimSuffix(endpoint, "/")
+	if !strings.HasSuffix(url, OtlpTracesPath) {
+		url += OtlpTracesPath
+	}
+	return &OtlpExporter{
+		url:         url,
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// OTLP JSON encoding of the export request, with the fields used here
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceId           string          `json:"traceId"`
+	SpanId            string          `json:"spanId"`
+	ParentSpanId      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              SpanKind        `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+type otlpStatus struct {
+	// 2 for an error
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+const otlpStatusError = 2
+
+// Attributes in key order, as OTLP typed values
+func otlpAttributes(fields Fields) []otlpAttribute {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	attrs := make([]otlpAttribute, len(keys))
+	for i, key := range keys {
+		var value map[string]interface{}
+		switch v := fields[key].(type) {
+		case string:
+			value = map[string]interface{}{"stringValue": v}
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		case int:
+			value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			value = map[string]interface{}{"doubleValue": v}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+		attrs[i] = otlpAttribute{Key: key, Value: value}
+	}
+	return attrs
+}
+
+func (e *OtlpExporter) ExportSpans(ctx context.Context, spans []SpanData) error {
+	otlpSpans := make([]otlpSpan, len(spans))
+	for i, span := range spans {
+		s := otlpSpan{
+			TraceId:           span.TraceId.String(),
+			SpanId:            span.SpanId.String(),
+			Name:              span.Name,
+			Kind:              span.Kind,
+			StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+			Attributes:        otlpAttributes(span.Attributes),
+		}
+		if !span.ParentId.IsZero() {
+			s.ParentSpanId = span.ParentId.String()
+		}
+		if span.Error != "" {
+			s.Status = &otlpStatus{Code: otlpStatusError, Message: span.Error}
+		}
+		otlpSpans[i] = s
+	}
+
+	body, err := json.Marshal(otlpRequest{[]otlpResourceSpans{{
+		Resource: otlpResource{otlpAttributes(Fields{"service.name": e.serviceName})},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{e.serviceName},
+			Spans: otlpSpans,
+		}},
+	}}})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", JsonContentType)
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf(OtlpExportError, resp.Status)
+	}
+	return nil
+}
+
+func (e *OtlpExporter) Close() error {
+	return nil
+}
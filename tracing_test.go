@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const testTraceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+// Keeps exported spans, for checking
+type recordingExporter struct {
+	lock   sync.Mutex
+	spans  []SpanData
+	closed bool
+}
+
+func (e *recordingExporter) ExportSpans(ctx context.Context, spans []SpanData) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+func (e *recordingExporter) Close() error {
+	e.closed = true
+	return nil
+}
+
+// The exported span named name, or the zero SpanData
+func (e *recordingExporter) span(name string) SpanData {
+	for _, span := range e.spans {
+		if span.Name == name {
+			return span
+		}
+	}
+	return SpanData{}
+}
+
+func newTestTracer() (*Tracer, *recordingExporter) {
+	exporter := new(recordingExporter)
+	return NewTracer(exporter, 1, NewLogger(ioutil.Discard, LevelInfo)), exporter
+}
+
+func TestParseTraceparent(t *testing.T) {
+	sc, ok := ParseTraceparent(testTraceparent)
+	assert.True(t, ok)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceId.String())
+	assert.Equal(t, "00f067aa0ba902b7", sc.SpanId.String())
+	assert.True(t, sc.Sampled)
+	assert.Equal(t, testTraceparent, sc.Traceparent())
+
+	sc, ok = ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	assert.True(t, ok)
+	assert.False(t, sc.Sampled)
+
+	// A later version may add fields
+	_, ok = ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra")
+	assert.True(t, ok)
+
+	invalid := []string{
+		"",
+		"garbage",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"00-4bf92f3577b34da6a3ce929d0e0e473-600f067aa0ba902b7-01",
+	}
+	for _, header := range invalid {
+		_, ok := ParseTraceparent(header)
+		assert.False(t, ok, header)
+	}
+}
+
+func TestStartSpanOutsideTrace(t *testing.T) {
+	ctx, span := StartSpan(context.Background(), "test", SpanKindInternal)
+	assert.Nil(t, span)
+	assert.Nil(t, SpanFromContext(ctx))
+
+	// A nil span does nothing
+	span.SetAttribute("key", "value")
+	span.SetError(errors.New("failed"))
+	span.Finish()
+	assert.False(t, span.Context().Valid())
+
+	var tracer *Tracer
+	_, span = tracer.StartRequestSpan(context.Background(), "test", SpanContext{})
+	assert.Nil(t, span)
+	assert.Nil(t, tracer.Close())
+}
+
+func TestTracerSpans(t *testing.T) {
+	tracer, exporter := newTestTracer()
+	remote, _ := ParseTraceparent(testTraceparent)
+
+	ctx, root := tracer.StartRequestSpan(context.Background(), "root", remote)
+	assert.True(t, SpanFromContext(ctx) == root)
+	_, child := StartSpan(ctx, "child", SpanKindClient)
+	child.SetAttribute("db.operation", QueryGetUser)
+	child.SetError(errors.New("failed"))
+	child.Finish()
+	root.Finish()
+	// Only the first Finish counts
+	root.Finish()
+
+	assert.Nil(t, tracer.Close())
+	assert.True(t, exporter.closed)
+	if !assert.Equal(t, 2, len(exporter.spans)) {
+		return
+	}
+
+	rootData, childData := exporter.span("root"), exporter.span("child")
+	assert.Equal(t, remote.TraceId, rootData.TraceId)
+	assert.Equal(t, remote.SpanId, rootData.ParentId)
+	assert.Equal(t, SpanKindServer, rootData.Kind)
+	assert.Equal(t, remote.TraceId, childData.TraceId)
+	assert.Equal(t, rootData.SpanId, childData.ParentId)
+	assert.Equal(t, SpanKindClient, childData.Kind)
+	assert.Equal(t, Fields{"db.operation": QueryGetUser}, childData.Attributes)
+	assert.Equal(t, "failed", childData.Error)
+	assert.False(t, childData.End.Before(childData.Start))
+}
+
+func TestTracerSampling(t *testing.T) {
+	tracer, exporter := newTestTracer()
+	tracer.sampleRatio = 0.5
+
+	tracer.random = func() float64 { return 0.7 }
+	ctx, span := tracer.StartRequestSpan(context.Background(), "dropped", SpanContext{})
+	assert.True(t, span.Context().Valid())
+	assert.False(t, span.Context().Sampled)
+	_, child := StartSpan(ctx, "dropped child", SpanKindInternal)
+	child.Finish()
+	span.Finish()
+
+	tracer.random = func() float64 { return 0.2 }
+	_, span = tracer.StartRequestSpan(context.Background(), "kept", SpanContext{})
+	assert.True(t, span.Context().Sampled)
+	assert.True(t, span.Context().Valid())
+	span.Finish()
+
+	// The caller's decision wins
+	unsampled, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	_, span = tracer.StartRequestSpan(context.Background(), "caller", unsampled)
+	span.Finish()
+
+	tracer.Close()
+	assert.Equal(t, 1, len(exporter.spans))
+	assert.Equal(t, "kept", exporter.span("kept").Name)
+}
+
+func TestWriterExporter(t *testing.T) {
+	buf := new(bytes.Buffer)
+	tracer := NewTracer(NewWriterExporter(buf), 1, NewLogger(ioutil.Discard, LevelInfo))
+	remote, _ := ParseTraceparent(testTraceparent)
+
+	_, span := tracer.StartRequestSpan(context.Background(), "GET /api/person", remote)
+	span.SetAttribute("http.status_code", 200)
+	span.Finish()
+	tracer.Close()
+
+	var line map[string]interface{}
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &line), buf.String())
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", line["trace_id"])
+	assert.Equal(t, "00f067aa0ba902b7", line["parent_id"])
+	assert.Equal(t, "GET /api/person", line["name"])
+	assert.Equal(t, "server", line["kind"])
+	assert.Equal(t, map[string]interface{}{"http.status_code": float64(200)}, line["attributes"])
+}
+
+func TestOtlpExporter(t *testing.T) {
+	// Stands in for an OpenTelemetry collector
+	var received otlpRequest
+	var path, contentType string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, contentType = r.URL.Path, r.Header.Get("Content-Type")
+		json.NewDecoder(r.Body).Decode(&received)
+	}))
+	defer collector.Close()
+
+	tracer := NewTracer(NewOtlpExporter(collector.URL, "people-test"), 1, NewLogger(ioutil.Discard, LevelInfo))
+	ctx, root := tracer.StartRequestSpan(context.Background(), "GET /api/person", SpanContext{})
+	_, child := StartSpan(ctx, "db get_people", SpanKindClient)
+	child.SetAttribute("db.system", "postgresql")
+	child.SetError(errors.New("timeout"))
+	child.Finish()
+	root.Finish()
+	assert.Nil(t, tracer.Close())
+
+	assert.Equal(t, OtlpTracesPath, path)
+	assert.Equal(t, JsonContentType, contentType)
+	if !assert.Equal(t, 1, len(received.ResourceSpans)) {
+		return
+	}
+	resource := received.ResourceSpans[0]
+	assert.Equal(t, []otlpAttribute{{"service.name", map[string]interface{}{"stringValue": "people-test"}}}, resource.Resource.Attributes)
+	spans := resource.ScopeSpans[0].Spans
+	if !assert.Equal(t, 2, len(spans)) {
+		return
+	}
+
+	assert.Equal(t, "db get_people", spans[0].Name)
+	assert.Equal(t, SpanKindClient, spans[0].Kind)
+	assert.Equal(t, root.Context().TraceId.String(), spans[0].TraceId)
+	assert.Equal(t, root.Context().SpanId.String(), spans[0].ParentSpanId)
+	assert.Equal(t, &otlpStatus{Code: otlpStatusError, Message: "timeout"}, spans[0].Status)
+	assert.Equal(t, "GET /api/person", spans[1].Name)
+	assert.Equal(t, "", spans[1].ParentSpanId)
+	assert.Nil(t, spans[1].Status)
+}
+
+func TestOtlpExporterError(t *testing.T) {
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer collector.Close()
+
+	exporter := NewOtlpExporter(collector.URL+OtlpTracesPath, "people-test")
+	err := exporter.ExportSpans(context.Background(), []SpanData{{Name: "test"}})
+	if assert.NotNil(t, err) {
+		assert.True(t, strings.Contains(err.Error(), "503"), err.Error())
+	}
+}
+
+func TestOpenTracer(t *testing.T) {
+	tracer, err := OpenTracer(TraceOptions{Exporter: TraceExporterNone}, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, tracer)
+
+	_, err = OpenTracer(TraceOptions{Exporter: "zipkin"}, nil)
+	assert.Equal(t, TraceExporterError, err)
+}
+
+func TestObserveQuery(t *testing.T) {
+	tracer, exporter := newTestTracer()
+	ctx, root := tracer.StartRequestSpan(context.Background(), "root", SpanContext{})
+
+	observeQuery(ctx, DbSystemSqlite, QueryGetPerson)()
+	root.Finish()
+	tracer.Close()
+
+	span := exporter.span("db " + QueryGetPerson)
+	assert.Equal(t, SpanKindClient, span.Kind)
+	assert.Equal(t, root.Context().SpanId, span.ParentId)
+	assert.Equal(t, Fields{"db.system": DbSystemSqlite, "db.operation": QueryGetPerson}, span.Attributes)
+}
+
+func TestTracingMiddleware(t *testing.T) {
+	serv := NewServer(newTestConfig())
+	logger, buf := newTestLogger(LevelInfo)
+	serv.SetLogger(logger)
+	tracer, exporter := newTestTracer()
+	serv.tracer = tracer
+	router := serv.setupRoutes()
+
+	req, _ := http.NewRequest("GET", "http://example.com/healthz", nil)
+	req.Header.Set(TraceparentHeader, testTraceparent)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	tracer.Close()
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	remote, _ := ParseTraceparent(testTraceparent)
+	server := exporter.span("GET /healthz")
+	assert.Equal(t, SpanKindServer, server.Kind)
+	assert.Equal(t, remote.SpanId, server.ParentId)
+	assert.Equal(t, "/healthz", server.Attributes["http.route"])
+	assert.Equal(t, http.StatusOK, server.Attributes["http.status_code"])
+	assert.NotEqual(t, "", server.Attributes["request_id"])
+	assert.True(t, strings.Contains(buf.String(), `"trace_id":"4bf92f3577b34da6a3ce929d0e0e4736"`), buf.String())
+
+	names := []string{
+		"middleware request_id",
+		"middleware access_log",
+		"middleware metrics",
+		"middleware recover",
+		"middleware cors",
+		"middleware timeout",
+		"handler (*Context).HealthzApi",
+	}
+	assert.Equal(t, len(names)+1, len(exporter.spans))
+	for _, name := range names {
+		span := exporter.span(name)
+		assert.Equal(t, remote.TraceId, span.TraceId, name)
+		assert.Equal(t, server.SpanId, span.ParentId, name)
+	}
+}
+
+func TestTracingMiddlewareOff(t *testing.T) {
+	serv := NewServer(newTestConfig())
+	rw, req, next, _ := mockMiddlewareParams()
+
+	serv.TracingMiddleware(rw, req, next.Next)
+
+	next.Mock.AssertExpectations(t)
+	assert.Nil(t, SpanFromContext(req.Context()))
+}
+
+func TestHandlerName(t *testing.T) {
+	serv := new(Server)
+	assert.Equal(t, "(*Context).HealthzApi", handlerName((*Context).HealthzApi))
+	assert.Equal(t, "(*Server).ReadyzApi", handlerName(serv.ReadyzApi))
+}
@@ -1,7 +1,7 @@
 package main
 
 import (
-	"errors"
+	"context"
 	"fmt"
 	"strings"
 
@@ -15,6 +15,9 @@ const (
 
 	UserInvalid = "User is not valid"
 
+	// Every column of "user" read into a User, in order
+	UserColumns = "id, email, pwhash, name, is_active, is_superuser, apikey"
+
 	// User.Validate errors
 	UserEmailEmpty    = "Email cannot be empty"
 	UserPasswordEmpty = "Password cannot be empty"
@@ -22,12 +25,34 @@ const (
 	UserInvalidEmail  = "Invalid email address"
 )
 
+const (
+	getUserSql = `SELECT ` + UserColumns + ` FROM "user" WHERE email=?`
+
+	createUserSql = `INSERT INTO "user" (
+        email,
+        pwhash,
+        name,
+        is_active,
+        is_superuser,
+        apikey
+    ) VALUES (?, ?, ?, ?, ?, ?) RETURNING id;`
+
+	updateUserSql = `UPDATE "user" SET
+		email = ?,
+		pwhash = ?,
+		name = ?,
+		is_active = ?,
+		is_superuser = ?,
+		apikey = ?
+	WHERE id=?;`
+)
+
 type UserService interface {
 	// User related methods
-	GetUser(email string) (*User, error)
+	GetUser(ctx context.Context, email string) (*User, error)
 	PasswordCost() int
-	CreateUser(email, pwhash, name, apikey string, isActive, isSuperuser bool) (*User, error)
-	UpdateUser(*User) error
+	CreateUser(ctx context.Context, email, pwhash, name, apikey string, isActive, isSuperuser bool) (*User, error)
+	UpdateUser(ctx context.Context, user *User) error
 }
 
 /*
@@ -109,13 +134,16 @@ func (u *User) CheckApiKey(apikey string) bool {
 Fetch a user given an email from the database
 Returns nil if no matching user is found
 */
-func (s *pgDbService) GetUser(email string) (*User, error) {
+func (s *pgDbService) GetUser(ctx context.Context, email string) (*User, error) {
+	defer observeQuery(ctx, s.system(), QueryGetUser)()
 	user := new(User)
 
-	err := s.db.Get(user, s.db.Rebind(`SELECT * FROM "user" WHERE email=?`), email)
+	err := s.read(ctx, []string{emailKey(email)}, func(stmts *pgStatements) error {
+		return stmts.use(ctx, stmts.getUser).GetContext(ctx, user, email)
+	})
 	if err != nil {
-		errMsg := fmt.Sprintf("User could not be found: %s", err)
-		return nil, errors.New(errMsg)
+		// Wrapped so callers can still tell a timeout from a missing user
+		return nil, fmt.Errorf("User could not be found: %w", err)
 	}
 
 	return user, nil
@@ -131,7 +159,8 @@ Create a User in the database with the given email, password hash, name and apik
 
 IsActive is set to true, IsSuperuser is set to false for the user
 */
-func (s *pgDbService) CreateUser(email, pwhash, name, apikey string, isActive, isSuperuser bool) (*User, error) {
+func (s *pgDbService) CreateUser(ctx context.Context, email, pwhash, name, apikey string, isActive, isSuperuser bool) (*User, error) {
+	defer observeQuery(ctx, s.system(), QueryCreateUser)()
 	newUser := new(User)
 
 	var userId int
@@ -147,16 +176,7 @@ func (s *pgDbService) CreateUser(email, pwhash, name, apikey string, isActive, i
 		return nil, NewValidationError(UserInvalid, newUser.Errors())
 	}
 
-	insertSql := s.db.Rebind(`INSERT INTO "user" (
-        email,
-        pwhash,
-        name,
-        is_active,
-        is_superuser,
-        apikey
-    ) VALUES (?, ?, ?, ?, ?, ?) RETURNING id;`)
-
-	err := s.db.QueryRowx(insertSql,
+	err := s.stmts.use(ctx, s.stmts.createUser).QueryRowxContext(ctx,
 		newUser.Email,
 		newUser.Pwhash,
 		newUser.Name,
@@ -169,25 +189,18 @@ func (s *pgDbService) CreateUser(email, pwhash, name, apikey string, isActive, i
 	}
 
 	newUser.Id = userId
+	s.wrote(userKey(userId), emailKey(email))
 
 	return newUser, nil
 }
 
-func (s *pgDbService) UpdateUser(user *User) error {
+func (s *pgDbService) UpdateUser(ctx context.Context, user *User) error {
+	defer observeQuery(ctx, s.system(), QueryUpdateUser)()
 	if !user.Validate() {
 		return NewValidationError(UserInvalid, user.Errors())
 	}
 
-	updateSql := s.db.Rebind(`UPDATE "user" SET
-		email = ?,
-		pwhash = ?,
-		name = ?,
-		is_active = ?,
-		is_superuser = ?,
-		apikey = ?
-	WHERE id=?;`)
-
-	_, err := s.db.Exec(updateSql,
+	_, err := s.stmts.use(ctx, s.stmts.updateUser).ExecContext(ctx,
 		user.Email,
 		user.Pwhash,
 		user.Name,
@@ -199,6 +212,7 @@ func (s *pgDbService) UpdateUser(user *User) error {
 	if err != nil {
 		return err
 	}
+	s.wrote(userKey(user.Id), emailKey(user.Email))
 
 	return nil
 }
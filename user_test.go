@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/stretchr/testify/assert"
@@ -125,11 +126,11 @@ func TestGetUser(t *testing.T) {
 	cols := []string{"id", "email", "pwhash", "name", "is_active", "is_superuser", "apikey"}
 	data := "1,test@example.com,,Test User,true,false,abcdefg"
 
-	sqlmock.ExpectQuery(`SELECT \* FROM "user" WHERE email=?`).
+	sqlmock.ExpectQuery(`SELECT id, email, pwhash, name, is_active, is_superuser, apikey FROM "user" WHERE email=?`).
 		WithArgs(userEmail).
 		WillReturnRows(sqlmock.NewRows(cols).FromCSVString(data))
 
-	u, err := pgdbs.GetUser(userEmail)
+	u, err := pgdbs.GetUser(context.Background(), userEmail)
 	if !assert.Nil(t, err, "Query should not error") {
 		return
 	}
@@ -146,11 +147,11 @@ func TestGetUserError(t *testing.T) {
 
 	userEmail := "test2@example.com"
 
-	sqlmock.ExpectQuery(`SELECT \* FROM "user" WHERE email=?`).
+	sqlmock.ExpectQuery(`SELECT id, email, pwhash, name, is_active, is_superuser, apikey FROM "user" WHERE email=?`).
 		WithArgs(userEmail).
 		WillReturnError(errors.New("Could not find user"))
 
-	u, err := pgdbs.GetUser(userEmail)
+	u, err := pgdbs.GetUser(context.Background(), userEmail)
 	if !assert.Nil(t, u, "User should be nil") {
 		return
 	}
@@ -180,7 +181,7 @@ func TestCreateUserInsertError(t *testing.T) {
 		WithArgs(userEmail, userPwhash, userName, true, false, userApikey).
 		WillReturnError(errors.New("Could not insert"))
 
-	u, err := pgdbs.CreateUser(userEmail, userPwhash, userName, userApikey, defaultActive, defaultSuperuser)
+	u, err := pgdbs.CreateUser(context.Background(), userEmail, userPwhash, userName, userApikey, defaultActive, defaultSuperuser)
 
 	if !assert.Nil(t, u, "User should be nil") {
 		return
@@ -204,7 +205,7 @@ func TestCreateUserEmailError(t *testing.T) {
 		"email": UserEmailEmpty,
 	}
 
-	u, err := pgdbs.CreateUser(userEmail, userPwhash, userName, userApikey, defaultActive, defaultSuperuser)
+	u, err := pgdbs.CreateUser(context.Background(), userEmail, userPwhash, userName, userApikey, defaultActive, defaultSuperuser)
 
 	if !assert.Nil(t, u, UserInvalid) {
 		return
@@ -235,7 +236,7 @@ func TestCreateUser(t *testing.T) {
 		WithArgs(userEmail, userPwhash, userName, userIsActive, userIsSuperuser, userApikey).
 		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(userNewId))
 
-	u, err := pgdbs.CreateUser(userEmail, userPwhash, userName, userApikey, userIsActive, userIsSuperuser)
+	u, err := pgdbs.CreateUser(context.Background(), userEmail, userPwhash, userName, userApikey, userIsActive, userIsSuperuser)
 
 	if !assert.Nil(t, err, "Error should be nil") {
 		return
@@ -344,7 +345,7 @@ func TestUpdateUserInvalidUser(t *testing.T) {
 		"name": UserNameEmpty,
 	}
 
-	err := pgdbs.UpdateUser(user)
+	err := pgdbs.UpdateUser(context.Background(), user)
 
 	if !assert.NotNil(t, err) {
 		return
@@ -365,7 +366,7 @@ func TestUpdateUserUpdateError(t *testing.T) {
 		WithArgs(user.Email, user.Pwhash, user.Name, user.IsActive, user.IsSuperuser, user.ApiKey, user.Id).
 		WillReturnError(errors.New("Could not execute"))
 
-	err := pgdbs.UpdateUser(user)
+	err := pgdbs.UpdateUser(context.Background(), user)
 
 	if !assert.NotNil(t, err) {
 		return
@@ -385,7 +386,7 @@ func TestUpdateUser(t *testing.T) {
 		WithArgs(user.Email, user.Pwhash, user.Name, user.IsActive, user.IsSuperuser, user.ApiKey, user.Id).
 		WillReturnResult(sqlmock.NewResult(0, 1))
 
-	err := pgdbs.UpdateUser(user)
+	err := pgdbs.UpdateUser(context.Background(), user)
 
 	if !assert.Nil(t, err) {
 		return
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// Size and lifetime of the user cache. A Size of 0 disables it
+type AuthCacheOptions struct {
+	Size int
+	Ttl  time.Duration
+}
+
+// Counters for monitoring the user cache
+type UserCacheStats struct {
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+	Size      int    `json:"size"`
+}
+
+type userCacheEntry struct {
+	user    *User
+	expires time.Time
+}
+
+/*
+Bounded cache of users by email
+
+Holds at most size users, dropping the least recently used first. Each
+is kept for ttl at most, which bounds how stale it can be after a change
+made by another server. Safe for concurrent use
+*/
+type UserCache struct {
+	lock    sync.Mutex
+	size    int
+	ttl     time.Duration
+	order   *list.List
+	byEmail map[string]*list.Element
+	byId    map[int]*list.Element
+	stats   UserCacheStats
+	now     func() time.Time
+	// Raised by every Invalidate, see PutIfCurrent
+	generation uint64
+}
+
+func NewUserCache(size int, ttl time.Duration) *UserCache {
+	return &UserCache{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		byEmail: map[string]*list.Element{},
+		byId:    map[int]*list.Element{},
+		now:     time.Now,
+	}
+}
+
+// A copy of the cached user with email, if there is one still fresh
+func (c *UserCache) Get(email string) (*User, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	elem, ok := c.byEmail[email]
+	if ok && c.now().Before(elem.Value.(*userCacheEntry).expires) {
+		c.stats.Hits++
+		c.order.MoveToFront(elem)
+		return copyUser(elem.Value.(*userCacheEntry).user), true
+	}
+	if ok {
+		c.remove(elem)
+	}
+	c.stats.Misses++
+	return nil, false
+}
+
+// Cache a copy of user, replacing any entry for the same email or id
+func (c *UserCache) Put(user *User) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.put(user)
+}
+
+func (c *UserCache) put(user *User) {
+	c.invalidate(user)
+	elem := c.order.PushFront(&userCacheEntry{copyUser(user), c.now().Add(c.ttl)})
+	c.byEmail[user.Email] = elem
+	c.byId[user.Id] = elem
+
+	for c.order.Len() > c.size {
+		c.remove(c.order.Back())
+		c.stats.Evictions++
+	}
+}
+
+/*
+Cache user read from the database, unless the cache was invalidated since
+
+generation is what Generation returned before the read. Once it has
+moved, a write may have committed after the read, and the user read
+could be older than the database: caching it would undo the
+invalidation until the ttl runs out. Returns whether user was cached
+*/
+func (c *UserCache) PutIfCurrent(user *User, generation uint64) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.generation != generation {
+		return false
+	}
+	c.put(user)
+	return true
+}
+
+// Stamp to pass PutIfCurrent, taken before reading a user to cache
+func (c *UserCache) Generation() uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.generation
+}
+
+/*
+Drop user from the cache
+
+Matches by id as well as email, so a user whose email changed is
+dropped under the old one too
+*/
+func (c *UserCache) Invalidate(user *User) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.generation++
+	c.invalidate(user)
+}
+
+func (c *UserCache) invalidate(user *User) {
+	if elem, ok := c.byEmail[user.Email]; ok {
+		c.remove(elem)
+	}
+	if elem, ok := c.byId[user.Id]; ok {
+		c.remove(elem)
+	}
+}
+
+func (c *UserCache) remove(elem *list.Element) {
+	user := c.order.Remove(elem).(*userCacheEntry).user
+	delete(c.byEmail, user.Email)
+	delete(c.byId, user.Id)
+}
+
+func (c *UserCache) Stats() UserCacheStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	stats := c.stats
+	stats.Size = c.order.Len()
+	return stats
+}
+
+// Export the counters in m, read on each scrape. Call at most once per cache
+func (c *UserCache) RegisterMetrics(m *Metrics) {
+	m.NewCounterFunc("people_auth_cache_hits_total", "Users found in the authentication cache", func() float64 {
+		return float64(c.Stats().Hits)
+	})
+	m.NewCounterFunc("people_auth_cache_misses_total", "Users looked up in the database, not cached or expired", func() float64 {
+		return float64(c.Stats().Misses)
+	})
+	m.NewCounterFunc("people_auth_cache_evictions_total", "Users dropped to make room for others", func() float64 {
+		return float64(c.Stats().Evictions)
+	})
+	m.NewGaugeFunc("people_auth_cache_size", "Users in the authentication cache", func() float64 {
+		return float64(c.Stats().Size)
+	})
+}
+
+/*
+DbService serving GetUser from a UserCache
+
+Authenticating a request then needs no database round trip while the
+user is cached. Creating or updating a user drops it from the cache;
+inside WithTx it is dropped again once the unit of work ends. A user
+read on a miss is only cached if nothing was dropped meanwhile, so a
+read racing the commit cannot leave the old user cached
+*/
+type cachedDbService struct {
+	DbService
+	cache *UserCache
+	// Users written in the current unit of work, nil outside one
+	written *[]*User
+}
+
+func NewCachedDbService(s DbService, cache *UserCache) *cachedDbService {
+	return &cachedDbService{DbService: s, cache: cache}
+}
+
+func (s *cachedDbService) GetUser(ctx context.Context, email string) (*User, error) {
+	// A unit of work must see its own writes
+	if s.written != nil {
+		return s.DbService.GetUser(ctx, email)
+	}
+
+	if user, ok := s.cache.Get(email); ok {
+		return user, nil
+	}
+
+	// From the primary, as a lagging replica could still have a user
+	// changed or deactivated before the invalidation
+	generation := s.cache.Generation()
+	user, err := s.DbService.GetUser(withPrimaryReads(ctx), email)
+	if err != nil {
+		return nil, err
+	}
+	s.cache.PutIfCurrent(user, generation)
+	return user, nil
+}
+
+func (s *cachedDbService) CreateUser(ctx context.Context, email, pwhash, name, apikey string, isActive, isSuperuser bool) (*User, error) {
+	user, err := s.DbService.CreateUser(ctx, email, pwhash, name, apikey, isActive, isSuperuser)
+	if user != nil {
+		s.wrote(user)
+	}
+	return user, err
+}
+
+func (s *cachedDbService) UpdateUser(ctx context.Context, user *User) error {
+	err := s.DbService.UpdateUser(ctx, user)
+	s.wrote(user)
+	return err
+}
+
+func (s *cachedDbService) wrote(user *User) {
+	s.cache.Invalidate(user)
+	if s.written != nil {
+		*s.written = append(*s.written, copyUser(user))
+	}
+}
+
+func (s *cachedDbService) WithTx(ctx context.Context, fn func(tx DbService) error) error {
+	if s.written != nil {
+		return s.DbService.WithTx(ctx, func(tx DbService) error {
+			return fn(&cachedDbService{DbService: tx, cache: s.cache, written: s.written})
+		})
+	}
+
+	written := []*User{}
+	defer func() {
+		for _, user := range written {
+			s.cache.Invalidate(user)
+		}
+	}()
+
+	return s.DbService.WithTx(ctx, func(tx DbService) error {
+		return fn(&cachedDbService{DbService: tx, cache: s.cache, written: &written})
+	})
+}
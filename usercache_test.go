@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"testing"
+	"time"
+)
+
+func newTestUserCache(size int) (*UserCache, *time.Time) {
+	now := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	cache := NewUserCache(size, time.Minute)
+	cache.now = func() time.Time { return now }
+	return cache, &now
+}
+
+func cacheTestUser(id int) *User {
+	user := newTestUser()
+	user.Id = id
+	user.Email = fmt.Sprintf("user%d@example.com", id)
+	return user
+}
+
+func TestUserCacheGetPut(t *testing.T) {
+	cache, _ := newTestUserCache(2)
+	user := cacheTestUser(1)
+
+	u, ok := cache.Get(user.Email)
+	assert.Nil(t, u)
+	assert.False(t, ok)
+
+	cache.Put(user)
+	u, ok = cache.Get(user.Email)
+	assert.True(t, ok)
+	assert.Equal(t, user, u)
+
+	// Callers get their own copy
+	u.Name = "Changed"
+	u, _ = cache.Get(user.Email)
+	assert.Equal(t, "Test User", u.Name)
+
+	assert.Equal(t, UserCacheStats{Hits: 2, Misses: 1, Size: 1}, cache.Stats())
+}
+
+func TestUserCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache, _ := newTestUserCache(2)
+	one, two, three := cacheTestUser(1), cacheTestUser(2), cacheTestUser(3)
+
+	cache.Put(one)
+	cache.Put(two)
+	cache.Get(one.Email)
+	cache.Put(three)
+
+	_, ok := cache.Get(two.Email)
+	assert.False(t, ok)
+	_, ok = cache.Get(one.Email)
+	assert.True(t, ok)
+	_, ok = cache.Get(three.Email)
+	assert.True(t, ok)
+
+	stats := cache.Stats()
+	assert.Equal(t, uint64(1), stats.Evictions)
+	assert.Equal(t, 2, stats.Size)
+}
+
+func TestUserCacheTtl(t *testing.T) {
+	cache, now := newTestUserCache(2)
+	user := cacheTestUser(1)
+
+	cache.Put(user)
+	*now = now.Add(59 * time.Second)
+	_, ok := cache.Get(user.Email)
+	assert.True(t, ok)
+
+	*now = now.Add(time.Second)
+	_, ok = cache.Get(user.Email)
+	assert.False(t, ok)
+	assert.Equal(t, 0, cache.Stats().Size)
+}
+
+func TestUserCacheInvalidate(t *testing.T) {
+	cache, _ := newTestUserCache(2)
+	user := cacheTestUser(1)
+	cache.Put(user)
+
+	// Changing the email drops the entry under the old one
+	changed := *user
+	changed.Email = "new@example.com"
+	cache.Invalidate(&changed)
+
+	_, ok := cache.Get(user.Email)
+	assert.False(t, ok)
+	assert.Equal(t, 0, cache.Stats().Size)
+}
+
+func TestUserCachePutIfCurrent(t *testing.T) {
+	cache, _ := newTestUserCache(2)
+	user := cacheTestUser(1)
+
+	generation := cache.Generation()
+	cache.Invalidate(cacheTestUser(2))
+	assert.False(t, cache.PutIfCurrent(user, generation))
+	_, ok := cache.Get(user.Email)
+	assert.False(t, ok)
+
+	assert.True(t, cache.PutIfCurrent(user, cache.Generation()))
+	_, ok = cache.Get(user.Email)
+	assert.True(t, ok)
+}
+
+// A user changed while it was being read is not cached in its old state
+func TestCachedDbServiceGetUserInvalidatedDuringRead(t *testing.T) {
+	user := newTestUser()
+	cache := NewUserCache(10, time.Minute)
+	dbs := new(MockDbService)
+	dbs.Mock.On("GetUser", user.Email).Return(user, nil).Run(func(mock.Arguments) {
+		cache.Invalidate(user)
+	})
+
+	s := NewCachedDbService(dbs, cache)
+
+	for i := 0; i < 2; i++ {
+		u, err := s.GetUser(context.Background(), user.Email)
+		assert.Nil(t, err)
+		assert.Equal(t, user, u)
+	}
+	dbs.Mock.AssertNumberOfCalls(t, "GetUser", 2)
+	assert.Equal(t, 0, cache.Stats().Size)
+}
+
+func TestUserCacheRegisterMetrics(t *testing.T) {
+	cache, _ := newTestUserCache(1)
+	m := NewMetrics()
+	cache.RegisterMetrics(m)
+
+	cache.Get("nobody@example.com")
+	cache.Put(cacheTestUser(1))
+	cache.Put(cacheTestUser(2))
+	cache.Get(cacheTestUser(2).Email)
+
+	buf := new(bytes.Buffer)
+	m.WriteTo(buf)
+	for _, sample := range []string{
+		"people_auth_cache_hits_total 1\n",
+		"people_auth_cache_misses_total 1\n",
+		"people_auth_cache_evictions_total 1\n",
+		"people_auth_cache_size 1\n",
+	} {
+		assert.Contains(t, buf.String(), sample)
+	}
+}
+
+func TestCachedDbServiceGetUser(t *testing.T) {
+	user := newTestUser()
+	dbs := new(MockDbService)
+	dbs.Mock.On("GetUser", user.Email).Return(user, nil)
+	dbs.Mock.On("GetUser", "nobody@example.com").Return(nil, errors.New("User could not be found"))
+
+	s := NewCachedDbService(dbs, NewUserCache(10, time.Minute))
+
+	for i := 0; i < 3; i++ {
+		u, err := s.GetUser(context.Background(), user.Email)
+		assert.Nil(t, err)
+		assert.Equal(t, user, u)
+	}
+	dbs.Mock.AssertNumberOfCalls(t, "GetUser", 1)
+
+	// Failed lookups are not cached
+	for i := 0; i < 2; i++ {
+		u, err := s.GetUser(context.Background(), "nobody@example.com")
+		assert.Nil(t, u)
+		assert.NotNil(t, err)
+	}
+	dbs.Mock.AssertNumberOfCalls(t, "GetUser", 3)
+}
+
+func TestCachedDbServiceUpdateUser(t *testing.T) {
+	mdbs, user := newTestMemDbService(t)
+	s := NewCachedDbService(mdbs, NewUserCache(10, time.Minute))
+
+	s.GetUser(context.Background(), user.Email)
+
+	// Rotating the key and deactivating both go through UpdateUser
+	user.ApiKey = "newkey"
+	user.IsActive = false
+	assert.Nil(t, s.UpdateUser(context.Background(), user))
+
+	u, err := s.GetUser(context.Background(), user.Email)
+	assert.Nil(t, err)
+	assert.Equal(t, "newkey", u.ApiKey)
+	assert.False(t, u.IsActive)
+}
+
+func TestCachedDbServiceWithTx(t *testing.T) {
+	mdbs, user := newTestMemDbService(t)
+	cache := NewUserCache(10, time.Minute)
+	s := NewCachedDbService(mdbs, cache)
+
+	s.GetUser(context.Background(), user.Email)
+
+	err := s.WithTx(context.Background(), func(tx DbService) error {
+		user.Name = "Renamed"
+		if err := tx.UpdateUser(context.Background(), user); err != nil {
+			return err
+		}
+
+		// Reads inside the unit see its writes, and are not cached
+		u, _ := tx.GetUser(context.Background(), user.Email)
+		assert.Equal(t, "Renamed", u.Name)
+		cache.Put(u)
+		return nil
+	})
+	assert.Nil(t, err)
+
+	// Dropped again once the unit ended
+	assert.Equal(t, 0, cache.Stats().Size)
+
+	u, _ := s.GetUser(context.Background(), user.Email)
+	assert.Equal(t, "Renamed", u.Name)
+}
+
+func TestAppConfigAuthCacheOptions(t *testing.T) {
+	config := appConfig{}
+	assert.Equal(t, AuthCacheOptions{DefaultAuthCacheSize, DefaultAuthCacheTtl}, config.AuthCacheOptions())
+
+	config.AuthCacheConf = authCacheConfig{Size: 50, Ttl: Duration(time.Second)}
+	assert.Equal(t, AuthCacheOptions{50, time.Second}, config.AuthCacheOptions())
+
+	config.AuthCacheConf.Disabled = true
+	assert.Equal(t, AuthCacheOptions{}, config.AuthCacheOptions())
+}